@@ -1,21 +1,51 @@
 package mirageecs
 
 import (
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"slices"
+	"strconv"
 	"sync"
 	"time"
 )
 
+// maxLatencySamples is the maximum number of latency samples in a unit of accessCounter.
+// The samples over it are ignored not to consume memory unboundedly.
+const maxLatencySamples = 10000
+
 // accessCount is a map for access count
 // key is a time truncated by accessCounter.unit
 type accessCount map[time.Time]int64
 
+// statusCount is a map for response count by status class (e.g. "2xx")
+// key is a time truncated by accessCounter.unit
+type statusCount map[time.Time]map[string]int64
+
 // accessCounter is a thread-safe counter for access
 type AccessCounter struct {
 	mu    *sync.Mutex
 	unit  time.Duration
 	count accessCount
+
+	statuses     statusCount
+	statusTotals map[string]int64
+
+	latencies map[time.Time][]time.Duration
+}
+
+// latencyStats is the aggregated upstream latency in a unit of accessCounter.
+type latencyStats struct {
+	Count int           `json:"count"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
 }
 
+// latencyMetrics is a map for latencyStats
+// key is a time truncated by accessCounter.unit
+type latencyMetrics map[time.Time]latencyStats
+
 // NewAccessCounter returns a new access counter
 // unit is the time unit for the counter (default: time.Minute)
 func NewAccessCounter(unit time.Duration) *AccessCounter {
@@ -26,6 +56,10 @@ func NewAccessCounter(unit time.Duration) *AccessCounter {
 		mu:    new(sync.Mutex),
 		count: make(accessCount, 2), // 2 is enough for most cases
 		unit:  unit,
+
+		statuses:     make(statusCount, 2),
+		statusTotals: make(map[string]int64),
+		latencies:    make(map[time.Time][]time.Duration, 2),
 	}
 	c.fill()
 	return c
@@ -52,6 +86,123 @@ func (c *AccessCounter) Collect() accessCount {
 	return r
 }
 
+// AddStatus increments the response counter of the status class
+func (c *AccessCounter) AddStatus(code int) {
+	class := statusClass(code)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().Truncate(c.unit)
+	if c.statuses[now] == nil {
+		c.statuses[now] = make(map[string]int64)
+	}
+	c.statuses[now][class]++
+	c.statusTotals[class]++
+}
+
+// CollectStatuses returns the response count by status class and resets the counter
+// The totals returned by StatusTotals are not reset.
+func (c *AccessCounter) CollectStatuses() statusCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := make(statusCount, len(c.statuses))
+	for k, v := range c.statuses {
+		r[k] = v
+		delete(c.statuses, k)
+	}
+	return r
+}
+
+// StatusTotals returns the response count by status class since the counter is created
+func (c *AccessCounter) StatusTotals() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := make(map[string]int64, len(c.statusTotals))
+	for k, v := range c.statusTotals {
+		r[k] = v
+	}
+	return r
+}
+
+// AddLatency records the latency of the upstream
+func (c *AccessCounter) AddLatency(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now().Truncate(c.unit)
+	if len(c.latencies[now]) < maxLatencySamples {
+		c.latencies[now] = append(c.latencies[now], d)
+	}
+}
+
+// CollectLatencies returns the aggregated latencies and resets them
+func (c *AccessCounter) CollectLatencies() latencyMetrics {
+	c.mu.Lock()
+	samples := c.latencies
+	c.latencies = make(map[time.Time][]time.Duration, 2)
+	c.mu.Unlock()
+
+	r := make(latencyMetrics, len(samples))
+	for ts, s := range samples {
+		r[ts] = aggregateLatencies(s)
+	}
+	return r
+}
+
+// aggregateLatencies returns p50 and p95 of the samples by the nearest-rank method.
+func aggregateLatencies(samples []time.Duration) latencyStats {
+	if len(samples) == 0 {
+		return latencyStats{}
+	}
+	sorted := slices.Clone(samples)
+	slices.Sort(sorted)
+	return latencyStats{
+		Count: len(sorted),
+		P50:   percentile(sorted, 50),
+		P95:   percentile(sorted, 95),
+	}
+}
+
+// percentile returns the p-th percentile of the sorted samples by the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// statusClass returns the class of the status code, e.g. "2xx"
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
+
 func (c *AccessCounter) fill() {
 	c.count[time.Now().Truncate(c.unit)] = 0
 }
+
+// saveAccessCounts saves the access counts to the file as JSON.
+func saveAccessCounts(file string, all map[string]accessCount) error {
+	b, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0644)
+}
+
+// loadAccessCounts loads the access counts saved by saveAccessCounts, and removes the file not to load them twice.
+// It returns nil without error if the file does not exist.
+func loadAccessCounts(file string) (map[string]accessCount, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var all map[string]accessCount
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	return all, os.Remove(file)
+}
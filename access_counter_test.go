@@ -36,3 +36,53 @@ func TestAccessCounter(t *testing.T) {
 		}
 	}
 }
+
+func TestAggregateLatencies(t *testing.T) {
+	ms := func(ns ...int) []time.Duration {
+		ds := make([]time.Duration, 0, len(ns))
+		for _, n := range ns {
+			ds = append(ds, time.Duration(n)*time.Millisecond)
+		}
+		return ds
+	}
+	hundred := make([]int, 0, 100)
+	for i := 100; i >= 1; i-- {
+		hundred = append(hundred, i)
+	}
+	tests := []struct {
+		name     string
+		samples  []time.Duration
+		expected mirageecs.LatencyStats
+	}{
+		{name: "empty", samples: nil, expected: mirageecs.LatencyStats{}},
+		{name: "single", samples: ms(42), expected: mirageecs.LatencyStats{Count: 1, P50: 42 * time.Millisecond, P95: 42 * time.Millisecond}},
+		{name: "unsorted", samples: ms(30, 10, 20, 50, 40), expected: mirageecs.LatencyStats{Count: 5, P50: 30 * time.Millisecond, P95: 50 * time.Millisecond}},
+		{name: "1 to 100", samples: ms(hundred...), expected: mirageecs.LatencyStats{Count: 100, P50: 50 * time.Millisecond, P95: 95 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mirageecs.AggregateLatencies(tt.samples); got != tt.expected {
+				t.Errorf("unexpected stats %#v, want %#v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestAccessCounterLatencies(t *testing.T) {
+	c := mirageecs.NewAccessCounter(time.Hour)
+	for _, d := range []time.Duration{3 * time.Millisecond, time.Millisecond, 2 * time.Millisecond} {
+		c.AddLatency(d)
+	}
+	r := c.CollectLatencies()
+	if len(r) != 1 {
+		t.Fatalf("unexpected latencies %#v", r)
+	}
+	for _, stats := range r {
+		if stats.Count != 3 || stats.P50 != 2*time.Millisecond || stats.P95 != 3*time.Millisecond {
+			t.Errorf("unexpected stats %#v", stats)
+		}
+	}
+	if r := c.CollectLatencies(); len(r) != 0 {
+		t.Errorf("latencies should be reset %#v", r)
+	}
+}
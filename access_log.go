@@ -0,0 +1,127 @@
+package mirageecs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// AccessLog configures the structured access logs of the proxied requests.
+// The logs have the fields of the request and the response, but not the bodies.
+type AccessLog struct {
+	Level string `yaml:"level"` // default info
+
+	level slog.Level
+}
+
+func (a *AccessLog) Validate() error {
+	if a.Level == "" {
+		a.Level = "info"
+	}
+	if err := a.level.UnmarshalText([]byte(a.Level)); err != nil {
+		return fmt.Errorf("invalid level %s: %w", a.Level, err)
+	}
+	return nil
+}
+
+type accessLogEntryKey struct{}
+
+// accessLogEntry is the values of the access log which are known in the Transport.
+type accessLogEntry struct {
+	upstream string
+}
+
+func withAccessLogEntry(ctx context.Context) (context.Context, *accessLogEntry) {
+	e := &accessLogEntry{}
+	return context.WithValue(ctx, accessLogEntryKey{}, e), e
+}
+
+// setAccessLogUpstream records the upstream address of the request for the access log.
+func setAccessLogUpstream(req *http.Request) {
+	if e, ok := req.Context().Value(accessLogEntryKey{}).(*accessLogEntry); ok {
+		e.upstream = req.URL.Host
+	}
+}
+
+// accessLogWriter records the status and the size of the response.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap allows http.ResponseController to flush the streaming responses.
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush flushes the streaming responses copied by rproxy, which doesn't use http.ResponseController.
+func (w *accessLogWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the connection of the WebSocket upgrade, which rproxy asserts http.Hijacker without checking.
+// The response from the upstream is written to the connection directly, so the access is logged as 101 Switching Protocols.
+func (w *accessLogWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T is not a http.Hijacker", w.ResponseWriter)
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// serve serves the request by the handler and logs the access.
+func (a *AccessLog) serve(w http.ResponseWriter, req *http.Request, subdomain string, handler http.Handler) {
+	if a == nil {
+		handler.ServeHTTP(w, req)
+		return
+	}
+	ctx, entry := withAccessLogEntry(req.Context())
+	lw := &accessLogWriter{ResponseWriter: w}
+	start := time.Now()
+	handler.ServeHTTP(lw, req.WithContext(ctx))
+	status := lw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	upstream := entry.upstream
+	if host, _, err := net.SplitHostPort(upstream); err == nil {
+		upstream = host
+	}
+	slog.Log(ctx, a.level, "access",
+		"event", "access",
+		"subdomain", subdomain,
+		"method", req.Method,
+		"path", req.URL.Path,
+		"status", status,
+		"bytes", lw.bytes,
+		"duration", time.Since(start),
+		"upstream", upstream,
+	)
+}
@@ -0,0 +1,182 @@
+package mirageecs_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestAccessLog(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, "created")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	targetPort, _ := strconv.Atoi(u.Port())
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{
+		{ListenPort: 8080, TargetPort: targetPort},
+	}
+	cfg.Network.AccessLog = &mirageecs.AccessLog{}
+	if err := cfg.Network.AccessLog.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", targetPort)
+
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	req := httptest.NewRequest(http.MethodPost, "/items?token=secret", strings.NewReader("secret body"))
+	req.Host = "aaa.example.net:8080"
+	rec := httptest.NewRecorder()
+	rp.ServeHTTPWithPort(rec, req, 8080)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("not a JSON log %s: %s", line, err)
+		}
+		if m["event"] == "access" {
+			entry = m
+		}
+	}
+	if entry == nil {
+		t.Fatalf("access log is not found in %s", buf.String())
+	}
+	for key, want := range map[string]interface{}{
+		"level":     "INFO",
+		"subdomain": "aaa",
+		"method":    http.MethodPost,
+		"path":      "/items",
+		"status":    float64(http.StatusCreated),
+		"bytes":     float64(len("created")),
+		"upstream":  "127.0.0.1",
+	} {
+		if entry[key] != want {
+			t.Errorf("unexpected %s: %v, want %v", key, entry[key], want)
+		}
+	}
+	if _, ok := entry["duration"].(float64); !ok {
+		t.Errorf("duration is missing: %v", entry)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Errorf("the query and the body must not be logged: %s", buf.String())
+	}
+
+	if err := (&mirageecs.AccessLog{Level: "verbose"}).Validate(); err == nil {
+		t.Error("invalid level must be an error")
+	}
+}
+
+func TestAccessLogWebSocket(t *testing.T) {
+	// the upstream switches the protocol and closes the connection after echoing a message
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		if _, err := http.ReadRequest(r); err != nil {
+			return
+		}
+		io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		line, _ := r.ReadString('\n')
+		io.WriteString(conn, line)
+	}()
+	targetPort := l.Addr().(*net.TCPAddr).Port
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{
+		{ListenPort: 8080, TargetPort: targetPort},
+	}
+	cfg.Network.AccessLog = &mirageecs.AccessLog{}
+	if err := cfg.Network.AccessLog.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", targetPort)
+
+	var buf bytes.Buffer
+	defaultLogger := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer slog.SetDefault(defaultLogger)
+
+	done := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		rp.ServeHTTPWithPort(w, r, 8080)
+	}))
+	defer ts.Close()
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: aaa.example.net:8080\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	io.WriteString(conn, "hello\n")
+	if line, err := r.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("unexpected message %q %v", line, err)
+	}
+	<-done
+
+	var entry map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err == nil && m["event"] == "access" {
+			entry = m
+		}
+	}
+	if entry == nil {
+		t.Fatalf("access log is not found in %s", buf.String())
+	}
+	if entry["status"] != float64(http.StatusSwitchingProtocols) || entry["path"] != "/ws" {
+		t.Errorf("unexpected access log %v", entry)
+	}
+}
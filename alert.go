@@ -0,0 +1,86 @@
+package mirageecs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultAccessAlertCooldown is the default duration to suppress the repeated alerts of a subdomain.
+const DefaultAccessAlertCooldown = 10 * time.Minute
+
+// AccessAlert configures alerting when the request rate of a subdomain exceeds the threshold.
+type AccessAlert struct {
+	RequestsPerMinute float64       `yaml:"requests_per_minute"`
+	WebhookURL        string        `yaml:"webhook_url"`
+	Cooldown          time.Duration `yaml:"cooldown"`
+
+	mu        sync.Mutex
+	lastAlert map[string]time.Time
+}
+
+func (a *AccessAlert) Validate() error {
+	if a.RequestsPerMinute <= 0 {
+		return fmt.Errorf("requests_per_minute must be greater than 0")
+	}
+	if a.WebhookURL == "" {
+		return fmt.Errorf("webhook_url is required")
+	}
+	if a.Cooldown < 0 {
+		return fmt.Errorf("cooldown must not be negative")
+	}
+	if a.Cooldown == 0 {
+		a.Cooldown = DefaultAccessAlertCooldown
+	}
+	return nil
+}
+
+// AccessAlertEvent is a payload of the access alert webhook.
+type AccessAlertEvent struct {
+	Event             string    `json:"event"`
+	Subdomain         string    `json:"subdomain"`
+	RequestsPerMinute float64   `json:"requests_per_minute"`
+	Threshold         float64   `json:"threshold"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// Evaluate returns events for subdomains that the request rate exceeds the threshold.
+// unit is the time unit of the access counters.
+// A subdomain has at most one event of the highest rate, and it is not alerted again
+// until the cooldown elapses since the last alert.
+func (a *AccessAlert) Evaluate(all map[string]accessCount, unit time.Duration) []AccessAlertEvent {
+	if a == nil || unit <= 0 {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.lastAlert == nil {
+		a.lastAlert = make(map[string]time.Time)
+	}
+	var events []AccessAlertEvent
+	for subdomain, counts := range all {
+		var ev *AccessAlertEvent
+		for ts, count := range counts {
+			rate := float64(count) * float64(time.Minute) / float64(unit)
+			if rate < a.RequestsPerMinute || (ev != nil && rate <= ev.RequestsPerMinute) {
+				continue
+			}
+			ev = &AccessAlertEvent{
+				Event:             "access_rate_exceeded",
+				Subdomain:         subdomain,
+				RequestsPerMinute: rate,
+				Threshold:         a.RequestsPerMinute,
+				Timestamp:         ts,
+			}
+		}
+		if ev == nil {
+			continue
+		}
+		if last, ok := a.lastAlert[subdomain]; ok && ev.Timestamp.Sub(last) < a.Cooldown {
+			continue
+		}
+		a.lastAlert[subdomain] = ev.Timestamp
+		events = append(events, *ev)
+	}
+	return events
+}
@@ -0,0 +1,78 @@
+package mirageecs_test
+
+import (
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestAccessAlertEvaluate(t *testing.T) {
+	a := &mirageecs.AccessAlert{
+		RequestsPerMinute: 100,
+		WebhookURL:        "http://localhost/webhook",
+	}
+	ts := time.Date(2024, 11, 7, 11, 22, 0, 0, time.UTC)
+	all := map[string]mirageecs.AccessCount{
+		"quiet": {ts: 10},
+		"busy":  {ts: 30},
+	}
+	// 30 requests in 10 seconds = 180 req/min
+	events := a.Evaluate(all, 10*time.Second)
+	if len(events) != 1 {
+		t.Fatalf("unexpected events %#v", events)
+	}
+	ev := events[0]
+	if ev.Subdomain != "busy" {
+		t.Errorf("unexpected subdomain %s", ev.Subdomain)
+	}
+	if ev.RequestsPerMinute != 180 {
+		t.Errorf("unexpected rate %f", ev.RequestsPerMinute)
+	}
+	if !ev.Timestamp.Equal(ts) {
+		t.Errorf("unexpected timestamp %s", ev.Timestamp)
+	}
+
+	if events := a.Evaluate(all, time.Minute); len(events) != 0 {
+		t.Errorf("unexpected events %#v", events)
+	}
+}
+
+func TestAccessAlertCooldown(t *testing.T) {
+	a := &mirageecs.AccessAlert{
+		RequestsPerMinute: 100,
+		WebhookURL:        "http://localhost/webhook",
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Cooldown != mirageecs.DefaultAccessAlertCooldown {
+		t.Errorf("unexpected default cooldown %s", a.Cooldown)
+	}
+	ts := time.Date(2024, 11, 7, 11, 22, 0, 0, time.UTC)
+	cycle := func(ts time.Time) []mirageecs.AccessAlertEvent {
+		// a sustained spike over two buckets
+		return a.Evaluate(map[string]mirageecs.AccessCount{
+			"busy": {ts: 30, ts.Add(10 * time.Second): 40},
+		}, 10*time.Second)
+	}
+
+	events := cycle(ts)
+	if len(events) != 1 {
+		t.Fatalf("unexpected events %#v", events)
+	}
+	if events[0].RequestsPerMinute != 240 {
+		t.Errorf("unexpected rate %f", events[0].RequestsPerMinute)
+	}
+	if events := cycle(ts.Add(20 * time.Second)); len(events) != 0 {
+		t.Errorf("alert must be suppressed in the cooldown %#v", events)
+	}
+	if events := cycle(ts.Add(a.Cooldown)); len(events) != 1 {
+		t.Errorf("alert must be fired after the cooldown %#v", events)
+	}
+
+	a.Cooldown = -time.Minute
+	if err := a.Validate(); err == nil {
+		t.Error("negative cooldown should be an error")
+	}
+}
@@ -0,0 +1,85 @@
+package mirageecs
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/smithy-go/middleware"
+)
+
+// AWSAPICallCount is a counter of AWS API calls per operation.
+type AWSAPICallCount struct {
+	Service   string `json:"service"`
+	Operation string `json:"operation"`
+	Calls     int64  `json:"calls"`
+	Errors    int64  `json:"errors"`
+	Throttles int64  `json:"throttles"`
+}
+
+type awsAPICallKey struct {
+	service   string
+	operation string
+}
+
+// awsAPICallCounter counts AWS API calls by SDK middleware.
+// Each attempt is counted, including retries.
+type awsAPICallCounter struct {
+	mu     sync.Mutex
+	counts map[awsAPICallKey]*AWSAPICallCount
+}
+
+func newAWSAPICallCounter() *awsAPICallCounter {
+	return &awsAPICallCounter{
+		counts: make(map[awsAPICallKey]*AWSAPICallCount),
+	}
+}
+
+// register adds the counter middleware to the stack. It is used as aws.Config.APIOptions.
+func (c *awsAPICallCounter) register(stack *middleware.Stack) error {
+	return stack.Finalize.Add(middleware.FinalizeMiddlewareFunc("MirageAPICallCounter",
+		func(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+			out, md, err := next.HandleFinalize(ctx, in)
+			c.count(awsmiddleware.GetServiceID(ctx), awsmiddleware.GetOperationName(ctx), err)
+			return out, md, err
+		},
+	), middleware.After)
+}
+
+func (c *awsAPICallCounter) count(service, operation string, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := awsAPICallKey{service: service, operation: operation}
+	cnt, ok := c.counts[key]
+	if !ok {
+		cnt = &AWSAPICallCount{Service: service, Operation: operation}
+		c.counts[key] = cnt
+	}
+	cnt.Calls++
+	if err != nil {
+		cnt.Errors++
+		if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary {
+			cnt.Throttles++
+		}
+	}
+}
+
+// Counts returns a snapshot of the counters sorted by service and operation.
+func (c *awsAPICallCounter) Counts() []AWSAPICallCount {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make([]AWSAPICallCount, 0, len(c.counts))
+	for _, cnt := range c.counts {
+		counts = append(counts, *cnt)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Service != counts[j].Service {
+			return counts[i].Service < counts[j].Service
+		}
+		return counts[i].Operation < counts[j].Operation
+	})
+	return counts
+}
@@ -0,0 +1,70 @@
+package mirageecs_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/smithy-go/middleware"
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+type fakeECSEndpoint struct {
+	throttle bool
+}
+
+func (e *fakeECSEndpoint) Do(req *http.Request) (*http.Response, error) {
+	if e.throttle {
+		return &http.Response{
+			StatusCode: http.StatusBadRequest,
+			Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+			Body:       io.NopCloser(strings.NewReader(`{"__type":"ThrottlingException","message":"Rate exceeded"}`)),
+		}, nil
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.1"}},
+		Body:       io.NopCloser(strings.NewReader(`{}`)),
+	}, nil
+}
+
+func TestAWSAPICallCounter(t *testing.T) {
+	ctx := context.Background()
+	counter := mirageecs.NewAWSAPICallCounter()
+	endpoint := &fakeECSEndpoint{}
+	svc := ecs.NewFromConfig(aws.Config{
+		Region:      "ap-northeast-1",
+		Credentials: aws.AnonymousCredentials{},
+		HTTPClient:  endpoint,
+		Retryer:     func() aws.Retryer { return aws.NopRetryer{} },
+		APIOptions:  []func(*middleware.Stack) error{counter.Register},
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := svc.DescribeTasks(ctx, &ecs.DescribeTasksInput{Cluster: aws.String("test"), Tasks: []string{"x"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := svc.ListTasks(ctx, &ecs.ListTasksInput{Cluster: aws.String("test")}); err != nil {
+		t.Fatal(err)
+	}
+	endpoint.throttle = true
+	if _, err := svc.RunTask(ctx, &ecs.RunTaskInput{TaskDefinition: aws.String("test")}); err == nil {
+		t.Fatal("expected throttling error")
+	}
+
+	expected := []mirageecs.AWSAPICallCount{
+		{Service: "ECS", Operation: "DescribeTasks", Calls: 2},
+		{Service: "ECS", Operation: "ListTasks", Calls: 1},
+		{Service: "ECS", Operation: "RunTask", Calls: 1, Errors: 1, Throttles: 1},
+	}
+	if diff := cmp.Diff(expected, counter.Counts()); diff != "" {
+		t.Errorf("unexpected counts %s", diff)
+	}
+}
@@ -1,6 +1,8 @@
 package mirageecs
 
 import (
+	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"fmt"
 	"log/slog"
@@ -11,31 +13,150 @@ import (
 
 	"github.com/fujiwara/go-amzn-oidc/validator"
 	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/crypto/bcrypt"
 )
 
 type Auth struct {
 	Basic        *AuthMethodBasic    `yaml:"basic"`
 	Token        *AuthMethodToken    `yaml:"token"`
 	AmznOIDC     *AuthMethodAmznOIDC `yaml:"amzn_oidc"`
+	JWT          *AuthMethodJWT      `yaml:"jwt"`
 	CookieSecret string              `yaml:"cookie_secret"`
+	OriginCheck  string              `yaml:"origin_check"`
+
+	// AllowedOriginHosts are the hosts allowed in Origin header in addition to host.webapi.
+	AllowedOriginHosts []string `yaml:"allowed_origin_hosts"`
+
+	// the attributes of the auth cookie. the defaults are mirage-ecs-auth, lax, secure and host.reverse_proxy_suffix.
+	CookieName     string `yaml:"cookie_name"`
+	CookieSameSite string `yaml:"cookie_same_site"`
+	CookieSecure   *bool  `yaml:"cookie_secure"`
+	CookieDomain   string `yaml:"cookie_domain"`
 
 	jwtParser  *jwt.Parser
 	jwtKeyFunc func(*jwt.Token) (interface{}, error)
 	once       sync.Once
 }
 
+const (
+	OriginCheckStrict  = "strict"
+	OriginCheckLenient = "lenient"
+	OriginCheckOff     = "off"
+)
+
+func (a *Auth) Validate() error {
+	switch a.OriginCheck {
+	case "", OriginCheckStrict, OriginCheckLenient, OriginCheckOff:
+	default:
+		return fmt.Errorf("origin_check must be one of strict, lenient or off: %s", a.OriginCheck)
+	}
+	sameSite, err := a.cookieSameSite()
+	if err != nil {
+		return err
+	}
+	if sameSite == http.SameSiteNoneMode && !a.cookieSecure() {
+		return fmt.Errorf("cookie_same_site none requires cookie_secure")
+	}
+	if a.CookieName != "" && !isValidCookieName(a.CookieName) {
+		return fmt.Errorf("invalid cookie_name %q", a.CookieName)
+	}
+	if a.JWT != nil {
+		if err := a.JWT.Validate(); err != nil {
+			return fmt.Errorf("invalid jwt: %w", err)
+		}
+	}
+	return nil
+}
+
+func (a *Auth) cookieName() string {
+	if a == nil || a.CookieName == "" {
+		return AuthCookieName
+	}
+	return a.CookieName
+}
+
+func (a *Auth) cookieSameSite() (http.SameSite, error) {
+	if a == nil {
+		return http.SameSiteLaxMode, nil
+	}
+	switch strings.ToLower(a.CookieSameSite) {
+	case "", "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	default:
+		return 0, fmt.Errorf("cookie_same_site must be one of lax, strict or none: %s", a.CookieSameSite)
+	}
+}
+
+func (a *Auth) cookieSecure() bool {
+	if a == nil || a.CookieSecure == nil {
+		return true
+	}
+	return *a.CookieSecure
+}
+
+// isAllowedOriginHost reports whether the host is one of allowed_origin_hosts.
+func (a *Auth) isAllowedOriginHost(host string) bool {
+	if a == nil {
+		return false
+	}
+	for _, h := range a.AllowedOriginHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Auth) originCheck() string {
+	if a == nil || a.OriginCheck == "" {
+		return OriginCheckStrict
+	}
+	return a.OriginCheck
+}
+
 type Authorizer func(req *http.Request, res http.ResponseWriter) (bool, error)
 
+type authIdentityKey struct{}
+
+// authIdentity is the identity of the user authenticated by the authorizers.
+type authIdentity struct {
+	name string
+}
+
+func withAuthIdentity(ctx context.Context) context.Context {
+	return context.WithValue(ctx, authIdentityKey{}, &authIdentity{})
+}
+
+// setAuthIdentity records the identity authenticated for the request. It is a no-op without withAuthIdentity.
+func setAuthIdentity(req *http.Request, name string) {
+	if id, ok := req.Context().Value(authIdentityKey{}).(*authIdentity); ok {
+		id.name = name
+	}
+}
+
+// authIdentityOf returns the identity authenticated for the request, or empty if not authenticated.
+func authIdentityOf(req *http.Request) string {
+	if id, ok := req.Context().Value(authIdentityKey{}).(*authIdentity); ok {
+		return id.name
+	}
+	return ""
+}
+
 func (a *Auth) ByBasic(req *http.Request, res http.ResponseWriter) (bool, error) {
 	if a == nil || a.Basic == nil {
 		return false, nil
 	}
 	if ok := a.Basic.Match(req.Header); ok {
 		slog.Debug("basic auth succeeded")
+		setAuthIdentity(req, a.Basic.Username)
 		return ok, nil
 	} else {
 		slog.Debug("basic auth failed. set WWW-Authenticate header")
-		res.Header().Set("WWW-Authenticate", "Basic realm=\"Restricted\"")
+		res.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", a.Basic.realm()))
 	}
 	return false, nil
 }
@@ -46,20 +167,37 @@ func (a *Auth) ByToken(req *http.Request, res http.ResponseWriter) (bool, error)
 	}
 	if ok := a.Token.Match(req.Header); ok {
 		slog.Debug("token auth succeeded")
+		setAuthIdentity(req, a.Token.name())
 		return ok, nil
 	}
 	slog.Debug("token auth failed")
 	return false, nil
 }
 
+func (a *Auth) ByJWT(req *http.Request, res http.ResponseWriter) (bool, error) {
+	if a == nil || a.JWT == nil {
+		return false, nil
+	}
+	if sub, ok, err := a.JWT.matchSubject(req.Context(), req.Header); err != nil {
+		return false, err
+	} else if ok {
+		slog.Debug("jwt auth succeeded")
+		setAuthIdentity(req, sub)
+		return true, nil
+	}
+	slog.Debug("jwt auth failed")
+	return false, nil
+}
+
 func (a *Auth) ByAmznOIDC(req *http.Request, res http.ResponseWriter) (bool, error) {
 	if a == nil || a.AmznOIDC == nil {
 		return false, nil
 	}
-	if ok, err := a.AmznOIDC.Match(req.Header); err != nil {
+	if value, ok, err := a.AmznOIDC.matchClaim(req.Header); err != nil {
 		return false, err
 	} else if ok {
 		slog.Debug("amzn_oidc auth succeeded")
+		setAuthIdentity(req, value)
 		return true, nil
 	}
 	slog.Debug("amzn_oidc auth failed")
@@ -95,14 +233,21 @@ func (a *Auth) NewAuthCookie(expire time.Duration, domain string) (*http.Cookie,
 	if err != nil {
 		return nil, fmt.Errorf("failed to sign cookie: %w", err)
 	}
+	if a.CookieDomain != "" {
+		domain = a.CookieDomain
+	}
+	sameSite, err := a.cookieSameSite()
+	if err != nil {
+		return nil, err
+	}
 	return &http.Cookie{
-		Name:     AuthCookieName,
+		Name:     a.cookieName(),
 		Value:    tokenStr,
 		Expires:  expireAt,
 		Domain:   domain,
 		HttpOnly: true,
-		SameSite: http.SameSiteLaxMode,
-		Secure:   true,
+		SameSite: sameSite,
+		Secure:   a.cookieSecure(),
 	}, nil
 }
 
@@ -110,6 +255,9 @@ func (a *Auth) ValidateAuthCookie(c *http.Cookie) error {
 	if a == nil || a.CookieSecret == "" {
 		return fmt.Errorf("cookie_secret is not set")
 	}
+	if c.Name != a.cookieName() {
+		return fmt.Errorf("unexpected cookie %s", c.Name)
+	}
 	a.once.Do(func() {
 		a.jwtParser = jwt.NewParser(jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Name}))
 		a.jwtKeyFunc = func(token *jwt.Token) (interface{}, error) {
@@ -137,27 +285,42 @@ func (a *Auth) ValidateAuthCookie(c *http.Cookie) error {
 	return nil
 }
 
+const DefaultBasicAuthRealm = "Restricted"
+
 type AuthMethodBasic struct {
 	Username string `yaml:"username"`
-	Password string `yaml:"password"`
+	Password string `yaml:"password"` // plaintext or bcrypt hash
+	Realm    string `yaml:"realm"`
 
-	gen      sync.Once
-	expected string
+	mu       sync.Mutex
+	verified string // Authorization header verified by bcrypt
+}
+
+func (b *AuthMethodBasic) realm() string {
+	if b.Realm == "" {
+		return DefaultBasicAuthRealm
+	}
+	return b.Realm
+}
+
+func (b *AuthMethodBasic) isHashed() bool {
+	return strings.HasPrefix(b.Password, "$2")
 }
 
 func (b *AuthMethodBasic) Match(h http.Header) bool {
 	if b == nil {
 		return false
 	}
-	slog.Debug(f("auth basic %s %s", b.Username, b.Password))
-	if b.Username == "" || b.Password == "" || h.Get("Authorization") == "" {
+	header := h.Get("Authorization")
+	if b.Username == "" || b.Password == "" || header == "" {
 		return false
 	}
-	b.gen.Do(func() {
-		b.expected = "Basic " + base64.StdEncoding.EncodeToString([]byte(b.Username+":"+b.Password))
-	})
-	slog.Debug(f("auth basic comparing %s %s %s", b.Username, b.Password, h.Get("Authorization")))
-	if h.Get("Authorization") == b.expected {
+	username, password, ok := parseBasicAuth(header)
+	if !ok {
+		slog.Warn("auth basic failed: malformed authorization header")
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(username), []byte(b.Username)) == 1 && b.matchPassword(header, password) {
 		slog.Debug(f("auth basic succeeded"))
 		return true
 	}
@@ -165,9 +328,53 @@ func (b *AuthMethodBasic) Match(h http.Header) bool {
 	return false
 }
 
+func (b *AuthMethodBasic) matchPassword(header, password string) bool {
+	if !b.isHashed() {
+		return subtle.ConstantTimeCompare([]byte(password), []byte(b.Password)) == 1
+	}
+	// bcrypt is slow by design. skip it for the header verified already.
+	b.mu.Lock()
+	verified := b.verified
+	b.mu.Unlock()
+	if verified != "" && subtle.ConstantTimeCompare([]byte(header), []byte(verified)) == 1 {
+		return true
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(b.Password), []byte(password)); err != nil {
+		return false
+	}
+	b.mu.Lock()
+	b.verified = header
+	b.mu.Unlock()
+	return true
+}
+
+// parseBasicAuth parses the value of Authorization header as net/http.Request.BasicAuth.
+func parseBasicAuth(header string) (username, password string, ok bool) {
+	const prefix = "Basic "
+	if len(header) < len(prefix) || !strings.EqualFold(header[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(c), ":")
+}
+
+// DefaultAuthTokenName is the identity of the users authenticated by the token.
+const DefaultAuthTokenName = "token"
+
 type AuthMethodToken struct {
 	Token  string `yaml:"token"`
 	Header string `yaml:"header"`
+	Name   string `yaml:"name"` // identity of the token users, e.g. the owner of reservations
+}
+
+func (b *AuthMethodToken) name() string {
+	if b.Name == "" {
+		return DefaultAuthTokenName
+	}
+	return b.Name
 }
 
 func (b *AuthMethodToken) Match(h http.Header) bool {
@@ -193,18 +400,28 @@ type AuthMethodAmznOIDC struct {
 }
 
 func (a *AuthMethodAmznOIDC) Match(h http.Header) (bool, error) {
+	_, ok, err := a.matchClaim(h)
+	return ok, err
+}
+
+// matchClaim returns the value of the claim when it matches.
+func (a *AuthMethodAmznOIDC) matchClaim(h http.Header) (string, bool, error) {
 	if a == nil {
-		return false, nil
+		return "", false, nil
 	}
 	if a.Claim == "" {
-		return false, nil
+		return "", false, nil
 	}
 	slog.Debug(f("auth amzn_oidc comparing %s with %s", a.Claim, h.Get("x-amzn-oidc-data")))
 	claims, err := validator.Validate(h.Get("x-amzn-oidc-data"))
 	if err != nil {
-		return false, fmt.Errorf("failed to validate x-amzn-oidc-data: %s", err)
+		return "", false, fmt.Errorf("failed to validate x-amzn-oidc-data: %s", err)
+	}
+	if !a.MatchClaims(claims) {
+		return "", false, nil
 	}
-	return a.MatchClaims(claims), nil
+	value, _ := claims[a.Claim].(string)
+	return value, true, nil
 }
 
 func (a *AuthMethodAmznOIDC) MatchClaims(claims map[string]interface{}) bool {
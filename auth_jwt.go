@@ -0,0 +1,240 @@
+package mirageecs
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+const (
+	DefaultJWKSCacheTTL    = time.Hour
+	jwksMinRefreshInterval = time.Minute
+)
+
+// AuthMethodJWT authenticates the bearer tokens issued by an identity provider.
+// The signature is verified by the keys of jwks_url or public_key.
+type AuthMethodJWT struct {
+	JWKSURL      string        `yaml:"jwks_url"`
+	PublicKey    string        `yaml:"public_key"` // PEM encoded RSA or ECDSA public key
+	Issuer       string        `yaml:"issuer"`
+	Audience     string        `yaml:"audience"`
+	JWKSCacheTTL time.Duration `yaml:"jwks_cache_ttl"`
+
+	publicKey crypto.PublicKey
+	parser    *jwt.Parser
+	client    *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+func (a *AuthMethodJWT) Validate() error {
+	if (a.JWKSURL == "") == (a.PublicKey == "") {
+		return fmt.Errorf("either jwks_url or public_key is required")
+	}
+	if a.Issuer == "" || a.Audience == "" {
+		return fmt.Errorf("issuer and audience are required")
+	}
+	if a.PublicKey != "" {
+		key, err := parsePublicKeyPEM([]byte(a.PublicKey))
+		if err != nil {
+			return fmt.Errorf("invalid public_key: %w", err)
+		}
+		a.publicKey = key
+	}
+	if a.JWKSCacheTTL <= 0 {
+		a.JWKSCacheTTL = DefaultJWKSCacheTTL
+	}
+	a.parser = jwt.NewParser(jwt.WithValidMethods([]string{
+		"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512",
+	}))
+	a.client = &http.Client{Timeout: 10 * time.Second}
+	return nil
+}
+
+func parsePublicKeyPEM(b []byte) (crypto.PublicKey, error) {
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(b); err == nil {
+		return key, nil
+	}
+	if key, err := jwt.ParseECPublicKeyFromPEM(b); err == nil {
+		return key, nil
+	}
+	return nil, fmt.Errorf("not a RSA or ECDSA public key")
+}
+
+func (a *AuthMethodJWT) Match(ctx context.Context, h http.Header) (bool, error) {
+	_, ok, err := a.matchSubject(ctx, h)
+	return ok, err
+}
+
+// matchSubject returns the sub claim of the token when it matches.
+func (a *AuthMethodJWT) matchSubject(ctx context.Context, h http.Header) (string, bool, error) {
+	if a == nil {
+		return "", false, nil
+	}
+	tokenStr, ok := strings.CutPrefix(h.Get("Authorization"), "Bearer ")
+	if !ok || tokenStr == "" {
+		return "", false, nil
+	}
+	token, err := a.parser.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		return a.keyOf(ctx, token)
+	})
+	if err != nil {
+		slog.Warn(f("auth jwt failed: %s", err))
+		return "", false, nil
+	}
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		slog.Warn("auth jwt failed: invalid token")
+		return "", false, nil
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		slog.Warn("auth jwt failed: exp is required")
+		return "", false, nil
+	}
+	if !claims.VerifyIssuer(a.Issuer, true) {
+		slog.Warn(f("auth jwt failed: unexpected iss %v", claims["iss"]))
+		return "", false, nil
+	}
+	if !claims.VerifyAudience(a.Audience, true) {
+		slog.Warn(f("auth jwt failed: unexpected aud %v", claims["aud"]))
+		return "", false, nil
+	}
+	sub, _ := claims["sub"].(string)
+	slog.Debug(f("auth jwt succeeded: sub=%s", sub))
+	return sub, true, nil
+}
+
+func (a *AuthMethodJWT) keyOf(ctx context.Context, token *jwt.Token) (crypto.PublicKey, error) {
+	if a.publicKey != nil {
+		return a.publicKey, nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key, ok := a.keys[kid]
+	if ok && time.Since(a.fetchedAt) < a.JWKSCacheTTL {
+		return key, nil
+	}
+	if !ok && time.Since(a.fetchedAt) < jwksMinRefreshInterval {
+		// don't hammer the identity provider by the tokens of unknown keys
+		return nil, fmt.Errorf("key %q is not found in %s", kid, a.JWKSURL)
+	}
+	// refresh the keys when expired or the key is rotated
+	if err := a.fetchJWKS(ctx); err != nil {
+		return nil, err
+	}
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("key %q is not found in %s", kid, a.JWKSURL)
+}
+
+// fetchJWKS fetches the keys from jwks_url. It must be called with the lock.
+func (a *AuthMethodJWT) fetchJWKS(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.JWKSURL, nil)
+	if err != nil {
+		return err
+	}
+	res, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to fetch jwks: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch jwks: %s", res.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode jwks: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			slog.Warn(f("skip the key %s in jwks: %s", k.Kid, err))
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	a.keys = keys
+	a.fetchedAt = time.Now()
+	slog.Info(f("fetched %d keys from %s", len(keys), a.JWKSURL))
+	return nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, fmt.Errorf("not a signing key: %s", k.Use)
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid n: %w", err)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid e: %w", err)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported crv %s", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x: %w", err)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y: %w", err)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
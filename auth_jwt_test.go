@@ -0,0 +1,166 @@
+package mirageecs_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestAuthByJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int64
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "key-1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	}))
+	defer jwks.Close()
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = &mirageecs.Auth{
+		JWT: &mirageecs.AuthMethodJWT{
+			JWKSURL:  jwks.URL,
+			Issuer:   "https://idp.example.com/",
+			Audience: "mirage-ecs",
+		},
+	}
+	if err := cfg.Auth.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	sign := func(claims jwt.MapClaims, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = kid
+		s, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	now := time.Now()
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{
+			name: "valid",
+			token: sign(jwt.MapClaims{
+				"iss": "https://idp.example.com/",
+				"aud": "mirage-ecs",
+				"sub": "alice",
+				"exp": now.Add(time.Minute).Unix(),
+			}, "key-1"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name: "expired",
+			token: sign(jwt.MapClaims{
+				"iss": "https://idp.example.com/",
+				"aud": "mirage-ecs",
+				"exp": now.Add(-time.Minute).Unix(),
+			}, "key-1"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong audience",
+			token: sign(jwt.MapClaims{
+				"iss": "https://idp.example.com/",
+				"aud": "other-app",
+				"exp": now.Add(time.Minute).Unix(),
+			}, "key-1"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "wrong issuer",
+			token: sign(jwt.MapClaims{
+				"iss": "https://evil.example.net/",
+				"aud": "mirage-ecs",
+				"exp": now.Add(time.Minute).Unix(),
+			}, "key-1"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "without exp",
+			token: sign(jwt.MapClaims{
+				"iss": "https://idp.example.com/",
+				"aud": "mirage-ecs",
+			}, "key-1"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name: "unknown key",
+			token: sign(jwt.MapClaims{
+				"iss": "https://idp.example.com/",
+				"aud": "mirage-ecs",
+				"exp": now.Add(time.Minute).Unix(),
+			}, "key-2"),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no token",
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/list", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+		})
+	}
+	// the keys are cached, and the unknown key doesn't refresh them immediately
+	if n := fetches.Load(); n != 1 {
+		t.Errorf("jwks is fetched %d times", n)
+	}
+
+	invalid := []*mirageecs.AuthMethodJWT{
+		{Issuer: "https://idp.example.com/", Audience: "mirage-ecs"},
+		{JWKSURL: jwks.URL, PublicKey: "xxx", Issuer: "https://idp.example.com/", Audience: "mirage-ecs"},
+		{JWKSURL: jwks.URL, Audience: "mirage-ecs"},
+		{PublicKey: "not a pem", Issuer: "https://idp.example.com/", Audience: "mirage-ecs"},
+	}
+	for _, a := range invalid {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%#v must be invalid", a)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package mirageecs_test
 
 import (
+	"encoding/base64"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -344,6 +346,58 @@ func TestAuthMethodBasic_Match(t *testing.T) {
 			},
 			want: false,
 		},
+		{
+			name: "Username and bcrypt hashed password match",
+			fields: fields{
+				Username: "user",
+				Password: "$2a$04$NGB3votD.Sedl6WweCdUDeR1lge.xaLH8xg1ct9lGV/ezo8sICSWK", // pass
+			},
+			args: args{
+				h: http.Header{
+					"Authorization": []string{"Basic dXNlcjpwYXNz"},
+				},
+			},
+			want: true,
+		},
+		{
+			name: "bcrypt hashed password does not match",
+			fields: fields{
+				Username: "user",
+				Password: "$2a$04$NGB3votD.Sedl6WweCdUDeR1lge.xaLH8xg1ct9lGV/ezo8sICSWK", // pass
+			},
+			args: args{
+				h: http.Header{
+					"Authorization": []string{"Basic dXNlcjpwYXN6"}, // user:pasz
+				},
+			},
+			want: false,
+		},
+		{
+			name: "Hash itself is not accepted as password",
+			fields: fields{
+				Username: "user",
+				Password: "$2a$04$NGB3votD.Sedl6WweCdUDeR1lge.xaLH8xg1ct9lGV/ezo8sICSWK",
+			},
+			args: args{
+				h: http.Header{
+					"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte("user:$2a$04$NGB3votD.Sedl6WweCdUDeR1lge.xaLH8xg1ct9lGV/ezo8sICSWK"))},
+				},
+			},
+			want: false,
+		},
+		{
+			name: "Malformed authorization header",
+			fields: fields{
+				Username: "user",
+				Password: "pass",
+			},
+			args: args{
+				h: http.Header{
+					"Authorization": []string{"Basic !!!"},
+				},
+			},
+			want: false,
+		},
 		{
 			name: "Username is empty",
 			fields: fields{
@@ -406,6 +460,30 @@ func TestAuthMethodBasic_Match(t *testing.T) {
 	}
 }
 
+func TestAuthByBasicRealm(t *testing.T) {
+	tests := []struct {
+		realm string
+		want  string
+	}{
+		{realm: "", want: `Basic realm="Restricted"`},
+		{realm: "Mirage Preview", want: `Basic realm="Mirage Preview"`},
+	}
+	for _, tt := range tests {
+		auth := &mirageecs.Auth{
+			Basic: &mirageecs.AuthMethodBasic{Username: "user", Password: "pass", Realm: tt.realm},
+		}
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.SetBasicAuth("user", "wrong")
+		res := httptest.NewRecorder()
+		if ok, err := auth.ByBasic(req, res); ok || err != nil {
+			t.Errorf("unexpected result %v %v", ok, err)
+		}
+		if got := res.Header().Get("WWW-Authenticate"); got != tt.want {
+			t.Errorf("unexpected WWW-Authenticate %q", got)
+		}
+	}
+}
+
 func TestAuthCookie(t *testing.T) {
 	auth := mirageecs.Auth{
 		CookieSecret: "secret",
@@ -449,3 +527,51 @@ func TestAuthCookie(t *testing.T) {
 		t.Error("should be expired")
 	}
 }
+
+func TestAuthCookieAttributes(t *testing.T) {
+	secure := false
+	auth := &mirageecs.Auth{
+		CookieSecret:   "secret",
+		CookieName:     "preview-auth",
+		CookieSameSite: "strict",
+		CookieSecure:   &secure,
+		CookieDomain:   ".preview.example.com",
+	}
+	if err := auth.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := auth.NewAuthCookie(time.Minute, ".example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Name != "preview-auth" || cookie.SameSite != http.SameSiteStrictMode || cookie.Secure || cookie.Domain != ".preview.example.com" {
+		t.Errorf("unexpected cookie %#v", cookie)
+	}
+	if err := auth.ValidateAuthCookie(cookie); err != nil {
+		t.Error(err)
+	}
+	cookie.Name = mirageecs.AuthCookieName
+	if err := auth.ValidateAuthCookie(cookie); err == nil {
+		t.Error("cookie of the other name should be invalid")
+	}
+
+	// defaults
+	cookie, err = (&mirageecs.Auth{CookieSecret: "secret"}).NewAuthCookie(time.Minute, ".example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cookie.Name != mirageecs.AuthCookieName || cookie.SameSite != http.SameSiteLaxMode || !cookie.Secure || cookie.Domain != ".example.com" {
+		t.Errorf("unexpected default cookie %#v", cookie)
+	}
+
+	invalid := []*mirageecs.Auth{
+		{CookieSameSite: "none", CookieSecure: &secure},
+		{CookieSameSite: "relaxed"},
+		{CookieName: "preview auth"},
+	}
+	for _, a := range invalid {
+		if err := a.Validate(); err == nil {
+			t.Errorf("%#v must be invalid", a)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package mirageecs
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const DefaultCompressionMinSize = 1024
+
+// incompressibleContentTypes are the prefixes of the content types already compressed or streamed.
+var incompressibleContentTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/x-bzip2",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/zstd",
+	"application/octet-stream",
+	"text/event-stream",
+}
+
+// Compression configures compressing the responses proxied from upstreams.
+type Compression struct {
+	MinSize int `yaml:"min_size"`
+}
+
+func (c *Compression) Validate() error {
+	if c.MinSize == 0 {
+		c.MinSize = DefaultCompressionMinSize
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("min_size must be positive: %d", c.MinSize)
+	}
+	return nil
+}
+
+// Apply returns the response compressed by the encoding accepted by the request.
+// The response is returned as is when it is not worth compressing.
+func (c *Compression) Apply(req *http.Request, resp *http.Response) *http.Response {
+	if c == nil || req.Method == http.MethodHead {
+		return resp
+	}
+	enc := acceptedEncoding(req.Header.Get("Accept-Encoding"))
+	if enc == "" || !c.compressible(resp) {
+		return resp
+	}
+
+	// read the head of the body to skip the small one without Content-Length
+	head := make([]byte, c.MinSize)
+	n, err := io.ReadFull(resp.Body, head)
+	head = head[:n]
+	if err != nil {
+		// smaller than min_size, or failed to read. the error is returned again by the body.
+		resp.Body = &readCloser{Reader: io.MultiReader(bytes.NewReader(head), resp.Body), Closer: resp.Body}
+		return resp
+	}
+
+	pr, pw := io.Pipe()
+	go func(body io.Reader) {
+		w := newCompressWriter(enc, pw)
+		_, err := io.Copy(w, body)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}(io.MultiReader(bytes.NewReader(head), resp.Body))
+	resp.Body = &readCloser{Reader: pr, Closer: closers{pr, resp.Body}}
+
+	resp.Header.Set("Content-Encoding", enc)
+	resp.Header.Del("Content-Length")
+	resp.Header.Add("Vary", "Accept-Encoding")
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		// the compressed body is not byte-for-byte identical
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.ContentLength = -1
+	slog.Debug(f("compress response of %s by %s", req.URL, enc))
+	return resp
+}
+
+func (c *Compression) compressible(resp *http.Response) bool {
+	switch {
+	case resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified:
+		return false
+	case resp.Body == nil || resp.Body == http.NoBody:
+		return false
+	case resp.ContentLength >= 0 && resp.ContentLength < int64(c.MinSize):
+		return false
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return false
+	}
+	if resp.Header.Get("Content-Range") != "" ||
+		strings.Contains(resp.Header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	if strings.HasPrefix(ct, "image/svg+xml") {
+		return true
+	}
+	for _, t := range incompressibleContentTypes {
+		if strings.HasPrefix(ct, t) {
+			return false
+		}
+	}
+	return true
+}
+
+// acceptedEncoding returns "gzip" or "deflate" accepted by the Accept-Encoding header, preferring gzip.
+func acceptedEncoding(header string) string {
+	var deflate bool
+	for _, v := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(v), ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+				continue
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "gzip":
+			return "gzip"
+		case "deflate":
+			deflate = true
+		}
+	}
+	if deflate {
+		return "deflate"
+	}
+	return ""
+}
+
+func newCompressWriter(enc string, w io.Writer) io.WriteCloser {
+	if enc == "deflate" {
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression) // never fails with the default level
+		return fw
+	}
+	return gzip.NewWriter(w)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closers []io.Closer
+
+func (cs closers) Close() error {
+	var err error
+	for _, c := range cs {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,93 @@
+package mirageecs_test
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestReverseProxyCompression(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+	cfg.Network.Compression = &mirageecs.Compression{}
+	if err := cfg.Network.Compression.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("mirage-ecs ", 1000)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/large":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, large)
+		case "/small":
+			w.Header().Set("Content-Type", "text/plain")
+			io.WriteString(w, "small")
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			io.WriteString(w, large)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", port)
+
+	serve := func(path, acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Host = "aaa.example.net"
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 8080)
+		return rec
+	}
+
+	rec := serve("/large", "gzip, deflate")
+	if enc := rec.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("unexpected Content-Encoding %q", enc)
+	}
+	if rec.Header().Get("Content-Length") != "" {
+		t.Errorf("Content-Length should be removed: %s", rec.Header().Get("Content-Length"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil {
+		t.Fatal(err)
+	} else if string(b) != large {
+		t.Errorf("unexpected body after decompression: %d bytes", len(b))
+	}
+
+	for _, tt := range []struct {
+		path           string
+		acceptEncoding string
+	}{
+		{path: "/large", acceptEncoding: ""},
+		{path: "/large", acceptEncoding: "gzip;q=0, br"},
+		{path: "/small", acceptEncoding: "gzip"},
+		{path: "/image", acceptEncoding: "gzip"},
+	} {
+		rec := serve(tt.path, tt.acceptEncoding)
+		if enc := rec.Header().Get("Content-Encoding"); enc != "" {
+			t.Errorf("%s with %q should not be compressed: %s", tt.path, tt.acceptEncoding, enc)
+		}
+	}
+}
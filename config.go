@@ -14,7 +14,10 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -25,8 +28,11 @@ import (
 	metadata "github.com/brunoscheufler/aws-ecs-metadata-go"
 	config "github.com/kayac/go-config"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/bytes"
 )
 
+var platformVersionRegexp = regexp.MustCompile(`^(LATEST|[0-9]+\.[0-9]+\.[0-9]+)$`)
+
 var DefaultParameter = &Parameter{
 	Name:     "branch",
 	Env:      "GIT_BRANCH",
@@ -45,40 +51,140 @@ type Config struct {
 	Link      Link       `yaml:"link"`
 	Auth      *Auth      `yaml:"auth"`
 	Purge     *Purge     `yaml:"purge"`
+	UI        UI         `yaml:"ui"`
+
+	AccessAlert *AccessAlert `yaml:"access_alert"`
+	LocalRoutes []LocalRoute `yaml:"local_routes"`
+	History     *History     `yaml:"history"`
+
+	LaunchValidation *LaunchValidation `yaml:"launch_validation"`
+	TagColumns       []*TagColumn      `yaml:"tag_columns"`
+	Reservation      *Reservation      `yaml:"reservation"`
+	ScaleToZero      *ScaleToZero      `yaml:"scale_to_zero"`
+	Notification     *Notification     `yaml:"notification"`
+	Presets          []*Preset         `yaml:"presets"`
+	Metrics          *Metrics          `yaml:"metrics"`
+	CORS             *CORS             `yaml:"cors"`
+	Defaults         map[string]string `yaml:"defaults"` // the default values of the parameters for every launch
+	LocalDocker      *LocalDocker      `yaml:"local_docker"`
 
 	compatV1  bool
 	localMode bool
 	awscfg    *aws.Config
 	cleanups  []func() error
+
+	awsAPICalls   *awsAPICallCounter
+	eventListener EventListener
 }
 
 type ECSCfg struct {
 	Region                   string                   `yaml:"region"`
 	Cluster                  string                   `yaml:"cluster"`
 	CapacityProviderStrategy CapacityProviderStrategy `yaml:"capacity_provider_strategy"`
+	LaunchPreference         []string                 `yaml:"launch_preference"`
 	LaunchType               *string                  `yaml:"launch_type"`
 	NetworkConfiguration     *NetworkConfiguration    `yaml:"network_configuration"`
 	DefaultTaskDefinition    string                   `yaml:"default_task_definition"`
 	EnableExecuteCommand     *bool                    `yaml:"enable_execute_command"`
+	StartDeadline            time.Duration            `yaml:"start_deadline"`
+	TerminateOnStartDeadline bool                     `yaml:"terminate_on_start_deadline"`
+	LogStreamNameTemplate    string                   `yaml:"log_stream_name_template"`
+	PurgeConcurrency         int                      `yaml:"purge_concurrency"`
+	PurgeTerminateInterval   time.Duration            `yaml:"purge_terminate_interval"`
+	PortMappingName          string                   `yaml:"port_mapping_name"`
+	MaxLifetime              time.Duration            `yaml:"max_lifetime"`
+	OverrideTemplate         string                   `yaml:"override_template"`
+	TaskDefCacheTTL          time.Duration            `yaml:"task_def_cache_ttl"`
+	RunTaskMaxAttempts       int                      `yaml:"run_task_max_attempts"`
+	DefaultContainers        map[string]string        `yaml:"default_containers"`
+	DrainDuration            time.Duration            `yaml:"drain_duration"`
+	StatusClassMetrics       bool                     `yaml:"status_class_metrics"`
+	LatencyMetrics           bool                     `yaml:"latency_metrics"`
+	IPAddressFamily          string                   `yaml:"ip_address_family"`
+	PropagateTags            string                   `yaml:"propagate_tags"`
+	PlatformVersion          string                   `yaml:"platform_version"`
+	MaxConcurrentTasks       int                      `yaml:"max_concurrent_tasks"`
+	TraceDuration            time.Duration            `yaml:"trace_duration"`
+	TraceMaxDuration         time.Duration            `yaml:"trace_max_duration"`
+	TraceStdout              *bool                    `yaml:"trace_stdout"`
+	TraceSNSTopicArn         string                   `yaml:"trace_sns_topic_arn"`
+	TraceCacheTTL            time.Duration            `yaml:"trace_cache_ttl"`
+	AllowedTaskDefinitions   []string                 `yaml:"allowed_task_definitions"`
+	DeniedTaskDefinitions    []string                 `yaml:"denied_task_definitions"`
 
 	capacityProviderStrategy []types.CapacityProviderStrategyItem `yaml:"-"`
 	networkConfiguration     *types.NetworkConfiguration          `yaml:"-"`
+	overrideTemplate         *template.Template                   `yaml:"-"`
 }
 
 func (c ECSCfg) String() string {
 	m := map[string]interface{}{
-		"region":                     c.Region,
-		"cluster":                    c.Cluster,
-		"capacity_provider_strategy": c.capacityProviderStrategy,
-		"launch_type":                c.LaunchType,
-		"network_configuration":      c.networkConfiguration,
-		"default_task_definition":    c.DefaultTaskDefinition,
-		"enable_execute_command":     c.EnableExecuteCommand,
+		"region":                      c.Region,
+		"cluster":                     c.Cluster,
+		"capacity_provider_strategy":  c.capacityProviderStrategy,
+		"launch_type":                 c.LaunchType,
+		"network_configuration":       c.networkConfiguration,
+		"default_task_definition":     c.DefaultTaskDefinition,
+		"enable_execute_command":      c.EnableExecuteCommand,
+		"start_deadline":              c.StartDeadline.String(),
+		"terminate_on_start_deadline": c.TerminateOnStartDeadline,
+		"log_stream_name_template":    c.LogStreamNameTemplate,
+		"purge_concurrency":           c.PurgeConcurrency,
+		"purge_terminate_interval":    c.PurgeTerminateInterval.String(),
+		"port_mapping_name":           c.PortMappingName,
+		"max_lifetime":                c.MaxLifetime.String(),
+		"override_template":           c.OverrideTemplate,
+		"task_def_cache_ttl":          c.TaskDefCacheTTL.String(),
+		"run_task_max_attempts":       c.RunTaskMaxAttempts,
+		"default_containers":          c.DefaultContainers,
+		"drain_duration":              c.DrainDuration.String(),
+		"status_class_metrics":        c.StatusClassMetrics,
+		"latency_metrics":             c.LatencyMetrics,
+		"ip_address_family":           c.IPAddressFamily,
+		"propagate_tags":              c.PropagateTags,
+		"platform_version":            c.PlatformVersion,
+		"max_concurrent_tasks":        c.MaxConcurrentTasks,
+		"trace_duration":              c.TraceDuration.String(),
+		"trace_max_duration":          c.TraceMaxDuration.String(),
+		"trace_stdout":                c.TraceStdout,
+		"trace_sns_topic_arn":         c.TraceSNSTopicArn,
+		"trace_cache_ttl":             c.TraceCacheTTL.String(),
+		"allowed_task_definitions":    c.AllowedTaskDefinitions,
+		"denied_task_definitions":     c.DeniedTaskDefinitions,
 	}
 	b, _ := json.Marshal(m)
 	return string(b)
 }
 
+// traceStdout reports whether the trace is returned to the web UI and API. It is true unless trace_stdout is false.
+func (c ECSCfg) traceStdout() bool {
+	return c.TraceStdout == nil || *c.TraceStdout
+}
+
+// taskdefAllowed reports whether the task definition can be launched.
+// The task definitions matching denied_task_definitions are denied, and the others are allowed
+// when they match allowed_task_definitions or it is empty.
+func (c ECSCfg) taskdefAllowed(taskdef string) bool {
+	if matchTaskdef(c.DeniedTaskDefinitions, taskdef) {
+		return false
+	}
+	return len(c.AllowedTaskDefinitions) == 0 || matchTaskdef(c.AllowedTaskDefinitions, taskdef)
+}
+
+// matchTaskdef reports whether the name (family:revision or family) or the family of the task definition matches any of the glob patterns.
+func matchTaskdef(patterns []string, taskdef string) bool {
+	name, family := taskdefName(taskdef), taskdefFamily(taskdef)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, family); ok {
+			return true
+		}
+	}
+	return false
+}
+
 func (c ECSCfg) validate() error {
 	if c.Region == "" {
 		return fmt.Errorf("region is required")
@@ -108,6 +214,32 @@ func (s CapacityProviderStrategy) toSDK() []types.CapacityProviderStrategyItem {
 	return items
 }
 
+// capacityProviderStrategyFromPreference compiles capacity providers in order of preference
+// into a capacity provider strategy. The most preferred provider has the whole weight,
+// and the others are used by RunTask only when the preferred ones are short of capacity.
+func capacityProviderStrategyFromPreference(providers []string) (CapacityProviderStrategy, error) {
+	seen := make(map[string]bool, len(providers))
+	strategy := make(CapacityProviderStrategy, 0, len(providers))
+	for i, p := range providers {
+		if p == "" {
+			return nil, fmt.Errorf("empty capacity provider")
+		}
+		if seen[p] {
+			return nil, fmt.Errorf("duplicated capacity provider %s", p)
+		}
+		seen[p] = true
+		var weight int32
+		if i == 0 {
+			weight = 1
+		}
+		strategy = append(strategy, &CapacityProviderStrategyItem{
+			CapacityProvider: aws.String(p),
+			Weight:           weight,
+		})
+	}
+	return strategy, nil
+}
+
 type CapacityProviderStrategyItem struct {
 	CapacityProvider *string `yaml:"capacity_provider"`
 	Weight           int32   `yaml:"weight"`
@@ -150,19 +282,139 @@ func (c *AwsVpcConfiguration) toSDK() *types.AwsVpcConfiguration {
 }
 
 type Host struct {
-	WebApi             string `yaml:"webapi"`
-	ReverseProxySuffix string `yaml:"reverse_proxy_suffix"`
+	WebApi             string   `yaml:"webapi"`
+	ReverseProxySuffix string   `yaml:"reverse_proxy_suffix"`
+	ReservedSubdomains []string `yaml:"reserved_subdomains"`
+}
+
+// checkReserved returns an error when the subdomain collides with the webapi host or the reserved subdomains.
+func (h Host) checkReserved(subdomain string) error {
+	s := strings.ToLower(subdomain)
+	if strings.EqualFold(s+h.ReverseProxySuffix, h.WebApi) {
+		return newSubdomainError(SubdomainErrorReserved, subdomain,
+			fmt.Errorf("subdomain %s collides with the webapi host %s", subdomain, h.WebApi))
+	}
+	for _, r := range h.ReservedSubdomains {
+		if strings.EqualFold(s, r) {
+			return newSubdomainError(SubdomainErrorReserved, subdomain,
+				fmt.Errorf("subdomain %s is reserved", subdomain))
+		}
+	}
+	return nil
 }
 
 type Link struct {
-	HostedZoneID           string   `yaml:"hosted_zone_id"`
-	DefaultTaskDefinitions []string `yaml:"default_task_definitions"`
+	HostedZoneID                      string                             `yaml:"hosted_zone_id"`
+	DefaultTaskDefinitions            []string                           `yaml:"default_task_definitions"`
+	DefaultTaskDefinitionsByParameter *DefaultTaskDefinitionsByParameter `yaml:"default_task_definitions_by_parameter"`
+	StrictTaskdef                     bool                               `yaml:"strict_taskdef"`
+}
+
+// DefaultTaskDefinitionsByParameter maps a value of the parameter to the default task definitions.
+type DefaultTaskDefinitionsByParameter struct {
+	Parameter       string              `yaml:"parameter"`
+	TaskDefinitions map[string][]string `yaml:"task_definitions"`
+}
+
+func (d *DefaultTaskDefinitionsByParameter) validate(params Parameters) error {
+	if d.Parameter == "" {
+		return fmt.Errorf("parameter is required")
+	}
+	for _, p := range params {
+		if p.Name == d.Parameter {
+			return nil
+		}
+	}
+	return fmt.Errorf("parameter %s is not defined in parameters", d.Parameter)
+}
+
+// DefaultTaskDefinitions returns the default task definitions for the launch.
+// The task definitions mapped by the parameter value are preferred,
+// and falls back to link.default_task_definitions or ecs.default_task_definition.
+func (c *Config) DefaultTaskDefinitions(getParam func(string) string) []string {
+	if d := c.Link.DefaultTaskDefinitionsByParameter; d != nil {
+		if taskdefs := d.TaskDefinitions[getParam(d.Parameter)]; len(taskdefs) > 0 {
+			return taskdefs
+		}
+	}
+	if c.Link.DefaultTaskDefinitions != nil {
+		return c.Link.DefaultTaskDefinitions
+	}
+	if c.ECS.DefaultTaskDefinition != "" {
+		return []string{c.ECS.DefaultTaskDefinition}
+	}
+	return nil
+}
+
+// allowedTaskdefFamilies returns the families of the task definitions configured as defaults or in presets.
+func (c *Config) allowedTaskdefFamilies() map[string]bool {
+	allowed := make(map[string]bool)
+	add := func(taskdefs ...string) {
+		for _, td := range taskdefs {
+			allowed[taskdefFamily(td)] = true
+		}
+	}
+	add(c.Link.DefaultTaskDefinitions...)
+	if d := c.Link.DefaultTaskDefinitionsByParameter; d != nil {
+		for _, taskdefs := range d.TaskDefinitions {
+			add(taskdefs...)
+		}
+	}
+	if c.ECS.DefaultTaskDefinition != "" {
+		add(c.ECS.DefaultTaskDefinition)
+	}
+	for _, p := range c.Presets {
+		add(p.Taskdefs...)
+	}
+	return allowed
+}
+
+// validateTaskdefs rejects the task definitions of unknown families in link.strict_taskdef mode.
+// Any revision of the allowed families can be launched.
+func (c *Config) validateTaskdefs(taskdefs []string) error {
+	if !c.Link.StrictTaskdef {
+		return nil
+	}
+	allowed := c.allowedTaskdefFamilies()
+	var unknown []string
+	for _, td := range taskdefs {
+		if !allowed[taskdefFamily(td)] {
+			unknown = append(unknown, td)
+		}
+	}
+	if len(unknown) > 0 {
+		families := make([]string, 0, len(allowed))
+		for family := range allowed {
+			families = append(families, family)
+		}
+		slices.Sort(families)
+		return fmt.Errorf("unknown taskdef %s: must be one of %s", strings.Join(unknown, ", "), strings.Join(families, ", "))
+	}
+	return nil
+}
+
+// taskdefName returns the name of the task definition specified by ARN, family:revision or family.
+// The name of an ARN is family:revision.
+func taskdefName(taskdef string) string {
+	if _, name, ok := strings.Cut(taskdef, ":task-definition/"); ok {
+		return name
+	}
+	return taskdef
+}
+
+// taskdefFamily returns the family of the task definition specified by ARN, family:revision or family.
+func taskdefFamily(taskdef string) string {
+	family, _, _ := strings.Cut(taskdefName(taskdef), ":")
+	return family
 }
 
 type Listen struct {
 	ForeignAddress string    `yaml:"foreign_address,omitempty"`
 	HTTP           []PortMap `yaml:"http,omitempty"`
 	HTTPS          []PortMap `yaml:"https,omitempty"`
+
+	// LocalTargetPorts restricts the target ports proxied in local mode. Any port is allowed when empty.
+	LocalTargetPorts []int `yaml:"local_target_ports,omitempty"`
 }
 
 type PortMap struct {
@@ -171,6 +423,53 @@ type PortMap struct {
 	RequireAuthCookie bool `yaml:"require_auth_cookie"`
 }
 
+// hasTargetPort reports whether any of listen.http[] targets the port.
+func (l Listen) hasTargetPort(port int) bool {
+	for _, v := range l.HTTP {
+		if v.TargetPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsLocalTargetPort reports whether local mode proxies to the port.
+func (l Listen) allowsLocalTargetPort(port int) bool {
+	if len(l.LocalTargetPorts) == 0 {
+		return true
+	}
+	return slices.Contains(l.LocalTargetPorts, port)
+}
+
+func (l Listen) validateLocalTargetPorts() error {
+	for _, port := range l.LocalTargetPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid port %d", port)
+		}
+	}
+	return nil
+}
+
+// LocalRoute maps a subdomain to a fixed target in local mode.
+type LocalRoute struct {
+	Subdomain string `yaml:"subdomain"`
+	Address   string `yaml:"address"`
+	Port      int    `yaml:"port"`
+}
+
+func (r LocalRoute) validate() error {
+	if err := validateSubdomain(r.Subdomain); err != nil {
+		return err
+	}
+	if r.Address == "" {
+		return fmt.Errorf("address is required for %s", r.Subdomain)
+	}
+	if r.Port <= 0 || r.Port > 65535 {
+		return fmt.Errorf("invalid port %d for %s", r.Port, r.Subdomain)
+	}
+	return nil
+}
+
 type Parameter struct {
 	Name        string            `yaml:"name"`
 	Env         string            `yaml:"env"`
@@ -180,6 +479,45 @@ type Parameter struct {
 	Default     string            `yaml:"default"`
 	Description string            `yaml:"description"`
 	Options     []ParameterOption `yaml:"options"`
+	HelpURL     string            `yaml:"help_url"`
+	Group       string            `yaml:"group"`
+	MaxLength   int               `yaml:"max_length"`
+	Secret      bool              `yaml:"secret"`
+	// AllowedSecrets are the ARN prefixes of the secrets allowed as the values of the secret parameter.
+	AllowedSecrets []string `yaml:"allowed_secrets"`
+}
+
+const (
+	// DefaultParameterMaxLength is the max length of a parameter value without max_length.
+	DefaultParameterMaxLength = 255
+	// ParameterMaxLengthLimit is the ceiling of max_length, to keep the environment
+	// variables of a task within the size limit of ECS container overrides.
+	ParameterMaxLengthLimit = 4096
+)
+
+// ValueMaxLength returns the max length of the value in unicode characters.
+func (p *Parameter) ValueMaxLength() int {
+	if p.MaxLength == 0 {
+		return DefaultParameterMaxLength
+	}
+	return p.MaxLength
+}
+
+var secretReferenceRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:(ssm|secretsmanager):[a-z0-9-]+:[0-9]{12}:(parameter/|secret:).+`)
+
+// isSecretReference reports whether the value is an ARN of a parameter of SSM Parameter Store or a secret of Secrets Manager.
+func isSecretReference(value string) bool {
+	return secretReferenceRegexp.MatchString(value)
+}
+
+// secretAllowed reports whether the value is a reference to the secret allowed by allowed_secrets.
+func (p *Parameter) secretAllowed(value string) bool {
+	if !isSecretReference(value) {
+		return false
+	}
+	return slices.ContainsFunc(p.AllowedSecrets, func(prefix string) bool {
+		return strings.HasPrefix(value, prefix)
+	})
 }
 
 type ParameterOption struct {
@@ -189,6 +527,39 @@ type ParameterOption struct {
 
 type Parameters []*Parameter
 
+// isSecretEnv reports whether the environment variable holds the value of a secret parameter.
+func (ps Parameters) isSecretEnv(name string) bool {
+	for _, p := range ps {
+		if p.Secret && strings.EqualFold(p.Env, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParameterGroup is a group of parameters rendered together in the launcher.
+type ParameterGroup struct {
+	Name       string
+	Parameters Parameters
+}
+
+// Groups returns the parameters grouped by Group in order of first appearance.
+// The parameters without Group belong to the group of empty name.
+func (ps Parameters) Groups() []*ParameterGroup {
+	var groups []*ParameterGroup
+	index := make(map[string]*ParameterGroup)
+	for _, p := range ps {
+		g, ok := index[p.Group]
+		if !ok {
+			g = &ParameterGroup{Name: p.Group}
+			index[p.Group] = g
+			groups = append(groups, g)
+		}
+		g.Parameters = append(g.Parameters, p)
+	}
+	return groups
+}
+
 type ConfigParams struct {
 	Path        string
 	Domain      string
@@ -199,11 +570,240 @@ type ConfigParams struct {
 }
 
 type Network struct {
-	ProxyTimeout time.Duration `yaml:"proxy_timeout"`
+	ProxyTimeout  time.Duration    `yaml:"proxy_timeout"`
+	DrainTimeout  time.Duration    `yaml:"drain_timeout"`
+	UserAgent     *UserAgentFilter `yaml:"user_agent"`
+	Preflight     *Preflight       `yaml:"preflight"`
+	HealthCheck   *HealthCheck     `yaml:"health_check"`
+	StartupCheck  *StartupCheck    `yaml:"startup_check"`
+	StripRequest  *StripRequest    `yaml:"strip_request"`
+	DialLimit     *DialLimit       `yaml:"dial_limit"`
+	CatchAll      *CatchAll        `yaml:"catch_all"`
+	StickySession *StickySession   `yaml:"sticky_session"`
+
+	ResponseHeaders ResponseHeaders `yaml:"response_headers"`
+	Compression     *Compression    `yaml:"compression"`
+	RateLimit       *RateLimit      `yaml:"rate_limit"`
+	AccessLog       *AccessLog      `yaml:"access_log"`
+
+	// ProxyHandlerLifetime is how long the proxy handler lives without being refreshed by the task list.
+	ProxyHandlerLifetime time.Duration `yaml:"proxy_handler_lifetime"`
+
+	// WebApiBodyLimit is the maximum size of the request body to the webapi. e.g. 1M, 512K
+	WebApiBodyLimit string `yaml:"webapi_body_limit"`
+
+	// AccessCountsFile is the file to save the access counts on shutdown and restore on startup in local mode.
+	AccessCountsFile string `yaml:"access_counts_file"`
+
+	// TrustedProxies are the CIDRs of the proxies (e.g. load balancers) in front of mirage-ecs.
+	// X-Forwarded-For is used to get the client IP address only when the request comes from them.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+
+	trustedProxies []*net.IPNet
+}
+
+// ipExtractor returns the extractor of the client IP address.
+// X-Forwarded-For is trusted only when the trusted_proxies are configured, otherwise the remote address is used.
+func (n *Network) ipExtractor() echo.IPExtractor {
+	if len(n.trustedProxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, ipnet := range n.trustedProxies {
+		opts = append(opts, echo.TrustIPRange(ipnet))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+// clientIP returns the IP address of the client of the request.
+func (n *Network) clientIP(req *http.Request) string {
+	return n.ipExtractor()(req)
+}
+
+const DefaultStickySessionCookieName = "mirage-ecs-sticky"
+
+// StickySession configures cookie-based sticky routing to the upstreams of a subdomain.
+type StickySession struct {
+	CookieName string `yaml:"cookie_name"`
+}
+
+func (s *StickySession) Validate() error {
+	if s.CookieName == "" {
+		s.CookieName = DefaultStickySessionCookieName
+	}
+	if !isValidCookieName(s.CookieName) {
+		return fmt.Errorf("invalid cookie_name %s", s.CookieName)
+	}
+	return nil
+}
+
+// Cookie returns the cookie which pins the client to the upstream of the key.
+func (s *StickySession) Cookie(key string) *http.Cookie {
+	return &http.Cookie{
+		Name:     s.CookieName,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+func isValidCookieName(name string) bool {
+	c := &http.Cookie{Name: name, Value: "x"}
+	return c.Valid() == nil
+}
+
+// CatchAll configures the upstream for the subdomains that are not managed by mirage-ecs.
+type CatchAll struct {
+	Upstream string `yaml:"upstream"`
+}
+
+func (c *CatchAll) Validate() error {
+	if c.Upstream == "" {
+		return fmt.Errorf("upstream is required")
+	}
+	host, port, err := net.SplitHostPort(c.Upstream)
+	if err != nil {
+		return fmt.Errorf("invalid upstream %s: %w", c.Upstream, err)
+	}
+	if host == "" {
+		return fmt.Errorf("invalid upstream %s: host is required", c.Upstream)
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("invalid upstream %s: port must be 1-65535", c.Upstream)
+	}
+	return nil
+}
+
+// StripRequest configures request headers and cookies not to be forwarded to upstreams.
+type StripRequest struct {
+	Headers []string `yaml:"headers"`
+	Cookies []string `yaml:"cookies"`
+}
+
+// Apply returns a clone of the request without the headers and cookies.
+func (s *StripRequest) Apply(req *http.Request) *http.Request {
+	if s == nil || (len(s.Headers) == 0 && len(s.Cookies) == 0) {
+		return req
+	}
+	req = req.Clone(req.Context())
+	for _, h := range s.Headers {
+		req.Header.Del(h)
+	}
+	if len(s.Cookies) == 0 || req.Header.Get("Cookie") == "" {
+		return req
+	}
+	cookies := req.Cookies()
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if !slices.Contains(s.Cookies, c.Name) {
+			req.AddCookie(c)
+		}
+	}
+	return req
+}
+
+// Preflight configures responses for CORS preflight requests answered by the reverse proxy.
+type Preflight struct {
+	Subdomains []string          `yaml:"subdomains"`
+	Headers    map[string]string `yaml:"headers"`
+}
+
+func (p *Preflight) Validate() error {
+	if len(p.Headers) == 0 {
+		return fmt.Errorf("headers are required")
+	}
+	for _, s := range p.Subdomains {
+		if _, err := path.Match(s, "x"); err != nil {
+			return fmt.Errorf("invalid subdomain pattern %s: %w", s, err)
+		}
+	}
+	return nil
+}
+
+// HeadersFor returns the preflight response headers for the subdomain.
+// It returns nil when the subdomain does not match.
+func (p *Preflight) HeadersFor(subdomain string) http.Header {
+	if p == nil {
+		return nil
+	}
+	matched := len(p.Subdomains) == 0
+	for _, s := range p.Subdomains {
+		if m, _ := path.Match(s, subdomain); m {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return nil
+	}
+	h := make(http.Header, len(p.Headers))
+	for k, v := range p.Headers {
+		h.Set(k, v)
+	}
+	return h
+}
+
+// UserAgentFilter restricts requests to the reverse proxy by User-Agent regexps.
+type UserAgentFilter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+
+	allow []*regexp.Regexp
+	deny  []*regexp.Regexp
+}
+
+func (u *UserAgentFilter) Validate() error {
+	u.allow = u.allow[:0]
+	for _, s := range u.Allow {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid allow regexp %s: %w", s, err)
+		}
+		u.allow = append(u.allow, re)
+	}
+	u.deny = u.deny[:0]
+	for _, s := range u.Deny {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return fmt.Errorf("invalid deny regexp %s: %w", s, err)
+		}
+		u.deny = append(u.deny, re)
+	}
+	return nil
+}
+
+// Allowed reports whether the User-Agent is allowed.
+// Deny rules are preferred. When allow rules exist, the User-Agent must match one of them.
+func (u *UserAgentFilter) Allowed(ua string) bool {
+	if u == nil {
+		return true
+	}
+	for _, re := range u.deny {
+		if re.MatchString(ua) {
+			return false
+		}
+	}
+	if len(u.allow) == 0 {
+		return true
+	}
+	for _, re := range u.allow {
+		if re.MatchString(ua) {
+			return true
+		}
+	}
+	return false
 }
 
 const DefaultPort = 80
 const DefaultProxyTimeout = 0
+const DefaultProxyHandlerLifetime = 30 * time.Second
+const LocalProxyHandlerLifetime = time.Hour * 24 * 365 * 10 // not expire
+const DefaultWebApiBodyLimit = "1M"
 const AuthCookieName = "mirage-ecs-auth"
 const AuthCookieExpire = 24 * time.Hour
 
@@ -230,10 +830,19 @@ func NewConfig(ctx context.Context, p *ConfigParams) (*Config, error) {
 		},
 		Network: Network{
 			ProxyTimeout: DefaultProxyTimeout,
+			DrainTimeout: DefaultDrainTimeout,
+			StripRequest: &StripRequest{
+				Cookies: []string{AuthCookieName},
+			},
 		},
 		HtmlDir: "./html",
 		ECS: ECSCfg{
-			Region: os.Getenv("AWS_REGION"),
+			Region:             os.Getenv("AWS_REGION"),
+			TaskDefCacheTTL:    DefaultTaskDefCacheTTL,
+			RunTaskMaxAttempts: DefaultRunTaskMaxAttempts,
+			TraceDuration:      DefaultTraceDuration,
+			TraceMaxDuration:   DefaultTraceMaxDuration,
+			TraceCacheTTL:      DefaultTraceCacheTTL,
 		},
 		Auth:  nil,
 		Purge: nil,
@@ -258,6 +867,8 @@ func NewConfig(ctx context.Context, p *ConfigParams) (*Config, error) {
 	if awscfg, err := awsv2Config.LoadDefaultConfig(ctx, awsv2Config.WithRegion(cfg.ECS.Region)); err != nil {
 		return nil, err
 	} else {
+		cfg.awsAPICalls = newAWSAPICallCounter()
+		awscfg.APIOptions = append(awscfg.APIOptions, cfg.awsAPICalls.register)
 		cfg.awscfg = &awscfg
 	}
 
@@ -299,6 +910,40 @@ func NewConfig(ctx context.Context, p *ConfigParams) (*Config, error) {
 			}
 			v.Regexp = *paramRegex
 		}
+		if v.HelpURL != "" {
+			if u, err := url.Parse(v.HelpURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return nil, fmt.Errorf("invalid parameter help_url: %s: must be http or https URL", v.HelpURL)
+			}
+		}
+		if v.MaxLength < 0 || v.MaxLength > ParameterMaxLengthLimit {
+			return nil, fmt.Errorf("invalid parameter max_length: %s: must be between 1 and %d", v.Name, ParameterMaxLengthLimit)
+		}
+		if v.Secret && len(v.AllowedSecrets) == 0 {
+			return nil, fmt.Errorf("invalid parameter %s: allowed_secrets is required for the secret parameter", v.Name)
+		}
+		for _, prefix := range v.AllowedSecrets {
+			if !v.Secret {
+				return nil, fmt.Errorf("invalid parameter %s: allowed_secrets is only for the secret parameter", v.Name)
+			}
+			if !strings.HasPrefix(prefix, "arn:") {
+				return nil, fmt.Errorf("invalid parameter %s: allowed_secrets must be ARN prefixes: %s", v.Name, prefix)
+			}
+		}
+	}
+
+	for name := range cfg.Defaults {
+		if !cfg.Parameter.has(name) {
+			return nil, fmt.Errorf("invalid defaults config: parameter %s is not defined in parameters", name)
+		}
+	}
+
+	if d := cfg.Link.DefaultTaskDefinitionsByParameter; d != nil {
+		if err := d.validate(cfg.Parameter); err != nil {
+			return nil, fmt.Errorf("invalid link.default_task_definitions_by_parameter: %w", err)
+		}
+	}
+	if cfg.Link.StrictTaskdef && len(cfg.allowedTaskdefFamilies()) == 0 {
+		return nil, fmt.Errorf("link.strict_taskdef requires default task definitions or presets")
 	}
 
 	if strings.HasPrefix(cfg.HtmlDir, "s3://") {
@@ -312,10 +957,96 @@ func NewConfig(ctx context.Context, p *ConfigParams) (*Config, error) {
 		cfg.Host.ReverseProxySuffix = ".localtest.me"
 		cfg.Host.WebApi = "mirage.localtest.me"
 		slog.Info(f("You can access to http://mirage.localtest.me:%d/", cfg.Listen.HTTP[0].ListenPort))
+		for _, r := range cfg.LocalRoutes {
+			if err := r.validate(); err != nil {
+				return nil, fmt.Errorf("invalid local_routes: %w", err)
+			}
+		}
+		if err := cfg.Listen.validateLocalTargetPorts(); err != nil {
+			return nil, fmt.Errorf("invalid listen.local_target_ports: %w", err)
+		}
+	} else {
+		if len(cfg.LocalRoutes) > 0 {
+			slog.Warn("local_routes is ignored because not in local mode")
+			cfg.LocalRoutes = nil
+		}
+		if len(cfg.Listen.LocalTargetPorts) > 0 {
+			slog.Warn("listen.local_target_ports is ignored because not in local mode")
+		}
 	}
 
+	if len(cfg.ECS.LaunchPreference) > 0 {
+		if cfg.ECS.LaunchType != nil || cfg.ECS.CapacityProviderStrategy != nil {
+			return nil, fmt.Errorf("ecs.launch_preference cannot be used with launch_type or capacity_provider_strategy")
+		}
+		strategy, err := capacityProviderStrategyFromPreference(cfg.ECS.LaunchPreference)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ecs.launch_preference: %w", err)
+		}
+		cfg.ECS.CapacityProviderStrategy = strategy
+	}
+	if cfg.Auth != nil {
+		if err := cfg.Auth.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid auth config: %w", err)
+		}
+		if s := cfg.Network.StripRequest; s != nil && cfg.Auth.CookieName != "" && !slices.Contains(s.Cookies, cfg.Auth.CookieName) {
+			// the auth cookie is not forwarded to upstreams as the default name
+			s.Cookies = append(s.Cookies, cfg.Auth.CookieName)
+		}
+	}
+	if cfg.ECS.TaskDefCacheTTL <= 0 {
+		return nil, fmt.Errorf("ecs.task_def_cache_ttl must be positive: %s", cfg.ECS.TaskDefCacheTTL)
+	}
+	if cfg.ECS.DrainDuration < 0 || cfg.ECS.DrainDuration >= APICallTimeout {
+		// terminate API waits for the drain in APICallTimeout
+		return nil, fmt.Errorf("ecs.drain_duration must be 0 or positive and shorter than %s: %s", APICallTimeout, cfg.ECS.DrainDuration)
+	}
+	if cfg.ECS.TraceDuration <= 0 || cfg.ECS.TraceDuration > cfg.ECS.TraceMaxDuration {
+		return nil, fmt.Errorf("ecs.trace_duration must be positive and up to ecs.trace_max_duration %s: %s", cfg.ECS.TraceMaxDuration, cfg.ECS.TraceDuration)
+	}
+	if cfg.ECS.TraceCacheTTL < 0 {
+		return nil, fmt.Errorf("ecs.trace_cache_ttl must be 0 or positive: %s", cfg.ECS.TraceCacheTTL)
+	}
+	for _, p := range slices.Concat(cfg.ECS.AllowedTaskDefinitions, cfg.ECS.DeniedTaskDefinitions) {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid task definition pattern %q in ecs.allowed_task_definitions or ecs.denied_task_definitions: %w", p, err)
+		}
+	}
+	if !cfg.ECS.traceStdout() && cfg.ECS.TraceSNSTopicArn == "" {
+		return nil, fmt.Errorf("ecs.trace_sns_topic_arn is required when ecs.trace_stdout is false")
+	}
+	switch cfg.ECS.IPAddressFamily {
+	case "":
+		cfg.ECS.IPAddressFamily = IPAddressFamilyIPv4
+	case IPAddressFamilyIPv4, IPAddressFamilyIPv6:
+	default:
+		return nil, fmt.Errorf("ecs.ip_address_family must be %s or %s: %s", IPAddressFamilyIPv4, IPAddressFamilyIPv6, cfg.ECS.IPAddressFamily)
+	}
+	// RunTask rejects SERVICE, which is only for the tasks of services
+	runTaskPropagateTags := []types.PropagateTags{types.PropagateTagsTaskDefinition, types.PropagateTagsNone}
+	if p := cfg.ECS.PropagateTags; p != "" && !slices.Contains(runTaskPropagateTags, types.PropagateTags(p)) {
+		return nil, fmt.Errorf("ecs.propagate_tags must be one of %v: %s", runTaskPropagateTags, p)
+	}
+	if v := cfg.ECS.PlatformVersion; v != "" && !platformVersionRegexp.MatchString(v) {
+		return nil, fmt.Errorf("ecs.platform_version must be LATEST or a version like 1.4.0: %s", v)
+	}
 	cfg.ECS.capacityProviderStrategy = cfg.ECS.CapacityProviderStrategy.toSDK()
 	cfg.ECS.networkConfiguration = cfg.ECS.NetworkConfiguration.toSDK()
+	if p := cfg.ECS.OverrideTemplate; p != "" {
+		var content []byte
+		var err error
+		if strings.HasPrefix(p, "s3://") {
+			content, err = loadFromS3(ctx, cfg.awscfg, p)
+		} else {
+			content, err = loadFromFile(p)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot load ecs.override_template: %s: %w", p, err)
+		}
+		if cfg.ECS.overrideTemplate, err = parseTaskOverrideTemplate(p, content); err != nil {
+			return nil, fmt.Errorf("invalid ecs.override_template: %s: %w", p, err)
+		}
+	}
 
 	if err := cfg.fillECSDefaults(ctx); err != nil {
 		slog.Warn(f("failed to fill ECS defaults: %s", err))
@@ -326,6 +1057,153 @@ func NewConfig(ctx context.Context, p *ConfigParams) (*Config, error) {
 			return nil, fmt.Errorf("invalid purge config: %w", err)
 		}
 	}
+	if cfg.Network.UserAgent != nil {
+		if err := cfg.Network.UserAgent.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.user_agent config: %w", err)
+		}
+	}
+	if cfg.Network.Preflight != nil {
+		if err := cfg.Network.Preflight.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.preflight config: %w", err)
+		}
+	}
+	if cfg.Network.HealthCheck != nil {
+		if err := cfg.Network.HealthCheck.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.health_check config: %w", err)
+		}
+	}
+	if cfg.Metrics != nil {
+		if err := cfg.Metrics.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid metrics config: %w", err)
+		}
+	}
+	if cfg.CORS != nil {
+		if err := cfg.CORS.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid cors config: %w", err)
+		}
+	}
+	if cfg.LocalDocker != nil {
+		if err := cfg.LocalDocker.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid local_docker config: %w", err)
+		}
+	}
+	if cfg.Network.RateLimit != nil {
+		if err := cfg.Network.RateLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.rate_limit config: %w", err)
+		}
+	}
+	if cfg.Network.AccessLog != nil {
+		if err := cfg.Network.AccessLog.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.access_log config: %w", err)
+		}
+	}
+	if cfg.Network.Compression != nil {
+		if err := cfg.Network.Compression.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.compression config: %w", err)
+		}
+	}
+	if err := cfg.Network.ResponseHeaders.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid network.response_headers config: %w", err)
+	}
+	if cfg.Network.StartupCheck != nil {
+		if err := cfg.Network.StartupCheck.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.startup_check config: %w", err)
+		}
+	}
+	if cfg.Network.DialLimit != nil {
+		if err := cfg.Network.DialLimit.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.dial_limit config: %w", err)
+		}
+	}
+	if cfg.Network.DrainTimeout <= 0 {
+		return nil, fmt.Errorf("invalid network.drain_timeout: must be positive")
+	}
+	if cfg.Network.ProxyHandlerLifetime == 0 {
+		if cfg.localMode {
+			cfg.Network.ProxyHandlerLifetime = LocalProxyHandlerLifetime
+		} else {
+			cfg.Network.ProxyHandlerLifetime = DefaultProxyHandlerLifetime
+		}
+	} else if cfg.Network.ProxyHandlerLifetime < 0 {
+		return nil, fmt.Errorf("invalid network.proxy_handler_lifetime: must be positive")
+	}
+	if cfg.Network.WebApiBodyLimit == "" {
+		cfg.Network.WebApiBodyLimit = DefaultWebApiBodyLimit
+	}
+	if n, err := bytes.Parse(cfg.Network.WebApiBodyLimit); err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid network.webapi_body_limit: %s", cfg.Network.WebApiBodyLimit)
+	}
+	for _, cidr := range cfg.Network.TrustedProxies {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network.trusted_proxies: %w", err)
+		}
+		cfg.Network.trustedProxies = append(cfg.Network.trustedProxies, ipnet)
+	}
+	if cfg.Network.StickySession != nil {
+		if err := cfg.Network.StickySession.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.sticky_session config: %w", err)
+		}
+	}
+	if cfg.Network.CatchAll != nil {
+		if err := cfg.Network.CatchAll.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid network.catch_all config: %w", err)
+		}
+	}
+	if cfg.History != nil {
+		if err := cfg.History.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid history config: %w", err)
+		}
+	}
+	if cfg.Notification != nil {
+		if err := cfg.Notification.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid notification config: %w", err)
+		}
+	}
+	if cfg.AccessAlert != nil {
+		if err := cfg.AccessAlert.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid access_alert config: %w", err)
+		}
+	}
+	if cfg.LaunchValidation != nil {
+		if err := cfg.LaunchValidation.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid launch_validation config: %w", err)
+		}
+	}
+	if cfg.UI.Banner != nil {
+		if err := cfg.UI.Banner.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid ui.banner config: %w", err)
+		}
+	}
+	if cfg.ScaleToZero != nil {
+		if err := cfg.ScaleToZero.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid scale_to_zero config: %w", err)
+		}
+	}
+	if cfg.Reservation != nil {
+		if err := cfg.Reservation.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid reservation config: %w", err)
+		}
+		if cfg.Auth == nil {
+			// the owners of reservations are the authenticated users
+			return nil, fmt.Errorf("invalid reservation config: auth section is required")
+		}
+	}
+	for _, c := range cfg.TagColumns {
+		if err := c.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid tag_columns config: %w", err)
+		}
+	}
+	seenPresets := make(map[string]bool, len(cfg.Presets))
+	for _, p := range cfg.Presets {
+		if err := p.Validate(cfg.Parameter); err != nil {
+			return nil, fmt.Errorf("invalid presets config: %w", err)
+		}
+		if seenPresets[p.Name] {
+			return nil, fmt.Errorf("invalid presets config: preset %s is duplicated", p.Name)
+		}
+		seenPresets[p.Name] = true
+	}
 	return cfg, nil
 }
 
@@ -339,6 +1217,9 @@ func (c *Config) Cleanup() {
 
 func (c *Config) NewTaskRunner() TaskRunner {
 	if c.localMode {
+		if c.LocalDocker != nil {
+			return NewDockerTaskRunner(c)
+		}
 		return NewLocalTaskRunner(c)
 	} else {
 		return NewECSTaskRunner(c)
@@ -432,7 +1313,8 @@ func (c *Config) fillECSDefaults(ctx context.Context) error {
 
 func (cfg *Config) AuthMiddlewareForWeb(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		req := c.Request()
+		req := c.Request().WithContext(withAuthIdentity(c.Request().Context()))
+		c.SetRequest(req)
 		ok, err := cfg.Auth.Do(req, c.Response(),
 			cfg.Auth.ByToken, cfg.Auth.ByAmznOIDC, cfg.Auth.ByBasic,
 		)
@@ -447,22 +1329,8 @@ func (cfg *Config) AuthMiddlewareForWeb(next echo.HandlerFunc) echo.HandlerFunc
 
 		// check origin header
 		if req.Method == http.MethodPost {
-			origin := c.Request().Header.Get("Origin")
-			if origin == "" {
-				slog.Error("missing origin header")
-				return echo.ErrBadRequest
-			}
-			u, err := url.Parse(origin)
-			if err != nil {
-				slog.Error(f("invalid origin header: %s", origin))
-				return echo.ErrBadRequest
-			}
-			host, _, err := net.SplitHostPort(u.Host)
-			if err != nil {
-				host = u.Host // missing port
-			}
-			if host != cfg.Host.WebApi {
-				slog.Error(f("invalid origin host: %s", u.Host))
+			if err := cfg.checkOrigin(req); err != nil {
+				slog.Error(err.Error())
 				return echo.ErrBadRequest
 			}
 		}
@@ -481,8 +1349,10 @@ func (cfg *Config) AuthMiddlewareForWeb(next echo.HandlerFunc) echo.HandlerFunc
 
 func (cfg *Config) AuthMiddlewareForAPI(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		// API allows only token auth
-		ok, err := cfg.Auth.Do(c.Request(), c.Response(), cfg.Auth.ByToken)
+		// API allows only token auth and jwt auth
+		req := c.Request().WithContext(withAuthIdentity(c.Request().Context()))
+		c.SetRequest(req)
+		ok, err := cfg.Auth.Do(req, c.Response(), cfg.Auth.ByToken, cfg.Auth.ByJWT)
 		if err != nil {
 			slog.Error(f("auth error: %s", err))
 			return echo.ErrInternalServerError
@@ -614,8 +1484,72 @@ func copyToFile(src io.Reader, dst string) (int64, error) {
 	return io.Copy(f, src)
 }
 
+// checkOrigin checks the Origin header of the request by auth.origin_check.
+func (cfg *Config) checkOrigin(req *http.Request) error {
+	mode := cfg.Auth.originCheck()
+	if mode == OriginCheckOff {
+		return nil
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		if mode == OriginCheckStrict {
+			return fmt.Errorf("missing origin header")
+		}
+		// lenient: requests with a valid token are allowed without origin
+		if ok, _ := cfg.Auth.ByToken(req, nil); ok {
+			return nil
+		}
+		origin = req.Header.Get("Referer")
+		if origin == "" {
+			return fmt.Errorf("missing origin and referer header")
+		}
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return fmt.Errorf("invalid origin header: %s", origin)
+	}
+	host, _, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host = u.Host // missing port
+	}
+	if host != cfg.Host.WebApi && !cfg.Auth.isAllowedOriginHost(host) {
+		return fmt.Errorf("invalid origin host: %s", u.Host)
+	}
+	return nil
+}
+
+var hostnameRegexp = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*\.?$`)
+
+// checkWebApiHost checks the Host header of the request to the webapi to mitigate DNS rebinding.
+// The host must be host.webapi or auth.allowed_origin_hosts. IP addresses are allowed for direct access.
+func (cfg *Config) checkWebApiHost(hostport string) error {
+	host := hostWithoutPort(hostport)
+	if net.ParseIP(host) != nil {
+		return nil
+	}
+	if isSameHost(host, cfg.Host.WebApi) || cfg.Auth.isAllowedOriginHost(host) {
+		return nil
+	}
+	return fmt.Errorf("invalid host: %s", hostport)
+}
+
+// checkProxyHost checks the Host header of the request to the reverse proxy is a valid hostname.
+func (cfg *Config) checkProxyHost(hostport string) error {
+	host := hostWithoutPort(hostport)
+	if !hostnameRegexp.MatchString(host) || strings.HasPrefix(host, ".") {
+		return fmt.Errorf("invalid host: %s", hostport)
+	}
+	return nil
+}
+
+// ValidateOriginMiddleware rejects the requests whose Host header is not the webapi.
+// The Origin and Referer headers of POST requests are checked by AuthMiddlewareForWeb.
 func (cfg *Config) ValidateOriginMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
+		if err := cfg.checkWebApiHost(c.Request().Host); err != nil {
+			slog.Warn(err.Error())
+			return echo.ErrBadRequest
+		}
 		return next(c)
 	}
 }
@@ -1,6 +1,7 @@
 package mirageecs_test
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -247,3 +248,135 @@ func TestAuthMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestOriginCheck(t *testing.T) {
+	cases := []struct {
+		Name         string
+		Mode         string
+		AllowedHosts []string
+		Header       map[string]string
+		ExpectStatus int
+	}{
+		{Name: "strict rejects missing origin", Mode: "strict", ExpectStatus: 400},
+		{Name: "strict rejects missing origin with referer", Mode: "strict", Header: map[string]string{"Referer": "https://mirage.localtest.me/launcher"}, ExpectStatus: 400},
+		{Name: "default is strict", Mode: "", ExpectStatus: 400},
+		{Name: "lenient falls back to referer", Mode: "lenient", Header: map[string]string{"Referer": "https://mirage.localtest.me/launcher"}, ExpectStatus: 200},
+		{Name: "lenient rejects invalid referer", Mode: "lenient", Header: map[string]string{"Referer": "https://evil.example.com/"}, ExpectStatus: 400},
+		{Name: "lenient rejects missing origin and referer", Mode: "lenient", ExpectStatus: 400},
+		{Name: "lenient allows token without origin", Mode: "lenient", Header: map[string]string{"x-mirage-token": "mytoken"}, ExpectStatus: 200},
+		{Name: "lenient rejects invalid origin", Mode: "lenient", Header: map[string]string{"Origin": "https://evil.example.com", "x-mirage-token": "mytoken"}, ExpectStatus: 400},
+		{Name: "off allows missing origin", Mode: "off", ExpectStatus: 200},
+		{Name: "strict allows webapi host with aliases", Mode: "strict", AllowedHosts: []string{"mirage-alb.example.com"}, Header: map[string]string{"Origin": "https://mirage.localtest.me"}, ExpectStatus: 200},
+		{Name: "strict allows alias host", Mode: "strict", AllowedHosts: []string{"mirage-alb.example.com"}, Header: map[string]string{"Origin": "https://mirage-alb.example.com:8443"}, ExpectStatus: 200},
+		{Name: "strict rejects unknown host with aliases", Mode: "strict", AllowedHosts: []string{"mirage-alb.example.com"}, Header: map[string]string{"Origin": "https://evil.example.com"}, ExpectStatus: 400},
+		{Name: "lenient allows alias host in referer", Mode: "lenient", AllowedHosts: []string{"mirage-alb.example.com"}, Header: map[string]string{"Referer": "https://mirage-alb.example.com/launcher"}, ExpectStatus: 200},
+	}
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			config := &mirageecs.Config{
+				Host: mirageecs.Host{
+					WebApi:             "mirage.localtest.me",
+					ReverseProxySuffix: ".localtest.me",
+				},
+				Auth: &mirageecs.Auth{
+					OriginCheck:        tc.Mode,
+					AllowedOriginHosts: tc.AllowedHosts,
+					Token: &mirageecs.AuthMethodToken{
+						Header: "x-mirage-token",
+						Token:  "mytoken",
+					},
+					Basic: &mirageecs.AuthMethodBasic{
+						Username: "user",
+						Password: "pass",
+					},
+				},
+			}
+			handler := config.AuthMiddlewareForWeb(func(c echo.Context) error {
+				return c.String(http.StatusOK, "launched")
+			})
+			req := httptest.NewRequest(http.MethodPost, "/launch", nil)
+			req.SetBasicAuth("user", "pass")
+			for k, v := range tc.Header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+			if err := handler(c); err != nil {
+				if he, ok := err.(*echo.HTTPError); ok {
+					rec.Code = he.Code
+				} else {
+					t.Fatal(err)
+				}
+			}
+			if rec.Code != tc.ExpectStatus {
+				t.Errorf("unexpected status code: %d", rec.Code)
+			}
+		})
+	}
+}
+
+func TestValidateHost(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = &mirageecs.Auth{
+		AllowedOriginHosts: []string{"mirage-alb.example.com"},
+		Token: &mirageecs.AuthMethodToken{
+			Header: "x-mirage-token",
+			Token:  "mytoken",
+		},
+	}
+	m := mirageecs.New(ctx, cfg)
+
+	webapi := []struct {
+		host         string
+		expectStatus int
+	}{
+		{host: "mirage.localtest.me", expectStatus: http.StatusOK},
+		{host: "MIRAGE.localtest.me:8080", expectStatus: http.StatusOK},
+		{host: "mirage-alb.example.com", expectStatus: http.StatusOK},
+		{host: "127.0.0.1:8080", expectStatus: http.StatusOK},
+		{host: "[::1]:8080", expectStatus: http.StatusOK},
+		{host: "rebind.evil.example.com", expectStatus: http.StatusBadRequest},
+		{host: "", expectStatus: http.StatusBadRequest},
+	}
+	for _, tt := range webapi {
+		t.Run("webapi "+tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/list", nil)
+			req.Host = tt.host
+			req.Header.Set("x-mirage-token", "mytoken")
+			rec := httptest.NewRecorder()
+			m.WebApi.ServeHTTP(rec, req)
+			if rec.Code != tt.expectStatus {
+				t.Errorf("unexpected status code: %d", rec.Code)
+			}
+		})
+	}
+
+	proxy := []struct {
+		host         string
+		expectStatus int
+	}{
+		{host: "unknown.localtest.me", expectStatus: http.StatusNotFound},
+		{host: "unknown.localtest.me:8080", expectStatus: http.StatusNotFound},
+		{host: "bad_host.localtest.me", expectStatus: http.StatusBadRequest},
+		{host: "foo..localtest.me", expectStatus: http.StatusBadRequest},
+		{host: "-foo.localtest.me", expectStatus: http.StatusBadRequest},
+	}
+	for _, tt := range proxy {
+		t.Run("proxy "+tt.host, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = tt.host
+			rec := httptest.NewRecorder()
+			m.ServeHTTPWithPort(rec, req, 80)
+			if rec.Code != tt.expectStatus {
+				t.Errorf("unexpected status code: %d", rec.Code)
+			}
+		})
+	}
+}
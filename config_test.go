@@ -6,6 +6,8 @@ import (
 	"os"
 	"testing"
 
+	"github.com/google/go-cmp/cmp"
+
 	mirageecs "github.com/acidlemon/mirage-ecs/v2"
 )
 
@@ -125,3 +127,275 @@ link:
 		t.Error("could not parse link default task definitions")
 	}
 }
+
+func TestDefaultTaskDefinitions(t *testing.T) {
+	cfg := &mirageecs.Config{
+		ECS: mirageecs.ECSCfg{
+			DefaultTaskDefinition: "ecs-default",
+		},
+		Link: mirageecs.Link{
+			DefaultTaskDefinitionsByParameter: &mirageecs.DefaultTaskDefinitionsByParameter{
+				Parameter: "stack",
+				TaskDefinitions: map[string][]string{
+					"web": {"web-front", "web-back"},
+					"api": {"api"},
+				},
+			},
+		},
+	}
+	tests := []struct {
+		stack    string
+		expected []string
+	}{
+		{stack: "web", expected: []string{"web-front", "web-back"}},
+		{stack: "api", expected: []string{"api"}},
+		{stack: "unknown", expected: []string{"ecs-default"}},
+		{stack: "", expected: []string{"ecs-default"}},
+	}
+	for _, tt := range tests {
+		taskdefs := cfg.DefaultTaskDefinitions(func(name string) string {
+			if name == "stack" {
+				return tt.stack
+			}
+			return ""
+		})
+		if diff := cmp.Diff(taskdefs, tt.expected); diff != "" {
+			t.Errorf("unexpected taskdefs for stack=%s %s", tt.stack, diff)
+		}
+	}
+
+	cfg.Link.DefaultTaskDefinitions = []string{"link-a", "link-b"}
+	taskdefs := cfg.DefaultTaskDefinitions(func(string) string { return "" })
+	if diff := cmp.Diff(taskdefs, []string{"link-a", "link-b"}); diff != "" {
+		t.Errorf("unexpected taskdefs %s", diff)
+	}
+}
+
+func TestUserAgentFilter(t *testing.T) {
+	u := &mirageecs.UserAgentFilter{
+		Allow: []string{"^Mozilla/"},
+		Deny:  []string{"(?i)bot"},
+	}
+	if err := u.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ua      string
+		allowed bool
+	}{
+		{ua: "Mozilla/5.0 (Macintosh)", allowed: true},
+		{ua: "Mozilla/5.0 (compatible; Googlebot/2.1)", allowed: false},
+		{ua: "curl/8.0.1", allowed: false},
+		{ua: "", allowed: false},
+	}
+	for _, tt := range tests {
+		if got := u.Allowed(tt.ua); got != tt.allowed {
+			t.Errorf("Allowed(%q) = %v, want %v", tt.ua, got, tt.allowed)
+		}
+	}
+
+	var nilFilter *mirageecs.UserAgentFilter
+	if !nilFilter.Allowed("anything") {
+		t.Error("nil filter should allow any user agent")
+	}
+
+	if err := (&mirageecs.UserAgentFilter{Deny: []string{"("}}).Validate(); err == nil {
+		t.Error("invalid regexp should be an error")
+	}
+}
+
+func TestLaunchPreference(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		ecs      string
+		expected []int32
+		wantErr  bool
+	}{
+		{
+			name: "preference",
+			ecs: `
+  launch_preference:
+    - FARGATE_SPOT
+    - FARGATE`,
+			expected: []int32{1, 0},
+		},
+		{
+			name: "with launch_type",
+			ecs: `
+  launch_type: FARGATE
+  launch_preference:
+    - FARGATE_SPOT`,
+			wantErr: true,
+		},
+		{
+			name: "duplicated",
+			ecs: `
+  launch_preference:
+    - FARGATE
+    - FARGATE`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			data := "ecs:\n  region: ap-northeast-1\n  cluster: test-cluster" + tt.ecs + "\n"
+			if _, err := f.WriteString(data); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{Path: f.Name()})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ECS.LaunchType != nil {
+				t.Errorf("launch_type must not be set: %s", *cfg.ECS.LaunchType)
+			}
+			weights := []int32{}
+			for _, item := range cfg.ECS.CapacityProviderStrategy {
+				weights = append(weights, item.Weight)
+			}
+			if diff := cmp.Diff(tt.expected, weights); diff != "" {
+				t.Errorf("unexpected weights (-want +got):\n%s", diff)
+			}
+			if p := *cfg.ECS.CapacityProviderStrategy[0].CapacityProvider; p != "FARGATE_SPOT" {
+				t.Errorf("unexpected first capacity provider: %s", p)
+			}
+		})
+	}
+}
+
+func TestStripRequestConfig(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name     string
+		network  string
+		expected *mirageecs.StripRequest
+	}{
+		{
+			name:     "default",
+			network:  "",
+			expected: &mirageecs.StripRequest{Cookies: []string{mirageecs.AuthCookieName}},
+		},
+		{
+			name:     "headers only",
+			network:  "network:\n  strip_request:\n    headers: [X-Internal-Token]\n",
+			expected: &mirageecs.StripRequest{Headers: []string{"X-Internal-Token"}, Cookies: []string{mirageecs.AuthCookieName}},
+		},
+		{
+			name:     "forward auth cookie",
+			network:  "network:\n  strip_request:\n    cookies: []\n",
+			expected: &mirageecs.StripRequest{Cookies: []string{}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString("host:\n  webapi: mirage.example.net\n" + tt.network)
+			f.Close()
+			cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{Path: f.Name(), LocalMode: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.expected, cfg.Network.StripRequest); diff != "" {
+				t.Errorf("unexpected strip_request (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParameterGroups(t *testing.T) {
+	ps := mirageecs.Parameters{
+		{Name: "branch"},
+		{Name: "db_host", Group: "database"},
+		{Name: "feature_flag", Group: "app"},
+		{Name: "db_name", Group: "database"},
+		{Name: "launched_by"},
+	}
+	names := func(g *mirageecs.ParameterGroup) []string {
+		var s []string
+		for _, p := range g.Parameters {
+			s = append(s, p.Name)
+		}
+		return s
+	}
+	groups := ps.Groups()
+	expected := []struct {
+		name   string
+		params []string
+	}{
+		{name: "", params: []string{"branch", "launched_by"}},
+		{name: "database", params: []string{"db_host", "db_name"}},
+		{name: "app", params: []string{"feature_flag"}},
+	}
+	if len(groups) != len(expected) {
+		t.Fatalf("unexpected groups %d", len(groups))
+	}
+	for i, e := range expected {
+		if groups[i].Name != e.name {
+			t.Errorf("unexpected group name %q, expected %q", groups[i].Name, e.name)
+		}
+		if diff := cmp.Diff(e.params, names(groups[i])); diff != "" {
+			t.Errorf("unexpected parameters of group %q (-want +got):\n%s", e.name, diff)
+		}
+	}
+}
+
+func TestSecretParameterAllowedSecrets(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name    string
+		param   string
+		wantErr bool
+	}{
+		{
+			name:  "allowed",
+			param: "    secret: true\n    allowed_secrets:\n      - arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/\n",
+		},
+		{
+			name:    "missing allowed_secrets",
+			param:   "    secret: true\n",
+			wantErr: true,
+		},
+		{
+			name:    "not an ARN prefix",
+			param:   "    secret: true\n    allowed_secrets:\n      - /mirage/\n",
+			wantErr: true,
+		},
+		{
+			name:    "not secret",
+			param:   "    allowed_secrets:\n      - arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			f.WriteString("host:\n  webapi: mirage.example.net\nparameters:\n  - name: token\n    env: API_TOKEN\n" + tt.param)
+			f.Close()
+			_, err = mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{Path: f.Name(), LocalMode: true})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package mirageecs
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	"github.com/samber/lo"
+)
+
+// CORS configures Cross-Origin Resource Sharing of /api/*.
+// The origins of host.webapi are always allowed.
+type CORS struct {
+	AllowOrigins     []string `yaml:"allow_origins"`
+	AllowMethods     []string `yaml:"allow_methods"`
+	AllowHeaders     []string `yaml:"allow_headers"`
+	AllowCredentials bool     `yaml:"allow_credentials"`
+}
+
+func (c *CORS) Validate() error {
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			if c.AllowCredentials {
+				return fmt.Errorf("allow_origins * cannot be used with allow_credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || u.Scheme == "" || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("invalid origin %s: must be scheme://host[:port]", o)
+		}
+	}
+	for _, m := range c.AllowMethods {
+		if m == "" || strings.ToUpper(m) != m {
+			return fmt.Errorf("invalid method %q: must be upper case", m)
+		}
+	}
+	return nil
+}
+
+// middleware returns the CORS middleware allowing the origins of the configured and webapiHost.
+func (c *CORS) middleware(webapiHost string) echo.MiddlewareFunc {
+	allowAll := lo.Contains(c.AllowOrigins, "*")
+	allowed := lo.Map(c.AllowOrigins, func(o string, _ int) string {
+		return strings.TrimSuffix(o, "/")
+	})
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodPost}
+	}
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOriginFunc: func(origin string) (bool, error) {
+			if allowAll || lo.Contains(allowed, origin) {
+				return true, nil
+			}
+			u, err := url.Parse(origin)
+			if err != nil {
+				return false, nil
+			}
+			return u.Hostname() == webapiHost, nil
+		},
+		AllowMethods:     methods,
+		AllowHeaders:     c.AllowHeaders,
+		AllowCredentials: c.AllowCredentials,
+	})
+}
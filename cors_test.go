@@ -0,0 +1,138 @@
+package mirageecs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestCORS(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = &mirageecs.Auth{
+		Token: &mirageecs.AuthMethodToken{
+			Header: "x-mirage-token",
+			Token:  "mytoken",
+		},
+	}
+	cfg.CORS = &mirageecs.CORS{
+		AllowOrigins:     []string{"https://tools.example.com"},
+		AllowHeaders:     []string{"x-mirage-token", "content-type"},
+		AllowCredentials: true,
+	}
+	if err := cfg.CORS.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		token       string
+		wantStatus  int
+		allowOrigin string
+	}{
+		{
+			name:        "preflight from allowed origin",
+			method:      http.MethodOptions,
+			origin:      "https://tools.example.com",
+			wantStatus:  http.StatusNoContent,
+			allowOrigin: "https://tools.example.com",
+		},
+		{
+			name:        "preflight from webapi host",
+			method:      http.MethodOptions,
+			origin:      "http://mirage.localtest.me:8080",
+			wantStatus:  http.StatusNoContent,
+			allowOrigin: "http://mirage.localtest.me:8080",
+		},
+		{
+			name:       "preflight from disallowed origin",
+			method:     http.MethodOptions,
+			origin:     "https://evil.example.net",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:        "request from allowed origin",
+			method:      http.MethodGet,
+			origin:      "https://tools.example.com",
+			token:       "mytoken",
+			wantStatus:  http.StatusOK,
+			allowOrigin: "https://tools.example.com",
+		},
+		{
+			name:       "request from disallowed origin",
+			method:     http.MethodGet,
+			origin:     "https://evil.example.net",
+			token:      "mytoken",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:        "request without token",
+			method:      http.MethodGet,
+			origin:      "https://tools.example.com",
+			wantStatus:  http.StatusUnauthorized,
+			allowOrigin: "https://tools.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, ts.URL+"/api/list", nil)
+			req.Header.Set("Origin", tt.origin)
+			if tt.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+				req.Header.Set("Access-Control-Request-Headers", "x-mirage-token")
+			}
+			if tt.token != "" {
+				req.Header.Set("x-mirage-token", tt.token)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("unexpected Access-Control-Allow-Origin %q", got)
+			}
+			if tt.allowOrigin == "" {
+				return
+			}
+			if got := res.Header.Get("Access-Control-Allow-Credentials"); got != "true" {
+				t.Errorf("unexpected Access-Control-Allow-Credentials %q", got)
+			}
+			if tt.method == http.MethodOptions {
+				if got := res.Header.Get("Access-Control-Allow-Methods"); got != "GET,POST" {
+					t.Errorf("unexpected Access-Control-Allow-Methods %q", got)
+				}
+				if got := res.Header.Get("Access-Control-Allow-Headers"); got != "x-mirage-token,content-type" {
+					t.Errorf("unexpected Access-Control-Allow-Headers %q", got)
+				}
+			}
+		})
+	}
+
+	invalid := []*mirageecs.CORS{
+		{AllowOrigins: []string{"*"}, AllowCredentials: true},
+		{AllowOrigins: []string{"tools.example.com"}},
+		{AllowOrigins: []string{"https://tools.example.com/path"}},
+		{AllowMethods: []string{"get"}},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%#v must be invalid", c)
+		}
+	}
+}
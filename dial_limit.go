@@ -0,0 +1,90 @@
+package mirageecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// ErrDialLimitExceeded is returned when too many dials to an upstream are in flight.
+var ErrDialLimitExceeded = errors.New("too many concurrent dials to upstream")
+
+// DialLimit configures the limit of concurrent in-flight dials to each upstream.
+// It does not limit established connections.
+type DialLimit struct {
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	QueueTimeout  time.Duration `yaml:"queue_timeout"`
+}
+
+func (d *DialLimit) Validate() error {
+	if d.MaxConcurrent <= 0 {
+		return fmt.Errorf("max_concurrent must be positive")
+	}
+	if d.QueueTimeout < 0 {
+		return fmt.Errorf("queue_timeout must not be negative")
+	}
+	return nil
+}
+
+// dialLimiter limits concurrent dials. Dials beyond the limit wait up to queueTimeout,
+// or fail immediately when queueTimeout is 0.
+type dialLimiter struct {
+	sem          chan struct{}
+	queueTimeout time.Duration
+}
+
+func newDialLimiter(d *DialLimit) *dialLimiter {
+	if d == nil {
+		return nil
+	}
+	return &dialLimiter{
+		sem:          make(chan struct{}, d.MaxConcurrent),
+		queueTimeout: d.QueueTimeout,
+	}
+}
+
+// withDialLimiter replaces the dialer of the transport by the limiter.
+func withDialLimiter(rt http.RoundTripper, l *dialLimiter) http.RoundTripper {
+	if l == nil {
+		return rt
+	}
+	if tp, ok := rt.(*http.Transport); ok {
+		dial := tp.DialContext
+		tp.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if err := l.acquire(ctx); err != nil {
+				return nil, fmt.Errorf("dial %s: %w", addr, err)
+			}
+			defer l.release()
+			return dial(ctx, network, addr)
+		}
+	}
+	return rt
+}
+
+func (l *dialLimiter) acquire(ctx context.Context) error {
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queueTimeout <= 0 {
+		return ErrDialLimitExceeded
+	}
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrDialLimitExceeded
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *dialLimiter) release() {
+	<-l.sem
+}
@@ -130,6 +130,27 @@ func testE2EAPI(t *testing.T, reqs map[string]string, contentType string, compat
 		}
 	})
 
+	t.Run("/api/refresh", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", ts.URL+"/api/refresh", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", "application/json")
+		res, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("status code should be 200: %d", res.StatusCode)
+		}
+		var r mirageecs.APIRefreshResponse
+		json.NewDecoder(res.Body).Decode(&r)
+		if len(r.Added) != 1 || r.Added[0] != "mytask" {
+			t.Errorf("mytask should be added %#v", r)
+		}
+		if len(r.Removed) != 0 {
+			t.Errorf("removed should be empty %#v", r)
+		}
+	})
+
 	t.Run("/api/access", func(t *testing.T) {
 		res, err := client.Get(ts.URL + "/api/access?subdomain=mytask&duration=300")
 		if err != nil {
@@ -207,6 +228,30 @@ func testE2EAPI(t *testing.T, reqs map[string]string, contentType string, compat
 		}
 	})
 
+	t.Run("/api/history", func(t *testing.T) {
+		res, err := client.Get(ts.URL + "/api/history?subdomain=mytask")
+		if err != nil {
+			t.Error(err)
+		}
+		defer res.Body.Close()
+		if res.StatusCode != 200 {
+			t.Errorf("status code should be 200: %d", res.StatusCode)
+		}
+		var r mirageecs.APIHistoryResponse
+		json.NewDecoder(res.Body).Decode(&r)
+		if len(r.Result) != 2 {
+			t.Errorf("result should have 2 records %#v", r)
+			return
+		}
+		// newest first
+		if r.Result[0].Action != "terminate" || r.Result[1].Action != "launch" {
+			t.Errorf("unexpected actions %#v", r)
+		}
+		if r.Result[1].Branch != "develop" || r.Result[1].Outcome != "ok" {
+			t.Errorf("unexpected launch record %#v", r.Result[1])
+		}
+	})
+
 	t.Run("/api/launch with form", func(t *testing.T) {
 		req, _ := http.NewRequest("POST", ts.URL+"/api/launch", strings.NewReader(e2eRequestsForm["/api/launch"]))
 		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
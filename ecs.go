@@ -2,30 +2,36 @@ package mirageecs
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	ttlcache "github.com/ReneKroon/ttlcache/v2"
 	"github.com/fujiwara/tracer"
 	"github.com/samber/lo"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
 	cw "github.com/aws/aws-sdk-go-v2/service/cloudwatch"
 	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
 	cwlogs "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
 	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 
 	"golang.org/x/sync/errgroup"
 )
 
-var taskDefinitionCache = ttlcache.NewCache() // no need to expire because taskdef is immutable.
-
 type Information struct {
 	ID         string            `json:"id"`
 	ShortID    string            `json:"short_id"`
@@ -39,36 +45,130 @@ type Information struct {
 	Env        map[string]string `json:"env"`
 	Tags       []types.Tag       `json:"tags"`
 
+	// PortMappings are all of the port mappings of each container.
+	// PortMap has the primary one of them selected by port_mapping_name.
+	PortMappings map[string][]PortMapping `json:"port_mappings"`
+
+	StartFailed       bool   `json:"start_failed"`
+	StartFailedReason string `json:"start_failed_reason,omitempty"`
+
+	// StoppedReason is the reason why the task stopped.
+	StoppedReason string `json:"stopped_reason,omitempty"`
+	// ExitCodes are the exit codes of the stopped containers, keyed by names of the containers.
+	ExitCodes map[string]int32 `json:"exit_codes,omitempty"`
+
+	// Healthy is the result of the most recent health check. nil means not checked yet.
+	Healthy *bool `json:"healthy"`
+
+	// Labels are values of the tags configured by tag_columns, keyed by labels of the columns.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ExpiresAt is the time when the task exceeds the max lifetime. nil means no limit.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
 	task *types.Task
 }
 
+// ShouldBePurged reports whether the task is a candidate of purge by the rules of evaluatePurge at now.
+// keep_latest_per_branch and the access count are not checked.
 func (info Information) ShouldBePurged(p *PurgeParams) bool {
+	ev := evaluatePurge(&info, p, nil, time.Now())
+	slog.Debug(f("purge evaluation of subdomain %s: %s", info.SubDomain, ev.Reason))
+	return ev.Candidate
+}
+
+// purgeExclusionReason returns the reason why the task is excluded from purge.
+// It returns an empty string when the task is not excluded.
+func (info Information) purgeExclusionReason(p *PurgeParams) string {
 	if info.LastStatus != statusRunning {
-		slog.Info(f("skip not running task: %s subdomain: %s", info.LastStatus, info.SubDomain))
-		return false
+		return f("not running task: %s", info.LastStatus)
 	}
 	if _, ok := p.excludesMap[info.SubDomain]; ok {
-		slog.Info(f("skip exclude subdomain: %s", info.SubDomain))
-		return false
+		return "exclude subdomain"
 	}
 	for _, t := range info.Tags {
 		k, v := aws.ToString(t.Key), aws.ToString(t.Value)
 		if ev, ok := p.excludeTagsMap[k]; ok && ev == v {
-			slog.Info(f("skip exclude tag: %s=%s subdomain: %s", k, v, info.SubDomain))
-			return false
+			return f("exclude tag: %s=%s", k, v)
+		}
+	}
+	for k, v := range info.Env {
+		if ev, ok := p.excludeEnvMap[k]; ok && ev == v {
+			return f("exclude env: %s=%s", k, v)
 		}
 	}
 	if p.ExcludeRegexp != nil && p.ExcludeRegexp.MatchString(info.SubDomain) {
-		slog.Info(f("skip exclude regexp: %s subdomain: %s", p.ExcludeRegexp.String(), info.SubDomain))
-		return false
+		return f("exclude regexp: %s", p.ExcludeRegexp.String())
+	}
+	return ""
+}
+
+// inPurgeGracePeriod reports whether the task is created within min_age at now.
+func (info Information) inPurgeGracePeriod(p *PurgeParams, now time.Time) bool {
+	return p.MinAge > 0 && info.Created.After(now.Add(-p.MinAge))
+}
+
+// Expired reports whether the task exceeds the max lifetime at now.
+func (info Information) Expired(now time.Time) bool {
+	return info.ExpiresAt != nil && now.After(*info.ExpiresAt)
+}
+
+// expiresAt returns the time when the task exceeds the max lifetime.
+// The max lifetime is taken from the MaxLifetime tag of the task, or defaultLifetime.
+func expiresAt(info *Information, defaultLifetime time.Duration) *time.Time {
+	lifetime := defaultLifetime
+	for _, t := range info.Tags {
+		if aws.ToString(t.Key) != TagMaxLifetime {
+			continue
+		}
+		if d, err := time.ParseDuration(aws.ToString(t.Value)); err != nil || d <= 0 {
+			slog.Warn(f("invalid %s tag %s of subdomain %s", TagMaxLifetime, aws.ToString(t.Value), info.SubDomain))
+		} else {
+			lifetime = d
+		}
+		break
+	}
+	if lifetime <= 0 || info.Created.IsZero() {
+		return nil
 	}
+	t := info.Created.Add(lifetime)
+	return &t
+}
 
-	begin := time.Now().Add(-p.Duration)
-	if info.Created.After(begin) {
-		slog.Info(f("skip recent created: %s subdomain: %s", info.Created.Format(time.RFC3339), info.SubDomain))
-		return false
+// RetainedSubdomains returns the subdomains that are retained by keep_latest_per_branch.
+// For each branch, the N most recently created subdomains are retained.
+func (p *PurgeParams) RetainedSubdomains(infos []*Information) map[string]struct{} {
+	retained := make(map[string]struct{})
+	if p.KeepLatestPerBranch <= 0 {
+		return retained
+	}
+	// a subdomain may have multiple tasks (mirage link), use the latest one
+	latest := make(map[string]*Information)
+	for _, info := range infos {
+		if info.GitBranch == "" {
+			continue
+		}
+		if l, ok := latest[info.SubDomain]; !ok || info.Created.After(l.Created) {
+			latest[info.SubDomain] = info
+		}
+	}
+	byBranch := make(map[string][]*Information)
+	for _, info := range latest {
+		byBranch[info.GitBranch] = append(byBranch[info.GitBranch], info)
+	}
+	for branch, branchInfos := range byBranch {
+		sort.Slice(branchInfos, func(i, j int) bool {
+			return branchInfos[i].Created.After(branchInfos[j].Created)
+		})
+		for i, info := range branchInfos {
+			if i >= p.KeepLatestPerBranch {
+				break
+			}
+			slog.Debug(f("retain latest subdomain %s of branch %s", info.SubDomain, branch))
+			retained[info.SubDomain] = struct{}{}
+		}
 	}
-	return true
+	return retained
 }
 
 type TaskParameter map[string]string
@@ -87,7 +187,8 @@ func (p TaskParameter) ToECSKeyValuePairs(subdomain string, configParams Paramet
 	)
 	for _, v := range configParams {
 		v := v
-		if p[v.Name] == "" {
+		if p[v.Name] == "" || v.Secret {
+			// the secret parameters are injected by ToECSSecrets
 			continue
 		}
 		kvp = append(kvp, types.KeyValuePair{
@@ -98,6 +199,21 @@ func (p TaskParameter) ToECSKeyValuePairs(subdomain string, configParams Paramet
 	return kvp
 }
 
+// ToECSSecrets returns the secrets of the containers referencing the values of the secret parameters.
+func (p TaskParameter) ToECSSecrets(configParams Parameters) []types.Secret {
+	var secrets []types.Secret
+	for _, v := range configParams {
+		if !v.Secret || p[v.Name] == "" {
+			continue
+		}
+		secrets = append(secrets, types.Secret{
+			Name:      aws.String(v.Env),
+			ValueFrom: aws.String(p[v.Name]),
+		})
+	}
+	return secrets
+}
+
 func (p TaskParameter) ToECSTags(subdomain string, configParams Parameters) []types.Tag {
 	tags := make([]types.Tag, 0, len(p)+3)
 	tags = append(tags,
@@ -115,14 +231,188 @@ func (p TaskParameter) ToECSTags(subdomain string, configParams Parameters) []ty
 		if p[v.Name] == "" {
 			continue
 		}
+		if v.Secret {
+			// tags are visible to anyone who can describe the task.
+			continue
+		}
+		if utf8.RuneCountInString(p[v.Name]) > maxTagValueLength {
+			// ECS rejects the tag. The value is passed only as the environment variable.
+			continue
+		}
 		tags = append(tags, types.Tag{
 			Key:   aws.String(v.Name),
 			Value: aws.String(p[v.Name]),
 		})
 	}
+	for _, key := range []string{TagMaxLifetime, TagCpu, TagMemory} {
+		if p[key] == "" {
+			continue
+		}
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(p[key]),
+		})
+	}
+	for _, key := range p.customTagKeys() {
+		tags = append(tags, types.Tag{
+			Key:   aws.String(key),
+			Value: aws.String(p[customTagPrefix+key]),
+		})
+	}
 	return tags
 }
 
+// SetCustomTags sets the tags supplied at launch time.
+func (p TaskParameter) SetCustomTags(tags map[string]string) {
+	for k, v := range tags {
+		p[customTagPrefix+k] = v
+	}
+}
+
+// SetCommand sets the command overriding the container. The empty container means the first container.
+func (p TaskParameter) SetCommand(container string, command []string) {
+	b, _ := json.Marshal(command)
+	p[commandParameterKey] = string(b)
+	p[commandContainerParameterKey] = container
+}
+
+// command returns the container and the command set by SetCommand.
+func (p TaskParameter) command() (string, []string) {
+	var command []string
+	if s := p[commandParameterKey]; s != "" {
+		json.Unmarshal([]byte(s), &command)
+	}
+	return p[commandContainerParameterKey], command
+}
+
+func (p TaskParameter) customTagKeys() []string {
+	var keys []string
+	for k := range p {
+		if key, ok := strings.CutPrefix(k, customTagPrefix); ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// taskParameterFromInformation restores the parameters of the launch from the tags and the environment of the task.
+// The secret parameters are not restored because they are neither tagged nor exposed.
+func taskParameterFromInformation(info *Information, configParams Parameters) TaskParameter {
+	p := TaskParameter{}
+	tags := make(map[string]string, len(info.Tags))
+	for _, t := range info.Tags {
+		if t.Key != nil && t.Value != nil {
+			tags[*t.Key] = *t.Value
+		}
+	}
+	reserved := []string{TagManagedBy, TagSubdomain}
+	for _, v := range configParams {
+		reserved = append(reserved, v.Name)
+		if v.Secret {
+			continue
+		}
+		if value, ok := tags[v.Name]; ok {
+			p[v.Name] = value
+		} else if value, ok := info.Env[v.Env]; ok {
+			// too long value is not tagged
+			p[v.Name] = value
+		} else if value, ok := info.Env[strings.ToUpper(v.Env)]; ok {
+			p[v.Name] = value
+		}
+	}
+	for _, key := range []string{TagMaxLifetime, TagCpu, TagMemory} {
+		reserved = append(reserved, key)
+		if value, ok := tags[key]; ok {
+			p[key] = value
+		}
+	}
+	custom := make(map[string]string)
+	for k, v := range tags {
+		if lo.Contains(reserved, k) || strings.HasPrefix(strings.ToLower(k), "aws:") {
+			continue
+		}
+		custom[k] = v
+	}
+	p.SetCustomTags(custom)
+	return p
+}
+
+// launchedWithSecrets reports whether the task was launched with the secret parameters,
+// which are not restored by taskParameterFromInformation.
+func (info *Information) launchedWithSecrets(configParams Parameters) bool {
+	family, _, _ := strings.Cut(info.TaskDef, ":")
+	if strings.HasSuffix(family, secretTaskDefinitionFamilySuffix) {
+		return true
+	}
+	// the older versions passed the secret parameters as the environment variables
+	for _, c := range info.containerOverrides() {
+		for _, kv := range c.Environment {
+			if configParams.isSecretEnv(aws.ToString(kv.Name)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containerCommands returns the commands overriding the containers of the task, keyed by the names of the containers.
+func (info *Information) containerCommands() map[string][]string {
+	commands := make(map[string][]string)
+	for _, c := range info.containerOverrides() {
+		if len(c.Command) > 0 {
+			commands[aws.ToString(c.Name)] = c.Command
+		}
+	}
+	return commands
+}
+
+func (info *Information) containerOverrides() []types.ContainerOverride {
+	if info.task == nil || info.task.Overrides == nil {
+		return nil
+	}
+	return info.task.Overrides.ContainerOverrides
+}
+
+// taskdefsOf returns the unique task definitions of the tasks in order.
+func taskdefsOf(infos []*Information) []string {
+	var taskdefs []string
+	for _, info := range infos {
+		if !lo.Contains(taskdefs, info.TaskDef) {
+			taskdefs = append(taskdefs, info.TaskDef)
+		}
+	}
+	return taskdefs
+}
+
+var tagRegexp = regexp.MustCompile(`^[\p{L}\p{Z}\p{N}_.:/=+\-@]*$`)
+
+// validateCustomTags validates the tags supplied at launch time against the constraints of AWS tags.
+// The tags managed by mirage-ecs and the tags of the parameters cannot be overwritten.
+func validateCustomTags(tags map[string]string, configParams Parameters) error {
+	reserved := []string{TagManagedBy, TagSubdomain, TagMaxLifetime, TagCpu, TagMemory}
+	for _, v := range configParams {
+		reserved = append(reserved, v.Name)
+	}
+	for k, v := range tags {
+		if k == "" || utf8.RuneCountInString(k) > maxTagKeyLength || !tagRegexp.MatchString(k) {
+			return fmt.Errorf("invalid tag key %q", k)
+		}
+		if strings.HasPrefix(strings.ToLower(k), "aws:") {
+			return fmt.Errorf("tag key %q must not start with aws:", k)
+		}
+		for _, r := range reserved {
+			if strings.EqualFold(k, r) {
+				return fmt.Errorf("tag key %q is reserved", k)
+			}
+		}
+		if utf8.RuneCountInString(v) > maxTagValueLength || !tagRegexp.MatchString(v) {
+			return fmt.Errorf("invalid value of tag %q", k)
+		}
+	}
+	return nil
+}
+
 func (p TaskParameter) ToEnv(subdomain string, configParams Parameters, enc func(string) string) map[string]string {
 	env := make(map[string]string, len(p)+1)
 	env[EnvSubdomain] = enc(subdomain)
@@ -140,8 +430,20 @@ func (p TaskParameter) ToEnv(subdomain string, configParams Parameters, enc func
 const (
 	TagManagedBy   = "ManagedBy"
 	TagSubdomain   = "Subdomain"
+	TagMaxLifetime = "MaxLifetime"
+	TagCpu         = "Cpu"
+	TagMemory      = "Memory"
 	TagValueMirage = "Mirage"
 
+	maxTagKeyLength   = 128
+	maxTagValueLength = 256
+	maxTagsPerTask    = 50
+	customTagPrefix   = "tag:"
+
+	// the keys of the command override in TaskParameter. They are neither tags nor environment variables.
+	commandParameterKey          = "command:args"
+	commandContainerParameterKey = "command:container"
+
 	EnvSubdomain    = "SUBDOMAIN"
 	EnvSubdomainRaw = "SUBDOMAINRAW"
 
@@ -151,22 +453,28 @@ const (
 
 type TaskRunner interface {
 	Launch(ctx context.Context, subdomain string, param TaskParameter, taskdefs ...string) error
-	Logs(ctx context.Context, subdomain string, since time.Time, tail int) ([]string, error)
-	Trace(ctx context.Context, id string) (string, error)
+	PlanLaunch(ctx context.Context, subdomain string, param TaskParameter, taskdefs ...string) ([]*LaunchPlan, error)
+	Logs(ctx context.Context, subdomain string, container string, since time.Time, tail int) ([]LogEvent, error)
+	FollowLogs(ctx context.Context, subdomain string, container string, since time.Time, fn func([]LogEvent) error) error
+	Trace(ctx context.Context, id string, duration time.Duration) (*TraceResult, error)
 	Terminate(ctx context.Context, subdomain string) error
 	TerminateBySubdomain(ctx context.Context, subdomain string) error
 	List(ctx context.Context, status string) ([]*Information, error)
+	Status(ctx context.Context, subdomain string) ([]*Information, error)
 	SetProxyControlChannel(ch chan *proxyControl)
 	GetAccessCount(ctx context.Context, subdomain string, duration time.Duration) (int64, error)
 	PutAccessCounts(context.Context, map[string]accessCount) error
+	PutStatusCounts(context.Context, map[string]statusCount) error
+	PutLatencyMetrics(context.Context, map[string]latencyMetrics) error
 }
 
 type ECS struct {
 	cfg            *Config
 	svc            *ecs.Client
-	logsSvc        *cwlogs.Client
+	logsSvc        logEventsGetter
 	cwSvc          *cw.Client
 	proxyControlCh chan *proxyControl
+	taskdefCache   *taskDefinitionCache
 }
 
 func NewECSTaskRunner(cfg *Config) TaskRunner {
@@ -175,6 +483,8 @@ func NewECSTaskRunner(cfg *Config) TaskRunner {
 		svc:     ecs.NewFromConfig(*cfg.awscfg),
 		logsSvc: cwlogs.NewFromConfig(*cfg.awscfg),
 		cwSvc:   cw.NewFromConfig(*cfg.awscfg),
+
+		taskdefCache: newTaskDefinitionCache(cfg.ECS.TaskDefCacheTTL),
 	}
 	return e
 }
@@ -187,18 +497,48 @@ func (e *ECS) launchTask(ctx context.Context, subdomain string, taskdef string,
 	cfg := e.cfg
 
 	slog.Info(f("launching task subdomain:%s taskdef:%s", subdomain, taskdef))
-	tdOut, err := e.svc.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: aws.String(taskdef),
+	runtaskInput, td, err := e.runTaskInput(ctx, subdomain, taskdef, option)
+	if err != nil {
+		return err
+	}
+	if secrets := option.ToECSSecrets(cfg.Parameter); len(secrets) > 0 {
+		arn, err := e.registerSecretTaskDefinition(ctx, td, secrets)
+		if err != nil {
+			return err
+		}
+		runtaskInput.TaskDefinition = aws.String(arn)
+	}
+
+	// identifies the task started by the failed RunTask before retrying
+	runtaskInput.StartedBy = aws.String("mirage-" + generateRandomHexID(32))
+	slog.Debug(f("RunTaskInput: %v", runtaskInput))
+	task, err := runTaskWithPreference(ctx, e.svc, runtaskInput, cfg.ECS.LaunchPreference, cfg.ECS.RunTaskMaxAttempts, runTaskBackoff)
+	if err != nil {
+		return err
+	}
+	slog.Info(f("launced task ARN: %s", *task.TaskArn))
+	cfg.Notification.notifyInBackground(&NotificationEvent{
+		Event:     NotificationEventLaunched,
+		Subdomain: subdomain,
+		Taskdef:   taskdef,
+		Timestamp: time.Now(),
 	})
+	return nil
+}
+
+// runTaskInput builds the input of RunTask to launch the task definition for the subdomain.
+func (e *ECS) runTaskInput(ctx context.Context, subdomain string, taskdef string, option TaskParameter) (*ecs.RunTaskInput, *types.TaskDefinition, error) {
+	cfg := e.cfg
+	td, err := e.describeTaskDefinition(ctx, taskdef)
 	if err != nil {
-		return fmt.Errorf("failed to describe task definition: %w", err)
+		return nil, nil, fmt.Errorf("failed to describe task definition: %w", err)
 	}
 
 	// override envs for each container in taskdef
 	ov := &types.TaskOverride{}
 	env := option.ToECSKeyValuePairs(subdomain, cfg.Parameter, cfg.EncodeSubdomain)
 
-	for _, c := range tdOut.TaskDefinition.ContainerDefinitions {
+	for _, c := range td.ContainerDefinitions {
 		name := *c.Name
 		ov.ContainerOverrides = append(
 			ov.ContainerOverrides,
@@ -208,6 +548,30 @@ func (e *ECS) launchTask(ctx context.Context, subdomain string, taskdef string,
 			},
 		)
 	}
+	if tmpl := cfg.ECS.overrideTemplate; tmpl != nil {
+		tov, err := renderTaskOverride(tmpl, TaskOverrideTemplateData{
+			Subdomain:  subdomain,
+			Taskdef:    taskdef,
+			Parameters: option,
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := validateTaskOverride(tov, td); err != nil {
+			return nil, nil, fmt.Errorf("invalid task override: %w", err)
+		}
+		mergeTaskOverride(ov, tov)
+	}
+	if option[TagCpu] != "" || option[TagMemory] != "" {
+		if err := applyTaskSize(ov, td, option[TagCpu], option[TagMemory]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if container, command := option.command(); len(command) > 0 {
+		if err := applyCommand(ov, td, container, command); err != nil {
+			return nil, nil, err
+		}
+	}
 	slog.Debug(f("Task Override: %v", ov))
 
 	tags := option.ToECSTags(subdomain, cfg.Parameter)
@@ -224,29 +588,302 @@ func (e *ECS) launchTask(ctx context.Context, subdomain string, taskdef string,
 	if lt := cfg.ECS.LaunchType; lt != nil {
 		runtaskInput.LaunchType = types.LaunchType(*lt)
 	}
+	if p := cfg.ECS.PropagateTags; p != "" {
+		runtaskInput.PropagateTags = types.PropagateTags(p)
+	}
+	if v := cfg.ECS.PlatformVersion; v != "" {
+		runtaskInput.PlatformVersion = aws.String(v)
+	}
+	return runtaskInput, td, nil
+}
 
-	slog.Debug(f("RunTaskInput: %v", runtaskInput))
-	out, err := e.svc.RunTask(ctx, runtaskInput)
+// secretTaskDefinitionFamilySuffix is the suffix of the family of the task definitions
+// registered to inject the secret parameters.
+const secretTaskDefinitionFamilySuffix = "-mirage-secrets"
+
+// secretTaskDefinitionDigestTag is the tag key of the digest of the input registering the task definition
+// with the secret parameters. A revision with the same digest is reused instead of registering a new one.
+const secretTaskDefinitionDigestTag = "MirageSecretsDigest"
+
+// secretTaskDefinitionInput returns the input to register the task definition derived from td,
+// whose containers read the secrets from SSM Parameter Store or Secrets Manager.
+// It is registered to another family not to change the latest revision of the family of td.
+func secretTaskDefinitionInput(td *types.TaskDefinition, secrets []types.Secret) (*ecs.RegisterTaskDefinitionInput, error) {
+	if aws.ToString(td.ExecutionRoleArn) == "" {
+		return nil, fmt.Errorf("task definition %s has no execution role to read the secret parameters", aws.ToString(td.TaskDefinitionArn))
+	}
+	names := lo.Map(secrets, func(s types.Secret, _ int) string { return aws.ToString(s.Name) })
+	containers := make([]types.ContainerDefinition, 0, len(td.ContainerDefinitions))
+	for _, c := range td.ContainerDefinitions {
+		c.Environment = lo.Filter(c.Environment, func(kv types.KeyValuePair, _ int) bool {
+			return !lo.Contains(names, aws.ToString(kv.Name))
+		})
+		c.Secrets = append(lo.Filter(c.Secrets, func(s types.Secret, _ int) bool {
+			return !lo.Contains(names, aws.ToString(s.Name))
+		}), secrets...)
+		containers = append(containers, c)
+	}
+	in := &ecs.RegisterTaskDefinitionInput{
+		Family:                  aws.String(aws.ToString(td.Family) + secretTaskDefinitionFamilySuffix),
+		ContainerDefinitions:    containers,
+		Cpu:                     td.Cpu,
+		EphemeralStorage:        td.EphemeralStorage,
+		ExecutionRoleArn:        td.ExecutionRoleArn,
+		InferenceAccelerators:   td.InferenceAccelerators,
+		IpcMode:                 td.IpcMode,
+		Memory:                  td.Memory,
+		NetworkMode:             td.NetworkMode,
+		PidMode:                 td.PidMode,
+		PlacementConstraints:    td.PlacementConstraints,
+		ProxyConfiguration:      td.ProxyConfiguration,
+		RequiresCompatibilities: td.RequiresCompatibilities,
+		RuntimePlatform:         td.RuntimePlatform,
+		TaskRoleArn:             td.TaskRoleArn,
+		Volumes:                 td.Volumes,
+	}
+	b, err := json.Marshal(in)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal task definition with secrets: %w", err)
+	}
+	in.Tags = []types.Tag{
+		{Key: aws.String(TagManagedBy), Value: aws.String(TagValueMirage)},
+		{Key: aws.String(secretTaskDefinitionDigestTag), Value: aws.String(fmt.Sprintf("%x", sha256.Sum256(b)))},
+	}
+	return in, nil
+}
+
+// registerSecretTaskDefinition registers the task definition derived from td with the secrets and returns its ARN.
+// The latest revision of the family is reused when it was registered by the same input.
+func (e *ECS) registerSecretTaskDefinition(ctx context.Context, td *types.TaskDefinition, secrets []types.Secret) (string, error) {
+	in, err := secretTaskDefinitionInput(td, secrets)
+	if err != nil {
+		return "", err
+	}
+	if arn := e.latestSecretTaskDefinition(ctx, in); arn != "" {
+		slog.Info(f("reuse task definition with secrets: %s", arn))
+		return arn, nil
+	}
+	out, err := e.svc.RegisterTaskDefinition(ctx, in)
 	if err != nil {
+		return "", fmt.Errorf("failed to register task definition with secrets: %w", err)
+	}
+	arn := aws.ToString(out.TaskDefinition.TaskDefinitionArn)
+	slog.Info(f("registered task definition with secrets: %s", arn))
+	return arn, nil
+}
+
+// latestSecretTaskDefinition returns the ARN of the latest revision of the family of in
+// if it has the same digest as in. Otherwise it returns an empty string.
+func (e *ECS) latestSecretTaskDefinition(ctx context.Context, in *ecs.RegisterTaskDefinitionInput) string {
+	digest := lo.FindOrElse(in.Tags, types.Tag{}, func(t types.Tag) bool {
+		return aws.ToString(t.Key) == secretTaskDefinitionDigestTag
+	})
+	var out *ecs.DescribeTaskDefinitionOutput
+	err := retryOnThrottle(ctx, DescribeTaskDefinitionMaxAttempts, describeTaskDefinitionBackoff, func() error {
+		var err error
+		out, err = e.svc.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+			TaskDefinition: in.Family,
+			Include:        []types.TaskDefinitionField{types.TaskDefinitionFieldTags},
+		}, withoutRetryer)
 		return err
+	})
+	if err != nil {
+		// the family is not registered yet
+		slog.Debug(f("failed to describe task definition %s: %s", aws.ToString(in.Family), err))
+		return ""
+	}
+	for _, t := range out.Tags {
+		if aws.ToString(t.Key) == secretTaskDefinitionDigestTag && aws.ToString(t.Value) == aws.ToString(digest.Value) {
+			return aws.ToString(out.TaskDefinition.TaskDefinitionArn)
+		}
 	}
-	if len(out.Failures) > 0 {
-		f := out.Failures[0]
-		reason := "(unknown)"
-		if f.Reason != nil {
-			reason = *f.Reason
+	return ""
+}
+
+// LaunchPlan is what would be launched for the task definition. It is the result of the dry-run.
+type LaunchPlan struct {
+	Taskdef           string              `json:"taskdef"`
+	TaskDefinitionArn string              `json:"task_definition_arn"`
+	Overrides         *types.TaskOverride `json:"overrides"`
+	Tags              []types.Tag         `json:"tags"`
+	Secrets           []types.Secret      `json:"secrets,omitempty"`
+}
+
+// PlanLaunch resolves the task definitions and builds the inputs of RunTask without running tasks.
+func (e *ECS) PlanLaunch(ctx context.Context, subdomain string, option TaskParameter, taskdefs ...string) ([]*LaunchPlan, error) {
+	plans := make([]*LaunchPlan, 0, len(taskdefs))
+	for _, taskdef := range taskdefs {
+		in, td, err := e.runTaskInput(ctx, subdomain, taskdef, option)
+		if err != nil {
+			return nil, err
 		}
-		arn := "(unknown)"
-		if f.Arn != nil {
-			arn = *f.Arn
+		plan := &LaunchPlan{
+			Taskdef:           taskdef,
+			TaskDefinitionArn: aws.ToString(td.TaskDefinitionArn),
+			Overrides:         in.Overrides,
+			Tags:              in.Tags,
 		}
-		return fmt.Errorf(
-			"run task failed. reason:%s arn:%s", reason, arn,
-		)
+		if secrets := option.ToECSSecrets(e.cfg.Parameter); len(secrets) > 0 {
+			// the task definition with the secrets is registered only at launch
+			if _, err := secretTaskDefinitionInput(td, secrets); err != nil {
+				return nil, err
+			}
+			plan.Secrets = secrets
+		}
+		plans = append(plans, plan)
 	}
-	task := out.Tasks[0]
-	slog.Info(f("launced task ARN: %s", *task.TaskArn))
-	return nil
+	return plans, nil
+}
+
+// DefaultRunTaskMaxAttempts is the default max attempts of RunTask on transient failures.
+const DefaultRunTaskMaxAttempts = 3
+
+var runTaskBackoff = time.Second
+
+type runTaskAPI interface {
+	RunTask(context.Context, *ecs.RunTaskInput, ...func(*ecs.Options)) (*ecs.RunTaskOutput, error)
+	ListTasks(context.Context, *ecs.ListTasksInput, ...func(*ecs.Options)) (*ecs.ListTasksOutput, error)
+}
+
+// runTaskFailure is an error of RunTask reported as failures in the output.
+type runTaskFailure struct {
+	reason string
+	arn    string
+}
+
+func (e *runTaskFailure) Error() string {
+	return fmt.Sprintf("run task failed. reason:%s arn:%s", e.reason, e.arn)
+}
+
+// serverErrorCodes are the error codes of RunTask on the server side.
+// The task may have been started even if RunTask returns them.
+var serverErrorCodes = map[string]bool{
+	"ServerException":             true,
+	"ServiceUnavailableException": true,
+	"ServiceUnavailable":          true,
+}
+
+func isServerError(err error) bool {
+	var apiErr interface{ ErrorCode() string }
+	return errors.As(err, &apiErr) && serverErrorCodes[apiErr.ErrorCode()]
+}
+
+// isCapacityShortage reports whether RunTask failed for the shortage of capacity. No task is started then.
+func isCapacityShortage(err error) bool {
+	var failure *runTaskFailure
+	if !errors.As(err, &failure) {
+		return false
+	}
+	// e.g. "Capacity is unavailable at this time. Please try again later or in a different availability zone"
+	// "RESOURCE:MEMORY" on EC2 instances without enough resources
+	return strings.Contains(failure.reason, "Capacity is unavailable") ||
+		strings.HasPrefix(failure.reason, "RESOURCE:")
+}
+
+// isRetryableRunTaskError reports whether the error of RunTask is transient and RunTask did not start the task.
+// Capacity shortage and throttling are retryable. The server side errors are not, because the task may have been started.
+func isRetryableRunTaskError(err error) bool {
+	return isCapacityShortage(err) || retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) == aws.TrueTernary
+}
+
+// withoutRetryer disables the retryer of the SDK. RunTask is retried only by runTaskWithRetry,
+// because the retryer retries the server side errors without checking the task is started.
+// DescribeTaskDefinition is retried only by retryOnThrottle not to multiply the attempts.
+func withoutRetryer(o *ecs.Options) {
+	o.Retryer = aws.NopRetryer{}
+}
+
+// runTaskWithRetry calls RunTask until it succeeds, fails permanently or reaches maxAttempts.
+// The interval between attempts is doubled from backoff with jitter.
+// After a server side error, the task started by in.StartedBy is looked up by ListTasks,
+// and RunTask is retried only when no task is found.
+func runTaskWithRetry(ctx context.Context, svc runTaskAPI, in *ecs.RunTaskInput, maxAttempts int, backoff time.Duration) (*types.Task, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultRunTaskMaxAttempts
+	}
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		var out *ecs.RunTaskOutput
+		out, err = svc.RunTask(ctx, in, withoutRetryer)
+		retryable := false
+		switch {
+		case err == nil:
+			if len(out.Failures) == 0 && len(out.Tasks) > 0 {
+				return &out.Tasks[0], nil
+			}
+			failure := &runTaskFailure{reason: "(unknown)", arn: "(unknown)"}
+			if len(out.Failures) > 0 {
+				failure.reason = aws.ToString(out.Failures[0].Reason)
+				failure.arn = aws.ToString(out.Failures[0].Arn)
+			}
+			err = failure
+			retryable = isRetryableRunTaskError(err)
+		case isServerError(err) && in.StartedBy != nil:
+			task, lerr := findStartedTask(ctx, svc, in)
+			if lerr != nil {
+				return nil, fmt.Errorf("%w (failed to find the task started by %s: %s)", err, aws.ToString(in.StartedBy), lerr)
+			}
+			if task != nil {
+				slog.Warn(f("run task failed, but the task %s has been started: %s", aws.ToString(task.TaskArn), err))
+				return task, nil
+			}
+			retryable = true
+		default:
+			retryable = isRetryableRunTaskError(err)
+		}
+		if !retryable || i == maxAttempts-1 {
+			break
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.Warn(f("run task failed, retrying after %s (%d/%d): %s", wait, i+1, maxAttempts, err))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+	return nil, err
+}
+
+// runTaskWithPreference runs the task by the capacity providers in order of preference.
+// When RunTask fails for the shortage of capacity of a provider, it is retried with the next provider.
+// Without the preference, the capacity provider strategy of in is used as is.
+func runTaskWithPreference(ctx context.Context, svc runTaskAPI, in *ecs.RunTaskInput, preference []string, maxAttempts int, backoff time.Duration) (*types.Task, error) {
+	if len(preference) == 0 {
+		return runTaskWithRetry(ctx, svc, in, maxAttempts, backoff)
+	}
+	var err error
+	for i, p := range preference {
+		in.CapacityProviderStrategy = []types.CapacityProviderStrategyItem{
+			{CapacityProvider: aws.String(p), Weight: 1},
+		}
+		var task *types.Task
+		task, err = runTaskWithRetry(ctx, svc, in, maxAttempts, backoff)
+		if err == nil {
+			return task, nil
+		}
+		if !isCapacityShortage(err) || i == len(preference)-1 {
+			break
+		}
+		slog.Warn(f("capacity provider %s is short of capacity, falling back to %s: %s", p, preference[i+1], err))
+	}
+	return nil, err
+}
+
+// findStartedTask returns the task started by in.StartedBy, or nil if not found.
+func findStartedTask(ctx context.Context, svc runTaskAPI, in *ecs.RunTaskInput) (*types.Task, error) {
+	out, err := svc.ListTasks(ctx, &ecs.ListTasksInput{
+		Cluster:   in.Cluster,
+		StartedBy: in.StartedBy,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.TaskArns) == 0 {
+		return nil, nil
+	}
+	return &types.Task{TaskArn: aws.String(out.TaskArns[0])}, nil
 }
 
 func (e *ECS) Launch(ctx context.Context, subdomain string, option TaskParameter, taskdefs ...string) error {
@@ -272,24 +909,30 @@ func (e *ECS) Launch(ctx context.Context, subdomain string, option TaskParameter
 	return eg.Wait()
 }
 
-func (e *ECS) Trace(ctx context.Context, id string) (string, error) {
+// Trace traces the timeline of the task from duration before it is created to duration after it is started.
+func (e *ECS) Trace(ctx context.Context, id string, duration time.Duration) (*TraceResult, error) {
 	tr, err := tracer.NewWithConfig(*e.cfg.awscfg)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	if duration <= 0 {
+		duration = DefaultTraceDuration
 	}
 	tracerOpt := &tracer.RunOption{
-		Stdout:   true,
-		Duration: 5 * time.Minute,
+		Stdout:      e.cfg.ECS.traceStdout(),
+		SNSTopicArn: e.cfg.ECS.TraceSNSTopicArn,
+		Duration:    duration,
 	}
 	buf := &strings.Builder{}
 	tr.SetOutput(buf)
 	if err := tr.Run(ctx, e.cfg.ECS.Cluster, id, tracerOpt); err != nil {
-		return "", err
+		return nil, err
 	}
-	return buf.String(), nil
+	return parseTrace(buf.String()), nil
 }
 
-func (e *ECS) Logs(ctx context.Context, subdomain string, since time.Time, tail int) ([]string, error) {
+// Logs returns the log events of the subdomain in chronological order. tail is applied after the events of all tasks are merged.
+func (e *ECS) Logs(ctx context.Context, subdomain string, container string, since time.Time, tail int) ([]LogEvent, error) {
 	infos, err := e.find(ctx, subdomain)
 	if err != nil {
 		return nil, err
@@ -298,94 +941,405 @@ func (e *ECS) Logs(ctx context.Context, subdomain string, since time.Time, tail
 		return nil, fmt.Errorf("subdomain %s is not found", subdomain)
 	}
 
-	var logs []string
+	var events [][]LogEvent
 	var eg errgroup.Group
 	var mu sync.Mutex
+	notFound := 0
 	for _, info := range infos {
 		info := info
 		eg.Go(func() error {
-			l, err := e.logs(ctx, info, since, tail)
+			l, err := e.logs(ctx, info, container, since, tail)
 			mu.Lock()
 			defer mu.Unlock()
-			logs = append(logs, l...)
+			if errors.Is(err, ErrContainerNotFound) && len(infos) > 1 {
+				// the other tasks linked to the subdomain may have the container
+				notFound++
+				return nil
+			}
+			events = append(events, l)
 			return err
 		})
 	}
-	return logs, eg.Wait()
+	if err := eg.Wait(); err != nil {
+		return nil, err
+	}
+	if notFound == len(infos) {
+		return nil, fmt.Errorf("%w: %s in subdomain %s", ErrContainerNotFound, container, subdomain)
+	}
+	return mergeLogEvents(tail, events...), nil
 }
 
-func (e *ECS) logs(ctx context.Context, info *Information, since time.Time, tail int) ([]string, error) {
-	task := info.task
-	taskdefOut, err := e.svc.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
-		TaskDefinition: task.TaskDefinitionArn,
-		Include:        []types.TaskDefinitionField{types.TaskDefinitionFieldTags},
+// mergeLogEvents merges the log events of the streams in chronological order, and returns the last tail events.
+// The events of the same timestamp are kept in the order of the streams.
+func mergeLogEvents(tail int, streams ...[]LogEvent) []LogEvent {
+	merged := []LogEvent{}
+	for _, s := range streams {
+		merged = append(merged, s...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return merged[i].Timestamp.Before(merged[j].Timestamp)
 	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to describe task definition: %w", err)
+	if tail > 0 && len(merged) > tail {
+		return merged[len(merged)-tail:]
 	}
+	return merged
+}
 
-	streams := make(map[string][]string)
-	for _, c := range taskdefOut.TaskDefinition.ContainerDefinitions {
-		c := c
-		logConf := c.LogConfiguration
-		if logConf == nil {
-			continue
-		}
-		if logConf.LogDriver != types.LogDriverAwslogs {
-			slog.Warn(f("LogDriver %s is not supported", logConf.LogDriver))
+// logMessages renders the log events as plain text lines.
+func logMessages(events []LogEvent) []string {
+	return lo.Map(events, func(ev LogEvent, _ int) string {
+		return ev.Message
+	})
+}
+
+var (
+	// ErrSubdomainNotFound is returned when no tasks are running for the subdomain.
+	ErrSubdomainNotFound = errors.New("subdomain is not found")
+	// ErrContainerNotFound is returned when the specified container is not defined in the task definition.
+	ErrContainerNotFound = errors.New("container is not found")
+	// ErrAmbiguousContainer is returned when the container is not specified for a task definition which has multiple containers.
+	ErrAmbiguousContainer = errors.New("container is ambiguous")
+)
+
+// selectContainer returns the container of the task definition to be used by logs.
+// When container is empty, the default container of the family in defaults is used,
+// or the sole container of the task definition.
+func selectContainer(td *types.TaskDefinition, container string, defaults map[string]string) (string, error) {
+	names := lo.Map(td.ContainerDefinitions, func(c types.ContainerDefinition, _ int) string {
+		return aws.ToString(c.Name)
+	})
+	family := aws.ToString(td.Family)
+	if container == "" {
+		container = defaults[family]
+	}
+	if container != "" {
+		if !lo.Contains(names, container) {
+			return "", fmt.Errorf("%w: %s in task definition %s", ErrContainerNotFound, container, family)
+		}
+		return container, nil
+	}
+	if len(names) == 1 {
+		return names[0], nil
+	}
+	return "", fmt.Errorf("%w: task definition %s has containers %s. specify container or ecs.default_containers",
+		ErrAmbiguousContainer, family, strings.Join(names, ", "))
+}
+
+// logStream is a log stream of a container in CloudWatch Logs.
+type logStream struct {
+	group     string
+	name      string
+	container string
+}
+
+// logStreams returns the log streams of the container of the task.
+func (e *ECS) logStreams(ctx context.Context, info *Information, container string) ([]logStream, error) {
+	task := info.task
+	td, err := e.describeTaskDefinition(ctx, aws.ToString(task.TaskDefinitionArn))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe task definition: %w", err)
+	}
+	container, err = selectContainer(td, container, e.cfg.ECS.DefaultContainers)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl := e.cfg.ECS.LogStreamNameTemplate
+	if tmpl == "" {
+		tmpl = DefaultLogStreamNameTemplate
+	}
+	streams := []logStream{}
+	for _, c := range td.ContainerDefinitions {
+		c := c
+		if aws.ToString(c.Name) != container {
+			continue
+		}
+		logConf := c.LogConfiguration
+		if logConf == nil {
+			continue
+		}
+		if logConf.LogDriver == types.LogDriverAwsfirelens {
+			group, stream, ok := firelensLogStream(logConf.Options, aws.ToString(c.Name), info.ShortID)
+			if !ok {
+				slog.Warn(f("awsfirelens of container %s doesn't send logs to CloudWatch Logs in a known log stream", aws.ToString(c.Name)))
+				continue
+			}
+			streams = append(streams, logStream{group: group, name: stream, container: aws.ToString(c.Name)})
+			continue
+		}
+		if logConf.LogDriver != types.LogDriverAwslogs {
+			slog.Warn(f("LogDriver %s is not supported", logConf.LogDriver))
 			continue
 		}
 		group := logConf.Options["awslogs-group"]
 		streamPrefix := logConf.Options["awslogs-stream-prefix"]
-		if group == "" || streamPrefix == "" {
+		if group == "" || (streamPrefix == "" && strings.Contains(tmpl, "{prefix}")) {
 			slog.Warn(f("invalid options. awslogs-group %s awslogs-stream-prefix %s", group, streamPrefix))
 			continue
 		}
-		// streamName: prefix/containerName/taskID
-		streams[group] = append(
-			streams[group],
-			fmt.Sprintf("%s/%s/%s", streamPrefix, *c.Name, info.ShortID),
-		)
+		streams = append(streams, logStream{
+			group:     group,
+			name:      logStreamName(tmpl, streamPrefix, *c.Name, info.ShortID),
+			container: aws.ToString(c.Name),
+		})
+	}
+	return streams, nil
+}
+
+// logs returns the log events of the container of the task in chronological order.
+func (e *ECS) logs(ctx context.Context, info *Information, container string, since time.Time, tail int) ([]LogEvent, error) {
+	streams, err := e.logStreams(ctx, info, container)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([][]LogEvent, 0, len(streams))
+	for _, stream := range streams {
+		slog.Debug(f("get log events from group:%s stream:%s start:%s tail:%d", stream.group, stream.name, since, tail))
+		l, err := getLogEvents(ctx, e.logsSvc, stream.group, stream.name, since, tail)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get log events from group %s stream %s: %w", stream.group, stream.name, err)
+		}
+		slog.Debug(f("%d log events", len(l)))
+		for i := range l {
+			l[i].Container = stream.container
+		}
+		events = append(events, l)
+	}
+	return mergeLogEvents(0, events...), nil
+}
+
+// firelensLogStream resolves the log group and stream of the container which sends logs by the awsfirelens driver
+// with the cloudwatch or cloudwatch_logs output plugin of Fluent Bit.
+// The stream is log_stream_name ($(ecs_task_id) is replaced), or log_stream_prefix followed by the tag of FireLens.
+func firelensLogStream(options map[string]string, container, taskID string) (string, string, bool) {
+	switch options["Name"] {
+	case "cloudwatch", "cloudwatch_logs":
+	default:
+		return "", "", false
+	}
+	group := options["log_group_name"]
+	if group == "" {
+		return "", "", false
+	}
+	if name := options["log_stream_name"]; name != "" {
+		return group, strings.ReplaceAll(name, "$(ecs_task_id)", taskID), true
+	}
+	if prefix := options["log_stream_prefix"]; prefix != "" {
+		// the tag of the logs sent by FireLens is {container}-firelens-{task_id}
+		return group, prefix + container + "-firelens-" + taskID, true
 	}
+	return "", "", false
+}
+
+// followLogsInterval is the interval to poll the new log events in FollowLogs.
+const followLogsInterval = 2 * time.Second
 
-	logs := []string{}
-	for group, streamNames := range streams {
-		group := group
-		for _, stream := range streamNames {
-			stream := stream
-			slog.Debug(f("get log events from group:%s stream:%s start:%s", group, stream, since))
-			in := &cwlogs.GetLogEventsInput{
-				LogGroupName:  aws.String(group),
-				LogStreamName: aws.String(stream),
+// FollowLogs calls fn with the new log events of the subdomain until ctx is done.
+// The events of each log stream are polled incrementally by the forward token.
+// The log streams are resolved before fn is called first, so an error of the lookup is returned without calling fn.
+// fn is called with no events when the streams are resolved and on each idle poll, and it is never called concurrently.
+func (e *ECS) FollowLogs(ctx context.Context, subdomain string, container string, since time.Time, fn func([]LogEvent) error) error {
+	infos, err := e.find(ctx, subdomain)
+	if err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		return fmt.Errorf("%w: %s", ErrSubdomainNotFound, subdomain)
+	}
+
+	var streams []logStream
+	for _, info := range infos {
+		s, err := e.logStreams(ctx, info, container)
+		if errors.Is(err, ErrContainerNotFound) && len(infos) > 1 {
+			// the other tasks linked to the subdomain may have the container
+			continue
+		} else if err != nil {
+			return err
+		}
+		streams = append(streams, s...)
+	}
+	if len(streams) == 0 {
+		return fmt.Errorf("no log streams to follow in subdomain %s", subdomain)
+	}
+
+	var mu sync.Mutex
+	send := func(container string, logs []LogEvent) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for i := range logs {
+			logs[i].Container = container
+		}
+		return fn(logs)
+	}
+	if err := send("", nil); err != nil {
+		return err
+	}
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, stream := range streams {
+		eg.Go(func() error {
+			return followLogEvents(ctx, e.logsSvc, stream.group, stream.name, since, followLogsInterval, func(logs []LogEvent) error {
+				return send(stream.container, logs)
+			})
+		})
+	}
+	return eg.Wait()
+}
+
+// logEventsGetter is the subset of the CloudWatch Logs client to get log events.
+type logEventsGetter interface {
+	GetLogEvents(ctx context.Context, params *cwlogs.GetLogEventsInput, optFns ...func(*cwlogs.Options)) (*cwlogs.GetLogEventsOutput, error)
+}
+
+// getLogEvents returns the events of the log stream since the time, following the forward tokens to the end of the stream.
+// When since is zero and tail is positive, the last tail events are returned following the backward tokens from the end.
+func getLogEvents(ctx context.Context, svc logEventsGetter, group, stream string, since time.Time, tail int) ([]LogEvent, error) {
+	if since.IsZero() && tail > 0 {
+		return getLastLogEvents(ctx, svc, group, stream, tail)
+	}
+	in := &cwlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		StartFromHead: aws.Bool(true),
+	}
+	if !since.IsZero() {
+		in.StartTime = aws.Int64(since.Unix() * 1000)
+	}
+	logs := []LogEvent{}
+	for {
+		out, err := svc.GetLogEvents(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, toLogEvents(out.Events)...)
+		// the same token is returned at the end of the stream. The pages before the end may be empty.
+		if out.NextForwardToken == nil || aws.ToString(out.NextForwardToken) == aws.ToString(in.NextToken) {
+			return logs, nil
+		}
+		in.NextToken = out.NextForwardToken
+	}
+}
+
+// maxLogEventsLimit is the max number of the events returned by GetLogEvents at once.
+const maxLogEventsLimit = 10000
+
+// getLastLogEvents returns the last tail events of the log stream, following the backward tokens from the end.
+func getLastLogEvents(ctx context.Context, svc logEventsGetter, group, stream string, tail int) ([]LogEvent, error) {
+	in := &cwlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		StartFromHead: aws.Bool(false),
+		Limit:         aws.Int32(int32(min(tail, maxLogEventsLimit))),
+	}
+	logs := []LogEvent{}
+	for len(logs) < tail {
+		out, err := svc.GetLogEvents(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		logs = append(toLogEvents(out.Events), logs...)
+		// the same token is returned at the head of the stream
+		if out.NextBackwardToken == nil || aws.ToString(out.NextBackwardToken) == aws.ToString(in.NextToken) {
+			break
+		}
+		in.NextToken = out.NextBackwardToken
+	}
+	if len(logs) > tail {
+		logs = logs[len(logs)-tail:]
+	}
+	return logs, nil
+}
+
+func toLogEvents(events []cwlogsTypes.OutputLogEvent) []LogEvent {
+	return lo.Map(events, func(ev cwlogsTypes.OutputLogEvent, _ int) LogEvent {
+		return LogEvent{
+			Timestamp: time.UnixMilli(aws.ToInt64(ev.Timestamp)),
+			Message:   aws.ToString(ev.Message),
+		}
+	})
+}
+
+// followLogEvents calls fn with the new events of the log stream until ctx is done.
+// The stream is polled by the interval while no new events, and also while it is not created yet.
+// fn is called with no events on each idle poll.
+func followLogEvents(ctx context.Context, svc logEventsGetter, group, stream string, since time.Time, interval time.Duration, fn func([]LogEvent) error) error {
+	in := &cwlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(group),
+		LogStreamName: aws.String(stream),
+		StartFromHead: aws.Bool(true),
+	}
+	if !since.IsZero() {
+		in.StartTime = aws.Int64(since.Unix() * 1000)
+	}
+	for {
+		out, err := svc.GetLogEvents(ctx, in)
+		var notFound *cwlogsTypes.ResourceNotFoundException
+		switch {
+		case ctx.Err() != nil:
+			return nil
+		case errors.As(err, &notFound):
+			slog.Debug(f("log stream %s is not found in group %s yet", stream, group))
+			if err := fn(nil); err != nil {
+				return err
 			}
-			if !since.IsZero() {
-				in.StartTime = aws.Int64(since.Unix() * 1000)
+		case err != nil:
+			return fmt.Errorf("failed to get log events from group %s stream %s: %w", group, stream, err)
+		default:
+			logs := toLogEvents(out.Events)
+			if err := fn(logs); err != nil {
+				return err
 			}
-			eventsOut, err := e.logsSvc.GetLogEvents(ctx, in)
-			if err != nil {
-				slog.Warn(f("failed to get log events from group %s stream %s: %s", group, stream, err))
+			advanced := aws.ToString(out.NextForwardToken) != aws.ToString(in.NextToken)
+			in.NextToken = out.NextForwardToken
+			if advanced && len(logs) > 0 {
+				// more events may be available now
 				continue
 			}
-			slog.Debug(f("%d log events", len(eventsOut.Events)))
-			for _, ev := range eventsOut.Events {
-				logs = append(logs, *ev.Message)
-			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
 		}
 	}
-	if tail > 0 && len(logs) >= tail {
-		return logs[len(logs)-tail:], nil
-	}
-	return logs, nil
+}
+
+// DefaultLogStreamNameTemplate is the stream name format of awslogs driver.
+const DefaultLogStreamNameTemplate = "{prefix}/{container}/{task_id}"
+
+// logStreamName builds a log stream name from the template.
+// The template can contain {prefix}, {container} and {task_id} placeholders.
+func logStreamName(tmpl, prefix, container, taskID string) string {
+	return strings.NewReplacer(
+		"{prefix}", prefix,
+		"{container}", container,
+		"{task_id}", taskID,
+	).Replace(tmpl)
 }
 
 func (e *ECS) Terminate(ctx context.Context, taskArn string) error {
-	slog.Info(f("stop task %s", taskArn))
-	_, err := e.svc.StopTask(ctx, &ecs.StopTaskInput{
-		Cluster: aws.String(e.cfg.ECS.Cluster),
-		Task:    aws.String(taskArn),
-		Reason:  aws.String("Terminate requested by Mirage"),
-	})
-	return err
+	drain := e.cfg.ECS.DrainDuration
+	var subdomain, ipaddress string
+	if drain > 0 || e.cfg.Notification != nil {
+		var err error
+		if subdomain, ipaddress, err = e.subdomainOfTask(ctx, taskArn); err != nil {
+			slog.Warn(f("failed to find subdomain of task %s: %s", taskArn, err))
+		}
+	}
+	if drain > 0 && subdomain != "" && ipaddress != "" {
+		// stop routing new requests to the task before draining.
+		// the other tasks of the subdomain are still routed.
+		if err := e.drainProxy(ctx, subdomain, ipaddress); err != nil {
+			return err
+		}
+		defer e.drainedProxy(ipaddress)
+	}
+	task, err := stopTaskAfterDrain(ctx, e.svc, e.cfg.ECS.Cluster, taskArn, drain)
+	if err != nil {
+		return err
+	}
+	e.notifyTerminated(subdomain, task)
+	return nil
 }
 
 func (e *ECS) TerminateBySubdomain(ctx context.Context, subdomain string) error {
@@ -393,40 +1347,152 @@ func (e *ECS) TerminateBySubdomain(ctx context.Context, subdomain string) error
 	if err != nil {
 		return err
 	}
+	drain := e.cfg.ECS.DrainDuration
 	var eg errgroup.Group
-	eg.Go(func() error {
-		e.proxyControlCh <- &proxyControl{
-			Action:    proxyRemove,
-			Subdomain: subdomain,
+	if drain > 0 {
+		for _, info := range infos {
+			if info.IPAddress == "" {
+				continue
+			}
+			if err := e.drainProxy(ctx, subdomain, info.IPAddress); err != nil {
+				return err
+			}
+			defer e.drainedProxy(info.IPAddress)
 		}
-		return nil
-	})
+	} else {
+		eg.Go(func() error {
+			return e.removeProxy(ctx, subdomain)
+		})
+	}
 	for _, info := range infos {
 		info := info
 		eg.Go(func() error {
-			return e.Terminate(ctx, info.ID)
+			task, err := stopTaskAfterDrain(ctx, e.svc, e.cfg.ECS.Cluster, info.ID, drain)
+			if err != nil {
+				return err
+			}
+			e.notifyTerminated(subdomain, task)
+			return nil
 		})
 	}
 	return eg.Wait()
 }
 
-func (e *ECS) find(ctx context.Context, subdomain string) ([]*Information, error) {
-	var results []*Information
+func (e *ECS) removeProxy(ctx context.Context, subdomain string) error {
+	select {
+	case e.proxyControlCh <- &proxyControl{Action: proxyRemove, Subdomain: subdomain}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainProxy stops routing to the task at the IP address of the subdomain.
+// The task is not routed again by the sync while draining, even if it is still running.
+func (e *ECS) drainProxy(ctx context.Context, subdomain, ipaddress string) error {
+	select {
+	case e.proxyControlCh <- &proxyControl{Action: proxyDrain, Subdomain: subdomain, IPAddress: ipaddress}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drainedProxy allows the IP address to be routed again after the task is stopped (or failed to stop).
+// It doesn't block the caller, because the terminate request may be canceled.
+func (e *ECS) drainedProxy(ipaddress string) {
+	go func() {
+		e.proxyControlCh <- &proxyControl{Action: proxyDrained, IPAddress: ipaddress}
+	}()
+}
 
-	infos, err := e.List(ctx, statusRunning)
+// subdomainOfTask returns the subdomain and the IP address of the task.
+func (e *ECS) subdomainOfTask(ctx context.Context, taskArn string) (string, string, error) {
+	out, err := e.svc.DescribeTasks(ctx, &ecs.DescribeTasksInput{
+		Cluster: aws.String(e.cfg.ECS.Cluster),
+		Tasks:   []string{taskArn},
+		Include: []types.TaskField{types.TaskFieldTags},
+	})
 	if err != nil {
-		return nil, err
+		return "", "", fmt.Errorf("failed to describe task: %w", err)
 	}
-	for _, info := range infos {
-		if info.SubDomain == subdomain {
-			results = append(results, info)
+	if len(out.Tasks) == 0 {
+		return "", "", fmt.Errorf("task %s is not found", taskArn)
+	}
+	task := &out.Tasks[0]
+	subdomain := decodeTagValue(getTagsFromTask(task, TagSubdomain))
+	if subdomain == "" {
+		return "", "", fmt.Errorf("task %s has no %s tag", taskArn, TagSubdomain)
+	}
+	return subdomain, getIPAddressFromTask(task, e.cfg.ECS.IPAddressFamily), nil
+}
+
+type stopTaskAPI interface {
+	StopTask(context.Context, *ecs.StopTaskInput, ...func(*ecs.Options)) (*ecs.StopTaskOutput, error)
+}
+
+// stopTaskAfterDrain waits for the drain duration to complete in-flight requests to the task, then stops the task.
+// The proxy to the task should be removed before. When ctx is done while draining, the task is not stopped.
+func stopTaskAfterDrain(ctx context.Context, svc stopTaskAPI, cluster, taskArn string, drain time.Duration) (*types.Task, error) {
+	if drain > 0 {
+		slog.Info(f("draining task %s for %s", taskArn, drain))
+		timer := time.NewTimer(drain)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return nil, fmt.Errorf("drain of task %s is canceled: %w", taskArn, ctx.Err())
 		}
 	}
-	return results, nil
+	slog.Info(f("stop task %s", taskArn))
+	out, err := svc.StopTask(ctx, &ecs.StopTaskInput{
+		Cluster: aws.String(cluster),
+		Task:    aws.String(taskArn),
+		Reason:  aws.String("Terminate requested by Mirage"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Task, nil
+}
+
+func (e *ECS) notifyTerminated(subdomain string, task *types.Task) {
+	if e.cfg.Notification == nil || subdomain == "" {
+		return
+	}
+	var taskdef string
+	if task != nil && task.TaskDefinitionArn != nil {
+		taskdef = shortenArn(*task.TaskDefinitionArn)
+	}
+	e.cfg.Notification.notifyInBackground(&NotificationEvent{
+		Event:     NotificationEventTerminated,
+		Subdomain: subdomain,
+		Taskdef:   taskdef,
+		Timestamp: time.Now(),
+	})
+}
+
+func (e *ECS) find(ctx context.Context, subdomain string) ([]*Information, error) {
+	return e.Status(ctx, subdomain)
+}
+
+// Status returns the running tasks of the subdomain.
+// ListTasks API cannot filter tasks by tags, so the tasks are filtered by the Subdomain tag
+// after DescribeTasks. The task definitions of the other subdomains are not described.
+func (e *ECS) Status(ctx context.Context, subdomain string) ([]*Information, error) {
+	slog.Debug(f("call ecs.Status(%s)", subdomain))
+	return e.list(ctx, statusRunning, func(task *types.Task) bool {
+		return decodeTagValue(getTagsFromTask(task, TagSubdomain)) == subdomain
+	})
 }
 
 func (e *ECS) List(ctx context.Context, desiredStatus string) ([]*Information, error) {
 	slog.Debug(f("call ecs.List(%s)", desiredStatus))
+	return e.list(ctx, desiredStatus, nil)
+}
+
+// list returns the tasks managed by mirage-ecs. When filter is not nil, only the tasks matched by the filter are returned.
+func (e *ECS) list(ctx context.Context, desiredStatus string, filter func(*types.Task) bool) ([]*Information, error) {
 	infos := []*Information{}
 	var nextToken *string
 	cluster := aws.String(e.cfg.ECS.Cluster)
@@ -459,26 +1525,20 @@ func (e *ECS) List(ctx context.Context, desiredStatus string) ([]*Information, e
 				// task is not managed by Mirage
 				continue
 			}
-			info := &Information{
-				ID:         *task.TaskArn,
-				ShortID:    shortenArn(*task.TaskArn),
-				SubDomain:  decodeTagValue(getTagsFromTask(&task, "Subdomain")),
-				GitBranch:  getEnvironmentFromTask(&task, "GIT_BRANCH"),
-				TaskDef:    shortenArn(*task.TaskDefinitionArn),
-				IPAddress:  getIPV4AddressFromTask(&task),
-				LastStatus: *task.LastStatus,
-				Env:        getEnvironmentsFromTask(&task),
-				Tags:       task.Tags,
-				task:       &task,
+			if filter != nil && !filter(&task) {
+				continue
 			}
-			if portMap, err := e.portMapInTask(ctx, &task); err != nil {
+			info := newInformation(&task, e.cfg)
+			if mappings, err := e.portMappingsInTask(ctx, &task); err != nil {
 				slog.Warn(f("failed to get portMap in task %s %s", *task.TaskArn, err))
 			} else {
-				info.PortMap = portMap
+				info.PortMappings = mappings
+				info.PortMap = primaryPortMap(mappings, e.cfg.ECS.PortMappingName)
 			}
 			if task.StartedAt != nil {
 				info.Created = (*task.StartedAt).In(time.Local)
 			}
+			checkStartDeadline(info, &task, e.cfg.ECS.StartDeadline, time.Now())
 			infos = append(infos, info)
 		}
 
@@ -495,6 +1555,52 @@ func (e *ECS) List(ctx context.Context, desiredStatus string) ([]*Information, e
 	return infos, nil
 }
 
+// newInformation builds Information of the task except the port mappings.
+func newInformation(task *types.Task, cfg *Config) *Information {
+	info := &Information{
+		ID:            *task.TaskArn,
+		ShortID:       shortenArn(*task.TaskArn),
+		SubDomain:     decodeTagValue(getTagsFromTask(task, "Subdomain")),
+		GitBranch:     getEnvironmentFromTask(task, "GIT_BRANCH"),
+		TaskDef:       shortenArn(*task.TaskDefinitionArn),
+		IPAddress:     getIPAddressFromTask(task, cfg.ECS.IPAddressFamily),
+		LastStatus:    *task.LastStatus,
+		Env:           getEnvironmentsFromTask(task, cfg.Parameter),
+		Tags:          task.Tags,
+		StoppedReason: aws.ToString(task.StoppedReason),
+		task:          task,
+	}
+	for _, c := range task.Containers {
+		if c.ExitCode == nil {
+			continue
+		}
+		if info.ExitCodes == nil {
+			info.ExitCodes = make(map[string]int32, len(task.Containers))
+		}
+		info.ExitCodes[aws.ToString(c.Name)] = *c.ExitCode
+	}
+	return info
+}
+
+// checkStartDeadline flags the task as failed when it is not running after the deadline since created.
+func checkStartDeadline(info *Information, task *types.Task, deadline time.Duration, now time.Time) {
+	if deadline <= 0 || task.CreatedAt == nil || task.StartedAt != nil {
+		return
+	}
+	switch aws.ToString(task.LastStatus) {
+	case statusRunning, statusStopped, "DEACTIVATING", "STOPPING", "DEPROVISIONING":
+		return
+	}
+	if now.Sub(*task.CreatedAt) < deadline {
+		return
+	}
+	info.StartFailed = true
+	info.StartFailedReason = fmt.Sprintf("not running after %s (last status: %s)", deadline, aws.ToString(task.LastStatus))
+	if r := aws.ToString(task.StoppedReason); r != "" {
+		info.StartFailedReason += ": " + r
+	}
+}
+
 func shortenArn(arn string) string {
 	p := strings.SplitN(arn, ":", 6)
 	if len(p) != 6 {
@@ -507,13 +1613,45 @@ func shortenArn(arn string) string {
 	return ps[len(ps)-1]
 }
 
+const (
+	IPAddressFamilyIPv4 = "ipv4"
+	IPAddressFamilyIPv6 = "ipv6"
+)
+
 func getIPV4AddressFromTask(task *types.Task) string {
+	return getAttachmentDetail(task, "privateIPv4Address")
+}
+
+func getIPV6AddressFromTask(task *types.Task) string {
+	if addr := getAttachmentDetail(task, "privateIPv6Address"); addr != "" {
+		return addr
+	}
+	return getAttachmentDetail(task, "ipv6Address")
+}
+
+// getIPAddressFromTask returns the address of the task in the preferred family.
+// The address in the other family is returned when the task has no address in the preferred one,
+// e.g. IPv6-only tasks.
+func getIPAddressFromTask(task *types.Task, family string) string {
+	get := []func(*types.Task) string{getIPV4AddressFromTask, getIPV6AddressFromTask}
+	if family == IPAddressFamilyIPv6 {
+		get[0], get[1] = get[1], get[0]
+	}
+	for _, fn := range get {
+		if addr := fn(task); addr != "" {
+			return addr
+		}
+	}
+	return ""
+}
+
+func getAttachmentDetail(task *types.Task, name string) string {
 	if len(task.Attachments) == 0 {
 		return ""
 	}
 	for _, d := range task.Attachments[0].Details {
-		if *d.Name == "privateIPv4Address" {
-			return *d.Value
+		if aws.ToString(d.Name) == name {
+			return aws.ToString(d.Value)
 		}
 	}
 	return ""
@@ -541,13 +1679,17 @@ func getEnvironmentFromTask(task *types.Task, name string) string {
 	return ""
 }
 
-func getEnvironmentsFromTask(task *types.Task) map[string]string {
+// getEnvironmentsFromTask returns the environment variables of the task except the secret parameters.
+func getEnvironmentsFromTask(task *types.Task, params Parameters) map[string]string {
 	env := map[string]string{}
 	if len(task.Overrides.ContainerOverrides) == 0 {
 		return env
 	}
 	ov := task.Overrides.ContainerOverrides[0]
 	for _, e := range ov.Environment {
+		if params.isSecretEnv(*e.Name) {
+			continue
+		}
 		env[*e.Name] = *e.Value
 	}
 	return env
@@ -566,49 +1708,205 @@ func decodeTagValue(s string) string {
 	return string(d)
 }
 
-func (e *ECS) portMapInTask(ctx context.Context, task *types.Task) (map[string]int, error) {
-	portMap := make(map[string]int)
-	tdArn := *task.TaskDefinitionArn
-	td, err := taskDefinitionCache.Get(tdArn)
-	if err != nil && err == ttlcache.ErrNotFound {
-		slog.Debug(f("cache miss for %s", tdArn))
-		out, err := e.svc.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
-			TaskDefinition: &tdArn,
+func (e *ECS) portMappingsInTask(ctx context.Context, task *types.Task) (map[string][]PortMapping, error) {
+	td, err := e.describeTaskDefinition(ctx, *task.TaskDefinitionArn)
+	if err != nil {
+		return nil, err
+	}
+	return containerPortMappings(td), nil
+}
+
+// DefaultTaskDefCacheTTL is the default TTL of task definitions cached by family aliases.
+const DefaultTaskDefCacheTTL = 5 * time.Minute
+
+// taskDefinitionCache caches task definitions.
+// The task definitions looked up by ARN are cached forever because they are immutable.
+// The ones looked up by family aliases (family or family:revision) expire in ttl,
+// because an alias may resolve to another task definition later.
+type taskDefinitionCache struct {
+	arns    *ttlcache.Cache
+	aliases *ttlcache.Cache
+}
+
+func newTaskDefinitionCache(ttl time.Duration) *taskDefinitionCache {
+	if ttl <= 0 {
+		ttl = DefaultTaskDefCacheTTL
+	}
+	aliases := ttlcache.NewCache()
+	aliases.SetTTL(ttl)
+	aliases.SkipTTLExtensionOnHit(true)
+	return &taskDefinitionCache{
+		arns:    ttlcache.NewCache(),
+		aliases: aliases,
+	}
+}
+
+func isTaskDefinitionARN(name string) bool {
+	return strings.HasPrefix(name, "arn:")
+}
+
+func (c *taskDefinitionCache) store(name string) *ttlcache.Cache {
+	if isTaskDefinitionARN(name) {
+		return c.arns
+	}
+	return c.aliases
+}
+
+// get returns the cached task definition, or describes it and caches the result.
+func (c *taskDefinitionCache) get(ctx context.Context, name string, describe func(context.Context, string) (*types.TaskDefinition, error)) (*types.TaskDefinition, error) {
+	if td, err := c.store(name).Get(name); err == nil {
+		if _td, ok := td.(*types.TaskDefinition); ok {
+			slog.Debug(f("cache hit for %s", name))
+			return _td, nil
+		}
+	}
+	slog.Debug(f("cache miss for %s", name))
+	td, err := describe(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	c.store(name).Set(name, td)
+	if arn := aws.ToString(td.TaskDefinitionArn); arn != "" && arn != name {
+		c.arns.Set(arn, td)
+	}
+	return td, nil
+}
+
+// describeTaskDefinition describes the task definition with retries on throttling.
+func (e *ECS) describeTaskDefinition(ctx context.Context, taskdef string) (*types.TaskDefinition, error) {
+	return e.taskdefCache.get(ctx, taskdef, func(ctx context.Context, name string) (*types.TaskDefinition, error) {
+		var out *ecs.DescribeTaskDefinitionOutput
+		err := retryOnThrottle(ctx, DescribeTaskDefinitionMaxAttempts, describeTaskDefinitionBackoff, func() error {
+			var err error
+			out, err = e.svc.DescribeTaskDefinition(ctx, &ecs.DescribeTaskDefinitionInput{
+				TaskDefinition: aws.String(name),
+			}, withoutRetryer)
+			return err
 		})
 		if err != nil {
 			return nil, err
 		}
-		taskDefinitionCache.Set(tdArn, out.TaskDefinition)
-		td = out.TaskDefinition
-	} else {
-		slog.Debug(f("cache hit for %s", tdArn))
-	}
-	if _td, ok := td.(*types.TaskDefinition); ok {
-		for _, c := range _td.ContainerDefinitions {
-			for _, m := range c.PortMappings {
-				if m.HostPort == nil {
-					continue
-				}
-				portMap[*c.Name] = int(*m.HostPort)
+		return out.TaskDefinition, nil
+	})
+}
+
+// DescribeTaskDefinitionMaxAttempts is the max attempts of DescribeTaskDefinition on throttling.
+const DescribeTaskDefinitionMaxAttempts = 5
+
+var describeTaskDefinitionBackoff = 500 * time.Millisecond
+
+// retryOnThrottle calls fn until it succeeds or returns an error except throttling.
+// The interval between attempts is doubled from backoff.
+func retryOnThrottle(ctx context.Context, maxAttempts int, backoff time.Duration, fn func() error) error {
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if retry.IsErrorThrottles(retry.DefaultThrottles).IsErrorThrottle(err) != aws.TrueTernary {
+			return err
+		}
+		if i == maxAttempts-1 {
+			break
+		}
+		slog.Warn(f("throttled, retrying after %s (%d/%d): %s", backoff, i+1, maxAttempts, err))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	return err
+}
+
+// PortMapping is a port mapping of a container.
+type PortMapping struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int    `json:"container_port"`
+	HostPort      int    `json:"host_port"`
+}
+
+// containerPortMappings returns the port mappings that have a host port of each container in the task definition.
+func containerPortMappings(td *types.TaskDefinition) map[string][]PortMapping {
+	mappings := make(map[string][]PortMapping)
+	for _, c := range td.ContainerDefinitions {
+		for _, m := range c.PortMappings {
+			if m.HostPort == nil {
+				continue
 			}
+			mappings[*c.Name] = append(mappings[*c.Name], PortMapping{
+				Name:          aws.ToString(m.Name),
+				ContainerPort: int(aws.ToInt32(m.ContainerPort)),
+				HostPort:      int(*m.HostPort),
+			})
 		}
-	} else {
-		slog.Warn(f("invalid type %s", td))
 	}
-	return portMap, nil
+	return mappings
+}
+
+// primaryPortMap returns the primary host port of each container.
+// When a container has a port mapping named mappingName, the port is selected.
+// Otherwise the last port mapping of the container is selected.
+func primaryPortMap(mappings map[string][]PortMapping, mappingName string) map[string]int {
+	portMap := make(map[string]int, len(mappings))
+	for name, ms := range mappings {
+		for _, m := range ms {
+			portMap[name] = m.HostPort
+			if mappingName != "" && m.Name == mappingName {
+				break
+			}
+		}
+	}
+	return portMap
+}
+
+// containerPortMap returns the primary host port of each container in the task definition.
+func containerPortMap(td *types.TaskDefinition, mappingName string) map[string]int {
+	return primaryPortMap(containerPortMappings(td), mappingName)
 }
 
 func (e *ECS) GetAccessCount(ctx context.Context, subdomain string, duration time.Duration) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, APICallTimeout)
+	defer cancel()
+	return getAccessCount(ctx, e.cwSvc, subdomain, duration, time.Now())
+}
+
+const (
+	// accessCountPeriod is the period of the buckets summed by getAccessCount.
+	accessCountPeriod = 5 * time.Minute
+	// accessCountLongPeriod is used for the window longer than 63 days,
+	// because CloudWatch keeps the data points of 5 minutes only for 63 days.
+	accessCountLongPeriod     = time.Hour
+	accessCountLongPeriodFrom = 63 * 24 * time.Hour
+)
+
+// accessCountPeriodOf returns the period of the buckets for the duration.
+// Period must be a multiple of 60.
+// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_GetMetricData.html
+func accessCountPeriodOf(duration time.Duration) time.Duration {
+	switch {
+	case duration > accessCountLongPeriodFrom:
+		return accessCountLongPeriod
+	case duration > accessCountPeriod:
+		return accessCountPeriod
+	case duration < time.Minute:
+		return time.Minute
+	default:
+		return duration
+	}
+}
+
+// getAccessCount sums the access counts of the subdomain in the duration until now.
+// The duration is split into the buckets of the period, and all the pages of the results are summed.
+func getAccessCount(ctx context.Context, svc cw.GetMetricDataAPIClient, subdomain string, duration time.Duration, now time.Time) (int64, error) {
 	// truncate to minute
-	// Period must be a multiple of 60
-	// https://docs.aws.amazon.com/AmazonCloudWatch/latest/APIReference/API_GetMetricData.html
 	duration = duration.Truncate(time.Minute)
+	period := accessCountPeriodOf(duration)
 
-	ctx, cancel := context.WithTimeout(ctx, APICallTimeout)
-	defer cancel()
-	res, err := e.cwSvc.GetMetricData(ctx, &cw.GetMetricDataInput{
-		StartTime: aws.Time(time.Now().Add(-duration)),
-		EndTime:   aws.Time(time.Now()),
+	p := cw.NewGetMetricDataPaginator(svc, &cw.GetMetricDataInput{
+		StartTime: aws.Time(now.Add(-duration)),
+		EndTime:   aws.Time(now),
 		MetricDataQueries: []cwTypes.MetricDataQuery{
 			{
 				Id: aws.String("request_count"),
@@ -623,19 +1921,22 @@ func (e *ECS) GetAccessCount(ctx context.Context, subdomain string, duration tim
 						MetricName: aws.String(CloudWatchMetricName),
 						Namespace:  aws.String(CloudWatchMetricNameSpace),
 					},
-					Period: aws.Int32(int32(duration.Seconds())),
+					Period: aws.Int32(int32(period.Seconds())),
 					Stat:   aws.String("Sum"),
 				},
 			},
 		},
 	})
-	if err != nil {
-		return 0, err
-	}
 	var sum int64
-	for _, v := range res.MetricDataResults {
-		for _, vv := range v.Values {
-			sum += int64(vv)
+	for p.HasMorePages() {
+		res, err := p.NextPage(ctx)
+		if err != nil {
+			return 0, err
+		}
+		for _, v := range res.MetricDataResults {
+			for _, vv := range v.Values {
+				sum += int64(vv)
+			}
 		}
 	}
 	return sum, nil
@@ -659,6 +1960,71 @@ func (e *ECS) PutAccessCounts(ctx context.Context, all map[string]accessCount) e
 			})
 		}
 	}
+	return e.putMetricData(ctx, metricData)
+}
+
+// PutStatusCounts puts the response counts with the dimensions of the subdomain and the status class.
+func (e *ECS) PutStatusCounts(ctx context.Context, all map[string]statusCount) error {
+	var metricData []cwTypes.MetricDatum
+	for subdomain, counters := range all {
+		for ts, classes := range counters {
+			for class, count := range classes {
+				metricData = append(metricData, cwTypes.MetricDatum{
+					MetricName: aws.String(CloudWatchMetricName),
+					Timestamp:  aws.Time(ts),
+					Value:      aws.Float64(float64(count)),
+					Dimensions: []cwTypes.Dimension{
+						{
+							Name:  aws.String(CloudWatchDimensionName),
+							Value: aws.String(subdomain),
+						},
+						{
+							Name:  aws.String(CloudWatchStatusClassDimensionName),
+							Value: aws.String(class),
+						},
+					},
+				})
+			}
+		}
+	}
+	return e.putMetricData(ctx, metricData)
+}
+
+// PutLatencyMetrics puts p50 and p95 of the upstream latency with the dimensions of the subdomain and the percentile.
+func (e *ECS) PutLatencyMetrics(ctx context.Context, all map[string]latencyMetrics) error {
+	var metricData []cwTypes.MetricDatum
+	for subdomain, metrics := range all {
+		for ts, stats := range metrics {
+			if stats.Count == 0 {
+				continue
+			}
+			for _, p := range []struct {
+				name  string
+				value time.Duration
+			}{{"p50", stats.P50}, {"p95", stats.P95}} {
+				metricData = append(metricData, cwTypes.MetricDatum{
+					MetricName: aws.String(CloudWatchLatencyMetricName),
+					Timestamp:  aws.Time(ts),
+					Value:      aws.Float64(float64(p.value) / float64(time.Millisecond)),
+					Unit:       cwTypes.StandardUnitMilliseconds,
+					Dimensions: []cwTypes.Dimension{
+						{
+							Name:  aws.String(CloudWatchDimensionName),
+							Value: aws.String(subdomain),
+						},
+						{
+							Name:  aws.String(CloudWatchPercentileDimensionName),
+							Value: aws.String(p.name),
+						},
+					},
+				})
+			}
+		}
+	}
+	return e.putMetricData(ctx, metricData)
+}
+
+func (e *ECS) putMetricData(ctx context.Context, metricData []cwTypes.MetricDatum) error {
 	// CloudWatch API has a limit of 20 metric data per request
 	var eg errgroup.Group
 	for _, chunk := range lo.Chunk(metricData, 20) {
@@ -2,10 +2,24 @@ package mirageecs_test
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	cw "github.com/aws/aws-sdk-go-v2/service/cloudwatch"
+	cwTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatch/types"
+	cwlogs "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs"
+	cwlogsTypes "github.com/aws/aws-sdk-go-v2/service/cloudwatchlogs/types"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
 	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -88,6 +102,36 @@ func TestToECSKeyValuePairsAndTags(t *testing.T) {
 			},
 			compatV1: false,
 		},
+		{
+			name: "Long value is not tagged",
+			taskParam: mirageecs.TaskParameter{
+				"Param1": "Value1",
+				"Param2": strings.Repeat("x", 257),
+			},
+			configParams: mirageecs.Parameters{
+				&mirageecs.Parameter{Name: "Param1", Env: "ENV1"},
+				&mirageecs.Parameter{Name: "Param2", Env: "ENV2", MaxLength: 4096},
+			},
+			subdomain: "testsubdomain",
+			expectedKVP: []types.KeyValuePair{
+				{Name: aws.String("SUBDOMAIN"), Value: aws.String("testsubdomain")},
+				{Name: aws.String("SUBDOMAINRAW"), Value: aws.String("testsubdomain")},
+				{Name: aws.String("ENV1"), Value: aws.String("Value1")},
+				{Name: aws.String("ENV2"), Value: aws.String(strings.Repeat("x", 257))},
+			},
+			expectedTags: []types.Tag{
+				{Key: aws.String("Subdomain"), Value: aws.String("dGVzdHN1YmRvbWFpbg==")},
+				{Key: aws.String("ManagedBy"), Value: aws.String(mirageecs.TagValueMirage)},
+				{Key: aws.String("Param1"), Value: aws.String("Value1")},
+			},
+			expectedEnv: map[string]string{
+				"SUBDOMAIN":    "testsubdomain",
+				"SUBDOMAINRAW": "testsubdomain",
+				"ENV1":         "Value1",
+				"ENV2":         strings.Repeat("x", 257),
+			},
+			compatV1: false,
+		},
 	}
 
 	opt := cmpopts.IgnoreUnexported(types.KeyValuePair{}, types.Tag{})
@@ -113,6 +157,193 @@ func TestToECSKeyValuePairsAndTags(t *testing.T) {
 	}
 }
 
+func TestSecretParameter(t *testing.T) {
+	const ref = "arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/token"
+	params := mirageecs.Parameters{
+		&mirageecs.Parameter{Name: "branch", Env: "GIT_BRANCH"},
+		&mirageecs.Parameter{Name: "token", Env: "API_TOKEN", Secret: true},
+	}
+	taskParam := mirageecs.TaskParameter{
+		"branch": "develop",
+		"token":  ref,
+	}
+	for _, tag := range taskParam.ToECSTags("testsubdomain", params) {
+		if aws.ToString(tag.Key) == "token" || aws.ToString(tag.Value) == ref {
+			t.Errorf("secret parameter is tagged: %s=%s", aws.ToString(tag.Key), aws.ToString(tag.Value))
+		}
+	}
+	for _, kv := range taskParam.ToECSKeyValuePairs("testsubdomain", params, func(s string) string { return s }) {
+		if aws.ToString(kv.Name) == "API_TOKEN" {
+			t.Errorf("secret parameter is in the environment overrides: %s", aws.ToString(kv.Value))
+		}
+	}
+	secrets := taskParam.ToECSSecrets(params)
+	if len(secrets) != 1 || aws.ToString(secrets[0].Name) != "API_TOKEN" || aws.ToString(secrets[0].ValueFrom) != ref {
+		t.Errorf("unexpected secrets: %#v", secrets)
+	}
+
+	task := &types.Task{
+		Overrides: &types.TaskOverride{
+			ContainerOverrides: []types.ContainerOverride{
+				{Environment: []types.KeyValuePair{
+					{Name: aws.String("GIT_BRANCH"), Value: aws.String("develop")},
+					// launched by the older version
+					{Name: aws.String("API_TOKEN"), Value: aws.String("s3cr3t")},
+				}},
+			},
+		},
+	}
+	env := mirageecs.GetEnvironmentsFromTask(task, params)
+	if _, ok := env["API_TOKEN"]; ok {
+		t.Errorf("secret parameter is in the environments: %v", env)
+	}
+	if env["GIT_BRANCH"] != "develop" {
+		t.Errorf("unexpected environments: %v", env)
+	}
+}
+
+func TestSecretTaskDefinitionInput(t *testing.T) {
+	secrets := []types.Secret{{
+		Name:      aws.String("API_TOKEN"),
+		ValueFrom: aws.String("arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:mirage-token"),
+	}}
+	td := &types.TaskDefinition{
+		TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3"),
+		Family:            aws.String("app"),
+		ExecutionRoleArn:  aws.String("arn:aws:iam::123456789012:role/ecsTaskExecutionRole"),
+		TaskRoleArn:       aws.String("arn:aws:iam::123456789012:role/app"),
+		Cpu:               aws.String("256"),
+		Memory:            aws.String("512"),
+		NetworkMode:       types.NetworkModeAwsvpc,
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name: aws.String("app"),
+				Environment: []types.KeyValuePair{
+					{Name: aws.String("API_TOKEN"), Value: aws.String("dummy")},
+					{Name: aws.String("LANG"), Value: aws.String("C")},
+				},
+			},
+			{Name: aws.String("nginx")},
+		},
+	}
+	in, err := mirageecs.SecretTaskDefinitionInput(td, secrets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(in.Family) != "app-mirage-secrets" {
+		t.Errorf("unexpected family %s", aws.ToString(in.Family))
+	}
+	if aws.ToString(in.ExecutionRoleArn) != aws.ToString(td.ExecutionRoleArn) || aws.ToString(in.TaskRoleArn) != aws.ToString(td.TaskRoleArn) ||
+		aws.ToString(in.Cpu) != "256" || aws.ToString(in.Memory) != "512" || in.NetworkMode != types.NetworkModeAwsvpc {
+		t.Errorf("task definition is not copied: %#v", in)
+	}
+	for _, c := range in.ContainerDefinitions {
+		if diff := cmp.Diff(secrets, c.Secrets, cmpopts.IgnoreUnexported(types.Secret{})); diff != "" {
+			t.Errorf("unexpected secrets of %s (-want +got):\n%s", aws.ToString(c.Name), diff)
+		}
+		for _, kv := range c.Environment {
+			if aws.ToString(kv.Name) == "API_TOKEN" {
+				t.Errorf("environment of %s conflicts with the secret", aws.ToString(c.Name))
+			}
+		}
+	}
+	if n := len(td.ContainerDefinitions[0].Environment); n != 2 {
+		t.Errorf("original task definition is modified: %d environments", n)
+	}
+
+	td.ExecutionRoleArn = nil
+	if _, err := mirageecs.SecretTaskDefinitionInput(td, secrets); err == nil {
+		t.Error("expected error without execution role")
+	}
+}
+
+// secretTaskDefinitionServer registers the task definitions and describes the latest revision with the tags.
+type secretTaskDefinitionServer struct {
+	mu        sync.Mutex
+	revisions []json.RawMessage
+	tags      []json.RawMessage
+}
+
+func (s *secretTaskDefinitionServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var in struct {
+		Family string          `json:"family"`
+		Tags   json.RawMessage `json:"tags"`
+	}
+	json.NewDecoder(r.Body).Decode(&in)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	action := r.Header.Get("X-Amz-Target")
+	switch action[strings.LastIndex(action, ".")+1:] {
+	case "RegisterTaskDefinition":
+		td := json.RawMessage(fmt.Sprintf(`{"taskDefinitionArn":"arn:aws:ecs:ap-northeast-1:123456789012:task-definition/%s:%d","family":%q}`,
+			in.Family, len(s.revisions)+1, in.Family))
+		s.revisions = append(s.revisions, td)
+		s.tags = append(s.tags, in.Tags)
+		fmt.Fprintf(w, `{"taskDefinition":%s,"tags":%s}`, td, in.Tags)
+	case "DescribeTaskDefinition":
+		if len(s.revisions) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"ClientException","message":"Unable to describe task definition."}`)
+			return
+		}
+		fmt.Fprintf(w, `{"taskDefinition":%s,"tags":%s}`, s.revisions[len(s.revisions)-1], s.tags[len(s.tags)-1])
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"ClientException","message":"unexpected action"}`)
+	}
+}
+
+func TestRegisterSecretTaskDefinitionReuse(t *testing.T) {
+	ctx := context.Background()
+	fake := &secretTaskDefinitionServer{}
+	ecsServer := httptest.NewServer(fake)
+	defer ecsServer.Close()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := mirageecs.NewECSTaskRunnerWithClient(cfg, ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	}))
+	td := &types.TaskDefinition{
+		TaskDefinitionArn:    aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3"),
+		Family:               aws.String("app"),
+		ExecutionRoleArn:     aws.String("arn:aws:iam::123456789012:role/ecsTaskExecutionRole"),
+		ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("app")}},
+	}
+	secretsOf := func(name string) []types.Secret {
+		return []types.Secret{{
+			Name:      aws.String("API_TOKEN"),
+			ValueFrom: aws.String("arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/" + name),
+		}}
+	}
+
+	tests := []struct {
+		secret   string
+		expected string
+	}{
+		{secret: "token", expected: "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app-mirage-secrets:1"},
+		{secret: "token", expected: "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app-mirage-secrets:1"},
+		{secret: "other", expected: "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app-mirage-secrets:2"},
+		{secret: "other", expected: "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app-mirage-secrets:2"},
+	}
+	for i, tt := range tests {
+		arn, err := mirageecs.RegisterSecretTaskDefinition(ctx, runner, td, secretsOf(tt.secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if arn != tt.expected {
+			t.Errorf("launch %d: unexpected task definition %s, expected %s", i, arn, tt.expected)
+		}
+	}
+	if n := len(fake.revisions); n != 2 {
+		t.Errorf("unexpected registered revisions %d", n)
+	}
+}
+
 var purgeTests = []struct {
 	name     string
 	param    *mirageecs.APIPurgeRequest
@@ -132,6 +363,22 @@ var purgeTests = []struct {
 		},
 		expected: true,
 	},
+	{
+		name: "in grace period",
+		param: &mirageecs.APIPurgeRequest{
+			Duration: "300",
+			MinAge:   "600", // 10 minutes
+		},
+		expected: false,
+	},
+	{
+		name: "after grace period",
+		param: &mirageecs.APIPurgeRequest{
+			Duration: "300",
+			MinAge:   "360", // 6 minutes
+		},
+		expected: true,
+	},
 	{
 		name: "excluded task",
 		param: &mirageecs.APIPurgeRequest{
@@ -156,6 +403,22 @@ var purgeTests = []struct {
 		},
 		expected: false,
 	},
+	{
+		name: "excluded env",
+		param: &mirageecs.APIPurgeRequest{
+			Duration:   "300",
+			ExcludeEnv: []string{"ENV:test"},
+		},
+		expected: false,
+	},
+	{
+		name: "excluded env not match",
+		param: &mirageecs.APIPurgeRequest{
+			Duration:   "300",
+			ExcludeEnv: []string{"ENV:production"},
+		},
+		expected: true,
+	},
 	{
 		name: "excluded regexp",
 		param: &mirageecs.APIPurgeRequest{
@@ -211,4 +474,1137 @@ func TestShouldBePurged(t *testing.T) {
 			}
 		})
 	}
+
+	t.Run("expired young task", func(t *testing.T) {
+		p, err := (&mirageecs.APIPurgeRequest{Duration: "3600"}).Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := info
+		expiresAt := time.Now().Add(-time.Minute)
+		expired.ExpiresAt = &expiresAt
+		if !expired.ShouldBePurged(p) {
+			t.Error("expired task should be purged")
+		}
+	})
+}
+
+func TestRetainedSubdomains(t *testing.T) {
+	now := time.Now()
+	infos := []*mirageecs.Information{
+		{SubDomain: "feature-1", GitBranch: "feature", Created: now.Add(-3 * time.Hour)},
+		{SubDomain: "feature-2", GitBranch: "feature", Created: now.Add(-2 * time.Hour)},
+		{SubDomain: "feature-3", GitBranch: "feature", Created: now.Add(-1 * time.Hour)},
+		{SubDomain: "feature-3", GitBranch: "feature", Created: now.Add(-4 * time.Hour)}, // linked task
+		{SubDomain: "main", GitBranch: "main", Created: now.Add(-5 * time.Hour)},
+		{SubDomain: "nobranch", Created: now},
+	}
+	tests := []struct {
+		keep     int
+		expected []string
+	}{
+		{keep: 0, expected: []string{}},
+		{keep: 1, expected: []string{"feature-3", "main"}},
+		{keep: 2, expected: []string{"feature-2", "feature-3", "main"}},
+	}
+	for _, tt := range tests {
+		p, err := (&mirageecs.APIPurgeRequest{
+			Duration:            "300",
+			KeepLatestPerBranch: tt.keep,
+		}).Validate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		retained := p.RetainedSubdomains(infos)
+		got := make([]string, 0, len(retained))
+		for s := range retained {
+			got = append(got, s)
+		}
+		if diff := cmp.Diff(got, tt.expected, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+			t.Errorf("keep=%d unexpected retained subdomains %s", tt.keep, diff)
+		}
+	}
+}
+
+func TestExpiresAt(t *testing.T) {
+	created := time.Date(2023, 3, 13, 0, 0, 0, 0, time.UTC)
+	tag := func(v string) []types.Tag {
+		return []types.Tag{{Key: aws.String(mirageecs.TagMaxLifetime), Value: aws.String(v)}}
+	}
+	tests := []struct {
+		name     string
+		info     *mirageecs.Information
+		lifetime time.Duration
+		expected *time.Time
+	}{
+		{name: "unlimited", info: &mirageecs.Information{Created: created}},
+		{name: "default", info: &mirageecs.Information{Created: created}, lifetime: time.Hour, expected: aws.Time(created.Add(time.Hour))},
+		{name: "tag overrides default", info: &mirageecs.Information{Created: created, Tags: tag("24h")}, lifetime: time.Hour, expected: aws.Time(created.Add(24 * time.Hour))},
+		{name: "tag without default", info: &mirageecs.Information{Created: created, Tags: tag("30m")}, expected: aws.Time(created.Add(30 * time.Minute))},
+		{name: "invalid tag", info: &mirageecs.Information{Created: created, Tags: tag("forever")}, lifetime: time.Hour, expected: aws.Time(created.Add(time.Hour))},
+		{name: "not created yet", info: &mirageecs.Information{}, lifetime: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mirageecs.ExpiresAt(tt.info, tt.lifetime)
+			if diff := cmp.Diff(tt.expected, got); diff != "" {
+				t.Errorf("unexpected expires_at %s", diff)
+			}
+			tt.info.ExpiresAt = got
+			if tt.expected != nil {
+				if tt.info.Expired(tt.expected.Add(-time.Second)) {
+					t.Error("must not be expired before expires_at")
+				}
+				if !tt.info.Expired(tt.expected.Add(time.Second)) {
+					t.Error("must be expired after expires_at")
+				}
+			} else if tt.info.Expired(created.Add(24 * 365 * time.Hour)) {
+				t.Error("must not be expired without max lifetime")
+			}
+		})
+	}
+}
+
+func TestCheckStartDeadline(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name     string
+		task     types.Task
+		deadline time.Duration
+		failed   bool
+	}{
+		{
+			name:     "pending over deadline",
+			task:     types.Task{LastStatus: aws.String("PENDING"), CreatedAt: aws.Time(now.Add(-11 * time.Minute))},
+			deadline: 10 * time.Minute,
+			failed:   true,
+		},
+		{
+			name:     "pending within deadline",
+			task:     types.Task{LastStatus: aws.String("PENDING"), CreatedAt: aws.Time(now.Add(-9 * time.Minute))},
+			deadline: 10 * time.Minute,
+			failed:   false,
+		},
+		{
+			name:     "running",
+			task:     types.Task{LastStatus: aws.String("RUNNING"), CreatedAt: aws.Time(now.Add(-time.Hour)), StartedAt: aws.Time(now.Add(-time.Hour))},
+			deadline: 10 * time.Minute,
+			failed:   false,
+		},
+		{
+			name:     "deadline disabled",
+			task:     types.Task{LastStatus: aws.String("PROVISIONING"), CreatedAt: aws.Time(now.Add(-time.Hour))},
+			deadline: 0,
+			failed:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info := &mirageecs.Information{}
+			mirageecs.CheckStartDeadline(info, &tt.task, tt.deadline, now)
+			if info.StartFailed != tt.failed {
+				t.Errorf("StartFailed = %v, want %v", info.StartFailed, tt.failed)
+			}
+			if tt.failed && info.StartFailedReason == "" {
+				t.Error("StartFailedReason should not be empty")
+			}
+		})
+	}
+}
+
+func TestLogStreamName(t *testing.T) {
+	tests := []struct {
+		tmpl     string
+		expected string
+	}{
+		{tmpl: mirageecs.DefaultLogStreamNameTemplate, expected: "app/web/0123abcd"},
+		{tmpl: "{container}/{task_id}", expected: "web/0123abcd"},
+		{tmpl: "custom-{prefix}-{container}.{task_id}.log", expected: "custom-app-web.0123abcd.log"},
+	}
+	for _, tt := range tests {
+		if got := mirageecs.LogStreamName(tt.tmpl, "app", "web", "0123abcd"); got != tt.expected {
+			t.Errorf("LogStreamName(%s) = %s, want %s", tt.tmpl, got, tt.expected)
+		}
+	}
+}
+
+func TestContainerPortMap(t *testing.T) {
+	td := &types.TaskDefinition{
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name: aws.String("app"),
+				PortMappings: []types.PortMapping{
+					{Name: aws.String("web"), HostPort: aws.Int32(80)},
+					{Name: aws.String("metrics"), HostPort: aws.Int32(9090)},
+				},
+			},
+			{
+				Name: aws.String("sidecar"),
+				PortMappings: []types.PortMapping{
+					{HostPort: aws.Int32(8080)},
+					{HostPort: aws.Int32(8081)},
+				},
+			},
+			{
+				Name:         aws.String("worker"),
+				PortMappings: []types.PortMapping{{ContainerPort: aws.Int32(5000)}},
+			},
+		},
+	}
+	tests := []struct {
+		name     string
+		expected map[string]int
+	}{
+		{name: "", expected: map[string]int{"app": 9090, "sidecar": 8081}},
+		{name: "web", expected: map[string]int{"app": 80, "sidecar": 8081}},
+		{name: "metrics", expected: map[string]int{"app": 9090, "sidecar": 8081}},
+	}
+	for _, tt := range tests {
+		if diff := cmp.Diff(tt.expected, mirageecs.ContainerPortMap(td, tt.name)); diff != "" {
+			t.Errorf("port_mapping_name=%q: unexpected port map (-want +got):\n%s", tt.name, diff)
+		}
+	}
+}
+
+func TestContainerPortMappings(t *testing.T) {
+	td := &types.TaskDefinition{
+		ContainerDefinitions: []types.ContainerDefinition{
+			{
+				Name: aws.String("app"),
+				PortMappings: []types.PortMapping{
+					{Name: aws.String("web"), ContainerPort: aws.Int32(3000), HostPort: aws.Int32(3000)},
+					{Name: aws.String("metrics"), ContainerPort: aws.Int32(9090), HostPort: aws.Int32(9090)},
+					{Name: aws.String("debug"), ContainerPort: aws.Int32(6060), HostPort: aws.Int32(6060)},
+				},
+			},
+			{
+				Name:         aws.String("worker"),
+				PortMappings: []types.PortMapping{{ContainerPort: aws.Int32(5000)}},
+			},
+		},
+	}
+	expected := map[string][]mirageecs.PortMapping{
+		"app": {
+			{Name: "web", ContainerPort: 3000, HostPort: 3000},
+			{Name: "metrics", ContainerPort: 9090, HostPort: 9090},
+			{Name: "debug", ContainerPort: 6060, HostPort: 6060},
+		},
+	}
+	if diff := cmp.Diff(expected, mirageecs.ContainerPortMappings(td)); diff != "" {
+		t.Errorf("unexpected port mappings (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(map[string]int{"app": 9090}, mirageecs.ContainerPortMap(td, "metrics")); diff != "" {
+		t.Errorf("unexpected port map (-want +got):\n%s", diff)
+	}
+}
+
+type testAPIError struct {
+	code string
+}
+
+func (e *testAPIError) Error() string     { return e.code }
+func (e *testAPIError) ErrorCode() string { return e.code }
+
+func TestRetryOnThrottle(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantErr   bool
+	}{
+		{
+			name:      "success",
+			errs:      []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "success after throttled",
+			errs:      []error{&testAPIError{"ThrottlingException"}, &testAPIError{"ThrottlingException"}, nil},
+			wantCalls: 3,
+		},
+		{
+			name:      "not throttled",
+			errs:      []error{&testAPIError{"ClientException"}},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "throttled until max attempts",
+			errs:      []error{&testAPIError{"ThrottlingException"}, &testAPIError{"ThrottlingException"}, &testAPIError{"ThrottlingException"}},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := mirageecs.RetryOnThrottle(ctx, 3, time.Millisecond, func() error {
+				err := tt.errs[calls]
+				calls++
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, calls)
+			}
+		})
+	}
+}
+
+func TestDescribeTaskDefinitionThrottled(t *testing.T) {
+	var calls atomic.Int32
+	ecsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		calls.Add(1)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	}))
+	defer ecsServer.Close()
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := mirageecs.NewECSTaskRunnerWithClient(cfg, ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	}))
+	mirageecs.SetDescribeTaskDefinitionBackoff(time.Millisecond)
+	defer mirageecs.SetDescribeTaskDefinitionBackoff(500 * time.Millisecond)
+
+	if _, err := mirageecs.RunTaskInput(context.Background(), runner, "foo", "app", mirageecs.TaskParameter{}); err == nil {
+		t.Error("expected error")
+	}
+	if n := calls.Load(); n != mirageecs.DescribeTaskDefinitionMaxAttempts {
+		t.Errorf("expected %d calls, got %d", mirageecs.DescribeTaskDefinitionMaxAttempts, n)
+	}
+}
+
+func TestTaskDefinitionCacheTTL(t *testing.T) {
+	ctx := context.Background()
+	var port int32 = 80
+	calls := map[string]int{}
+	describe := func(_ context.Context, name string) (*types.TaskDefinition, error) {
+		calls[name]++
+		return &types.TaskDefinition{
+			TaskDefinitionArn: aws.String(fmt.Sprintf("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/myapp:%d", port)),
+			ContainerDefinitions: []types.ContainerDefinition{
+				{
+					Name:         aws.String("app"),
+					PortMappings: []types.PortMapping{{HostPort: aws.Int32(port)}},
+				},
+			},
+		}, nil
+	}
+	cache := mirageecs.NewTaskDefinitionCache(100 * time.Millisecond)
+
+	portOf := func(name string) int {
+		t.Helper()
+		td, err := cache.Get(ctx, name, describe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return mirageecs.ContainerPortMap(td, "")["app"]
+	}
+
+	if p := portOf("myapp"); p != 80 {
+		t.Errorf("unexpected port %d", p)
+	}
+	// the task definition is re-registered
+	port = 8080
+	if p := portOf("myapp"); p != 80 {
+		t.Errorf("family alias must be cached until TTL elapses: %d", p)
+	}
+	if calls["myapp"] != 1 {
+		t.Errorf("unexpected describe calls %d", calls["myapp"])
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	if p := portOf("myapp"); p != 8080 {
+		t.Errorf("family alias must be refreshed after TTL elapses: %d", p)
+	}
+	if calls["myapp"] != 2 {
+		t.Errorf("unexpected describe calls %d", calls["myapp"])
+	}
+
+	// ARN resolved by the first lookup is cached forever
+	if p := portOf("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/myapp:80"); p != 80 {
+		t.Errorf("unexpected port %d", p)
+	}
+	if n := calls["arn:aws:ecs:ap-northeast-1:123456789012:task-definition/myapp:80"]; n != 0 {
+		t.Errorf("ARN must be cached: %d calls", n)
+	}
+}
+
+type mockRunTaskClient struct {
+	results   []func() (*ecs.RunTaskOutput, error)
+	calls     int
+	started   []string
+	listCalls int
+	providers []string
+}
+
+func (m *mockRunTaskClient) RunTask(_ context.Context, in *ecs.RunTaskInput, _ ...func(*ecs.Options)) (*ecs.RunTaskOutput, error) {
+	for _, item := range in.CapacityProviderStrategy {
+		if item.Weight > 0 {
+			m.providers = append(m.providers, aws.ToString(item.CapacityProvider))
+		}
+	}
+	r := m.results[m.calls]
+	m.calls++
+	return r()
+}
+
+func (m *mockRunTaskClient) ListTasks(_ context.Context, in *ecs.ListTasksInput, _ ...func(*ecs.Options)) (*ecs.ListTasksOutput, error) {
+	m.listCalls++
+	if aws.ToString(in.StartedBy) == "" {
+		return nil, errors.New("startedBy is not specified")
+	}
+	return &ecs.ListTasksOutput{TaskArns: m.started}, nil
+}
+
+func TestRunTaskWithRetry(t *testing.T) {
+	ctx := context.Background()
+	succeeded := func() (*ecs.RunTaskOutput, error) {
+		return &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/0123")}}}, nil
+	}
+	failed := func(reason string) func() (*ecs.RunTaskOutput, error) {
+		return func() (*ecs.RunTaskOutput, error) {
+			return &ecs.RunTaskOutput{Failures: []types.Failure{{Reason: aws.String(reason)}}}, nil
+		}
+	}
+	apiError := func(code string) func() (*ecs.RunTaskOutput, error) {
+		return func() (*ecs.RunTaskOutput, error) {
+			return nil, &testAPIError{code}
+		}
+	}
+	tests := []struct {
+		name          string
+		results       []func() (*ecs.RunTaskOutput, error)
+		started       []string
+		wantCalls     int
+		wantListCalls int
+		wantErr       bool
+	}{
+		{
+			name:      "success after throttled and capacity shortage",
+			results:   []func() (*ecs.RunTaskOutput, error){apiError("ThrottlingException"), failed("Capacity is unavailable at this time."), succeeded},
+			wantCalls: 3,
+		},
+		{
+			name:          "success after server error without started task",
+			results:       []func() (*ecs.RunTaskOutput, error){apiError("ServerException"), succeeded},
+			wantCalls:     2,
+			wantListCalls: 1,
+		},
+		{
+			name:          "task started despite server error",
+			results:       []func() (*ecs.RunTaskOutput, error){apiError("ServiceUnavailableException"), succeeded},
+			started:       []string{"arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/4567"},
+			wantCalls:     1,
+			wantListCalls: 1,
+		},
+		{
+			name:      "invalid task definition",
+			results:   []func() (*ecs.RunTaskOutput, error){apiError("ClientException")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "permanent failure",
+			results:   []func() (*ecs.RunTaskOutput, error){failed("MISSING")},
+			wantCalls: 1,
+			wantErr:   true,
+		},
+		{
+			name:      "capacity shortage until max attempts",
+			results:   []func() (*ecs.RunTaskOutput, error){failed("RESOURCE:MEMORY"), failed("RESOURCE:MEMORY"), failed("RESOURCE:MEMORY")},
+			wantCalls: 3,
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mockRunTaskClient{results: tt.results, started: tt.started}
+			in := &ecs.RunTaskInput{StartedBy: aws.String("mirage-0123")}
+			task, err := mirageecs.RunTaskWithRetry(ctx, m, in, 3, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && aws.ToString(task.TaskArn) == "" {
+				t.Error("task must be returned")
+			}
+			if len(tt.started) > 0 && err == nil && aws.ToString(task.TaskArn) != tt.started[0] {
+				t.Errorf("unexpected task %s", aws.ToString(task.TaskArn))
+			}
+			if m.calls != tt.wantCalls {
+				t.Errorf("expected %d calls, got %d", tt.wantCalls, m.calls)
+			}
+			if m.listCalls != tt.wantListCalls {
+				t.Errorf("expected %d ListTasks calls, got %d", tt.wantListCalls, m.listCalls)
+			}
+		})
+	}
+}
+
+func TestRunTaskWithPreference(t *testing.T) {
+	ctx := context.Background()
+	succeeded := func() (*ecs.RunTaskOutput, error) {
+		return &ecs.RunTaskOutput{Tasks: []types.Task{{TaskArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/0123")}}}, nil
+	}
+	failed := func(reason string) func() (*ecs.RunTaskOutput, error) {
+		return func() (*ecs.RunTaskOutput, error) {
+			return &ecs.RunTaskOutput{Failures: []types.Failure{{Reason: aws.String(reason)}}}, nil
+		}
+	}
+	shortage := failed("Capacity is unavailable at this time.")
+	tests := []struct {
+		name          string
+		results       []func() (*ecs.RunTaskOutput, error)
+		wantProviders []string
+		wantErr       bool
+	}{
+		{
+			name:          "preferred provider",
+			results:       []func() (*ecs.RunTaskOutput, error){succeeded},
+			wantProviders: []string{"FARGATE_SPOT"},
+		},
+		{
+			name:          "fallback on capacity shortage",
+			results:       []func() (*ecs.RunTaskOutput, error){shortage, shortage, succeeded},
+			wantProviders: []string{"FARGATE_SPOT", "FARGATE_SPOT", "FARGATE"},
+		},
+		{
+			name:          "no fallback on permanent failure",
+			results:       []func() (*ecs.RunTaskOutput, error){failed("MISSING")},
+			wantProviders: []string{"FARGATE_SPOT"},
+			wantErr:       true,
+		},
+		{
+			name:          "all providers are short of capacity",
+			results:       []func() (*ecs.RunTaskOutput, error){shortage, shortage, shortage, shortage},
+			wantProviders: []string{"FARGATE_SPOT", "FARGATE_SPOT", "FARGATE", "FARGATE"},
+			wantErr:       true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mockRunTaskClient{results: tt.results}
+			in := &ecs.RunTaskInput{StartedBy: aws.String("mirage-0123")}
+			task, err := mirageecs.RunTaskWithPreference(ctx, m, in, []string{"FARGATE_SPOT", "FARGATE"}, 2, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err == nil && aws.ToString(task.TaskArn) == "" {
+				t.Error("task must be returned")
+			}
+			if diff := cmp.Diff(tt.wantProviders, m.providers); diff != "" {
+				t.Errorf("unexpected capacity providers (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestRunTaskWithRetryServerErrorWithoutStartedBy(t *testing.T) {
+	m := &mockRunTaskClient{results: []func() (*ecs.RunTaskOutput, error){
+		func() (*ecs.RunTaskOutput, error) { return nil, &testAPIError{"ServerException"} },
+	}}
+	if _, err := mirageecs.RunTaskWithRetry(context.Background(), m, &ecs.RunTaskInput{}, 3, time.Millisecond); err == nil {
+		t.Error("expected error")
+	}
+	if m.calls != 1 || m.listCalls != 0 {
+		t.Errorf("server error must not be retried without startedBy: %d calls, %d ListTasks calls", m.calls, m.listCalls)
+	}
+}
+
+func TestSelectContainer(t *testing.T) {
+	single := &types.TaskDefinition{
+		Family:               aws.String("single"),
+		ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("app")}},
+	}
+	multi := &types.TaskDefinition{
+		Family: aws.String("multi"),
+		ContainerDefinitions: []types.ContainerDefinition{
+			{Name: aws.String("nginx")},
+			{Name: aws.String("app")},
+		},
+	}
+	defaults := map[string]string{"multi": "app"}
+	tests := []struct {
+		name      string
+		td        *types.TaskDefinition
+		container string
+		defaults  map[string]string
+		expected  string
+		err       error
+	}{
+		{name: "sole container", td: single, expected: "app"},
+		{name: "specified", td: multi, container: "nginx", expected: "nginx"},
+		{name: "specified overrides default", td: multi, container: "nginx", defaults: defaults, expected: "nginx"},
+		{name: "default", td: multi, defaults: defaults, expected: "app"},
+		{name: "ambiguous", td: multi, err: mirageecs.ErrAmbiguousContainer},
+		{name: "not found", td: single, container: "nginx", err: mirageecs.ErrContainerNotFound},
+		{name: "default not found", td: multi, defaults: map[string]string{"multi": "worker"}, err: mirageecs.ErrContainerNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mirageecs.SelectContainer(tt.td, tt.container, tt.defaults)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+type mockStopTaskClient struct {
+	stoppedAt time.Time
+	calls     int
+}
+
+func (m *mockStopTaskClient) StopTask(_ context.Context, _ *ecs.StopTaskInput, _ ...func(*ecs.Options)) (*ecs.StopTaskOutput, error) {
+	m.stoppedAt = time.Now()
+	m.calls++
+	return &ecs.StopTaskOutput{}, nil
+}
+
+func TestStopTaskAfterDrain(t *testing.T) {
+	ctx := context.Background()
+	drain := 100 * time.Millisecond
+
+	t.Run("no drain", func(t *testing.T) {
+		m := &mockStopTaskClient{}
+		if _, err := mirageecs.StopTaskAfterDrain(ctx, m, "mirage", "task-1", 0); err != nil {
+			t.Fatal(err)
+		}
+		if m.calls != 1 {
+			t.Errorf("StopTask must be called once: %d", m.calls)
+		}
+	})
+
+	t.Run("drain", func(t *testing.T) {
+		m := &mockStopTaskClient{}
+		start := time.Now()
+		if _, err := mirageecs.StopTaskAfterDrain(ctx, m, "mirage", "task-1", drain); err != nil {
+			t.Fatal(err)
+		}
+		if m.calls != 1 {
+			t.Errorf("StopTask must be called once: %d", m.calls)
+		}
+		if elapsed := m.stoppedAt.Sub(start); elapsed < drain {
+			t.Errorf("StopTask is called before the drain interval: %s", elapsed)
+		}
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		m := &mockStopTaskClient{}
+		ctx, cancel := context.WithTimeout(ctx, drain/2)
+		defer cancel()
+		_, err := mirageecs.StopTaskAfterDrain(ctx, m, "mirage", "task-1", drain)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("unexpected error: %v", err)
+		}
+		if m.calls != 0 {
+			t.Errorf("StopTask must not be called when the drain is canceled: %d", m.calls)
+		}
+	})
+}
+
+func TestGetIPAddressFromTask(t *testing.T) {
+	taskWith := func(details map[string]string) *types.Task {
+		var kvs []types.KeyValuePair
+		for k, v := range details {
+			kvs = append(kvs, types.KeyValuePair{Name: aws.String(k), Value: aws.String(v)})
+		}
+		return &types.Task{Attachments: []types.Attachment{{Details: kvs}}}
+	}
+	dualStack := taskWith(map[string]string{
+		"privateIPv4Address": "10.0.0.1",
+		"privateIPv6Address": "2001:db8::1",
+	})
+	ipv6Only := taskWith(map[string]string{
+		"privateIPv6Address": "2001:db8::2",
+	})
+	tests := []struct {
+		name   string
+		task   *types.Task
+		family string
+		want   string
+	}{
+		{name: "dual stack prefers ipv4", task: dualStack, family: mirageecs.IPAddressFamilyIPv4, want: "10.0.0.1"},
+		{name: "dual stack prefers ipv6", task: dualStack, family: mirageecs.IPAddressFamilyIPv6, want: "2001:db8::1"},
+		{name: "ipv6 only prefers ipv4", task: ipv6Only, family: mirageecs.IPAddressFamilyIPv4, want: "2001:db8::2"},
+		{name: "ipv6 only prefers ipv6", task: ipv6Only, family: mirageecs.IPAddressFamilyIPv6, want: "2001:db8::2"},
+		{name: "no attachments", task: &types.Task{}, family: mirageecs.IPAddressFamilyIPv4, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mirageecs.GetIPAddressFromTask(tt.task, tt.family); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInformationStoppedTask(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := &types.Task{
+		TaskArn:           aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/0123456789abcdef"),
+		TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3"),
+		LastStatus:        aws.String("STOPPED"),
+		StoppedReason:     aws.String("Essential container in task exited"),
+		Overrides: &types.TaskOverride{
+			ContainerOverrides: []types.ContainerOverride{
+				{Name: aws.String("app"), Environment: []types.KeyValuePair{{Name: aws.String("GIT_BRANCH"), Value: aws.String("develop")}}},
+			},
+		},
+		Tags: []types.Tag{
+			{Key: aws.String("Subdomain"), Value: aws.String("Zm9v")},
+			{Key: aws.String(mirageecs.TagManagedBy), Value: aws.String(mirageecs.TagValueMirage)},
+		},
+		Containers: []types.Container{
+			{Name: aws.String("app"), ExitCode: aws.Int32(137)},
+			{Name: aws.String("nginx"), ExitCode: aws.Int32(0)},
+			{Name: aws.String("sidecar")}, // not started
+		},
+	}
+	info := mirageecs.NewInformation(task, cfg)
+	if info.SubDomain != "foo" || info.ShortID != "0123456789abcdef" || info.GitBranch != "develop" || info.LastStatus != "STOPPED" {
+		t.Errorf("unexpected information %#v", info)
+	}
+	if info.StoppedReason != "Essential container in task exited" {
+		t.Errorf("unexpected stopped reason %s", info.StoppedReason)
+	}
+	if diff := cmp.Diff(map[string]int32{"app": 137, "nginx": 0}, info.ExitCodes); diff != "" {
+		t.Errorf("unexpected exit codes (-want +got):\n%s", diff)
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{`"stopped_reason":"Essential container in task exited"`, `"exit_codes":{"app":137,"nginx":0}`} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("%s should contain %s", b, s)
+		}
+	}
+}
+
+type mockGetMetricDataClient struct {
+	pages  [][]float64
+	inputs []*cw.GetMetricDataInput
+}
+
+func (m *mockGetMetricDataClient) GetMetricData(_ context.Context, in *cw.GetMetricDataInput, _ ...func(*cw.Options)) (*cw.GetMetricDataOutput, error) {
+	m.inputs = append(m.inputs, in)
+	page := len(m.inputs) - 1
+	if in.NextToken != nil && *in.NextToken != fmt.Sprintf("page-%d", page) {
+		return nil, fmt.Errorf("unexpected next token %s", *in.NextToken)
+	}
+	out := &cw.GetMetricDataOutput{
+		MetricDataResults: []cwTypes.MetricDataResult{
+			{Id: aws.String("request_count"), Values: m.pages[page]},
+		},
+	}
+	if page+1 < len(m.pages) {
+		out.NextToken = aws.String(fmt.Sprintf("page-%d", page+1))
+	}
+	return out, nil
+}
+
+func TestGetAccessCount(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+	tests := []struct {
+		name       string
+		duration   time.Duration
+		pages      [][]float64
+		wantSum    int64
+		wantPeriod int32
+	}{
+		{
+			name:       "paginated 24h",
+			duration:   24 * time.Hour,
+			pages:      [][]float64{{1, 2, 3}, {4, 5}, {6}},
+			wantSum:    21,
+			wantPeriod: 300,
+		},
+		{
+			name:       "short",
+			duration:   3*time.Minute + 10*time.Second,
+			pages:      [][]float64{{7}},
+			wantSum:    7,
+			wantPeriod: 180,
+		},
+		{
+			name:       "longer than 63 days",
+			duration:   90 * 24 * time.Hour,
+			pages:      [][]float64{{10}, {20}},
+			wantSum:    30,
+			wantPeriod: 3600,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &mockGetMetricDataClient{pages: tt.pages}
+			sum, err := mirageecs.GetAccessCount(ctx, m, "foo", tt.duration, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sum != tt.wantSum {
+				t.Errorf("unexpected sum %d, want %d", sum, tt.wantSum)
+			}
+			if len(m.inputs) != len(tt.pages) {
+				t.Errorf("GetMetricData must be called %d times: %d", len(tt.pages), len(m.inputs))
+			}
+			in := m.inputs[0]
+			if p := *in.MetricDataQueries[0].MetricStat.Period; p != tt.wantPeriod {
+				t.Errorf("unexpected period %d, want %d", p, tt.wantPeriod)
+			}
+			if d := in.EndTime.Sub(*in.StartTime); d != tt.duration.Truncate(time.Minute) {
+				t.Errorf("unexpected window %s", d)
+			}
+		})
+	}
+}
+
+type mockLogEventsPage struct {
+	messages []string
+	token    string
+	backward string
+	err      error
+}
+
+type mockGetLogEventsClient struct {
+	pages  []mockLogEventsPage
+	tokens []string
+	done   func()
+}
+
+func (m *mockGetLogEventsClient) GetLogEvents(_ context.Context, in *cwlogs.GetLogEventsInput, _ ...func(*cwlogs.Options)) (*cwlogs.GetLogEventsOutput, error) {
+	m.tokens = append(m.tokens, aws.ToString(in.NextToken))
+	if len(m.pages) == 0 {
+		m.done()
+		return &cwlogs.GetLogEventsOutput{NextForwardToken: in.NextToken}, nil
+	}
+	page := m.pages[0]
+	m.pages = m.pages[1:]
+	if page.err != nil {
+		return nil, page.err
+	}
+	out := &cwlogs.GetLogEventsOutput{NextForwardToken: aws.String(page.token)}
+	if page.backward != "" {
+		out.NextBackwardToken = aws.String(page.backward)
+	}
+	for _, msg := range page.messages {
+		out.Events = append(out.Events, cwlogsTypes.OutputLogEvent{Message: aws.String(msg)})
+	}
+	return out, nil
+}
+
+func TestFollowLogEvents(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	svc := &mockGetLogEventsClient{
+		pages: []mockLogEventsPage{
+			{err: &cwlogsTypes.ResourceNotFoundException{}}, // not created yet
+			{messages: []string{"a", "b"}, token: "f/1"},
+			{token: "f/1"}, // no new events
+			{messages: []string{"c"}, token: "f/2"},
+		},
+		done: cancel,
+	}
+	var logs [][]string
+	err := mirageecs.FollowLogEvents(ctx, svc, "group", "stream", time.Time{}, time.Millisecond, func(l []mirageecs.LogEvent) error {
+		logs = append(logs, logMessages(l))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the idle polls are notified with no events
+	if diff := cmp.Diff([][]string{{}, {"a", "b"}, {}, {"c"}}, logs); diff != "" {
+		t.Errorf("unexpected logs (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]string{"", "", "f/1", "f/1", "f/2"}, svc.tokens); diff != "" {
+		t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+	}
+
+	svc = &mockGetLogEventsClient{
+		pages: []mockLogEventsPage{{err: errors.New("access denied")}},
+		done:  func() {},
+	}
+	err = mirageecs.FollowLogEvents(context.Background(), svc, "group", "stream", time.Time{}, time.Millisecond, func([]mirageecs.LogEvent) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("error must be returned")
+	}
+}
+
+func TestGetLogEvents(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    []mockLogEventsPage
+		since    time.Time
+		tail     int
+		expected []string
+		tokens   []string
+		wantErr  bool
+	}{
+		{
+			name: "multiple pages",
+			pages: []mockLogEventsPage{
+				{messages: []string{"a", "b"}, token: "f/1"},
+				{messages: []string{"c"}, token: "f/2"},
+				{messages: []string{"d"}, token: "f/3"},
+			},
+			since:    time.Now(),
+			expected: []string{"a", "b", "c", "d"},
+			tokens:   []string{"", "f/1", "f/2", "f/3"},
+		},
+		{
+			name: "empty pages in the middle",
+			pages: []mockLogEventsPage{
+				{messages: []string{"a"}, token: "f/1"},
+				{token: "f/2"},
+				{messages: []string{"b"}, token: "f/3"},
+				{token: "f/3"},
+			},
+			since:    time.Now(),
+			expected: []string{"a", "b"},
+			tokens:   []string{"", "f/1", "f/2", "f/3"},
+		},
+		{
+			name: "token doesn't advance",
+			pages: []mockLogEventsPage{
+				{messages: []string{"a"}, token: "f/1"},
+				{messages: []string{"b"}, token: "f/1"},
+				{messages: []string{"c"}, token: "f/1"},
+			},
+			since:    time.Now(),
+			expected: []string{"a", "b"},
+			tokens:   []string{"", "f/1"},
+		},
+		{
+			name: "error on a page",
+			pages: []mockLogEventsPage{
+				{messages: []string{"a"}, token: "f/1"},
+				{err: errors.New("throttled")},
+			},
+			since:   time.Now(),
+			tokens:  []string{"", "f/1"},
+			wantErr: true,
+		},
+		{
+			name: "tail from the end",
+			pages: []mockLogEventsPage{
+				{messages: []string{"d", "e"}, backward: "b/1"},
+				{messages: []string{"b", "c"}, backward: "b/2"},
+				{messages: []string{"a"}, backward: "b/3"},
+			},
+			tail:     3,
+			expected: []string{"c", "d", "e"},
+			tokens:   []string{"", "b/1"},
+		},
+		{
+			name: "tail longer than the stream",
+			pages: []mockLogEventsPage{
+				{messages: []string{"b", "c"}, backward: "b/1"},
+				{messages: []string{"a"}, backward: "b/2"},
+				{backward: "b/2"},
+			},
+			tail:     10,
+			expected: []string{"a", "b", "c"},
+			tokens:   []string{"", "b/1", "b/2"},
+		},
+		{
+			name: "error on tail",
+			pages: []mockLogEventsPage{
+				{messages: []string{"b", "c"}, backward: "b/1"},
+				{err: errors.New("throttled")},
+			},
+			tail:    10,
+			tokens:  []string{"", "b/1"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockGetLogEventsClient{pages: tt.pages, done: func() {}}
+			logs, err := mirageecs.GetLogEvents(context.Background(), svc, "group", "stream", tt.since, tt.tail)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error %v", err)
+			}
+			if tt.wantErr && logs != nil {
+				t.Errorf("partial logs must not be returned with the error: %v", logMessages(logs))
+			}
+			if !tt.wantErr {
+				if diff := cmp.Diff(tt.expected, logMessages(logs)); diff != "" {
+					t.Errorf("unexpected logs (-want +got):\n%s", diff)
+				}
+			}
+			if diff := cmp.Diff(tt.tokens, svc.tokens); diff != "" {
+				t.Errorf("unexpected tokens (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+type streamLogEventsClient struct {
+	events map[string][]string // keyed by group/stream
+}
+
+func (m *streamLogEventsClient) GetLogEvents(_ context.Context, in *cwlogs.GetLogEventsInput, _ ...func(*cwlogs.Options)) (*cwlogs.GetLogEventsOutput, error) {
+	out := &cwlogs.GetLogEventsOutput{NextForwardToken: aws.String("f/end")}
+	if in.NextToken != nil {
+		return out, nil
+	}
+	key := aws.ToString(in.LogGroupName) + "/" + aws.ToString(in.LogStreamName)
+	for _, msg := range m.events[key] {
+		out.Events = append(out.Events, cwlogsTypes.OutputLogEvent{Message: aws.String(msg)})
+	}
+	return out, nil
+}
+
+// newTaskDefinitionRunner returns the ECS TaskRunner which describes the task definition of the containers.
+func newTaskDefinitionRunner(t *testing.T, containers string) mirageecs.TaskRunner {
+	ecsServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		io.WriteString(w, `{"taskDefinition":{
+			"taskDefinitionArn":"arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3",
+			"family":"app",
+			"containerDefinitions":`+containers+`
+		}}`)
+	}))
+	t.Cleanup(ecsServer.Close)
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	return mirageecs.NewECSTaskRunnerWithClient(cfg, svc)
+}
+
+func TestLogsOfContainer(t *testing.T) {
+	runner := newTaskDefinitionRunner(t, `[
+		{"name":"app","logConfiguration":{"logDriver":"awslogs","options":{"awslogs-group":"/ecs/app","awslogs-stream-prefix":"ecs"}}},
+		{"name":"nginx","logConfiguration":{"logDriver":"awslogs","options":{"awslogs-group":"/ecs/app","awslogs-stream-prefix":"ecs"}}}
+	]`)
+	logsSvc := &streamLogEventsClient{
+		events: map[string][]string{
+			"/ecs/app/ecs/app/0123abcd":   {"app log 1", "app log 2"},
+			"/ecs/app/ecs/nginx/0123abcd": {"nginx log"},
+		},
+	}
+	const arn = "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3"
+
+	for container, expected := range map[string][]string{
+		"app":   {"app log 1", "app log 2"},
+		"nginx": {"nginx log"},
+	} {
+		logs, err := mirageecs.LogsOfTask(context.Background(), runner, logsSvc, arn, "0123abcd", container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, logMessages(logs)); diff != "" {
+			t.Errorf("container %s: unexpected logs (-want +got):\n%s", container, diff)
+		}
+		for _, ev := range logs {
+			if ev.Container != container {
+				t.Errorf("unexpected container of the event %#v", ev)
+			}
+		}
+	}
+
+	if _, err := mirageecs.LogsOfTask(context.Background(), runner, logsSvc, arn, "0123abcd", "sidecar"); !errors.Is(err, mirageecs.ErrContainerNotFound) {
+		t.Errorf("unexpected error for undefined container: %v", err)
+	}
+	if _, err := mirageecs.LogsOfTask(context.Background(), runner, logsSvc, arn, "0123abcd", ""); !errors.Is(err, mirageecs.ErrAmbiguousContainer) {
+		t.Errorf("unexpected error without container: %v", err)
+	}
+}
+
+func logMessages(events []mirageecs.LogEvent) []string {
+	messages := make([]string, 0, len(events))
+	for _, ev := range events {
+		messages = append(messages, ev.Message)
+	}
+	return messages
+}
+
+func TestMergeLogEvents(t *testing.T) {
+	at := func(sec int) time.Time {
+		return time.Date(2024, 1, 1, 0, 0, sec, 0, time.UTC)
+	}
+	app := []mirageecs.LogEvent{
+		{Timestamp: at(1), Container: "app", Message: "app 1"},
+		{Timestamp: at(3), Container: "app", Message: "app 3"},
+		{Timestamp: at(5), Container: "app", Message: "app 5"},
+	}
+	nginx := []mirageecs.LogEvent{
+		{Timestamp: at(2), Container: "nginx", Message: "nginx 2"},
+		{Timestamp: at(3), Container: "nginx", Message: "nginx 3"},
+		{Timestamp: at(4), Container: "nginx", Message: "nginx 4"},
+	}
+	tests := []struct {
+		tail     int
+		expected []string
+	}{
+		{tail: 0, expected: []string{"app 1", "nginx 2", "app 3", "nginx 3", "nginx 4", "app 5"}},
+		{tail: 3, expected: []string{"nginx 3", "nginx 4", "app 5"}},
+		{tail: 10, expected: []string{"app 1", "nginx 2", "app 3", "nginx 3", "nginx 4", "app 5"}},
+	}
+	for _, tt := range tests {
+		merged := mirageecs.MergeLogEvents(tt.tail, app, nginx)
+		if diff := cmp.Diff(tt.expected, logMessages(merged)); diff != "" {
+			t.Errorf("tail=%d unexpected events (-want +got):\n%s", tt.tail, diff)
+		}
+	}
+}
+
+func TestLogsOfFirelensContainer(t *testing.T) {
+	runner := newTaskDefinitionRunner(t, `[
+		{"name":"app","logConfiguration":{"logDriver":"awsfirelens","options":{"Name":"cloudwatch_logs","region":"ap-northeast-1","log_group_name":"/ecs/firelens","log_stream_prefix":"app/"}}},
+		{"name":"worker","logConfiguration":{"logDriver":"awsfirelens","options":{"Name":"cloudwatch","log_group_name":"/ecs/firelens","log_stream_name":"worker/$(ecs_task_id)"}}},
+		{"name":"datadog","logConfiguration":{"logDriver":"awsfirelens","options":{"Name":"datadog","apikey":"xxx"}}},
+		{"name":"log_router","firelensConfiguration":{"type":"fluentbit"}}
+	]`)
+	logsSvc := &streamLogEventsClient{
+		events: map[string][]string{
+			"/ecs/firelens/app/app-firelens-0123abcd": {"app log"},
+			"/ecs/firelens/worker/0123abcd":           {"worker log"},
+		},
+	}
+	const arn = "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3"
+	for container, expected := range map[string][]string{
+		"app":     {"app log"},
+		"worker":  {"worker log"},
+		"datadog": {}, // not sent to CloudWatch Logs
+	} {
+		logs, err := mirageecs.LogsOfTask(context.Background(), runner, logsSvc, arn, "0123abcd", container)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(expected, logMessages(logs)); diff != "" {
+			t.Errorf("container %s: unexpected logs (-want +got):\n%s", container, diff)
+		}
+	}
 }
@@ -0,0 +1,49 @@
+package mirageecs
+
+// EventListener observes the lifecycle events of subdomains.
+// It is for the programs embedding mirage-ecs as a library.
+// The methods are called synchronously after the operation succeeded, so they should not block.
+type EventListener interface {
+	OnLaunch(*LaunchEvent)
+	OnTerminate(*TerminateEvent)
+	OnPurge(*PurgeEvent)
+}
+
+// LaunchEvent is an event of launching the subdomain.
+type LaunchEvent struct {
+	Subdomain  string
+	Taskdefs   []string
+	Parameters TaskParameter
+	Actor      string
+}
+
+// TerminateEvent is an event of terminating the subdomain or the task.
+type TerminateEvent struct {
+	Subdomain string // empty when the subdomain of the task is unknown
+	TaskID    string // empty when terminated by the subdomain
+	Actor     string
+}
+
+// PurgeEvent is an event of purging the subdomain.
+type PurgeEvent struct {
+	Subdomain string
+	Expired   bool // exceeded the max lifetime
+}
+
+type nopEventListener struct{}
+
+func (nopEventListener) OnLaunch(*LaunchEvent)       {}
+func (nopEventListener) OnTerminate(*TerminateEvent) {}
+func (nopEventListener) OnPurge(*PurgeEvent)         {}
+
+// SetEventListener sets the listener of lifecycle events. nil resets it to no-op.
+func (c *Config) SetEventListener(l EventListener) {
+	c.eventListener = l
+}
+
+func (c *Config) events() EventListener {
+	if c.eventListener == nil {
+		return nopEventListener{}
+	}
+	return c.eventListener
+}
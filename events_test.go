@@ -0,0 +1,86 @@
+package mirageecs_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+type recordingEventListener struct {
+	mu         sync.Mutex
+	launches   []*mirageecs.LaunchEvent
+	terminates []*mirageecs.TerminateEvent
+	purges     []*mirageecs.PurgeEvent
+}
+
+func (l *recordingEventListener) OnLaunch(ev *mirageecs.LaunchEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.launches = append(l.launches, ev)
+}
+
+func (l *recordingEventListener) OnTerminate(ev *mirageecs.TerminateEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.terminates = append(l.terminates, ev)
+}
+
+func (l *recordingEventListener) OnPurge(ev *mirageecs.PurgeEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.purges = append(l.purges, ev)
+}
+
+func TestEventListener(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &recordingEventListener{}
+	cfg.SetEventListener(l)
+	m := mirageecs.New(ctx, cfg)
+	ts := httptest.NewServer(m.WebApi)
+	defer ts.Close()
+
+	for _, subdomain := range []string{"foo", "bar"} {
+		res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json",
+			strings.NewReader(`{"subdomain":"`+subdomain+`","taskdef":["dummy"],"branch":"develop"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	res, err := ts.Client().Post(ts.URL+"/api/terminate", "application/json", strings.NewReader(`{"subdomain":"foo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	m.WebApi.PurgeSubdomains(ctx, []string{"bar"}, map[string]struct{}{"bar": {}}, time.Minute)
+
+	expectedLaunches := []*mirageecs.LaunchEvent{
+		{Subdomain: "foo", Taskdefs: []string{"dummy"}, Parameters: mirageecs.TaskParameter{"branch": "develop"}, Actor: "127.0.0.1"},
+		{Subdomain: "bar", Taskdefs: []string{"dummy"}, Parameters: mirageecs.TaskParameter{"branch": "develop"}, Actor: "127.0.0.1"},
+	}
+	if diff := cmp.Diff(expectedLaunches, l.launches); diff != "" {
+		t.Errorf("unexpected launch events (-want +got):\n%s", diff)
+	}
+	expectedTerminates := []*mirageecs.TerminateEvent{{Subdomain: "foo", Actor: "127.0.0.1"}}
+	if diff := cmp.Diff(expectedTerminates, l.terminates); diff != "" {
+		t.Errorf("unexpected terminate events (-want +got):\n%s", diff)
+	}
+	expectedPurges := []*mirageecs.PurgeEvent{{Subdomain: "bar", Expired: true}}
+	if diff := cmp.Diff(expectedPurges, l.purges); diff != "" {
+		t.Errorf("unexpected purge events (-want +got):\n%s", diff)
+	}
+}
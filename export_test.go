@@ -1,6 +1,182 @@
 package mirageecs
 
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/aws/smithy-go/middleware"
+)
+
 var (
-	ValidateSubdomain = validateSubdomain
-	NewHTTPTransport  = newHTTPTransport
+	ValidateSubdomain         = validateSubdomain
+	NewHTTPTransport          = newHTTPTransport
+	NewDialLimiter            = newDialLimiter
+	WithDialLimiter           = withDialLimiter
+	SubdomainFromHost         = subdomainFromHost
+	CheckStartDeadline        = checkStartDeadline
+	AggregateBySubdomain      = aggregateBySubdomain
+	LogStreamName             = logStreamName
+	PrometheusSDTargetGroups  = prometheusSDTargetGroups
+	TagLabels                 = tagLabels
+	ContainerPortMap          = containerPortMap
+	ContainerPortMappings     = containerPortMappings
+	RetryOnThrottle           = retryOnThrottle
+	RunTaskWithRetry          = runTaskWithRetry
+	RunTaskWithPreference     = runTaskWithPreference
+	StopTaskAfterDrain        = stopTaskAfterDrain
+	GetAccessCount            = getAccessCount
+	FollowLogEvents           = followLogEvents
+	GetLogEvents              = getLogEvents
+	MergeLogEvents            = mergeLogEvents
+	ParseDockerLogLine        = parseDockerLogLine
+	SplitDockerLogs           = splitDockerLogs
+	SelectContainer           = selectContainer
+	ExpiresAt                 = expiresAt
+	ParseTaskOverrideTemplate = parseTaskOverrideTemplate
+	RenderTaskOverride        = renderTaskOverride
+	ValidateTaskOverride      = validateTaskOverride
+	MergeTaskOverride         = mergeTaskOverride
+	ValidateTaskSize          = validateTaskSize
+	ValidateFargateTaskSize   = validateFargateTaskSize
+	ApplyTaskSize             = applyTaskSize
+	NewTaskDefinitionCache    = newTaskDefinitionCache
+	NewAWSAPICallCounter      = newAWSAPICallCounter
+	ParseTrace                = parseTrace
+	DrainContext              = drainContext
+	NewInflightRequests       = newInflightRequests
+	LaunchWithRetry           = launchWithRetry
+	AggregateLatencies        = aggregateLatencies
+	GetEnvironmentsFromTask   = getEnvironmentsFromTask
+	GetIPAddressFromTask      = getIPAddressFromTask
+	NewInformation            = newInformation
+	SecretTaskDefinitionInput = secretTaskDefinitionInput
 )
+
+func NewRunTaskFailure(reason string) error {
+	return &runTaskFailure{reason: reason}
+}
+
+type AccessCount = accessCount
+type LatencyStats = latencyStats
+type ProxyControl = proxyControl
+
+func (c *awsAPICallCounter) Register(stack *middleware.Stack) error {
+	return c.register(stack)
+}
+
+func (c *taskDefinitionCache) Get(ctx context.Context, name string, describe func(context.Context, string) (*types.TaskDefinition, error)) (*types.TaskDefinition, error) {
+	return c.get(ctx, name, describe)
+}
+
+func (api *WebApi) ScheduledPurge(ctx context.Context, p *PurgeParams) error {
+	return api.scheduledPurge(ctx, p)
+}
+
+func (api *WebApi) PurgeSubdomains(ctx context.Context, subdomains []string, expired map[string]struct{}, duration time.Duration) {
+	api.purgeSubdomains(ctx, subdomains, expired, duration)
+}
+
+// RunScheduledPurge runs the scheduled purger by the fake clock.
+func RunScheduledPurge(ctx context.Context, p *Purge, now func() time.Time, after func(time.Duration) <-chan time.Time, purge func(context.Context, *PurgeParams) error) {
+	runScheduledPurge(ctx, p, purgeClock{now: now, after: after}, purge)
+}
+
+func (m *Mirage) Runner() TaskRunner {
+	return m.runner
+}
+
+func (m *Mirage) ScaleToZero(ctx context.Context) error {
+	return m.scaleToZero(ctx, m.Config.ScaleToZero)
+}
+
+func (m *Mirage) RestoreSleeping(ctx context.Context) error {
+	return m.restoreSleeping(ctx)
+}
+
+func (m *Mirage) HistoryStore() HistoryStore {
+	return m.WebApi.history
+}
+
+func (m *Mirage) SetHistoryStore(h HistoryStore) {
+	m.WebApi.history = h
+}
+
+// SleepingState returns whether the subdomain is sleeping and woken.
+func (m *Mirage) SleepingState(subdomain string) (sleeping bool, woken bool) {
+	ss, ok := m.sleeping.get(subdomain)
+	if !ok {
+		return false, false
+	}
+	m.sleeping.mu.Lock()
+	defer m.sleeping.mu.Unlock()
+	return true, !ss.WokenAt.IsZero()
+}
+
+func (r *inflightRequests) Track(req *http.Request) func() {
+	return r.track(req)
+}
+
+func (r *inflightRequests) List(now time.Time) []string {
+	return r.list(now)
+}
+
+func (n *Notification) Post(ctx context.Context, ev *NotificationEvent, retryInterval time.Duration) error {
+	return n.post(ctx, ev, retryInterval)
+}
+
+func (m *Mirage) MarkLaunching(subdomain string) {
+	m.launching.add(subdomain)
+}
+
+func (m *Mirage) ServeMetrics(w http.ResponseWriter, req *http.Request) {
+	m.serveMetrics(w, req)
+}
+
+// NewECSTaskRunnerWithClient returns ECS TaskRunner calling ECS API by the client.
+func NewECSTaskRunnerWithClient(cfg *Config, svc *ecs.Client) TaskRunner {
+	return &ECS{
+		cfg:          cfg,
+		svc:          svc,
+		taskdefCache: newTaskDefinitionCache(cfg.ECS.TaskDefCacheTTL),
+	}
+}
+
+func SetDescribeTaskDefinitionBackoff(d time.Duration) {
+	describeTaskDefinitionBackoff = d
+}
+
+func RegisterSecretTaskDefinition(ctx context.Context, runner TaskRunner, td *types.TaskDefinition, secrets []types.Secret) (string, error) {
+	return runner.(*ECS).registerSecretTaskDefinition(ctx, td, secrets)
+}
+
+func RunTaskInput(ctx context.Context, runner TaskRunner, subdomain, taskdef string, option TaskParameter) (*ecs.RunTaskInput, error) {
+	in, _, err := runner.(*ECS).runTaskInput(ctx, subdomain, taskdef, option)
+	return in, err
+}
+
+// LogsOfTask returns the logs of the task of the task definition by the CloudWatch Logs client.
+func LogsOfTask(ctx context.Context, runner TaskRunner, svc logEventsGetter, taskdefArn, shortID, container string) ([]LogEvent, error) {
+	e := runner.(*ECS)
+	e.logsSvc = svc
+	info := &Information{
+		ShortID: shortID,
+		task:    &types.Task{TaskDefinitionArn: aws.String(taskdefArn)},
+	}
+	return e.logs(ctx, info, container, time.Time{}, 0)
+}
+
+func (d *LocalDocker) Ping(ctx context.Context) error {
+	return d.client.ping(ctx)
+}
+
+func (d *LocalDocker) RemoveContainer(ctx context.Context, id string) error {
+	return d.client.removeContainer(ctx, id)
+}
+
+func (r *ReverseProxy) SetPutAccessCounts(put func(context.Context, map[string]accessCount) error) {
+	r.putAccessCounts = put
+}
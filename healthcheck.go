@@ -0,0 +1,140 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultHealthCheckPath     = "/"
+	DefaultHealthCheckInterval = 30 * time.Second
+	DefaultHealthCheckTimeout  = 5 * time.Second
+
+	DefaultStartupCheckInterval = 2 * time.Second
+	startingRetryAfter          = 5
+)
+
+// HealthCheck configures active health checks to upstreams of the reverse proxy.
+type HealthCheck struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+func (h *HealthCheck) Validate() error {
+	if h.Path == "" {
+		h.Path = DefaultHealthCheckPath
+	}
+	if !strings.HasPrefix(h.Path, "/") {
+		return fmt.Errorf("path must start with /: %s", h.Path)
+	}
+	if h.Interval == 0 {
+		h.Interval = DefaultHealthCheckInterval
+	}
+	if h.Timeout == 0 {
+		h.Timeout = DefaultHealthCheckTimeout
+	}
+	if h.Interval < 0 || h.Timeout < 0 {
+		return fmt.Errorf("interval and timeout must be positive")
+	}
+	return nil
+}
+
+// StartupCheck configures health checks to a new upstream before routing requests to it.
+type StartupCheck struct {
+	HealthCheck `yaml:",inline"`
+}
+
+func (s *StartupCheck) Validate() error {
+	if s.Interval == 0 {
+		s.Interval = DefaultStartupCheckInterval
+	}
+	return s.HealthCheck.Validate()
+}
+
+// Probe returns true when the upstream responds with a status code less than 500.
+func (h *HealthCheck) Probe(ctx context.Context, addr string) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+h.Path, nil)
+	if err != nil {
+		slog.Warn(f("invalid health check request to %s: %s", addr, err))
+		return false
+	}
+	req.Header.Set("User-Agent", "mirage-ecs-healthcheck/"+Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.Debug(f("health check to %s failed: %s", addr, err))
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < http.StatusInternalServerError
+}
+
+func (m *Mirage) RunHealthChecker(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	h := m.Config.Network.HealthCheck
+	if h == nil {
+		slog.Debug("HealthCheck is not configured")
+		return
+	}
+	tk := time.NewTicker(h.Interval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-ctx.Done():
+			slog.Info("RunHealthChecker() is done")
+			return
+		}
+		m.checkHealth(ctx, h)
+	}
+}
+
+func (m *Mirage) checkHealth(ctx context.Context, h *HealthCheck) {
+	rp := m.ReverseProxy
+	var wg sync.WaitGroup
+	for subdomain, addrs := range rp.Upstreams() {
+		wg.Add(1)
+		go func(subdomain string, addrs []string) {
+			defer wg.Done()
+			// healthy when any of upstreams is healthy
+			healthy := false
+			for _, addr := range addrs {
+				if h.Probe(ctx, addr) {
+					healthy = true
+					break
+				}
+			}
+			slog.Debug(f("health check of %s: %t", subdomain, healthy))
+			rp.SetHealth(subdomain, healthy)
+		}(subdomain, addrs)
+	}
+	wg.Wait()
+}
+
+// waitReady probes the new upstream until it passes, and marks the handlers to it ready.
+// It gives up when the handlers are removed or replaced.
+func (r *ReverseProxy) waitReady(s *StartupCheck, subdomain, addr string, handlers map[int]*proxyHandler) {
+	tk := time.NewTicker(s.Interval)
+	defer tk.Stop()
+	for {
+		if s.Probe(context.Background(), addr) {
+			slog.Info(f("startup check of %s passed: %s", subdomain, addr))
+			for _, h := range handlers {
+				h.setReady()
+			}
+			return
+		}
+		<-tk.C
+		if !r.registered(subdomain, addr, handlers) {
+			slog.Info(f("startup check of %s is canceled: %s is removed", subdomain, addr))
+			return
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package mirageecs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestHealthCheckProbe(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			w.WriteHeader(http.StatusOK)
+		case "/notfound":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	for path, expected := range map[string]bool{
+		"/ok":       true,
+		"/notfound": true,
+		"/error":    false,
+	} {
+		h := &mirageecs.HealthCheck{Path: path, Timeout: time.Second}
+		if err := h.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if got := h.Probe(context.Background(), addr); got != expected {
+			t.Errorf("probe %s: expected %t, got %t", path, expected, got)
+		}
+	}
+
+	h := &mirageecs.HealthCheck{}
+	if err := h.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if h.Probe(context.Background(), "127.0.0.1:1") {
+		t.Error("probe to closed port must be unhealthy")
+	}
+}
+
+func TestReverseProxyHealth(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "192.168.1.1", 80)
+
+	if h := rp.Health("aaa"); h != nil {
+		t.Errorf("health must be nil before checked, got %v", *h)
+	}
+	rp.SetHealth("aaa", true)
+	if h := rp.Health("aaa"); h == nil || !*h {
+		t.Errorf("health must be true, got %v", h)
+	}
+	rp.SetHealth("bbb", false) // not exists
+	if h := rp.Health("bbb"); h != nil {
+		t.Errorf("health of unknown subdomain must be nil, got %v", *h)
+	}
+	rp.RemoveSubdomain("aaa")
+	if h := rp.Health("aaa"); h != nil {
+		t.Errorf("health must be nil after removed, got %v", *h)
+	}
+}
@@ -0,0 +1,248 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	HistoryActionLaunch    = "launch"
+	HistoryActionTerminate = "terminate"
+	HistoryActionPurge     = "purge"
+	HistoryActionSleep     = "sleep"
+
+	HistoryOutcomeOK = "ok"
+
+	DefaultHistoryLimit = 100
+)
+
+// History configures the persistent store of launch history.
+type History struct {
+	DynamoDB *HistoryDynamoDB `yaml:"dynamodb"`
+}
+
+type HistoryDynamoDB struct {
+	TableName string `yaml:"table_name"`
+}
+
+func (h *History) Validate() error {
+	if h.DynamoDB == nil {
+		return fmt.Errorf("dynamodb is required")
+	}
+	if h.DynamoDB.TableName == "" {
+		return fmt.Errorf("dynamodb.table_name is required")
+	}
+	return nil
+}
+
+// HistoryRecord is a record of launch, terminate, purge and sleep.
+type HistoryRecord struct {
+	Subdomain string   `json:"subdomain"`
+	Action    string   `json:"action"`
+	Branch    string   `json:"branch,omitempty"`
+	Taskdefs  []string `json:"taskdefs,omitempty"`
+	// Parameters are the parameters to relaunch the subdomain scaled to zero. They are recorded only by sleep.
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Actor      string            `json:"actor"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Outcome    string            `json:"outcome"`
+}
+
+// HistoryQuery is a query for HistoryStore.
+type HistoryQuery struct {
+	Subdomain string
+	Limit     int
+}
+
+// HistoryStore stores HistoryRecords persistently.
+type HistoryStore interface {
+	Put(ctx context.Context, r *HistoryRecord) error
+	Query(ctx context.Context, q HistoryQuery) ([]*HistoryRecord, error)
+}
+
+func (c *Config) NewHistoryStore() HistoryStore {
+	if c.History != nil && c.History.DynamoDB != nil {
+		return NewDynamoDBHistoryStore(c.awscfg, c.History.DynamoDB.TableName)
+	}
+	if c.localMode {
+		return NewMemoryHistoryStore()
+	}
+	return nil
+}
+
+func sortAndLimitHistory(records []*HistoryRecord, limit int) []*HistoryRecord {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp.After(records[j].Timestamp)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+	return records
+}
+
+// MemoryHistoryStore is an in-memory HistoryStore for local mode.
+type MemoryHistoryStore struct {
+	mu      sync.Mutex
+	records []*HistoryRecord
+}
+
+func NewMemoryHistoryStore() *MemoryHistoryStore {
+	return &MemoryHistoryStore{}
+}
+
+func (s *MemoryHistoryStore) Put(_ context.Context, r *HistoryRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, r)
+	return nil
+}
+
+func (s *MemoryHistoryStore) Query(_ context.Context, q HistoryQuery) ([]*HistoryRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := []*HistoryRecord{}
+	for _, r := range s.records {
+		if q.Subdomain != "" && r.Subdomain != q.Subdomain {
+			continue
+		}
+		records = append(records, r)
+	}
+	return sortAndLimitHistory(records, q.Limit), nil
+}
+
+// DynamoDBHistoryStore is a HistoryStore backed by a DynamoDB table.
+// The table must have a partition key "subdomain" (S) and a sort key "timestamp" (S).
+type DynamoDBHistoryStore struct {
+	svc       *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBHistoryStore(awscfg *aws.Config, tableName string) *DynamoDBHistoryStore {
+	return &DynamoDBHistoryStore{
+		svc:       dynamodb.NewFromConfig(*awscfg),
+		tableName: tableName,
+	}
+}
+
+func (s *DynamoDBHistoryStore) Put(ctx context.Context, r *HistoryRecord) error {
+	item := map[string]ddbTypes.AttributeValue{
+		"subdomain": &ddbTypes.AttributeValueMemberS{Value: r.Subdomain},
+		"timestamp": &ddbTypes.AttributeValueMemberS{Value: r.Timestamp.UTC().Format(time.RFC3339Nano)},
+		"action":    &ddbTypes.AttributeValueMemberS{Value: r.Action},
+		"actor":     &ddbTypes.AttributeValueMemberS{Value: r.Actor},
+		"outcome":   &ddbTypes.AttributeValueMemberS{Value: r.Outcome},
+	}
+	if r.Branch != "" {
+		item["branch"] = &ddbTypes.AttributeValueMemberS{Value: r.Branch}
+	}
+	if len(r.Taskdefs) > 0 {
+		item["taskdefs"] = &ddbTypes.AttributeValueMemberSS{Value: r.Taskdefs}
+	}
+	if len(r.Parameters) > 0 {
+		params := make(map[string]ddbTypes.AttributeValue, len(r.Parameters))
+		for k, v := range r.Parameters {
+			params[k] = &ddbTypes.AttributeValueMemberS{Value: v}
+		}
+		item["parameters"] = &ddbTypes.AttributeValueMemberM{Value: params}
+	}
+	_, err := s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item:      item,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put history to %s: %w", s.tableName, err)
+	}
+	return nil
+}
+
+func (s *DynamoDBHistoryStore) Query(ctx context.Context, q HistoryQuery) ([]*HistoryRecord, error) {
+	var items []map[string]ddbTypes.AttributeValue
+	if q.Subdomain != "" {
+		in := &dynamodb.QueryInput{
+			TableName:              aws.String(s.tableName),
+			KeyConditionExpression: aws.String("subdomain = :subdomain"),
+			ExpressionAttributeValues: map[string]ddbTypes.AttributeValue{
+				":subdomain": &ddbTypes.AttributeValueMemberS{Value: q.Subdomain},
+			},
+			ScanIndexForward: aws.Bool(false), // newest first
+		}
+		if q.Limit > 0 {
+			in.Limit = aws.Int32(int32(q.Limit))
+		}
+		out, err := s.svc.Query(ctx, in)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query history from %s: %w", s.tableName, err)
+		}
+		items = out.Items
+	} else {
+		// without subdomain, scan all of the table and sort by timestamp
+		p := dynamodb.NewScanPaginator(s.svc, &dynamodb.ScanInput{
+			TableName: aws.String(s.tableName),
+		})
+		for p.HasMorePages() {
+			out, err := p.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scan history from %s: %w", s.tableName, err)
+			}
+			items = append(items, out.Items...)
+		}
+	}
+	records := make([]*HistoryRecord, 0, len(items))
+	for _, item := range items {
+		records = append(records, historyRecordFromItem(item))
+	}
+	return sortAndLimitHistory(records, q.Limit), nil
+}
+
+func historyRecordFromItem(item map[string]ddbTypes.AttributeValue) *HistoryRecord {
+	str := func(name string) string {
+		if v, ok := item[name].(*ddbTypes.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	r := &HistoryRecord{
+		Subdomain: str("subdomain"),
+		Action:    str("action"),
+		Branch:    str("branch"),
+		Actor:     str("actor"),
+		Outcome:   str("outcome"),
+	}
+	if v, ok := item["taskdefs"].(*ddbTypes.AttributeValueMemberSS); ok {
+		r.Taskdefs = v.Value
+	}
+	if v, ok := item["parameters"].(*ddbTypes.AttributeValueMemberM); ok {
+		r.Parameters = make(map[string]string, len(v.Value))
+		for k, av := range v.Value {
+			if s, ok := av.(*ddbTypes.AttributeValueMemberS); ok {
+				r.Parameters[k] = s.Value
+			}
+		}
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, str("timestamp")); err != nil {
+		slog.Warn(f("invalid timestamp in history %s: %s", str("timestamp"), err))
+	} else {
+		r.Timestamp = ts.In(time.Local)
+	}
+	return r
+}
+
+func parseHistoryLimit(s string) (int, error) {
+	if s == "" {
+		return DefaultHistoryLimit, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid limit: %s", s)
+	}
+	return n, nil
+}
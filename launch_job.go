@@ -0,0 +1,88 @@
+package mirageecs
+
+import (
+	"sync"
+	"time"
+
+	ttlcache "github.com/ReneKroon/ttlcache/v2"
+)
+
+const (
+	LaunchStatusPending = "pending"
+
+	// LaunchJobTTL is how long the finished job is kept for polling its status.
+	LaunchJobTTL = time.Hour
+)
+
+// LaunchJob is the state of the launch requested asynchronously.
+type LaunchJob struct {
+	ID        string    `json:"job_id"`
+	Subdomain string    `json:"subdomain"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type launchJobs struct {
+	mu    sync.Mutex
+	cache *ttlcache.Cache
+}
+
+func newLaunchJobs(ttl time.Duration) *launchJobs {
+	cache := ttlcache.NewCache()
+	cache.SetTTL(ttl)
+	cache.SkipTTLExtensionOnHit(true)
+	return &launchJobs{cache: cache}
+}
+
+func (j *launchJobs) create(subdomain string) *LaunchJob {
+	now := time.Now()
+	job := &LaunchJob{
+		ID:        generateRandomHexID(32),
+		Subdomain: subdomain,
+		Status:    LaunchStatusPending,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cache.Set(job.ID, job)
+	return job
+}
+
+func (j *launchJobs) update(id string, status string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v, e := j.cache.Get(id)
+	if e != nil {
+		return
+	}
+	job := v.(*LaunchJob)
+	job.Status = status
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.UpdatedAt = time.Now()
+	// keep the finished job for the TTL from now
+	j.cache.Set(id, job)
+}
+
+// finish sets the job succeeded, or failed with the error.
+func (j *launchJobs) finish(id string, err error) {
+	if err != nil {
+		j.update(id, LaunchStatusFailed, err)
+	} else {
+		j.update(id, LaunchStatusSucceeded, nil)
+	}
+}
+
+func (j *launchJobs) get(id string) (LaunchJob, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	v, err := j.cache.Get(id)
+	if err != nil {
+		return LaunchJob{}, false
+	}
+	return *v.(*LaunchJob), true
+}
@@ -0,0 +1,96 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+type launchJobTestRunner struct {
+	*mirageecs.LocalTaskRunner
+}
+
+func (r *launchJobTestRunner) Launch(_ context.Context, subdomain string, _ mirageecs.TaskParameter, _ ...string) error {
+	if subdomain == "broken" {
+		return errors.New("unable to place a task")
+	}
+	return nil
+}
+
+func TestApiLaunchAsync(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &launchJobTestRunner{&mirageecs.LocalTaskRunner{}}))
+	defer ts.Close()
+
+	tests := []struct {
+		subdomain  string
+		wantStatus string
+		wantError  string
+	}{
+		{subdomain: "happy", wantStatus: mirageecs.LaunchStatusSucceeded},
+		{subdomain: "broken", wantStatus: mirageecs.LaunchStatusFailed, wantError: "unable to place a task"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subdomain, func(t *testing.T) {
+			res, err := ts.Client().Post(ts.URL+"/api/launch?async=true", "application/json",
+				strings.NewReader(`{"subdomain":"`+tt.subdomain+`","branch":"develop","taskdef":["app:1"]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusAccepted {
+				t.Fatalf("unexpected status %d", res.StatusCode)
+			}
+			var lr mirageecs.APILaunchResponse
+			if err := json.NewDecoder(res.Body).Decode(&lr); err != nil {
+				t.Fatal(err)
+			}
+			if lr.JobID == "" {
+				t.Fatal("job_id is empty")
+			}
+
+			var job mirageecs.LaunchJob
+			deadline := time.Now().Add(5 * time.Second)
+			for time.Now().Before(deadline) {
+				res, err := ts.Client().Get(ts.URL + "/api/launch/status?job_id=" + lr.JobID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = json.NewDecoder(res.Body).Decode(&job)
+				res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if job.Status != mirageecs.LaunchStatusPending && job.Status != mirageecs.LaunchStatusRunning {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			if job.Status != tt.wantStatus || job.Error != tt.wantError || job.Subdomain != tt.subdomain {
+				t.Errorf("unexpected job %#v", job)
+			}
+		})
+	}
+
+	res, err := ts.Client().Get(ts.URL + "/api/launch/status?job_id=unknown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status %d for unknown job", res.StatusCode)
+	}
+}
@@ -0,0 +1,290 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+// fakeECSServer responds to DescribeTaskDefinition and records the called ECS actions.
+type fakeECSServer struct {
+	mu      sync.Mutex
+	actions []string
+}
+
+func (s *fakeECSServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	io.Copy(io.Discard, r.Body)
+	action := r.Header.Get("X-Amz-Target")
+	action = action[strings.LastIndex(action, ".")+1:]
+	s.mu.Lock()
+	s.actions = append(s.actions, action)
+	s.mu.Unlock()
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	switch action {
+	case "DescribeTaskDefinition":
+		io.WriteString(w, `{"taskDefinition":{
+			"taskDefinitionArn":"arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3",
+			"family":"app",
+			"executionRoleArn":"arn:aws:iam::123456789012:role/ecsTaskExecutionRole",
+			"containerDefinitions":[{"name":"app"},{"name":"nginx"}]
+		}}`)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, `{"__type":"ClientException","message":"unexpected action"}`)
+	}
+}
+
+func (s *fakeECSServer) called(action string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, a := range s.actions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+func TestApiLaunchDryRun(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Parameter = append(cfg.Parameter, &mirageecs.Parameter{
+		Name:   "token",
+		Env:    "API_TOKEN",
+		Secret: true,
+		AllowedSecrets: []string{
+			"arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/",
+			"arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:mirage-",
+		},
+	})
+
+	fake := &fakeECSServer{}
+	ecsServer := httptest.NewServer(fake)
+	defer ecsServer.Close()
+	svc := ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, mirageecs.NewECSTaskRunnerWithClient(cfg, svc)))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/launch?dry_run=true", "application/json",
+		strings.NewReader(`{"subdomain":"foo","branch":"develop","taskdef":["app"],"parameters":{"token":"arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/token"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		t.Fatalf("unexpected status %d %s", res.StatusCode, b)
+	}
+	var r mirageecs.APILaunchResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.DryRun || len(r.Plans) != 1 {
+		t.Fatalf("unexpected response %#v", r)
+	}
+	plan := r.Plans[0]
+	if plan.Taskdef != "app" || plan.TaskDefinitionArn != "arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:3" {
+		t.Errorf("unexpected plan %#v", plan)
+	}
+	if n := len(plan.Overrides.ContainerOverrides); n != 2 {
+		t.Fatalf("unexpected container overrides %d", n)
+	}
+	env := make(map[string]string)
+	for _, kv := range plan.Overrides.ContainerOverrides[0].Environment {
+		env[aws.ToString(kv.Name)] = aws.ToString(kv.Value)
+	}
+	if _, ok := env["API_TOKEN"]; ok || env["GIT_BRANCH"] != "develop" {
+		t.Errorf("unexpected environments %v", env)
+	}
+	if len(plan.Secrets) != 1 || aws.ToString(plan.Secrets[0].ValueFrom) != "arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/token" {
+		t.Errorf("unexpected secrets %#v", plan.Secrets)
+	}
+	if len(plan.Tags) == 0 {
+		t.Error("tags are empty")
+	}
+
+	if !fake.called("DescribeTaskDefinition") {
+		t.Error("DescribeTaskDefinition is not called")
+	}
+	for _, action := range []string{"RegisterTaskDefinition", "RunTask", "ListTasks", "StopTask"} {
+		if fake.called(action) {
+			t.Errorf("%s is called in dry-run", action)
+		}
+	}
+}
+
+func TestRunTaskInputPropagateTagsAndPlatformVersion(t *testing.T) {
+	ctx := context.Background()
+	tests := []struct {
+		name            string
+		ecs             string
+		propagateTags   types.PropagateTags
+		platformVersion *string
+		wantErr         bool
+	}{
+		{
+			name: "unset",
+		},
+		{
+			name: "set",
+			ecs: `
+  propagate_tags: TASK_DEFINITION
+  platform_version: 1.4.0`,
+			propagateTags:   types.PropagateTagsTaskDefinition,
+			platformVersion: aws.String("1.4.0"),
+		},
+		{
+			name:    "invalid propagate_tags",
+			ecs:     "\n  propagate_tags: TASK",
+			wantErr: true,
+		},
+		{
+			name:    "SERVICE is not for RunTask",
+			ecs:     "\n  propagate_tags: SERVICE",
+			wantErr: true,
+		},
+		{
+			name:    "invalid platform_version",
+			ecs:     "\n  platform_version: latest-1",
+			wantErr: true,
+		},
+	}
+	ecsServer := httptest.NewServer(&fakeECSServer{})
+	defer ecsServer.Close()
+	svc := ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := os.CreateTemp("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(f.Name())
+			data := "ecs:\n  region: ap-northeast-1\n  cluster: test-cluster\n  launch_type: FARGATE" + tt.ecs + "\n"
+			if _, err := f.WriteString(data); err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+			cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{Path: f.Name()})
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			in, err := mirageecs.RunTaskInput(ctx, mirageecs.NewECSTaskRunnerWithClient(cfg, svc), "foo", "app", mirageecs.TaskParameter{"branch": "develop"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if in.PropagateTags != tt.propagateTags {
+				t.Errorf("unexpected propagateTags %q", in.PropagateTags)
+			}
+			if aws.ToString(in.PlatformVersion) != aws.ToString(tt.platformVersion) {
+				t.Errorf("unexpected platformVersion %q", aws.ToString(in.PlatformVersion))
+			}
+		})
+	}
+}
+
+func TestRunTaskInputCommand(t *testing.T) {
+	ctx := context.Background()
+	f, err := os.CreateTemp("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("ecs:\n  region: ap-northeast-1\n  cluster: test-cluster\n  launch_type: FARGATE\n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{Path: f.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecsServer := httptest.NewServer(&fakeECSServer{})
+	defer ecsServer.Close()
+	svc := ecs.New(ecs.Options{
+		Region:           "ap-northeast-1",
+		EndpointResolver: ecs.EndpointResolverFromURL(ecsServer.URL),
+		Credentials:      aws.AnonymousCredentials{},
+	})
+	runner := mirageecs.NewECSTaskRunnerWithClient(cfg, svc)
+
+	tests := []struct {
+		name      string
+		container string
+		want      map[string][]string
+		wantErr   bool
+	}{
+		{
+			name: "first container by default",
+			want: map[string][]string{"app": {"rails", "db:migrate"}, "nginx": nil},
+		},
+		{
+			name:      "named container",
+			container: "nginx",
+			want:      map[string][]string{"app": nil, "nginx": {"rails", "db:migrate"}},
+		},
+		{
+			name:      "undefined container",
+			container: "db",
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			param := mirageecs.TaskParameter{"branch": "develop"}
+			param.SetCommand(tt.container, []string{"rails", "db:migrate"})
+			in, err := mirageecs.RunTaskInput(ctx, runner, "foo", "app", param)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for _, c := range in.Overrides.ContainerOverrides {
+				got[aws.ToString(c.Name)] = c.Command
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected commands %s", diff)
+			}
+			for _, tag := range in.Tags {
+				if strings.HasPrefix(aws.ToString(tag.Key), "command") {
+					t.Errorf("command must not be tagged: %s", aws.ToString(tag.Key))
+				}
+			}
+		})
+	}
+}
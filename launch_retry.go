@@ -0,0 +1,163 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/samber/lo"
+)
+
+const (
+	MaxLaunchRetryAttempts    = 10
+	DefaultLaunchRetryTimeout = 10 * time.Minute
+	MaxLaunchRetryTimeout     = time.Hour
+
+	LaunchStatusRunning   = "running"
+	LaunchStatusRetrying  = "retrying"
+	LaunchStatusSucceeded = "succeeded"
+	LaunchStatusFailed    = "failed"
+)
+
+var launchRetryBackoff = 10 * time.Second
+
+// LaunchRetry is the parameters of the launch retried in background.
+type LaunchRetry struct {
+	Attempts int
+	Timeout  time.Duration
+}
+
+// launchRetryFrom returns LaunchRetry of the request, or nil if the retry is not requested.
+func launchRetryFrom(r *APILaunchRequest) (*LaunchRetry, error) {
+	if r.RetryAttempts <= 1 {
+		if r.RetryTimeout != "" {
+			return nil, fmt.Errorf("retry_timeout requires retry_attempts greater than 1")
+		}
+		return nil, nil
+	}
+	if r.RetryAttempts > MaxLaunchRetryAttempts {
+		return nil, fmt.Errorf("invalid retry_attempts %d: must be %d or less", r.RetryAttempts, MaxLaunchRetryAttempts)
+	}
+	lr := &LaunchRetry{Attempts: r.RetryAttempts, Timeout: DefaultLaunchRetryTimeout}
+	if r.RetryTimeout != "" {
+		d, err := time.ParseDuration(r.RetryTimeout)
+		if err != nil || d <= 0 || d > MaxLaunchRetryTimeout {
+			return nil, fmt.Errorf("invalid retry_timeout %s: must be positive and %s or less", r.RetryTimeout, MaxLaunchRetryTimeout)
+		}
+		lr.Timeout = d
+	}
+	return lr, nil
+}
+
+// LaunchProgress is the progress of the launch retried in background.
+type LaunchProgress struct {
+	Subdomain   string    `json:"subdomain"`
+	Status      string    `json:"status"`
+	Attempt     int       `json:"attempt"`
+	MaxAttempts int       `json:"max_attempts"`
+	LastError   string    `json:"last_error,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+type launchProgresses struct {
+	mu sync.Mutex
+	m  map[string]*LaunchProgress
+}
+
+func newLaunchProgresses() *launchProgresses {
+	return &launchProgresses{m: make(map[string]*LaunchProgress)}
+}
+
+func (p *launchProgresses) start(subdomain string, maxAttempts int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.m[subdomain] = &LaunchProgress{
+		Subdomain:   subdomain,
+		Status:      LaunchStatusRunning,
+		Attempt:     1,
+		MaxAttempts: maxAttempts,
+		StartedAt:   now,
+		UpdatedAt:   now,
+	}
+}
+
+func (p *launchProgresses) update(subdomain string, fn func(*LaunchProgress)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lp, ok := p.m[subdomain]; ok {
+		fn(lp)
+		lp.UpdatedAt = time.Now()
+	}
+}
+
+func (p *launchProgresses) get(subdomain string) (LaunchProgress, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if lp, ok := p.m[subdomain]; ok {
+		return *lp, true
+	}
+	return LaunchProgress{}, false
+}
+
+// subdomainLocks allows a single launch at once for each subdomain.
+type subdomainLocks struct {
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func newSubdomainLocks() *subdomainLocks {
+	return &subdomainLocks{locked: make(map[string]bool)}
+}
+
+func (l *subdomainLocks) tryLock(subdomain string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locked[subdomain] {
+		return false
+	}
+	l.locked[subdomain] = true
+	return true
+}
+
+func (l *subdomainLocks) unlock(subdomain string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.locked, subdomain)
+}
+
+// list returns the locked subdomains.
+func (l *subdomainLocks) list() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return lo.Keys(l.locked)
+}
+
+// launchWithRetry calls launch until it succeeds, fails permanently, reaches maxAttempts or ctx is done.
+// Only the capacity shortage is retried. Throttling and the server side errors are retried by runTaskWithRetry.
+// report is called with the failed attempt number and the error before each retry.
+func launchWithRetry(ctx context.Context, launch func(context.Context) error, maxAttempts int, backoff time.Duration, report func(int, error)) error {
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		if err = launch(ctx); err == nil {
+			return nil
+		}
+		if !isCapacityShortage(err) || i == maxAttempts-1 {
+			break
+		}
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		slog.Warn(f("launch failed, retrying after %s (%d/%d): %s", wait, i+1, maxAttempts, err))
+		report(i+1, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("launch retry is timed out: %w", err)
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package mirageecs_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestLaunchWithRetry(t *testing.T) {
+	shortage := mirageecs.NewRunTaskFailure("Capacity is unavailable at this time.")
+	throttled := &testAPIError{"ThrottlingException"}
+	tests := []struct {
+		name        string
+		results     []error
+		maxAttempts int
+		wantCalls   int
+		wantReports []int
+		wantErr     bool
+	}{
+		{
+			name:        "success at first",
+			results:     []error{nil},
+			maxAttempts: 3,
+			wantCalls:   1,
+		},
+		{
+			name:        "success after capacity shortage",
+			results:     []error{shortage, shortage, nil},
+			maxAttempts: 3,
+			wantCalls:   3,
+			wantReports: []int{1, 2},
+		},
+		{
+			name:        "attempts exhausted",
+			results:     []error{shortage, shortage, shortage},
+			maxAttempts: 2,
+			wantCalls:   2,
+			wantReports: []int{1},
+			wantErr:     true,
+		},
+		{
+			name:        "throttled is retried by RunTask",
+			results:     []error{throttled, nil},
+			maxAttempts: 3,
+			wantCalls:   1,
+			wantErr:     true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			launch := func(context.Context) error {
+				err := tt.results[calls]
+				calls++
+				return err
+			}
+			var reports []int
+			report := func(attempt int, err error) {
+				reports = append(reports, attempt)
+			}
+			err := mirageecs.LaunchWithRetry(context.Background(), launch, tt.maxAttempts, time.Millisecond, report)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("launch called %d times, want %d", calls, tt.wantCalls)
+			}
+			if len(reports) != len(tt.wantReports) {
+				t.Errorf("reported %v, want %v", reports, tt.wantReports)
+			}
+		})
+	}
+}
+
+func TestLaunchWithRetryTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	failure := mirageecs.NewRunTaskFailure("RESOURCE:CPU")
+	launch := func(context.Context) error {
+		return failure
+	}
+	err := mirageecs.LaunchWithRetry(ctx, launch, 5, time.Minute, func(int, error) {})
+	if !errors.Is(err, failure) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -0,0 +1,108 @@
+package mirageecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const DefaultLaunchValidationTimeout = 5 * time.Second
+
+// LaunchValidation configures an external webhook to validate launch requests.
+type LaunchValidation struct {
+	WebhookURL string        `yaml:"webhook_url"`
+	Timeout    time.Duration `yaml:"timeout"`
+	FailOpen   bool          `yaml:"fail_open"`
+}
+
+func (v *LaunchValidation) Validate() error {
+	if v.WebhookURL == "" {
+		return fmt.Errorf("webhook_url is required")
+	}
+	if u, err := url.Parse(v.WebhookURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid webhook_url: %s", v.WebhookURL)
+	}
+	if v.Timeout < 0 {
+		return fmt.Errorf("timeout must be positive")
+	}
+	if v.Timeout == 0 {
+		v.Timeout = DefaultLaunchValidationTimeout
+	}
+	return nil
+}
+
+// LaunchValidationRequest is a payload posted to the launch validation webhook.
+type LaunchValidationRequest struct {
+	Subdomain  string            `json:"subdomain"`
+	Branch     string            `json:"branch"`
+	Taskdefs   []string          `json:"taskdefs"`
+	Parameters map[string]string `json:"parameters"`
+	Actor      string            `json:"actor"`
+}
+
+// LaunchValidationResponse is a response of the launch validation webhook for rejection.
+type LaunchValidationResponse struct {
+	Message string `json:"message"`
+}
+
+// ErrLaunchRejected is returned when the launch validation webhook rejects the launch request.
+var ErrLaunchRejected = errors.New("launch request rejected")
+
+// Check posts the request to the webhook.
+// The launch request is allowed when the webhook returns 2xx, and rejected when it returns 4xx.
+// Other failures are ignored when FailOpen is true.
+func (v *LaunchValidation) Check(ctx context.Context, r *LaunchValidationRequest) error {
+	err := v.check(ctx, r)
+	if err == nil || errors.Is(err, ErrLaunchRejected) {
+		return err
+	}
+	if v.FailOpen {
+		slog.Warn(f("launch validation failed, but allowed by fail_open: %s", err))
+		return nil
+	}
+	return err
+}
+
+func (v *LaunchValidation) check(ctx context.Context, r *LaunchValidationRequest) error {
+	ctx, cancel := context.WithTimeout(ctx, v.Timeout)
+	defer cancel()
+	b, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("failed to marshal launch validation request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, v.WebhookURL, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("failed to create launch validation request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mirage-ecs/"+Version)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post launch validation webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode < 500:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var res LaunchValidationResponse
+		if err := json.Unmarshal(body, &res); err != nil || res.Message == "" {
+			res.Message = strings.TrimSpace(string(body))
+		}
+		if res.Message == "" {
+			return ErrLaunchRejected
+		}
+		return fmt.Errorf("%w: %s", ErrLaunchRejected, res.Message)
+	default:
+		return fmt.Errorf("launch validation webhook returned status %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,221 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestLaunchValidation(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req mirageecs.LaunchValidationRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.Subdomain == "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case !strings.HasPrefix(req.Branch, "feature/"):
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(mirageecs.LaunchValidationResponse{Message: "branch must start with feature/"})
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		req        *mirageecs.LaunchValidationRequest
+		failOpen   bool
+		wantErr    bool
+		wantReject bool
+		message    string
+	}{
+		{
+			name: "allowed",
+			req:  &mirageecs.LaunchValidationRequest{Subdomain: "foo", Branch: "feature/foo"},
+		},
+		{
+			name:       "rejected",
+			req:        &mirageecs.LaunchValidationRequest{Subdomain: "foo", Branch: "main"},
+			wantErr:    true,
+			wantReject: true,
+			message:    "branch must start with feature/",
+		},
+		{
+			name:       "rejected even if fail open",
+			req:        &mirageecs.LaunchValidationRequest{Subdomain: "foo", Branch: "main"},
+			failOpen:   true,
+			wantErr:    true,
+			wantReject: true,
+		},
+		{
+			name:    "failed closed",
+			req:     &mirageecs.LaunchValidationRequest{Subdomain: "broken", Branch: "feature/foo"},
+			wantErr: true,
+		},
+		{
+			name:     "failed open",
+			req:      &mirageecs.LaunchValidationRequest{Subdomain: "broken", Branch: "feature/foo"},
+			failOpen: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &mirageecs.LaunchValidation{WebhookURL: ts.URL, FailOpen: tt.failOpen}
+			if err := v.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			err := v.Check(context.Background(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if errors.Is(err, mirageecs.ErrLaunchRejected) != tt.wantReject {
+				t.Errorf("unexpected rejection: %v", err)
+			}
+			if tt.message != "" && !strings.Contains(err.Error(), tt.message) {
+				t.Errorf("error should contain %q: %v", tt.message, err)
+			}
+		})
+	}
+}
+
+func TestApiLaunchStrictTaskdef(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.DefaultTaskDefinition = "app"
+	cfg.Link.DefaultTaskDefinitions = []string{"frontend:3", "backend"}
+	cfg.Presets = []*mirageecs.Preset{{Name: "worker", Taskdefs: []string{"worker:1"}}}
+	cfg.Link.StrictTaskdef = true
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, mirageecs.NewLocalTaskRunner(cfg)))
+	defer ts.Close()
+
+	// dry-run not to run the mock tasks
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		message    string
+	}{
+		{
+			name:       "defaults",
+			body:       `{"subdomain":"foo","branch":"main","dry_run":true}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "other revisions of the default families",
+			body:       `{"subdomain":"foo","branch":"main","dry_run":true,"taskdef":["frontend:4","backend:2","arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:7"]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "preset",
+			body:       `{"subdomain":"foo","branch":"main","dry_run":true,"taskdef":["worker:2"]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "unknown",
+			body:       `{"subdomain":"foo","branch":"main","dry_run":true,"taskdef":["app","other:1"]}`,
+			wantStatus: http.StatusBadRequest,
+			message:    "unknown taskdef other:1: must be one of app, backend, frontend, worker",
+		},
+		{
+			name:       "unknown family in arn",
+			body:       `{"subdomain":"foo","branch":"main","dry_run":true,"taskdef":["arn:aws:ecs:ap-northeast-1:123456789012:task-definition/other:1"]}`,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+			if tt.message == "" {
+				return
+			}
+			var r mirageecs.APICommonResponse
+			if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Result != tt.message {
+				t.Errorf("unexpected result %s", r.Result)
+			}
+		})
+	}
+}
+
+func TestApiLaunchAllowedTaskDefinitions(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.AllowedTaskDefinitions = []string{"myteam-*", "shared-db:3"}
+	cfg.ECS.DeniedTaskDefinitions = []string{"myteam-admin"}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, mirageecs.NewLocalTaskRunner(cfg)))
+	defer ts.Close()
+
+	tests := []struct {
+		taskdefs   []string
+		wantStatus int
+	}{
+		{taskdefs: []string{"myteam-web"}, wantStatus: http.StatusOK},
+		{taskdefs: []string{"myteam-web:12", "shared-db:3"}, wantStatus: http.StatusOK},
+		{taskdefs: []string{"arn:aws:ecs:ap-northeast-1:123456789012:task-definition/myteam-api:5"}, wantStatus: http.StatusOK},
+		{taskdefs: []string{"shared-db:4"}, wantStatus: http.StatusForbidden},
+		{taskdefs: []string{"shared-db"}, wantStatus: http.StatusForbidden},
+		{taskdefs: []string{"myteam-web", "otherteam-web"}, wantStatus: http.StatusForbidden},
+		{taskdefs: []string{"arn:aws:ecs:ap-northeast-1:123456789012:task-definition/otherteam-web:1"}, wantStatus: http.StatusForbidden},
+		{taskdefs: []string{"myteam-admin:2"}, wantStatus: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		name := strings.Join(tt.taskdefs, ",")
+		// dry-run not to run the mock tasks
+		t.Run("api "+name, func(t *testing.T) {
+			b, _ := json.Marshal(mirageecs.APILaunchRequest{Subdomain: "foo", Branch: "main", Taskdef: tt.taskdefs, DryRun: true})
+			res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json", strings.NewReader(string(b)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+		})
+		t.Run("web "+name, func(t *testing.T) {
+			form := url.Values{"subdomain": {"foo"}, "branch": {"main"}, "taskdef": tt.taskdefs, "dry_run": {"true"}}
+			req, _ := http.NewRequest(http.MethodPost, ts.URL+"/launch", strings.NewReader(form.Encode()))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			req.Header.Set("Hx-Request", "true")
+			req.Header.Set("Origin", "http://mirage.localtest.me")
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+		})
+	}
+}
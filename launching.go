@@ -0,0 +1,56 @@
+package mirageecs
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+const launchingRetryAfter = 5
+
+// launchingGracePeriod keeps the subdomain launched by API as launching until its task is listed.
+var launchingGracePeriod = 30 * time.Second
+
+// launchingSubdomains is the set of the subdomains whose tasks are launched but not routed yet.
+type launchingSubdomains struct {
+	mu sync.Mutex
+	m  map[string]time.Time
+}
+
+func newLaunchingSubdomains() *launchingSubdomains {
+	return &launchingSubdomains{m: make(map[string]time.Time)}
+}
+
+func (l *launchingSubdomains) add(subdomain string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.m[subdomain] = time.Now()
+}
+
+func (l *launchingSubdomains) has(subdomain string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.m[subdomain]
+	return ok
+}
+
+// update replaces the set with the pending subdomains found by syncRouting.
+// The subdomains added within launchingGracePeriod are kept unless they are routed.
+func (l *launchingSubdomains) update(pending, routed map[string]bool, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for subdomain, addedAt := range l.m {
+		if routed[subdomain] || !pending[subdomain] && now.Sub(addedAt) > launchingGracePeriod {
+			delete(l.m, subdomain)
+		}
+	}
+	for subdomain := range pending {
+		if _, ok := l.m[subdomain]; !ok {
+			l.m[subdomain] = now
+		}
+	}
+}
+
+func (m *Mirage) serveLaunching(w http.ResponseWriter, subdomain string) {
+	m.WebApi.renderer.serveWaitingPage(w, subdomain, "launching", launchingRetryAfter)
+}
@@ -0,0 +1,87 @@
+package mirageecs_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestServeLaunching(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	m.MarkLaunching("pending")
+
+	req := httptest.NewRequest(http.MethodGet, "http://pending.localtest.me/", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTPWithPort(w, req, 80)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("launching page should be 503, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "pending is launching") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unexpected launching page %s", w.Body.String())
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://unknown.localtest.me/", nil)
+	w = httptest.NewRecorder()
+	m.ServeHTTPWithPort(w, req, 80)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown subdomain should be 404, got %d", w.Code)
+	}
+}
+
+func TestServeLaunchingReloadTemplates(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HtmlDir = t.TempDir()
+	page := filepath.Join(cfg.HtmlDir, "starting.html")
+	if err := os.WriteFile(page, []byte("v1 {{ .Subdomain }} {{ .State }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	m.MarkLaunching("pending")
+	serve := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://pending.localtest.me/", nil)
+		w := httptest.NewRecorder()
+		m.ServeHTTPWithPort(w, req, 80)
+		return w.Body.String()
+	}
+	if body := serve(); body != "v1 pending launching" {
+		t.Errorf("unexpected launching page %q", body)
+	}
+
+	if err := os.WriteFile(page, []byte("v2 {{ .Subdomain }} {{ .State }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(m.WebApi)
+	defer ts.Close()
+	res, err := http.Post(ts.URL+"/admin/reload-templates", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if body := serve(); body != "v2 pending launching" {
+		t.Errorf("unexpected launching page %q after reload", body)
+	}
+}
@@ -13,6 +13,9 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/fujiwara/tracer"
 	"github.com/samber/lo"
 )
 
@@ -47,8 +50,16 @@ func (e *LocalTaskRunner) List(_ context.Context, status string) ([]*Information
 	return infos, nil
 }
 
-func (e *LocalTaskRunner) Trace(_ context.Context, id string) (string, error) {
-	return fmt.Sprintf("mock trace of %s", id), nil
+func (e *LocalTaskRunner) Status(_ context.Context, subdomain string) ([]*Information, error) {
+	infos := lo.Filter(e.Informations, func(info *Information, _ int) bool {
+		return info.SubDomain == subdomain && info.LastStatus == statusRunning
+	})
+	return infos, nil
+}
+
+func (e *LocalTaskRunner) Trace(_ context.Context, id string, _ time.Duration) (*TraceResult, error) {
+	now := time.Now().Format(tracer.TimeFormat)
+	return parseTrace(fmt.Sprintf("Tracer: %s on local\n%s\tTASK\tmock trace of %s\n", id, now, id)), nil
 }
 
 func (e *LocalTaskRunner) Launch(ctx context.Context, subdomain string, option TaskParameter, taskdefs ...string) error {
@@ -64,6 +75,12 @@ func (e *LocalTaskRunner) Launch(ctx context.Context, subdomain string, option T
 	slog.Info(f("Launching a new mock task: subdomain=%s, taskdef=%s, id=%s", subdomain, taskdefs[0], id))
 	contents := fmt.Sprintf("Hello, Mirage! subdomain: %s\n%#v", subdomain, env)
 	port, stopServerFunc := runMockServer(contents)
+	infoEnv := make(map[string]string, len(env))
+	for k, v := range env {
+		if !e.cfg.Parameter.isSecretEnv(k) {
+			infoEnv[k] = v
+		}
+	}
 	e.Informations = append(e.Informations, &Information{
 		ID:         "arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/" + id,
 		ShortID:    id,
@@ -76,7 +93,10 @@ func (e *LocalTaskRunner) Launch(ctx context.Context, subdomain string, option T
 		PortMap: map[string]int{
 			"httpd": port,
 		},
-		Env:  env,
+		PortMappings: map[string][]PortMapping{
+			"httpd": {{ContainerPort: port, HostPort: port}},
+		},
+		Env:  infoEnv,
 		Tags: option.ToECSTags(subdomain, e.cfg.Parameter),
 	})
 	e.stopServerFuncs[id] = stopServerFunc
@@ -89,9 +109,56 @@ func (e *LocalTaskRunner) Launch(ctx context.Context, subdomain string, option T
 	return nil
 }
 
-func (e *LocalTaskRunner) Logs(_ context.Context, subdomain string, since time.Time, tail int) ([]string, error) {
+func (e *LocalTaskRunner) PlanLaunch(ctx context.Context, subdomain string, option TaskParameter, taskdefs ...string) ([]*LaunchPlan, error) {
+	plans := make([]*LaunchPlan, 0, len(taskdefs))
+	for _, taskdef := range taskdefs {
+		ov := &types.TaskOverride{
+			ContainerOverrides: []types.ContainerOverride{
+				{
+					Name:        aws.String("httpd"),
+					Environment: option.ToECSKeyValuePairs(subdomain, e.cfg.Parameter, e.cfg.EncodeSubdomain),
+				},
+			},
+		}
+		if container, command := option.command(); len(command) > 0 {
+			td := &types.TaskDefinition{
+				TaskDefinitionArn:    aws.String(taskdef),
+				ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("httpd")}},
+			}
+			if err := applyCommand(ov, td, container, command); err != nil {
+				return nil, err
+			}
+		}
+		plans = append(plans, &LaunchPlan{
+			Taskdef:           taskdef,
+			TaskDefinitionArn: taskdef,
+			Overrides:         ov,
+			Tags:              option.ToECSTags(subdomain, e.cfg.Parameter),
+			Secrets:           option.ToECSSecrets(e.cfg.Parameter),
+		})
+	}
+	return plans, nil
+}
+
+func (e *LocalTaskRunner) Logs(_ context.Context, subdomain string, container string, since time.Time, tail int) ([]LogEvent, error) {
 	// Logs returns logs of the specified subdomain.
-	return []string{"Sorry. mock server logs are empty."}, nil
+	return []LogEvent{{Timestamp: time.Now(), Message: "Sorry. mock server logs are empty."}}, nil
+}
+
+// FollowLogs calls fn with the mock logs once, and waits for ctx to be done.
+func (e *LocalTaskRunner) FollowLogs(ctx context.Context, subdomain string, container string, since time.Time, fn func([]LogEvent) error) error {
+	if _, ok := e.find(subdomain); !ok {
+		return fmt.Errorf("%w: %s", ErrSubdomainNotFound, subdomain)
+	}
+	logs, err := e.Logs(ctx, subdomain, container, since, 0)
+	if err != nil {
+		return err
+	}
+	if err := fn(logs); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
 }
 
 func (e *LocalTaskRunner) Terminate(ctx context.Context, id string) error {
@@ -160,3 +227,13 @@ func (e *LocalTaskRunner) PutAccessCounts(_ context.Context, _ map[string]access
 	slog.Debug("PutAccessCounts is not implemented in LocalTaskRunner")
 	return nil
 }
+
+func (e *LocalTaskRunner) PutLatencyMetrics(_ context.Context, _ map[string]latencyMetrics) error {
+	slog.Debug("PutLatencyMetrics is not implemented in LocalTaskRunner")
+	return nil
+}
+
+func (e *LocalTaskRunner) PutStatusCounts(_ context.Context, _ map[string]statusCount) error {
+	slog.Debug("PutStatusCounts is not implemented in LocalTaskRunner")
+	return nil
+}
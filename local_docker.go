@@ -0,0 +1,526 @@
+package mirageecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/samber/lo"
+)
+
+const (
+	DefaultDockerHost          = "unix:///var/run/docker.sock"
+	DefaultDockerContainerPort = 80
+	DefaultDockerStopTimeout   = 10 * time.Second
+
+	// dockerAPIVersion is the version of Docker Engine API. Docker 20.10 or later supports it.
+	dockerAPIVersion = "v1.41"
+
+	dockerLabelSubdomain = "mirage-ecs.subdomain"
+	dockerLabelTaskDef   = "mirage-ecs.taskdef"
+	dockerLabelTagPrefix = "mirage-ecs.tag."
+)
+
+// LocalDocker configures the local mode to launch the containers by Docker instead of the mock servers.
+type LocalDocker struct {
+	Host          string            `yaml:"host"`           // default: DOCKER_HOST or unix:///var/run/docker.sock
+	Images        map[string]string `yaml:"images"`         // images keyed by the task definitions. The task definition is used as the image if not found.
+	ContainerPort int               `yaml:"container_port"` // the port which the containers listen on
+	Network       string            `yaml:"network"`        // routes to the IP address of the containers in the network, instead of the published ports
+	StopTimeout   time.Duration     `yaml:"stop_timeout"`
+
+	client *dockerClient
+}
+
+func (d *LocalDocker) Validate() error {
+	if d.Host == "" {
+		d.Host = os.Getenv("DOCKER_HOST")
+	}
+	if d.Host == "" {
+		d.Host = DefaultDockerHost
+	}
+	client, err := newDockerClient(d.Host)
+	if err != nil {
+		return err
+	}
+	d.client = client
+	if d.ContainerPort == 0 {
+		d.ContainerPort = DefaultDockerContainerPort
+	}
+	if d.ContainerPort < 0 || d.ContainerPort > 65535 {
+		return fmt.Errorf("invalid container_port %d", d.ContainerPort)
+	}
+	if d.StopTimeout <= 0 {
+		d.StopTimeout = DefaultDockerStopTimeout
+	}
+	return nil
+}
+
+// image returns the image of the task definition.
+func (d *LocalDocker) image(taskdef string) string {
+	if image, ok := d.Images[taskdef]; ok {
+		return image
+	}
+	return taskdef
+}
+
+// dockerClient is a minimal client of Docker Engine API.
+type dockerClient struct {
+	client *http.Client
+	base   string
+}
+
+func newDockerClient(host string) (*dockerClient, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s: %w", host, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		socket := u.Path
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socket)
+			},
+		}
+		return &dockerClient{client: &http.Client{Transport: tr}, base: "http://docker/" + dockerAPIVersion}, nil
+	case "tcp", "http":
+		return &dockerClient{client: &http.Client{}, base: "http://" + u.Host + "/" + dockerAPIVersion}, nil
+	default:
+		return nil, fmt.Errorf("invalid docker host %s: scheme must be unix, tcp or http", host)
+	}
+}
+
+// dockerError is an error response of Docker Engine API.
+type dockerError struct {
+	StatusCode int
+	Message    string `json:"message"`
+}
+
+func (e *dockerError) Error() string {
+	return fmt.Sprintf("docker api error %d: %s", e.StatusCode, e.Message)
+}
+
+func isDockerNotFound(err error) bool {
+	var de *dockerError
+	return errors.As(err, &de) && de.StatusCode == http.StatusNotFound
+}
+
+// do calls the API and decodes the response into out. The raw body is returned when out is nil.
+func (c *dockerClient) do(ctx context.Context, method, path string, query url.Values, in, out interface{}) ([]byte, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(b)
+	}
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call docker api %s %s: %w", method, path, err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 400 {
+		de := &dockerError{StatusCode: res.StatusCode}
+		if err := json.Unmarshal(b, de); err != nil {
+			de.Message = strings.TrimSpace(string(b))
+		}
+		return nil, de
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return nil, fmt.Errorf("failed to decode the response of %s %s: %w", method, path, err)
+		}
+	}
+	return b, nil
+}
+
+func (c *dockerClient) ping(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodGet, "/_ping", nil, nil, nil)
+	return err
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+type dockerContainerConfig struct {
+	Image        string              `json:"Image"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Env          []string            `json:"Env"`
+	Labels       map[string]string   `json:"Labels"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	HostConfig   struct {
+		PortBindings map[string][]dockerPortBinding `json:"PortBindings,omitempty"`
+		NetworkMode  string                         `json:"NetworkMode,omitempty"`
+	} `json:"HostConfig"`
+}
+
+type dockerContainer struct {
+	ID      string            `json:"Id"`
+	Image   string            `json:"Image"`
+	Labels  map[string]string `json:"Labels"`
+	State   string            `json:"State"`
+	Status  string            `json:"Status"`
+	Created int64             `json:"Created"`
+	Ports   []struct {
+		IP          string `json:"IP"`
+		PrivatePort int    `json:"PrivatePort"`
+		PublicPort  int    `json:"PublicPort"`
+		Type        string `json:"Type"`
+	} `json:"Ports"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+func (c *dockerClient) listContainers(ctx context.Context) ([]dockerContainer, error) {
+	filters, _ := json.Marshal(map[string][]string{"label": {dockerLabelSubdomain}})
+	var containers []dockerContainer
+	_, err := c.do(ctx, http.MethodGet, "/containers/json", url.Values{
+		"all":     {"true"},
+		"filters": {string(filters)},
+	}, nil, &containers)
+	return containers, err
+}
+
+func (c *dockerClient) createContainer(ctx context.Context, cc *dockerContainerConfig) (string, error) {
+	var out struct {
+		ID string `json:"Id"`
+	}
+	_, err := c.do(ctx, http.MethodPost, "/containers/create", nil, cc, &out)
+	if isDockerNotFound(err) {
+		slog.Info(f("pulling image %s", cc.Image))
+		if _, err := c.do(ctx, http.MethodPost, "/images/create", url.Values{"fromImage": {cc.Image}}, nil, nil); err != nil {
+			return "", fmt.Errorf("failed to pull image %s: %w", cc.Image, err)
+		}
+		_, err = c.do(ctx, http.MethodPost, "/containers/create", nil, cc, &out)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create container of %s: %w", cc.Image, err)
+	}
+	return out.ID, nil
+}
+
+func (c *dockerClient) startContainer(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+	return err
+}
+
+func (c *dockerClient) stopContainer(ctx context.Context, id string, timeout time.Duration) error {
+	_, err := c.do(ctx, http.MethodPost, "/containers/"+id+"/stop", url.Values{
+		"t": {strconv.Itoa(int(timeout.Seconds()))},
+	}, nil, nil)
+	// 304 Not Modified means the container is already stopped
+	return err
+}
+
+func (c *dockerClient) removeContainer(ctx context.Context, id string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/containers/"+id, url.Values{"force": {"true"}}, nil, nil)
+	return err
+}
+
+// logs returns the events of stdout and stderr of the container.
+func (c *dockerClient) logs(ctx context.Context, id string, since time.Time, tail int) ([]LogEvent, error) {
+	q := url.Values{"stdout": {"true"}, "stderr": {"true"}, "timestamps": {"true"}}
+	if !since.IsZero() {
+		q.Set("since", strconv.FormatInt(since.Unix(), 10))
+	}
+	if tail > 0 {
+		q.Set("tail", strconv.Itoa(tail))
+	}
+	b, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", q, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Map(splitDockerLogs(b), func(line string, _ int) LogEvent {
+		return parseDockerLogLine(line)
+	}), nil
+}
+
+// parseDockerLogLine parses the line of the logs with timestamps, "2006-01-02T15:04:05.999999999Z07:00 message".
+func parseDockerLogLine(line string) LogEvent {
+	ts, msg, ok := strings.Cut(line, " ")
+	if !ok {
+		return LogEvent{Message: line}
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return LogEvent{Message: line}
+	}
+	return LogEvent{Timestamp: t, Message: msg}
+}
+
+// splitDockerLogs demultiplexes the stream of stdout and stderr into lines.
+// Each frame has 8 bytes header of the stream type and the size. The stream of a container with tty has no header.
+func splitDockerLogs(b []byte) []string {
+	var out bytes.Buffer
+	for len(b) >= 8 && b[0] <= 2 && b[1] == 0 && b[2] == 0 && b[3] == 0 {
+		size := int(binary.BigEndian.Uint32(b[4:8]))
+		if len(b) < 8+size {
+			break
+		}
+		out.Write(b[8 : 8+size])
+		b = b[8+size:]
+	}
+	out.Write(b)
+	s := strings.TrimSuffix(out.String(), "\n")
+	if s == "" {
+		return []string{}
+	}
+	return strings.Split(s, "\n")
+}
+
+// DockerTaskRunner is an implementation of TaskRunner for the local mode, which launches the containers by Docker.
+// The tasks which Docker doesn't support (metrics, trace and launch plans) are the same as LocalTaskRunner.
+type DockerTaskRunner struct {
+	*LocalTaskRunner
+
+	docker *LocalDocker
+}
+
+func NewDockerTaskRunner(cfg *Config) TaskRunner {
+	return &DockerTaskRunner{
+		LocalTaskRunner: NewLocalTaskRunner(cfg).(*LocalTaskRunner),
+		docker:          cfg.LocalDocker,
+	}
+}
+
+func (e *DockerTaskRunner) List(ctx context.Context, status string) ([]*Information, error) {
+	containers, err := e.docker.client.listContainers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*Information, 0, len(containers))
+	for _, c := range containers {
+		info := e.information(c)
+		if info.LastStatus == status {
+			infos = append(infos, info)
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Created.After(infos[j].Created)
+	})
+	return infos, nil
+}
+
+// information converts the container to Information. The container is routed by the published port on localhost,
+// or the IP address in the network if configured.
+func (e *DockerTaskRunner) information(c dockerContainer) *Information {
+	info := &Information{
+		ID:         c.ID,
+		ShortID:    c.ID[:min(12, len(c.ID))],
+		SubDomain:  c.Labels[dockerLabelSubdomain],
+		TaskDef:    c.Labels[dockerLabelTaskDef],
+		Created:    time.Unix(c.Created, 0).UTC(),
+		LastStatus: dockerContainerStatus(c.State),
+	}
+	for k, v := range c.Labels {
+		if key, ok := strings.CutPrefix(k, dockerLabelTagPrefix); ok {
+			info.Tags = append(info.Tags, types.Tag{Key: aws.String(key), Value: aws.String(v)})
+			if key == "branch" {
+				info.GitBranch = v
+			}
+		}
+	}
+	sort.Slice(info.Tags, func(i, j int) bool {
+		return *info.Tags[i].Key < *info.Tags[j].Key
+	})
+	if c.State != "running" {
+		return info
+	}
+	port := e.docker.ContainerPort
+	if n := e.docker.Network; n != "" {
+		info.IPAddress = c.NetworkSettings.Networks[n].IPAddress
+	} else {
+		info.IPAddress = "127.0.0.1"
+		port = 0
+		for _, p := range c.Ports {
+			if p.PrivatePort == e.docker.ContainerPort && p.PublicPort != 0 {
+				port = p.PublicPort
+				break
+			}
+		}
+	}
+	if info.IPAddress == "" || port == 0 {
+		// not routable yet
+		info.IPAddress = ""
+		return info
+	}
+	info.PortMap = map[string]int{"app": port}
+	info.PortMappings = map[string][]PortMapping{
+		"app": {{ContainerPort: e.docker.ContainerPort, HostPort: port}},
+	}
+	return info
+}
+
+// dockerContainerStatus maps the state of the container to the status of the task.
+func dockerContainerStatus(state string) string {
+	switch state {
+	case "running":
+		return statusRunning
+	case "created", "restarting":
+		return "PENDING"
+	default:
+		return statusStopped
+	}
+}
+
+func (e *DockerTaskRunner) Status(ctx context.Context, subdomain string) ([]*Information, error) {
+	infos, err := e.List(ctx, statusRunning)
+	if err != nil {
+		return nil, err
+	}
+	return lo.Filter(infos, func(info *Information, _ int) bool {
+		return info.SubDomain == subdomain
+	}), nil
+}
+
+func (e *DockerTaskRunner) Launch(ctx context.Context, subdomain string, option TaskParameter, taskdefs ...string) error {
+	if infos, err := e.Status(ctx, subdomain); err != nil {
+		return err
+	} else if len(infos) > 0 {
+		slog.Info(f("subdomain %s is already running container %s. Terminating...", subdomain, infos[0].ShortID))
+		if err := e.TerminateBySubdomain(ctx, subdomain); err != nil {
+			return err
+		}
+	}
+	cfg := e.cfg
+	taskdef := taskdefs[0]
+	cc := &dockerContainerConfig{
+		Image: e.docker.image(taskdef),
+		Labels: map[string]string{
+			dockerLabelSubdomain: subdomain,
+			dockerLabelTaskDef:   taskdef,
+		},
+	}
+	for _, kv := range option.ToECSKeyValuePairs(subdomain, cfg.Parameter, cfg.EncodeSubdomain) {
+		cc.Env = append(cc.Env, *kv.Name+"="+*kv.Value)
+	}
+	for _, t := range option.ToECSTags(subdomain, cfg.Parameter) {
+		cc.Labels[dockerLabelTagPrefix+*t.Key] = *t.Value
+	}
+	if _, command := option.command(); len(command) > 0 {
+		// the container of Docker is the only one, so the container name is ignored
+		cc.Cmd = command
+	}
+	containerPort := fmt.Sprintf("%d/tcp", e.docker.ContainerPort)
+	cc.ExposedPorts = map[string]struct{}{containerPort: {}}
+	if n := e.docker.Network; n != "" {
+		cc.HostConfig.NetworkMode = n
+	} else {
+		// publish to an ephemeral port of localhost
+		cc.HostConfig.PortBindings = map[string][]dockerPortBinding{
+			containerPort: {{HostIP: "127.0.0.1"}},
+		}
+	}
+	slog.Info(f("Launching a new container: subdomain=%s, taskdef=%s, image=%s", subdomain, taskdef, cc.Image))
+	id, err := e.docker.client.createContainer(ctx, cc)
+	if err != nil {
+		return err
+	}
+	if err := e.docker.client.startContainer(ctx, id); err != nil {
+		return fmt.Errorf("failed to start container %s: %w", id, err)
+	}
+	slog.Info(f("launched container %s", id))
+	infos, err := e.Status(ctx, subdomain)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.ID == id && info.IPAddress != "" {
+			e.proxyControlCh <- &proxyControl{
+				Action:    proxyAdd,
+				Subdomain: subdomain,
+				IPAddress: info.IPAddress,
+				Port:      info.PortMap["app"],
+			}
+		}
+	}
+	return nil
+}
+
+func (e *DockerTaskRunner) Logs(ctx context.Context, subdomain string, _ string, since time.Time, tail int) ([]LogEvent, error) {
+	infos, err := e.Status(ctx, subdomain)
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("subdomain %s is not found", subdomain)
+	}
+	return e.docker.client.logs(ctx, infos[0].ID, since, tail)
+}
+
+// FollowLogs is not supported by the Docker backend.
+func (e *DockerTaskRunner) FollowLogs(_ context.Context, _ string, _ string, _ time.Time, _ func([]LogEvent) error) error {
+	return errors.New("following logs is not supported by local_docker")
+}
+
+// Terminate stops the container of the ID.
+func (e *DockerTaskRunner) Terminate(ctx context.Context, id string) error {
+	infos, err := e.List(ctx, statusRunning)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.ID == id {
+			return e.TerminateBySubdomain(ctx, info.SubDomain)
+		}
+	}
+	return nil
+}
+
+func (e *DockerTaskRunner) TerminateBySubdomain(ctx context.Context, subdomain string) error {
+	infos, err := e.Status(ctx, subdomain)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		slog.Info(f("Stopping a container: subdomain=%s id=%s", subdomain, info.ShortID))
+		if err := e.docker.client.stopContainer(ctx, info.ID, e.docker.StopTimeout); err != nil {
+			return fmt.Errorf("failed to stop container %s: %w", info.ID, err)
+		}
+	}
+	if len(infos) > 0 {
+		e.proxyControlCh <- &proxyControl{
+			Action:    proxyRemove,
+			Subdomain: subdomain,
+		}
+	}
+	return nil
+}
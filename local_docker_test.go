@@ -0,0 +1,119 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func dockerLogFrame(stream byte, s string) []byte {
+	b := make([]byte, 8, 8+len(s))
+	b[0] = stream
+	binary.BigEndian.PutUint32(b[4:], uint32(len(s)))
+	return append(b, s...)
+}
+
+func TestSplitDockerLogs(t *testing.T) {
+	var b []byte
+	b = append(b, dockerLogFrame(1, "hello\n")...)
+	b = append(b, dockerLogFrame(2, "error\nworld\n")...)
+	if diff := cmp.Diff([]string{"hello", "error", "world"}, mirageecs.SplitDockerLogs(b)); diff != "" {
+		t.Errorf("unexpected lines %s", diff)
+	}
+	// tty has no header
+	if diff := cmp.Diff([]string{"foo", "bar"}, mirageecs.SplitDockerLogs([]byte("foo\nbar\n"))); diff != "" {
+		t.Errorf("unexpected lines %s", diff)
+	}
+}
+
+func TestDockerTaskRunner(t *testing.T) {
+	ctx := context.Background()
+	ld := &mirageecs.LocalDocker{
+		Images: map[string]string{"httpd": "nginx:alpine"},
+	}
+	if err := ld.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ld.Ping(ctx); err != nil {
+		t.Skipf("docker is not available: %s", err)
+	}
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.LocalDocker = ld
+	runner := cfg.NewTaskRunner()
+	ch := make(chan *mirageecs.ProxyControl, 10)
+	runner.SetProxyControlChannel(ch)
+
+	if err := runner.Launch(ctx, "docker-test", mirageecs.TaskParameter{"branch": "develop"}, "httpd"); err != nil {
+		t.Fatal(err)
+	}
+	infos, err := runner.Status(ctx, "docker-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("unexpected containers %d", len(infos))
+	}
+	info := infos[0]
+	t.Cleanup(func() {
+		ld.RemoveContainer(ctx, info.ID)
+	})
+	if info.IPAddress == "" || info.PortMap["app"] == 0 || info.GitBranch != "develop" {
+		t.Errorf("unexpected information %#v", info)
+	}
+
+	u := fmt.Sprintf("http://%s:%d/", info.IPAddress, info.PortMap["app"])
+	var status int
+	for i := 0; i < 50; i++ {
+		if res, err := http.Get(u); err == nil {
+			res.Body.Close()
+			status = res.StatusCode
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	if status != http.StatusOK {
+		t.Errorf("container is not responding at %s: %d", u, status)
+	}
+
+	if err := runner.TerminateBySubdomain(ctx, "docker-test"); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := runner.List(ctx, "STOPPED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range stopped {
+		found = found || s.ID == info.ID
+	}
+	if !found {
+		t.Errorf("container %s must be stopped", info.ID)
+	}
+}
+
+func TestParseDockerLogLine(t *testing.T) {
+	ev := mirageecs.ParseDockerLogLine("2024-01-01T00:00:01.123456789Z hello world")
+	expected := mirageecs.LogEvent{
+		Timestamp: time.Date(2024, 1, 1, 0, 0, 1, 123456789, time.UTC),
+		Message:   "hello world",
+	}
+	if diff := cmp.Diff(expected, ev); diff != "" {
+		t.Errorf("unexpected event (-want +got):\n%s", diff)
+	}
+	if ev := mirageecs.ParseDockerLogLine("no timestamp"); ev.Message != "no timestamp" || !ev.Timestamp.IsZero() {
+		t.Errorf("unexpected event %#v", ev)
+	}
+}
@@ -0,0 +1,143 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/samber/lo"
+)
+
+const DefaultMetricsPath = "/metrics"
+
+// Metrics configures the Prometheus exporter served apart from the reverse proxy.
+type Metrics struct {
+	Listen string `yaml:"listen"`
+	Path   string `yaml:"path"`
+}
+
+func (m *Metrics) Validate() error {
+	if m.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		return fmt.Errorf("invalid listen %s: %w", m.Listen, err)
+	}
+	if m.Path == "" {
+		m.Path = DefaultMetricsPath
+	}
+	if !strings.HasPrefix(m.Path, "/") {
+		return fmt.Errorf("path must start with /: %s", m.Path)
+	}
+	return nil
+}
+
+// taskEventCounts counts the tasks launched and terminated by mirage-ecs since the process started.
+type taskEventCounts struct {
+	launches     atomic.Int64
+	terminations atomic.Int64
+}
+
+func (m *Mirage) RunMetricsServer(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	cfg := m.Config.Metrics
+	if cfg == nil {
+		slog.Debug("Metrics is not configured")
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.Path, m.serveMetrics)
+	srv := &http.Server{Addr: cfg.Listen, Handler: mux}
+	go func() {
+		slog.Info(f("metrics listen addr: %s", cfg.Listen))
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error(f("metrics server failed: %s", err))
+		}
+	}()
+	<-ctx.Done()
+	srv.Close()
+	slog.Info("RunMetricsServer() is done")
+}
+
+// serveMetrics writes the metrics in the Prometheus text format.
+func (m *Mirage) serveMetrics(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), APICallTimeout)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	statuses := m.ReverseProxy.AllStatusTotals()
+	requests := make(map[string]int64, len(statuses))
+	for subdomain, counts := range statuses {
+		for _, n := range counts {
+			requests[subdomain] += n
+		}
+	}
+	writeMetricHeader(w, "mirage_ecs_requests_total", "counter", "Requests proxied to the subdomain.")
+	for _, subdomain := range sortedKeys(requests) {
+		writeMetric(w, "mirage_ecs_requests_total", requests[subdomain], "subdomain", subdomain)
+	}
+	writeMetricHeader(w, "mirage_ecs_responses_total", "counter", "Responses proxied from the subdomain by status class.")
+	for _, subdomain := range sortedKeys(statuses) {
+		for _, class := range sortedKeys(statuses[subdomain]) {
+			writeMetric(w, "mirage_ecs_responses_total", statuses[subdomain][class], "subdomain", subdomain, "status_class", class)
+		}
+	}
+
+	upstreams := m.ReverseProxy.Upstreams()
+	writeMetricHeader(w, "mirage_ecs_backends", "gauge", "Upstream addresses routed for the subdomain.")
+	for _, subdomain := range sortedKeys(upstreams) {
+		writeMetric(w, "mirage_ecs_backends", int64(len(upstreams[subdomain])), "subdomain", subdomain)
+	}
+
+	if running, err := m.runner.List(ctx, statusRunning); err != nil {
+		slog.Warn(f("failed to list tasks for metrics: %s", err))
+	} else {
+		tasks := make(map[string]int64)
+		for _, info := range running {
+			tasks[info.SubDomain]++
+		}
+		writeMetricHeader(w, "mirage_ecs_running_tasks", "gauge", "Tasks of the subdomain which desired status is RUNNING.")
+		for _, subdomain := range sortedKeys(tasks) {
+			writeMetric(w, "mirage_ecs_running_tasks", tasks[subdomain], "subdomain", subdomain)
+		}
+	}
+
+	counts := &m.WebApi.taskEvents
+	writeMetricHeader(w, "mirage_ecs_task_launches_total", "counter", "Subdomains launched by mirage-ecs.")
+	writeMetric(w, "mirage_ecs_task_launches_total", counts.launches.Load())
+	writeMetricHeader(w, "mirage_ecs_task_terminations_total", "counter", "Subdomains terminated or purged by mirage-ecs.")
+	writeMetric(w, "mirage_ecs_task_terminations_total", counts.terminations.Load())
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// writeMetric writes a sample with the labels given as name and value pairs.
+func writeMetric(w io.Writer, name string, value int64, labels ...string) {
+	if len(labels) == 0 {
+		fmt.Fprintf(w, "%s %d\n", name, value)
+		return
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	fmt.Fprintf(w, "%s{%s} %d\n", name, strings.Join(pairs, ","), value)
+}
+
+// labelValueEscaper escapes label values as the Prometheus text format requires.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := lo.Keys(m)
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,94 @@
+package mirageecs_test
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestServeMetrics(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 80, TargetPort: 80}}
+	m := mirageecs.New(ctx, cfg)
+
+	api := httptest.NewServer(m.WebApi)
+	defer api.Close()
+	res, err := http.Post(api.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"foo","branch":"develop","taskdef":["app:1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("launch failed %d", res.StatusCode)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+	m.ReverseProxy.AddSubdomain("foo", "127.0.0.1", port)
+	req := httptest.NewRequest(http.MethodGet, "http://foo.localtest.me/", nil)
+	m.ServeHTTPWithPort(httptest.NewRecorder(), req, 80)
+
+	ts := httptest.NewServer(http.HandlerFunc(m.ServeMetrics))
+	defer ts.Close()
+	res, err = http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	b, _ := io.ReadAll(res.Body)
+	body := string(b)
+	for _, expected := range []string{
+		"# TYPE mirage_ecs_requests_total counter",
+		`mirage_ecs_requests_total{subdomain="foo"} 1`,
+		`mirage_ecs_responses_total{subdomain="foo",status_class="2xx"} 1`,
+		`mirage_ecs_backends{subdomain="foo"} 1`,
+		`mirage_ecs_running_tasks{subdomain="foo"} 1`,
+		"mirage_ecs_task_launches_total 1",
+		"mirage_ecs_task_terminations_total 0",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("%s is not found in metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestMetricsValidate(t *testing.T) {
+	m := &mirageecs.Metrics{Listen: ":9100"}
+	if err := m.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if m.Path != mirageecs.DefaultMetricsPath {
+		t.Errorf("unexpected default path %s", m.Path)
+	}
+	for _, m := range []*mirageecs.Metrics{
+		{},
+		{Listen: "9100"},
+		{Listen: ":9100", Path: "metrics"},
+	} {
+		if err := m.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", m)
+		}
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"net"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/samber/lo"
 )
 
 var Version = "current"
@@ -23,6 +26,11 @@ type Mirage struct {
 
 	runner         TaskRunner
 	proxyControlCh chan *proxyControl
+	syncMu         sync.Mutex
+	sleeping       *sleepingSubdomains
+	launching      *launchingSubdomains
+	// terminating are the IDs of the tasks failed to start and being terminated in background.
+	terminating sync.Map
 }
 
 func New(ctx context.Context, cfg *Config) *Mirage {
@@ -37,7 +45,16 @@ func New(ctx context.Context, cfg *Config) *Mirage {
 		Route53:        NewRoute53(ctx, cfg),
 		runner:         runner,
 		proxyControlCh: ch,
+		sleeping:       newSleepingSubdomains(),
+		launching:      newLaunchingSubdomains(),
 	}
+	m.ReverseProxy.putAccessCounts = runner.PutAccessCounts
+	m.ReverseProxy.pages = m.WebApi.renderer
+	m.WebApi.syncRouting = m.syncRouting
+	m.WebApi.healthOf = m.ReverseProxy.Health
+	m.WebApi.forgetSleeping = m.sleeping.forget
+	m.WebApi.markLaunching = m.launching.add
+	m.WebApi.statusTotalsOf = m.ReverseProxy.StatusTotals
 	return m
 }
 
@@ -45,6 +62,9 @@ func (m *Mirage) Run(ctx context.Context) error {
 	var wg sync.WaitGroup
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	// drainCtx bounds the graceful shutdown after ctx is done
+	drainCtx, drainCancel := drainContext(ctx, m.Config.Network.DrainTimeout)
+	defer drainCancel()
 	errors := make(chan error, 10)
 	for _, v := range m.Config.Listen.HTTP {
 		wg.Add(1)
@@ -59,8 +79,11 @@ func (m *Mirage) Run(ctx context.Context) error {
 				return
 			}
 
+			inflight := newInflightRequests()
 			mux := http.NewServeMux()
 			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				done := inflight.track(req)
+				defer done()
 				m.ServeHTTPWithPort(w, req, port)
 			})
 			slog.Info(f("listen addr: %s", laddr))
@@ -70,15 +93,27 @@ func (m *Mirage) Run(ctx context.Context) error {
 			go srv.Serve(listener)
 			<-ctx.Done()
 			slog.Info(f("shutdown server: %s", laddr))
-			srv.Shutdown(ctx)
+			if err := srv.Shutdown(drainCtx); err != nil {
+				slog.Warn(f("shutdown server %s: drain timeout %s exceeded: %s", laddr, m.Config.Network.DrainTimeout, err))
+				if reqs := inflight.list(time.Now()); len(reqs) > 0 {
+					slog.Warn(f("requests still in flight on %s: %s", laddr, strings.Join(reqs, ", ")))
+				}
+				srv.Close()
+			}
 		}(v.ListenPort)
 	}
 
-	wg.Add(3)
+	wg.Add(6)
 	go m.syncECSToMirage(ctx, &wg)
 	go m.RunAccessCountCollector(ctx, &wg)
 	go m.RunScheduledPurger(ctx, &wg)
+	go m.RunHealthChecker(ctx, &wg)
+	go m.RunScaleToZero(ctx, &wg)
+	go m.RunMetricsServer(ctx, &wg)
 	wg.Wait()
+	if err := m.ReverseProxy.Shutdown(drainCtx); err != nil {
+		slog.Warn(f("failed to flush access counters on shutdown: %s", err))
+	}
 	slog.Info("shutdown mirage-ecs")
 	select {
 	case err := <-errors:
@@ -90,16 +125,41 @@ func (m *Mirage) Run(ctx context.Context) error {
 }
 
 func (m *Mirage) ServeHTTPWithPort(w http.ResponseWriter, req *http.Request, port int) {
-	host := strings.ToLower(strings.Split(req.Host, ":")[0])
+	host := hostWithoutPort(req.Host)
 
 	switch {
 	case m.isWebApiHost(host):
 		m.WebApi.ServeHTTP(w, req)
 
+	case strings.HasSuffix(host, m.Config.Host.ReverseProxySuffix) && m.Config.checkProxyHost(req.Host) != nil:
+		slog.Warn(f("invalid host: %s", req.Host))
+		http.Error(w, "invalid host", http.StatusBadRequest)
+
 	case m.isTaskHost(host):
 		m.ReverseProxy.ServeHTTPWithPort(w, req, port)
 
 	case strings.HasSuffix(host, m.Config.Host.ReverseProxySuffix):
+		subdomain := subdomainFromHost(host, m.Config.Host.ReverseProxySuffix)
+		// a sleeping or launching subdomain may be the first label of the multi-label subdomain
+		candidates := []string{subdomain}
+		if label := firstLabel(subdomain); label != subdomain {
+			candidates = append(candidates, label)
+		}
+		for _, s := range candidates {
+			if ss, ok := m.sleeping.get(s); ok {
+				if m.ReverseProxy.allowWake(w, req, s, port) {
+					m.serveSleeping(w, ss)
+				}
+				return
+			}
+			if m.launching.has(s) {
+				m.serveLaunching(w, s)
+				return
+			}
+		}
+		if m.ReverseProxy.ServeCatchAll(w, req, port) {
+			return
+		}
 		msg := fmt.Sprintf("%s is not found", host)
 		slog.Warn(msg)
 		http.Error(w, msg, http.StatusNotFound)
@@ -113,7 +173,7 @@ func (m *Mirage) ServeHTTPWithPort(w http.ResponseWriter, req *http.Request, por
 
 func (m *Mirage) isTaskHost(host string) bool {
 	if strings.HasSuffix(host, m.Config.Host.ReverseProxySuffix) {
-		subdomain := strings.ToLower(strings.Split(host, ".")[0])
+		subdomain := subdomainFromHost(host, m.Config.Host.ReverseProxySuffix)
 		return m.ReverseProxy.Exists(subdomain)
 	}
 
@@ -145,6 +205,25 @@ func (m *Mirage) RunAccessCountCollector(ctx context.Context, wg *sync.WaitGroup
 		s, _ := json.Marshal(all)
 		slog.Info(f("access counters: %s", string(s)))
 		m.runner.PutAccessCounts(ctx, all)
+		m.alertAccessRates(all)
+		// collect always not to accumulate the counts
+		if statuses := m.ReverseProxy.CollectStatusCounts(); m.Config.ECS.StatusClassMetrics && len(statuses) > 0 {
+			m.runner.PutStatusCounts(ctx, statuses)
+		}
+		if latencies := m.ReverseProxy.CollectLatencies(); m.Config.ECS.LatencyMetrics && len(latencies) > 0 {
+			m.runner.PutLatencyMetrics(ctx, latencies)
+		}
+	}
+}
+
+func (m *Mirage) alertAccessRates(all map[string]accessCount) {
+	a := m.Config.AccessAlert
+	if a == nil {
+		return
+	}
+	for _, ev := range a.Evaluate(all, m.ReverseProxy.accessCounterUnit) {
+		slog.Warn(f("access rate of %s is %.1f req/min (threshold %.1f)", ev.Subdomain, ev.RequestsPerMinute, ev.Threshold))
+		postWebhookInBackground(a.WebhookURL, ev)
 	}
 }
 
@@ -155,38 +234,67 @@ func (m *Mirage) RunScheduledPurger(ctx context.Context, wg *sync.WaitGroup) {
 		slog.Debug("Purge is not configured")
 		return
 	}
-	slog.Info(f("starting up RunScheduledPurger() schedule: %s", p.Cron.String()))
+	runScheduledPurge(ctx, p, realPurgeClock, m.WebApi.scheduledPurge)
+}
+
+// purgeClock is the clock of the scheduled purger. It is replaced by a fake clock in tests.
+type purgeClock struct {
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+var realPurgeClock = purgeClock{now: time.Now, after: time.After}
+
+// runScheduledPurge invokes purge on the schedule of p until ctx is done.
+func runScheduledPurge(ctx context.Context, p *Purge, clock purgeClock, purge func(context.Context, *PurgeParams) error) {
+	slog.Info(f("starting up RunScheduledPurger() schedule: %s timezone: %s", p.Cron.String(), p.Location))
 	for {
-		now := time.Now().Add(time.Minute)
-		next := p.Cron.Next(now)
+		now := clock.now()
+		next := p.Next(now.Add(time.Minute))
 		slog.Info(f("next purge invocation at: %s", next))
-		duration := time.Until(next)
 		select {
 		case <-ctx.Done():
 			slog.Info("RunScheduledPurger() is done")
 			return
-		case <-time.After(duration):
-			slog.Info("scheduled purge invoked")
-			if err := m.WebApi.purge(ctx, p.PurgeParams); err != nil {
-				slog.Warn(err.Error())
-			}
+		case <-clock.after(next.Sub(now)):
+			invokeScheduledPurge(ctx, p, purge)
 		}
 	}
 }
 
+// invokeScheduledPurge invokes purge once. A panic in purge doesn't stop the scheduler.
+func invokeScheduledPurge(ctx context.Context, p *Purge, purge func(context.Context, *PurgeParams) error) {
+	defer func() {
+		if err := recover(); err != nil {
+			slog.Error(f("scheduled purge panicked: %v", err))
+		}
+	}()
+	slog.Info("scheduled purge invoked")
+	if err := purge(ctx, p.PurgeParams); err != nil {
+		slog.Warn(f("scheduled purge failed: %s", err))
+		return
+	}
+	slog.Info("scheduled purge completed")
+}
+
 const (
 	CloudWatchMetricNameSpace = "mirage-ecs"
 	CloudWatchMetricName      = "RequestCount"
 	CloudWatchDimensionName   = "subdomain"
+
+	CloudWatchStatusClassDimensionName = "status_class"
+
+	CloudWatchLatencyMetricName       = "UpstreamLatency"
+	CloudWatchPercentileDimensionName = "percentile"
 )
 
 func (app *Mirage) syncECSToMirage(ctx context.Context, wg *sync.WaitGroup) {
 	wg.Done()
 	slog.Debug("starting up syncECSToMirage()")
 	rp := app.ReverseProxy
-	r53 := app.Route53
 	ticker := time.NewTicker(time.Second * 10)
 	defer ticker.Stop()
+	app.addLocalRoutes(make(map[string]bool))
 
 SYNC:
 	for {
@@ -201,45 +309,137 @@ SYNC:
 			return
 		}
 
-		running, err := app.runner.List(ctx, statusRunning)
-		if err != nil {
+		if _, err := app.syncRouting(ctx); err != nil {
 			slog.Warn(err.Error())
-			continue
 		}
-		sort.SliceStable(running, func(i, j int) bool {
-			return running[i].Created.Before(running[j].Created)
-		})
-		available := make(map[string]bool)
-		for _, info := range running {
-			slog.Debug(f("running task %s", info.ID))
-			if info.IPAddress != "" {
-				available[info.SubDomain] = true
-				for name, port := range info.PortMap {
-					rp.AddSubdomain(info.SubDomain, info.IPAddress, port)
-					r53.Add(name+"."+info.SubDomain, info.IPAddress)
+	}
+}
+
+// RoutingChanges represents changes of the proxy routing applied by syncRouting.
+type RoutingChanges struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// syncRouting reconciles the proxy routing and Route53 records with the tasks.
+func (app *Mirage) syncRouting(ctx context.Context) (*RoutingChanges, error) {
+	app.syncMu.Lock()
+	defer app.syncMu.Unlock()
+	rp := app.ReverseProxy
+	r53 := app.Route53
+
+	running, err := app.runner.List(ctx, statusRunning)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(running, func(i, j int) bool {
+		return running[i].Created.Before(running[j].Created)
+	})
+	if app.Config.ECS.TerminateOnStartDeadline {
+		app.terminateStartFailed(ctx, running)
+	}
+	current := make(map[string]bool)
+	for _, subdomain := range rp.Subdomains() {
+		current[subdomain] = true
+	}
+	changes := &RoutingChanges{
+		Added:   []string{},
+		Removed: []string{},
+	}
+
+	available := make(map[string]bool)
+	responseHeaders := make(map[string]http.Header)
+	// re-register every time, so the handlers never expire
+	app.addLocalRoutes(available)
+	// the draining tasks are still running until stopped, but must not be routed again
+	running = lo.Filter(running, func(info *Information, _ int) bool {
+		return info.IPAddress == "" || !rp.Draining(info.IPAddress)
+	})
+	for _, info := range running {
+		slog.Debug(f("running task %s", info.ID))
+		if info.IPAddress != "" {
+			available[info.SubDomain] = true
+			header := app.Config.Network.ResponseHeaders.For(info)
+			for name, port := range info.PortMap {
+				// the other ports are routed only when listen.http[] targets them
+				for _, m := range info.PortMappings[name] {
+					if m.HostPort != port && app.Config.Listen.hasTargetPort(m.HostPort) {
+						rp.AddSubdomain(info.SubDomain, info.IPAddress, m.HostPort)
+					}
+				}
+				rp.AddSubdomain(info.SubDomain, info.IPAddress, port)
+				r53.Add(name+"."+info.SubDomain, info.IPAddress)
+				if header != nil {
+					for _, m := range info.PortMappings[name] {
+						responseHeaders[net.JoinHostPort(info.IPAddress, strconv.Itoa(m.HostPort))] = header
+					}
+					responseHeaders[net.JoinHostPort(info.IPAddress, strconv.Itoa(port))] = header
 				}
 			}
 		}
+	}
+	rp.SetResponseHeaders(responseHeaders)
+	pending := make(map[string]bool)
+	for _, info := range running {
+		if !available[info.SubDomain] && !info.StartFailed {
+			pending[info.SubDomain] = true
+		}
+	}
+	app.launching.update(pending, available, time.Now())
+	for _, subdomain := range rp.Subdomains() {
+		if !current[subdomain] {
+			changes.Added = append(changes.Added, subdomain)
+		}
+	}
 
-		stopped, err := app.runner.List(ctx, statusStopped)
-		if err != nil {
-			slog.Warn(err.Error())
-			continue
+	stopped, err := app.runner.List(ctx, statusStopped)
+	if err != nil {
+		return changes, err
+	}
+	for _, info := range stopped {
+		slog.Debug(f("stopped task %s", info.ID))
+		for name := range info.PortMap {
+			r53.Delete(name+"."+info.SubDomain, info.IPAddress)
 		}
-		for _, info := range stopped {
-			slog.Debug(f("stopped task %s", info.ID))
-			for name := range info.PortMap {
-				r53.Delete(name+"."+info.SubDomain, info.IPAddress)
-			}
+	}
+
+	for _, subdomain := range rp.Subdomains() {
+		if !available[subdomain] {
+			rp.RemoveSubdomain(subdomain)
+			changes.Removed = append(changes.Removed, subdomain)
 		}
+	}
+	if err := r53.Apply(ctx); err != nil {
+		slog.Warn(err.Error())
+	}
+	return changes, nil
+}
 
-		for _, subdomain := range rp.Subdomains() {
-			if !available[subdomain] {
-				rp.RemoveSubdomain(subdomain)
-			}
+func (app *Mirage) addLocalRoutes(available map[string]bool) {
+	for _, route := range app.Config.LocalRoutes {
+		available[route.Subdomain] = true
+		app.ReverseProxy.AddSubdomain(route.Subdomain, route.Address, route.Port)
+	}
+}
+
+// terminateStartFailed terminates the tasks failed to start in background,
+// not to block the sync loop consuming the proxy controls while draining them.
+func (app *Mirage) terminateStartFailed(ctx context.Context, infos []*Information) {
+	for _, info := range infos {
+		if !info.StartFailed {
+			continue
 		}
-		if err := r53.Apply(ctx); err != nil {
-			slog.Warn(err.Error())
+		if _, loaded := app.terminating.LoadOrStore(info.ID, true); loaded {
+			continue // terminating by the previous sync
 		}
+		slog.Warn(f("terminating task %s of subdomain %s: %s", info.ShortID, info.SubDomain, info.StartFailedReason))
+		go func(info *Information) {
+			defer app.terminating.Delete(info.ID)
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), APICallTimeout)
+			defer cancel()
+			if err := app.runner.Terminate(ctx, info.ID); err != nil {
+				slog.Warn(f("failed to terminate task %s: %s", info.ShortID, err))
+			}
+		}(info)
 	}
 }
@@ -0,0 +1,90 @@
+package mirageecs
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	NotificationEventLaunched   = "launched"
+	NotificationEventTerminated = "terminated"
+
+	// NotificationSignatureHeader is the header of HMAC-SHA256 signature of the payload.
+	NotificationSignatureHeader = "X-Mirage-Signature"
+)
+
+var notificationRetryInterval = time.Second
+
+// Notification configures the webhook notified when tasks are launched and terminated.
+type Notification struct {
+	WebhookURL string `yaml:"webhook_url"`
+	Secret     string `yaml:"secret"`
+}
+
+func (n *Notification) Validate() error {
+	if n.WebhookURL == "" {
+		return fmt.Errorf("webhook_url is required")
+	}
+	return nil
+}
+
+// NotificationEvent is a payload of the notification webhook.
+type NotificationEvent struct {
+	Event     string    `json:"event"`
+	Subdomain string    `json:"subdomain"`
+	Taskdef   string    `json:"taskdef"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// sign returns the signature of the payload as "sha256=<hex>", or empty if secret is not set.
+func (n *Notification) sign(payload []byte) string {
+	if n.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post posts the event to the webhook. It retries once after retryInterval on failure.
+func (n *Notification) post(ctx context.Context, ev *NotificationEvent, retryInterval time.Duration) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification payload: %w", err)
+	}
+	header := http.Header{}
+	if sig := n.sign(b); sig != "" {
+		header.Set(NotificationSignatureHeader, sig)
+	}
+	err = postWebhookBody(ctx, n.WebhookURL, b, header)
+	if err == nil {
+		return nil
+	}
+	slog.Warn(f("notification failed, retrying: %s", err))
+	select {
+	case <-time.After(retryInterval):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return postWebhookBody(ctx, n.WebhookURL, b, header)
+}
+
+// notifyInBackground posts the event without blocking the caller.
+// Errors are only logged not to fail launching and terminating.
+func (n *Notification) notifyInBackground(ev *NotificationEvent) {
+	if n == nil {
+		return
+	}
+	go func() {
+		if err := n.post(context.Background(), ev, notificationRetryInterval); err != nil {
+			slog.Warn(f("notification of %s %s failed: %s", ev.Event, ev.Subdomain, err))
+		}
+	}()
+}
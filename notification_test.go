@@ -0,0 +1,89 @@
+package mirageecs_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestNotification(t *testing.T) {
+	var calls int
+	var body []byte
+	var signature string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ = io.ReadAll(r.Body)
+		signature = r.Header.Get(mirageecs.NotificationSignatureHeader)
+	}))
+	defer ts.Close()
+
+	n := &mirageecs.Notification{WebhookURL: ts.URL, Secret: "s3cr3t"}
+	ev := &mirageecs.NotificationEvent{
+		Event:     mirageecs.NotificationEventLaunched,
+		Subdomain: "foo",
+		Taskdef:   "app:1",
+		Timestamp: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC),
+	}
+	if err := n.Post(context.Background(), ev, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Errorf("notification must be retried once: %d calls", calls)
+	}
+
+	var got map[string]interface{}
+	if err := json.Unmarshal(body, &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"event":     "launched",
+		"subdomain": "foo",
+		"taskdef":   "app:1",
+		"timestamp": "2023-07-01T12:00:00Z",
+	}
+	if diff := cmp.Diff(expected, got); diff != "" {
+		t.Errorf("unexpected payload (-want +got):\n%s", diff)
+	}
+
+	mac := hmac.New(sha256.New, []byte("s3cr3t"))
+	mac.Write(body)
+	if expected := "sha256=" + hex.EncodeToString(mac.Sum(nil)); signature != expected {
+		t.Errorf("unexpected signature %s, expected %s", signature, expected)
+	}
+}
+
+func TestNotificationFailed(t *testing.T) {
+	var calls int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get(mirageecs.NotificationSignatureHeader) != "" {
+			t.Error("signature must not be sent without secret")
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	n := &mirageecs.Notification{WebhookURL: ts.URL}
+	err := n.Post(context.Background(), &mirageecs.NotificationEvent{Event: mirageecs.NotificationEventTerminated}, time.Millisecond)
+	if err == nil {
+		t.Error("notification must fail")
+	}
+	if calls != 2 {
+		t.Errorf("notification must be retried only once: %d calls", calls)
+	}
+}
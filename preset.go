@@ -0,0 +1,66 @@
+package mirageecs
+
+import (
+	"fmt"
+)
+
+// Preset is a named set of task definitions and parameter values to launch.
+type Preset struct {
+	Name       string            `yaml:"name"`
+	Taskdefs   []string          `yaml:"taskdefs"`
+	Parameters map[string]string `yaml:"parameters"`
+}
+
+func (p *Preset) Validate(params Parameters) error {
+	if p.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if len(p.Taskdefs) == 0 {
+		return fmt.Errorf("taskdefs of preset %s is required", p.Name)
+	}
+	for name := range p.Parameters {
+		if !params.has(name) {
+			return fmt.Errorf("parameter %s of preset %s is not defined in parameters", name, p.Name)
+		}
+	}
+	return nil
+}
+
+func (ps Parameters) has(name string) bool {
+	for _, p := range ps {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Preset returns the preset of the name.
+func (c *Config) Preset(name string) (*Preset, bool) {
+	for _, p := range c.Presets {
+		if p.Name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+// ApplyPreset expands the preset to the request. The values of the request take precedence.
+func (r *APILaunchRequest) ApplyPreset(p *Preset) {
+	if len(r.Taskdef) == 0 {
+		r.Taskdef = p.Taskdefs
+	}
+	if r.Parameters == nil {
+		r.Parameters = make(map[string]string, len(p.Parameters))
+	}
+	for name, value := range p.Parameters {
+		if r.GetParameter(name) != "" {
+			continue
+		}
+		if name == "branch" {
+			r.Branch = value
+		} else {
+			r.Parameters[name] = value
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+var testPreset = &mirageecs.Preset{
+	Name:     "standard",
+	Taskdefs: []string{"frontend:1", "backend:2"},
+	Parameters: map[string]string{
+		"branch":      "main",
+		"launched_by": "preset",
+	},
+}
+
+func TestApplyPreset(t *testing.T) {
+	tests := []struct {
+		name     string
+		req      mirageecs.APILaunchRequest
+		expected mirageecs.APILaunchRequest
+	}{
+		{
+			name: "preset only",
+			req:  mirageecs.APILaunchRequest{Subdomain: "foo"},
+			expected: mirageecs.APILaunchRequest{
+				Subdomain:  "foo",
+				Branch:     "main",
+				Taskdef:    []string{"frontend:1", "backend:2"},
+				Parameters: map[string]string{"launched_by": "preset"},
+			},
+		},
+		{
+			name: "request overrides preset",
+			req: mirageecs.APILaunchRequest{
+				Subdomain:  "foo",
+				Branch:     "feature/x",
+				Taskdef:    []string{"frontend:3"},
+				Parameters: map[string]string{"launched_by": "me"},
+			},
+			expected: mirageecs.APILaunchRequest{
+				Subdomain:  "foo",
+				Branch:     "feature/x",
+				Taskdef:    []string{"frontend:3"},
+				Parameters: map[string]string{"launched_by": "me"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.req
+			r.ApplyPreset(testPreset)
+			if diff := cmp.Diff(tt.expected, r); diff != "" {
+				t.Errorf("unexpected request (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPresetValidate(t *testing.T) {
+	params := mirageecs.Parameters{{Name: "branch"}, {Name: "launched_by"}}
+	if err := testPreset.Validate(params); err != nil {
+		t.Errorf("preset should be valid: %s", err)
+	}
+	invalid := []*mirageecs.Preset{
+		{Taskdefs: []string{"app:1"}},
+		{Name: "no-taskdefs"},
+		{Name: "undefined", Taskdefs: []string{"app:1"}, Parameters: map[string]string{"unknown": "x"}},
+	}
+	for _, p := range invalid {
+		if err := p.Validate(params); err == nil {
+			t.Errorf("preset %#v should be invalid", p)
+		}
+	}
+}
+
+func TestApiLaunchUndefinedPreset(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Presets = []*mirageecs.Preset{{Name: "standard", Taskdefs: []string{"app:1"}}}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"foo","preset":"missing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+	var r mirageecs.APICommonResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Result != "preset missing is not defined" {
+		t.Errorf("unexpected result %s", r.Result)
+	}
+}
@@ -2,16 +2,27 @@ package mirageecs
 
 import (
 	"fmt"
+	"time"
+	_ "time/tzdata" // the container image may not have the zoneinfo for purge.timezone
 
 	"github.com/winebarrel/cronplan"
 )
 
+const (
+	// DefaultPurgeConcurrency is the default number of concurrent access count checks in purge.
+	DefaultPurgeConcurrency = 1
+	// DefaultPurgeTerminateInterval is the default interval between terminations in purge.
+	DefaultPurgeTerminateInterval = 3 * time.Second
+)
+
 type Purge struct {
 	Schedule string           `json:"schedule" yaml:"schedule"`
+	Timezone string           `json:"timezone" yaml:"timezone"` // IANA time zone name of the schedule. default UTC
 	Request  *APIPurgeRequest `json:"request" yaml:"request"`
 
 	PurgeParams *PurgeParams         `json:"-" yaml:"-"`
 	Cron        *cronplan.Expression `json:"-" yaml:"-"`
+	Location    *time.Location       `json:"-" yaml:"-"`
 }
 
 func (p *Purge) Validate() error {
@@ -21,6 +32,15 @@ func (p *Purge) Validate() error {
 	}
 	p.Cron = cron
 
+	p.Location = time.UTC
+	if p.Timezone != "" {
+		loc, err := time.LoadLocation(p.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %s: %w", p.Timezone, err)
+		}
+		p.Location = loc
+	}
+
 	if p.Request == nil {
 		return fmt.Errorf("purge request is required")
 	}
@@ -32,3 +52,54 @@ func (p *Purge) Validate() error {
 
 	return nil
 }
+
+// Next returns the next time of the schedule after now, evaluated in the timezone.
+func (p *Purge) Next(now time.Time) time.Time {
+	return p.Cron.Next(now.In(p.Location))
+}
+
+// PurgeEvaluation is the result of purge rules evaluated for a task.
+type PurgeEvaluation struct {
+	ID        string     `json:"id"`
+	Created   time.Time  `json:"created"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// Candidate is true when the task is purged unless it is accessed in the duration.
+	Candidate bool `json:"candidate"`
+	// Expired is true when the task is purged regardless of access.
+	Expired bool   `json:"expired"`
+	Reason  string `json:"reason"`
+}
+
+// evaluatePurge evaluates purge rules for the task in the same order as purge.
+// The access count is not checked here.
+func evaluatePurge(info *Information, p *PurgeParams, retained map[string]struct{}, now time.Time) *PurgeEvaluation {
+	ev := &PurgeEvaluation{
+		ID:        info.ID,
+		Created:   info.Created,
+		ExpiresAt: info.ExpiresAt,
+	}
+	if _, ok := retained[info.SubDomain]; ok {
+		ev.Reason = f("latest subdomain of branch %s", info.GitBranch)
+		return ev
+	}
+	if reason := info.purgeExclusionReason(p); reason != "" {
+		ev.Reason = reason
+		return ev
+	}
+	if info.Expired(now) {
+		ev.Candidate, ev.Expired = true, true
+		ev.Reason = f("exceeds max lifetime at %s", info.ExpiresAt.Format(time.RFC3339))
+		return ev
+	}
+	if info.inPurgeGracePeriod(p, now) {
+		ev.Reason = f("in grace period of min_age %s: %s", p.MinAge, info.Created.Format(time.RFC3339))
+		return ev
+	}
+	if info.Created.After(now.Add(-p.Duration)) {
+		ev.Reason = f("recent created: %s", info.Created.Format(time.RFC3339))
+		return ev
+	}
+	ev.Candidate = true
+	ev.Reason = f("created before %s", p.Duration)
+	return ev
+}
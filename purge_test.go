@@ -1,10 +1,12 @@
 package mirageecs_test
 
 import (
+	"context"
 	"testing"
 	"time"
 
 	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/google/go-cmp/cmp"
 	"github.com/kayac/go-config"
 )
 
@@ -46,3 +48,91 @@ purge:
 		t.Errorf("unexpected exclude_regexp: %v", cfg.Purge.PurgeParams.ExcludeRegexp)
 	}
 }
+
+func TestRunScheduledPurge(t *testing.T) {
+	p := &mirageecs.Purge{
+		Schedule: "*/5 * * * ? *",
+		Request:  &mirageecs.APIPurgeRequest{Duration: "300"},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	now := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+	clock := func() time.Time { return now }
+	after := func(d time.Duration) <-chan time.Time {
+		if ctx.Err() != nil {
+			return nil // never fires after cancel
+		}
+		now = now.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- now
+		return ch
+	}
+	var invoked []time.Time
+	purge := func(_ context.Context, params *mirageecs.PurgeParams) error {
+		invoked = append(invoked, now)
+		if params != p.PurgeParams {
+			t.Errorf("unexpected params %#v", params)
+		}
+		switch len(invoked) {
+		case 1:
+			panic("purge panicked")
+		case 3:
+			cancel()
+		}
+		return nil
+	}
+	mirageecs.RunScheduledPurge(ctx, p, clock, after, purge)
+
+	expected := []time.Time{
+		time.Date(2024, 1, 1, 0, 5, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 0, 10, 0, 0, time.UTC),
+		time.Date(2024, 1, 1, 0, 15, 0, 0, time.UTC),
+	}
+	if diff := cmp.Diff(expected, invoked); diff != "" {
+		t.Errorf("unexpected invocations (-want +got):\n%s", diff)
+	}
+}
+
+func TestPurgeTimezone(t *testing.T) {
+	tests := []struct {
+		timezone string
+		expected time.Time
+	}{
+		{
+			// 09:00 JST is 00:00 UTC
+			timezone: "Asia/Tokyo",
+			expected: time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			timezone: "",
+			expected: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC),
+		},
+	}
+	now := time.Date(2024, 1, 1, 0, 30, 0, 0, time.UTC)
+	for _, tt := range tests {
+		p := &mirageecs.Purge{
+			Schedule: "0 9 * * ? *",
+			Timezone: tt.timezone,
+			Request:  &mirageecs.APIPurgeRequest{Duration: "300"},
+		}
+		if err := p.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		if next := p.Next(now); !next.Equal(tt.expected) {
+			t.Errorf("timezone %q: unexpected next %s", tt.timezone, next)
+		}
+	}
+
+	p := &mirageecs.Purge{
+		Schedule: "0 9 * * ? *",
+		Timezone: "Mars/Olympus_Mons",
+		Request:  &mirageecs.APIPurgeRequest{Duration: "300"},
+	}
+	if err := p.Validate(); err == nil {
+		t.Error("invalid timezone must be an error")
+	}
+}
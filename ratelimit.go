@@ -0,0 +1,103 @@
+package mirageecs
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitClientsPruneInterval is the interval to forget the idle clients of the rate limiter.
+var rateLimitClientsPruneInterval = time.Minute
+
+// RateLimit configures the token-bucket rate limit of the requests to each subdomain.
+type RateLimit struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	// PerClient limits the requests of each client IP address to the subdomain.
+	PerClient bool `yaml:"per_client"`
+}
+
+func (r *RateLimit) Validate() error {
+	if r.RequestsPerSecond <= 0 {
+		return fmt.Errorf("requests_per_second must be positive: %v", r.RequestsPerSecond)
+	}
+	if r.Burst == 0 {
+		r.Burst = int(math.Ceil(r.RequestsPerSecond))
+	}
+	if r.Burst < 0 {
+		return fmt.Errorf("burst must be positive: %d", r.Burst)
+	}
+	return nil
+}
+
+func (r *RateLimit) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(rate.Limit(r.RequestsPerSecond), r.Burst)
+}
+
+// subdomainRateLimiter limits the requests to a subdomain.
+type subdomainRateLimiter struct {
+	cfg      *RateLimit
+	mu       sync.Mutex
+	limiter  *rate.Limiter
+	clients  map[string]*rate.Limiter
+	prunedAt time.Time
+}
+
+func newSubdomainRateLimiter(cfg *RateLimit) *subdomainRateLimiter {
+	l := &subdomainRateLimiter{cfg: cfg, prunedAt: time.Now()}
+	if cfg.PerClient {
+		l.clients = make(map[string]*rate.Limiter)
+	} else {
+		l.limiter = cfg.newLimiter()
+	}
+	return l
+}
+
+// allow reports whether the request of the client is allowed.
+// When not allowed, it returns the duration to wait for the next token.
+func (l *subdomainRateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	limiter := l.limiter
+	if l.cfg.PerClient {
+		l.pruneClients(now)
+		limiter = l.clients[client]
+		if limiter == nil {
+			limiter = l.cfg.newLimiter()
+			l.clients[client] = limiter
+		}
+	}
+	r := limiter.ReserveN(now, 1)
+	if !r.OK() {
+		// burst is zero
+		return false, time.Second
+	}
+	if d := r.DelayFrom(now); d > 0 {
+		r.CancelAt(now)
+		return false, d
+	}
+	return true, 0
+}
+
+// pruneClients forgets the clients whose buckets are full, which are the same as new ones.
+func (l *subdomainRateLimiter) pruneClients(now time.Time) {
+	if now.Sub(l.prunedAt) < rateLimitClientsPruneInterval {
+		return
+	}
+	l.prunedAt = now
+	for client, limiter := range l.clients {
+		if limiter.TokensAt(now) >= float64(l.cfg.Burst) {
+			delete(l.clients, client)
+		}
+	}
+}
+
+func serveTooManyRequests(w http.ResponseWriter, subdomain string, retryAfter time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	http.Error(w, fmt.Sprintf("Too many requests to %s", subdomain), http.StatusTooManyRequests)
+}
@@ -0,0 +1,117 @@
+package mirageecs_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestReverseProxyRateLimit(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	newProxy := func(rl *mirageecs.RateLimit) *mirageecs.ReverseProxy {
+		cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+			LocalMode: true,
+			Domain:    "example.net",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+		if err := rl.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.Network.RateLimit = rl
+		rp := mirageecs.NewReverseProxy(cfg)
+		rp.AddSubdomain("aaa", "127.0.0.1", port)
+		rp.AddSubdomain("bbb", "127.0.0.1", port)
+		return rp
+	}
+	serve := func(rp *mirageecs.ReverseProxy, subdomain, client string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = subdomain + ".example.net"
+		req.RemoteAddr = client + ":12345"
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 8080)
+		return rec
+	}
+
+	t.Run("per subdomain", func(t *testing.T) {
+		rp := newProxy(&mirageecs.RateLimit{RequestsPerSecond: 0.1, Burst: 2})
+		for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+			rec := serve(rp, "aaa", "10.0.0.1")
+			if rec.Code != want {
+				t.Errorf("request %d: unexpected status %d, want %d", i, rec.Code, want)
+			}
+			if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "10" {
+				t.Errorf("unexpected Retry-After %q", rec.Header().Get("Retry-After"))
+			}
+		}
+		// the other client shares the bucket of the subdomain
+		if rec := serve(rp, "aaa", "10.0.0.2"); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("unexpected status of the other client %d", rec.Code)
+		}
+		// the other subdomain has its own bucket
+		if rec := serve(rp, "bbb", "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Errorf("unexpected status of the other subdomain %d", rec.Code)
+		}
+	})
+
+	t.Run("per client", func(t *testing.T) {
+		rp := newProxy(&mirageecs.RateLimit{RequestsPerSecond: 0.1, Burst: 1, PerClient: true})
+		if rec := serve(rp, "aaa", "10.0.0.1"); rec.Code != http.StatusOK {
+			t.Errorf("unexpected status %d", rec.Code)
+		}
+		if rec := serve(rp, "aaa", "10.0.0.1"); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("unexpected status %d", rec.Code)
+		}
+		if rec := serve(rp, "aaa", "10.0.0.2"); rec.Code != http.StatusOK {
+			t.Errorf("unexpected status of the other client %d", rec.Code)
+		}
+	})
+
+	t.Run("X-Forwarded-For from untrusted client", func(t *testing.T) {
+		rp := newProxy(&mirageecs.RateLimit{RequestsPerSecond: 0.1, Burst: 1, PerClient: true})
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "aaa.example.net"
+			req.RemoteAddr = "10.0.0.1:12345"
+			req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d", i+1))
+			rec := httptest.NewRecorder()
+			rp.ServeHTTPWithPort(rec, req, 8080)
+			if rec.Code != want {
+				t.Errorf("request %d: unexpected status %d, want %d", i, rec.Code, want)
+			}
+		}
+	})
+}
+
+func TestRateLimitValidate(t *testing.T) {
+	rl := &mirageecs.RateLimit{RequestsPerSecond: 2.5}
+	if err := rl.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if rl.Burst != 3 {
+		t.Errorf("unexpected default burst %d", rl.Burst)
+	}
+	for _, rl := range []*mirageecs.RateLimit{
+		{},
+		{RequestsPerSecond: -1},
+		{RequestsPerSecond: 1, Burst: -1},
+	} {
+		if err := rl.Validate(); err == nil {
+			t.Errorf("%#v should be invalid", rl)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package mirageecs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	ddbTypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const (
+	ReservationStoreMemory   = "memory"
+	ReservationStoreDynamoDB = "dynamodb"
+)
+
+// Reservation configures the store of subdomain reservations.
+type Reservation struct {
+	Store    string               `yaml:"store"`
+	DynamoDB *ReservationDynamoDB `yaml:"dynamodb"`
+}
+
+type ReservationDynamoDB struct {
+	TableName string `yaml:"table_name"`
+}
+
+func (r *Reservation) Validate() error {
+	switch r.Store {
+	case "", ReservationStoreMemory:
+		r.Store = ReservationStoreMemory
+	case ReservationStoreDynamoDB:
+		if r.DynamoDB == nil || r.DynamoDB.TableName == "" {
+			return fmt.Errorf("dynamodb.table_name is required")
+		}
+	default:
+		return fmt.Errorf("unsupported store %s", r.Store)
+	}
+	return nil
+}
+
+var (
+	// ErrReservedByOther is returned when the subdomain is reserved by another owner.
+	ErrReservedByOther = errors.New("subdomain is reserved by another owner")
+	// ErrNotReserved is returned when releasing the subdomain which is not reserved by the owner.
+	ErrNotReserved = errors.New("subdomain is not reserved by the owner")
+)
+
+// ReservationRecord is a reservation of a subdomain.
+type ReservationRecord struct {
+	Subdomain  string    `json:"subdomain"`
+	Owner      string    `json:"owner"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+// ReservationStore stores ReservationRecords.
+type ReservationStore interface {
+	// Reserve reserves the subdomain. It returns ErrReservedByOther when the subdomain is reserved by another owner.
+	Reserve(ctx context.Context, r *ReservationRecord) error
+	// Release releases the subdomain. It returns ErrNotReserved when the subdomain is not reserved by the owner.
+	Release(ctx context.Context, subdomain, owner string) error
+	// Get returns the reservation of the subdomain. It returns nil when the subdomain is not reserved.
+	Get(ctx context.Context, subdomain string) (*ReservationRecord, error)
+	List(ctx context.Context) ([]*ReservationRecord, error)
+}
+
+func (c *Config) NewReservationStore() ReservationStore {
+	if c.Reservation == nil {
+		return nil
+	}
+	switch c.Reservation.Store {
+	case ReservationStoreDynamoDB:
+		return NewDynamoDBReservationStore(c.awscfg, c.Reservation.DynamoDB.TableName)
+	default:
+		return NewMemoryReservationStore()
+	}
+}
+
+func sortReservations(records []*ReservationRecord) []*ReservationRecord {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Subdomain < records[j].Subdomain
+	})
+	return records
+}
+
+// MemoryReservationStore is an in-memory ReservationStore. Reservations are lost on restart.
+type MemoryReservationStore struct {
+	mu      sync.Mutex
+	records map[string]*ReservationRecord
+}
+
+func NewMemoryReservationStore() *MemoryReservationStore {
+	return &MemoryReservationStore{
+		records: make(map[string]*ReservationRecord),
+	}
+}
+
+func (s *MemoryReservationStore) Reserve(_ context.Context, r *ReservationRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.records[r.Subdomain]; ok && cur.Owner != r.Owner {
+		return ErrReservedByOther
+	}
+	s.records[r.Subdomain] = r
+	return nil
+}
+
+func (s *MemoryReservationStore) Release(_ context.Context, subdomain, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.records[subdomain]; !ok || cur.Owner != owner {
+		return ErrNotReserved
+	}
+	delete(s.records, subdomain)
+	return nil
+}
+
+func (s *MemoryReservationStore) Get(_ context.Context, subdomain string) (*ReservationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[subdomain], nil
+}
+
+func (s *MemoryReservationStore) List(_ context.Context) ([]*ReservationRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	records := make([]*ReservationRecord, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, r)
+	}
+	return sortReservations(records), nil
+}
+
+// DynamoDBReservationStore is a ReservationStore backed by a DynamoDB table.
+// The table must have a partition key "subdomain" (S).
+type DynamoDBReservationStore struct {
+	svc       *dynamodb.Client
+	tableName string
+}
+
+func NewDynamoDBReservationStore(awscfg *aws.Config, tableName string) *DynamoDBReservationStore {
+	return &DynamoDBReservationStore{
+		svc:       dynamodb.NewFromConfig(*awscfg),
+		tableName: tableName,
+	}
+}
+
+func (s *DynamoDBReservationStore) Reserve(ctx context.Context, r *ReservationRecord) error {
+	_, err := s.svc.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.tableName),
+		Item: map[string]ddbTypes.AttributeValue{
+			"subdomain":   &ddbTypes.AttributeValueMemberS{Value: r.Subdomain},
+			"owner":       &ddbTypes.AttributeValueMemberS{Value: r.Owner},
+			"reserved_at": &ddbTypes.AttributeValueMemberS{Value: r.ReservedAt.UTC().Format(time.RFC3339Nano)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(subdomain) OR #owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]ddbTypes.AttributeValue{
+			":owner": &ddbTypes.AttributeValueMemberS{Value: r.Owner},
+		},
+	})
+	var ccf *ddbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrReservedByOther
+	} else if err != nil {
+		return fmt.Errorf("failed to put reservation to %s: %w", s.tableName, err)
+	}
+	return nil
+}
+
+func (s *DynamoDBReservationStore) Release(ctx context.Context, subdomain, owner string) error {
+	_, err := s.svc.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]ddbTypes.AttributeValue{
+			"subdomain": &ddbTypes.AttributeValueMemberS{Value: subdomain},
+		},
+		ConditionExpression:      aws.String("#owner = :owner"),
+		ExpressionAttributeNames: map[string]string{"#owner": "owner"},
+		ExpressionAttributeValues: map[string]ddbTypes.AttributeValue{
+			":owner": &ddbTypes.AttributeValueMemberS{Value: owner},
+		},
+	})
+	var ccf *ddbTypes.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return ErrNotReserved
+	} else if err != nil {
+		return fmt.Errorf("failed to delete reservation from %s: %w", s.tableName, err)
+	}
+	return nil
+}
+
+func (s *DynamoDBReservationStore) Get(ctx context.Context, subdomain string) (*ReservationRecord, error) {
+	out, err := s.svc.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.tableName),
+		Key: map[string]ddbTypes.AttributeValue{
+			"subdomain": &ddbTypes.AttributeValueMemberS{Value: subdomain},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get reservation from %s: %w", s.tableName, err)
+	}
+	if len(out.Item) == 0 {
+		return nil, nil
+	}
+	return reservationRecordFromItem(out.Item), nil
+}
+
+func (s *DynamoDBReservationStore) List(ctx context.Context) ([]*ReservationRecord, error) {
+	records := []*ReservationRecord{}
+	p := dynamodb.NewScanPaginator(s.svc, &dynamodb.ScanInput{
+		TableName: aws.String(s.tableName),
+	})
+	for p.HasMorePages() {
+		out, err := p.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan reservations from %s: %w", s.tableName, err)
+		}
+		for _, item := range out.Items {
+			records = append(records, reservationRecordFromItem(item))
+		}
+	}
+	return sortReservations(records), nil
+}
+
+func reservationRecordFromItem(item map[string]ddbTypes.AttributeValue) *ReservationRecord {
+	str := func(name string) string {
+		if v, ok := item[name].(*ddbTypes.AttributeValueMemberS); ok {
+			return v.Value
+		}
+		return ""
+	}
+	r := &ReservationRecord{
+		Subdomain: str("subdomain"),
+		Owner:     str("owner"),
+	}
+	if ts, err := time.Parse(time.RFC3339Nano, str("reserved_at")); err != nil {
+		slog.Warn(f("invalid reserved_at in reservation %s: %s", str("reserved_at"), err))
+	} else {
+		r.ReservedAt = ts.In(time.Local)
+	}
+	return r
+}
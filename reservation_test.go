@@ -0,0 +1,152 @@
+package mirageecs_test
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestMemoryReservationStore(t *testing.T) {
+	ctx := context.Background()
+	s := mirageecs.NewMemoryReservationStore()
+	if err := s.Reserve(ctx, &mirageecs.ReservationRecord{Subdomain: "foo", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	// reserve again by the same owner
+	if err := s.Reserve(ctx, &mirageecs.ReservationRecord{Subdomain: "foo", Owner: "alice"}); err != nil {
+		t.Error(err)
+	}
+	if err := s.Reserve(ctx, &mirageecs.ReservationRecord{Subdomain: "foo", Owner: "bob"}); err != mirageecs.ErrReservedByOther {
+		t.Errorf("expected ErrReservedByOther, got %v", err)
+	}
+	if err := s.Release(ctx, "foo", "bob"); err != mirageecs.ErrNotReserved {
+		t.Errorf("expected ErrNotReserved, got %v", err)
+	}
+	if r, _ := s.Get(ctx, "foo"); r == nil || r.Owner != "alice" {
+		t.Errorf("unexpected reservation %#v", r)
+	}
+	if err := s.Release(ctx, "foo", "alice"); err != nil {
+		t.Error(err)
+	}
+	if r, _ := s.Get(ctx, "foo"); r != nil {
+		t.Errorf("reservation must be released %#v", r)
+	}
+}
+
+func TestReservationAPI(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = &mirageecs.Auth{
+		JWT: &mirageecs.AuthMethodJWT{
+			PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+			Issuer:    "https://idp.example.com/",
+			Audience:  "mirage-ecs",
+		},
+	}
+	if err := cfg.Auth.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Reservation = &mirageecs.Reservation{Store: mirageecs.ReservationStoreMemory}
+	m := mirageecs.New(ctx, cfg)
+	ts := httptest.NewServer(m.WebApi)
+	defer ts.Close()
+
+	bearer := func(sub string) string {
+		t.Helper()
+		claims := jwt.MapClaims{
+			"iss": "https://idp.example.com/",
+			"aud": "mirage-ecs",
+			"exp": time.Now().Add(time.Minute).Unix(),
+		}
+		if sub != "" {
+			claims["sub"] = sub
+		}
+		token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+	post := func(path, body, actor string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		// the owner is the subject of the token, not the client address spoofed
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("Authorization", bearer(actor))
+		res, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	launch := `{"subdomain":"reserved","branch":"main","taskdef":["dummy"]}`
+
+	if code := post("/api/reserve", `{"subdomain":"reserved"}`, ""); code != http.StatusForbidden {
+		t.Errorf("reserve without the subject should be forbidden: %d", code)
+	}
+	if code := post("/api/reserve", `{"subdomain":"reserved"}`, "alice"); code != http.StatusOK {
+		t.Errorf("reserve should succeed: %d", code)
+	}
+	if code := post("/api/reserve", `{"subdomain":"reserved"}`, "bob"); code != http.StatusConflict {
+		t.Errorf("reserve by other should conflict: %d", code)
+	}
+	if code := post("/api/launch", launch, "bob"); code != http.StatusForbidden {
+		t.Errorf("launch by other should be forbidden: %d", code)
+	}
+	if code := post("/api/launch", launch, "alice"); code != http.StatusOK {
+		t.Errorf("launch by owner should succeed: %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/api/reservations", nil)
+	req.Header.Set("Authorization", bearer("alice"))
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var r mirageecs.APIReservationsResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Result) != 1 || r.Result[0].Owner != "alice" {
+		t.Errorf("unexpected reservations %#v", r.Result)
+	}
+
+	if code := post("/api/release", `{"subdomain":"reserved"}`, "bob"); code != http.StatusConflict {
+		t.Errorf("release by other should conflict: %d", code)
+	}
+	if code := post("/api/release", `{"subdomain":"reserved"}`, "alice"); code != http.StatusOK {
+		t.Errorf("release by owner should succeed: %d", code)
+	}
+	if code := post("/api/launch", launch, "bob"); code != http.StatusOK {
+		t.Errorf("launch after released should succeed: %d", code)
+	}
+}
@@ -0,0 +1,80 @@
+package mirageecs
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+)
+
+const (
+	responseHeaderFromTagPrefix = "tag:"
+	responseHeaderFromEnvPrefix = "env:"
+)
+
+// ResponseHeader adds a header to the proxied responses from the value of the task.
+type ResponseHeader struct {
+	Name string `yaml:"name"`
+	// From is one of "subdomain", "branch", "taskdef", "task_id", "tag:{key}" and "env:{name}".
+	From string `yaml:"from"`
+}
+
+type ResponseHeaders []ResponseHeader
+
+func (hs ResponseHeaders) Validate() error {
+	for _, h := range hs {
+		if h.Name == "" {
+			return fmt.Errorf("name is required")
+		}
+		// a header name is a token as well as a cookie name
+		if !isValidCookieName(h.Name) {
+			return fmt.Errorf("invalid header name %s", h.Name)
+		}
+		switch {
+		case h.From == "subdomain", h.From == "branch", h.From == "taskdef", h.From == "task_id":
+		case strings.HasPrefix(h.From, responseHeaderFromTagPrefix) && len(h.From) > len(responseHeaderFromTagPrefix):
+		case strings.HasPrefix(h.From, responseHeaderFromEnvPrefix) && len(h.From) > len(responseHeaderFromEnvPrefix):
+		default:
+			return fmt.Errorf("invalid from %q of header %s", h.From, h.Name)
+		}
+	}
+	return nil
+}
+
+// For returns the response headers for the task. The headers of empty values are omitted.
+func (hs ResponseHeaders) For(info *Information) http.Header {
+	if len(hs) == 0 {
+		return nil
+	}
+	header := make(http.Header, len(hs))
+	for _, h := range hs {
+		if v := h.valueOf(info); v != "" {
+			header.Set(h.Name, v)
+		}
+	}
+	return header
+}
+
+func (h ResponseHeader) valueOf(info *Information) string {
+	switch {
+	case h.From == "subdomain":
+		return info.SubDomain
+	case h.From == "branch":
+		return info.GitBranch
+	case h.From == "taskdef":
+		return info.TaskDef
+	case h.From == "task_id":
+		return info.ShortID
+	case strings.HasPrefix(h.From, responseHeaderFromTagPrefix):
+		key := strings.TrimPrefix(h.From, responseHeaderFromTagPrefix)
+		for _, t := range info.Tags {
+			if aws.ToString(t.Key) == key {
+				return aws.ToString(t.Value)
+			}
+		}
+	case strings.HasPrefix(h.From, responseHeaderFromEnvPrefix):
+		return info.Env[strings.TrimPrefix(h.From, responseHeaderFromEnvPrefix)]
+	}
+	return ""
+}
@@ -0,0 +1,95 @@
+package mirageecs_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestResponseHeaders(t *testing.T) {
+	hs := mirageecs.ResponseHeaders{
+		{Name: "X-Mirage-Subdomain", From: "subdomain"},
+		{Name: "X-Mirage-Branch", From: "branch"},
+		{Name: "X-Mirage-Task", From: "task_id"},
+		{Name: "X-Mirage-Launched-By", From: "tag:launched_by"},
+		{Name: "X-Mirage-Env", From: "env:APP_ENV"},
+		{Name: "X-Mirage-Missing", From: "tag:missing"},
+	}
+	if err := hs.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	info := &mirageecs.Information{
+		ShortID:   "0123",
+		SubDomain: "foo",
+		GitBranch: "feature/foo",
+		Env:       map[string]string{"APP_ENV": "preview"},
+		Tags:      []types.Tag{{Key: aws.String("launched_by"), Value: aws.String("alice")}},
+	}
+	expected := http.Header{
+		"X-Mirage-Subdomain":   {"foo"},
+		"X-Mirage-Branch":      {"feature/foo"},
+		"X-Mirage-Task":        {"0123"},
+		"X-Mirage-Launched-By": {"alice"},
+		"X-Mirage-Env":         {"preview"},
+	}
+	if diff := cmp.Diff(expected, hs.For(info)); diff != "" {
+		t.Errorf("unexpected headers %s", diff)
+	}
+
+	for _, h := range []mirageecs.ResponseHeader{
+		{Name: "", From: "subdomain"},
+		{Name: "X Mirage", From: "subdomain"},
+		{Name: "X-Mirage", From: "unknown"},
+		{Name: "X-Mirage", From: "tag:"},
+	} {
+		if err := (mirageecs.ResponseHeaders{h}).Validate(); err == nil {
+			t.Errorf("%#v should be invalid", h)
+		}
+	}
+}
+
+func TestReverseProxyResponseHeaders(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+	cfg.Network.ResponseHeaders = mirageecs.ResponseHeaders{{Name: "X-Mirage-Subdomain", From: "subdomain"}}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", port)
+	rp.SetResponseHeaders(map[string]http.Header{
+		u.Host: cfg.Network.ResponseHeaders.For(&mirageecs.Information{SubDomain: "aaa"}),
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "aaa.example.net"
+	rec := httptest.NewRecorder()
+	rp.ServeHTTPWithPort(rec, req, 8080)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	if h := rec.Header().Get("X-Mirage-Subdomain"); h != "aaa" {
+		t.Errorf("unexpected X-Mirage-Subdomain header %q", h)
+	}
+}
@@ -1,6 +1,11 @@
 package mirageecs
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -11,10 +16,12 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	//	"github.com/acidlemon/go-dumper"
 	"github.com/methane/rproxy"
+	"github.com/samber/lo"
 )
 
 type proxyAction string
@@ -22,10 +29,11 @@ type proxyAction string
 const (
 	proxyAdd    = proxyAction("Add")
 	proxyRemove = proxyAction("Remove")
+	// proxyDrain stops routing to the task at IPAddress of the subdomain until proxyDrained.
+	proxyDrain   = proxyAction("Drain")
+	proxyDrained = proxyAction("Drained")
 )
 
-var proxyHandlerLifetime = 30 * time.Second
-
 type proxyControl struct {
 	Action    proxyAction
 	Subdomain string
@@ -39,49 +47,217 @@ type ReverseProxy struct {
 	domains           []string
 	domainMap         map[string]proxyHandlers
 	accessCounters    map[string]*AccessCounter
+	rateLimiters      map[string]*subdomainRateLimiter
 	accessCounterUnit time.Duration
+	handlerLifetime   time.Duration
+	health            map[string]bool
+	// catchAll are the handlers of network.catch_all by the listen ports.
+	catchAll map[int]http.Handler
+	// draining are the IP addresses of the tasks draining before stopped. They are not routed again by AddSubdomain.
+	draining map[string]bool
+	// responseHeaders are the headers added to the responses from the upstream address.
+	responseHeaders map[string]http.Header
+	// putAccessCounts puts the access counts flushed on shutdown. It is TaskRunner.PutAccessCounts.
+	putAccessCounts func(context.Context, map[string]accessCount) error
+	// pages renders the page for the upstream failing the startup check. It is the renderer of WebApi.
+	pages *Template
+	// restoredAccessCounts are the access counts saved by the previous process, merged into the next collection.
+	restoredAccessCounts map[string]accessCount
 }
 
 func NewReverseProxy(cfg *Config) *ReverseProxy {
 	unit := time.Minute
 	if cfg.localMode {
 		unit = time.Second * 10
-		proxyHandlerLifetime = time.Hour * 24 * 365 * 10 // not expire
 		slog.Debug(f("local mode: access counter unit=%s", unit))
 	}
-	return &ReverseProxy{
+	lifetime := cfg.Network.ProxyHandlerLifetime
+	if lifetime <= 0 {
+		lifetime = DefaultProxyHandlerLifetime
+	}
+	r := &ReverseProxy{
 		cfg:               cfg,
 		domainMap:         make(map[string]proxyHandlers),
 		accessCounters:    make(map[string]*AccessCounter),
+		rateLimiters:      make(map[string]*subdomainRateLimiter),
 		accessCounterUnit: unit,
+		handlerLifetime:   lifetime,
+		health:            make(map[string]bool),
+		catchAll:          newCatchAllHandlers(cfg),
+		draining:          make(map[string]bool),
+		pages:             &Template{templates: mustLoadDefaultTemplates()},
+	}
+	if file := cfg.Network.AccessCountsFile; cfg.localMode && file != "" {
+		counts, err := loadAccessCounts(file)
+		if err != nil {
+			slog.Warn(f("failed to load access counts from %s: %s", file, err))
+		} else if len(counts) > 0 {
+			slog.Info(f("loaded access counts of %d subdomains from %s", len(counts), file))
+			r.restoredAccessCounts = counts
+		}
+	}
+	return r
+}
+
+// newCatchAllHandlers returns the handlers proxy to network.catch_all.upstream for each listen.http[], or nil if not configured.
+// The handler of the listener requiring the auth cookie requires it as well as the handlers of the subdomains.
+func newCatchAllHandlers(cfg *Config) map[int]http.Handler {
+	c := cfg.Network.CatchAll
+	if c == nil {
+		return nil
+	}
+	handlers := make(map[int]http.Handler, len(cfg.Listen.HTTP))
+	for _, v := range cfg.Listen.HTTP {
+		handler := rproxy.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: c.Upstream})
+		tp := &Transport{
+			Transport:    newHTTPTransport(cfg.Network.ProxyTimeout),
+			Subdomain:    "(catch-all)",
+			StripRequest: cfg.Network.StripRequest,
+		}
+		if v.RequireAuthCookie {
+			tp.AuthCookieValidateFunc = cfg.Auth.ValidateAuthCookie
+			tp.AuthCookieName = cfg.Auth.cookieName()
+		}
+		handler.Transport = tp
+		handlers[v.ListenPort] = handler
+	}
+	return handlers
+}
+
+// ServeCatchAll proxies the request of the unmanaged subdomain to the catch-all upstream by the handler of the listen port.
+// It returns false if the catch-all upstream is not configured for the port.
+func (r *ReverseProxy) ServeCatchAll(w http.ResponseWriter, req *http.Request, port int) bool {
+	handler := r.catchAll[port]
+	if handler == nil {
+		return false
+	}
+	if ua := req.UserAgent(); !r.cfg.Network.UserAgent.Allowed(ua) {
+		slog.Info(f("%s denied by user agent: %s", req.Host, ua))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return true
 	}
+	slog.Debug(f("proxy %s to catch-all upstream", req.Host))
+	handler.ServeHTTP(w, req)
+	return true
 }
 
 func (r *ReverseProxy) ServeHTTPWithPort(w http.ResponseWriter, req *http.Request, port int) {
-	subdomain := strings.ToLower(strings.Split(req.Host, ".")[0])
+	subdomain := subdomainFromHost(req.Host, r.cfg.Host.ReverseProxySuffix)
+	if !r.filterRequest(w, req, subdomain) {
+		return
+	}
 
-	if handler := r.FindHandler(subdomain, port); handler != nil {
+	var sticky string
+	s := r.cfg.Network.StickySession
+	if s != nil {
+		if c, err := req.Cookie(s.CookieName); err == nil {
+			sticky = c.Value
+		}
+	}
+	if handler, key := r.findHandler(subdomain, port, sticky); handler != nil {
 		slog.Debug(f("proxy handler found for subdomain %s", subdomain))
-		handler.ServeHTTP(w, req)
+		if s != nil && key != "" && key != sticky {
+			// pin the client to the upstream
+			http.SetCookie(w, s.Cookie(key))
+		}
+		r.cfg.Network.AccessLog.serve(w, req, subdomain, handler)
 	} else {
 		slog.Debug(f("proxy handler not found for subdomain %s", subdomain))
 		http.NotFound(w, req)
 	}
 }
 
-func (r *ReverseProxy) Exists(subdomain string) bool {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
-	_, exists := r.domainMap[subdomain]
-	if exists {
-		return true
+// filterRequest checks the request to the subdomain by the user agent filter and the rate limit.
+// It returns false when the request is rejected and the response is written.
+func (r *ReverseProxy) filterRequest(w http.ResponseWriter, req *http.Request, subdomain string) bool {
+	if ua := req.UserAgent(); !r.cfg.Network.UserAgent.Allowed(ua) {
+		slog.Info(f("subdomain %s denied by user agent: %s", subdomain, ua))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if ok, retryAfter := r.allowRequest(subdomain, req); !ok {
+		slog.Info(f("subdomain %s rate limited: %s", subdomain, r.cfg.Network.clientIP(req)))
+		serveTooManyRequests(w, subdomain, retryAfter)
+		return false
+	}
+	return true
+}
+
+// allowWake checks the request waking up the sleeping subdomain as well as the requests proxied to the upstream,
+// by the user agent filter, the rate limit and the auth cookie required by the listener of the port.
+// It returns false when the request is rejected and the response is written.
+func (r *ReverseProxy) allowWake(w http.ResponseWriter, req *http.Request, subdomain string, port int) bool {
+	if !r.filterRequest(w, req, subdomain) {
+		return false
+	}
+	for _, v := range r.cfg.Listen.HTTP {
+		if v.ListenPort != port || !v.RequireAuthCookie {
+			continue
+		}
+		cookie, err := req.Cookie(r.cfg.Auth.cookieName())
+		if err == nil {
+			err = r.cfg.Auth.ValidateAuthCookie(cookie)
+		}
+		if err != nil {
+			slog.Warn(f("subdomain %s wake denied: %s", subdomain, err))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return false
+		}
+	}
+	return true
+}
+
+// hostWithoutPort returns the lower-cased host without the port.
+func hostWithoutPort(hostport string) string {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport // missing port
+	}
+	return strings.ToLower(host)
+}
+
+// subdomainFromHost extracts the subdomain from the Host header.
+// The port is stripped first, then the suffix. The subdomain may have multiple labels, e.g. foo.feature-123.
+func subdomainFromHost(hostport string, suffix string) string {
+	host := hostWithoutPort(hostport)
+	return strings.TrimSuffix(host, strings.ToLower(suffix))
+}
+
+// firstLabel returns the first label of the subdomain.
+func firstLabel(subdomain string) string {
+	return strings.Split(subdomain, ".")[0]
+}
+
+// matchSubdomain reports whether the subdomain matches the wildcard pattern label by label.
+// A wildcard doesn't match across the labels, so *.bar matches foo.bar but not foo.baz.bar.
+func matchSubdomain(pattern, subdomain string) bool {
+	m, _ := path.Match(strings.ReplaceAll(pattern, ".", "/"), strings.ReplaceAll(subdomain, ".", "/"))
+	return m
+}
+
+// resolve returns the registered subdomain routing the subdomain of the request, or empty.
+// The exact match precedes the wildcard matches, and the wildcards are matched in the registered order.
+// When nothing matches a multi-label subdomain, its first label is resolved for compatibility.
+// The caller must hold the lock.
+func (r *ReverseProxy) resolve(subdomain string) string {
+	if _, ok := r.domainMap[subdomain]; ok {
+		return subdomain
 	}
 	for _, name := range r.domains {
-		if m, _ := path.Match(name, subdomain); m {
-			return true
+		if matchSubdomain(name, subdomain) {
+			return name
 		}
 	}
-	return false
+	if label := firstLabel(subdomain); label != subdomain {
+		return r.resolve(label)
+	}
+	return ""
+}
+
+func (r *ReverseProxy) Exists(subdomain string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.resolve(subdomain) != ""
 }
 
 func (r *ReverseProxy) Subdomains() []string {
@@ -93,40 +269,70 @@ func (r *ReverseProxy) Subdomains() []string {
 }
 
 func (r *ReverseProxy) FindHandler(subdomain string, port int) http.Handler {
+	handler, _ := r.findHandler(subdomain, port, "")
+	return handler
+}
+
+// findHandler returns the handler and its sticky key.
+// The handler of the sticky key is preferred while it is alive.
+func (r *ReverseProxy) findHandler(subdomain string, port int, sticky string) (http.Handler, string) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	slog.Debug(f("FindHandler for %s:%d", subdomain, port))
 
-	proxyHandlers, ok := r.domainMap[subdomain]
-	if !ok {
-		for _, name := range r.domains {
-			if m, _ := path.Match(name, subdomain); m {
-				proxyHandlers = r.domainMap[name]
-				break
-			}
-		}
-		if proxyHandlers == nil {
-			return nil
-		}
+	name := r.resolve(subdomain)
+	if name == "" {
+		return nil, ""
 	}
+	proxyHandlers := r.domainMap[name]
 
-	handler, ok := proxyHandlers.Handler(port)
+	handler, key, ok := proxyHandlers.stickyHandler(port, sticky, r.pages)
 	if !ok {
-		return nil
+		return nil, ""
 	}
-	return handler
+	return handler, key
+}
+
+// allowRequest reports whether the request is allowed by network.rate_limit.
+func (r *ReverseProxy) allowRequest(subdomain string, req *http.Request) (bool, time.Duration) {
+	if r.cfg.Network.RateLimit == nil {
+		return true, 0
+	}
+	r.mu.RLock()
+	limiter := r.rateLimiters[r.resolve(subdomain)]
+	r.mu.RUnlock()
+	if limiter == nil {
+		return true, 0
+	}
+	return limiter.allow(r.cfg.Network.clientIP(req), time.Now())
 }
 
 type proxyHandler struct {
-	handler http.Handler
-	timer   *time.Timer
+	handler   http.Handler
+	timer     *time.Timer
+	lifetime  time.Duration
+	subdomain string
+	ready     atomic.Bool
 }
 
-func newProxyHandler(h http.Handler) *proxyHandler {
-	return &proxyHandler{
-		handler: h,
-		timer:   time.NewTimer(proxyHandlerLifetime),
+func newProxyHandler(subdomain string, h http.Handler, ready bool, lifetime time.Duration) *proxyHandler {
+	ph := &proxyHandler{
+		handler:   h,
+		timer:     time.NewTimer(lifetime),
+		lifetime:  lifetime,
+		subdomain: subdomain,
 	}
+	ph.ready.Store(ready)
+	return ph
+}
+
+// isReady reports whether the upstream passed the startup check.
+func (h *proxyHandler) isReady() bool {
+	return h.ready.Load()
+}
+
+func (h *proxyHandler) setReady() {
+	h.ready.Store(true)
 }
 
 func (h *proxyHandler) alive() bool {
@@ -139,26 +345,61 @@ func (h *proxyHandler) alive() bool {
 }
 
 func (h *proxyHandler) extend() {
-	h.timer.Reset(proxyHandlerLifetime) // extend lifetime
+	h.timer.Reset(h.lifetime) // extend lifetime
+}
+
+// expired reports that the handler was removed because its lifetime lapsed
+// without being refreshed by syncECSToMirage.
+func (h *proxyHandler) expired(port int, addr string) {
+	slog.Info("proxy handler expired",
+		"event", "handler_expired",
+		"subdomain", h.subdomain,
+		"address", addr,
+		"port", port,
+	)
 }
 
 type proxyHandlers map[int]map[string]*proxyHandler
 
-func (ph proxyHandlers) Handler(port int) (http.Handler, bool) {
+// stickyHandler returns the handler of the sticky key if it is alive and ready.
+// Otherwise, returns the first alive and ready handler (randomized by Go's map) and its sticky key.
+// When all alive handlers are still starting, returns the handler of the starting page rendered by pages with an empty key.
+func (ph proxyHandlers) stickyHandler(port int, sticky string, pages *Template) (http.Handler, string, bool) {
 	handlers := ph[port]
 	if len(handlers) == 0 {
-		return nil, false
+		return nil, "", false
 	}
+	if sticky != "" {
+		for ipaddress, handler := range handlers {
+			if stickyKey(ipaddress) == sticky && handler.isReady() && handler.alive() {
+				return handler.handler, sticky, true
+			}
+		}
+	}
+	var starting *proxyHandler
 	for ipaddress, handler := range ph[port] {
-		if handler.alive() {
+		if !handler.alive() {
+			handler.expired(port, ipaddress)
+			delete(ph[port], ipaddress)
+		} else if handler.isReady() {
 			// return first (randomized by Go's map)
-			return handler.handler, true
+			return handler.handler, stickyKey(ipaddress), true
 		} else {
-			slog.Info(f("proxy handler to %s is dead", ipaddress))
-			delete(ph[port], ipaddress)
+			starting = handler
 		}
 	}
-	return nil, false
+	if starting != nil {
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			pages.serveWaitingPage(w, starting.subdomain, "starting", startingRetryAfter)
+		}), "", true
+	}
+	return nil, "", false
+}
+
+// stickyKey returns the opaque key of the upstream address not to expose it to clients.
+func stickyKey(addr string) string {
+	sum := sha256.Sum256([]byte(addr))
+	return hex.EncodeToString(sum[:8])
 }
 
 func (ph proxyHandlers) exists(port int, addr string) bool {
@@ -172,24 +413,45 @@ func (ph proxyHandlers) exists(port int, addr string) bool {
 		h.extend()
 		return true
 	} else {
-		slog.Info(f("proxy handler to %s is dead", addr))
+		h.expired(port, addr)
 		delete(ph[port], addr)
 		return false
 	}
 }
 
-func (ph proxyHandlers) add(port int, ipaddress string, h http.Handler) {
+func (ph proxyHandlers) add(subdomain string, port int, ipaddress string, h http.Handler, ready bool, lifetime time.Duration) *proxyHandler {
 	if ph[port] == nil {
 		ph[port] = make(map[string]*proxyHandler)
 	}
 	slog.Info(f("new proxy handler to %s", ipaddress))
-	ph[port][ipaddress] = newProxyHandler(h)
+	handler := newProxyHandler(subdomain, h, ready, lifetime)
+	ph[port][ipaddress] = handler
+	return handler
+}
+
+// registered reports whether any of the handlers to addr is still registered for the subdomain.
+func (r *ReverseProxy) registered(subdomain string, addr string, handlers map[int]*proxyHandler) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ph := r.domainMap[subdomain]
+	for port, h := range handlers {
+		if ph[port][addr] == h {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPort int) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	// JoinHostPort brackets an IPv6 address by itself
+	ipaddress = strings.TrimSuffix(strings.TrimPrefix(ipaddress, "["), "]")
 	addr := net.JoinHostPort(ipaddress, strconv.Itoa(targetPort))
+	if r.draining[ipaddress] {
+		slog.Debug(f("AddSubdomain %s -> %s is skipped while draining", subdomain, addr))
+		return
+	}
 	slog.Debug(f("AddSubdomain %s -> %s", subdomain, addr))
 	var ph proxyHandlers
 	if _ph, exists := r.domainMap[subdomain]; exists {
@@ -205,13 +467,20 @@ func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPo
 		counter = NewAccessCounter(r.accessCounterUnit)
 		r.accessCounters[subdomain] = counter
 	}
+	if rl := r.cfg.Network.RateLimit; rl != nil && r.rateLimiters[subdomain] == nil {
+		r.rateLimiters[subdomain] = newSubdomainRateLimiter(rl)
+	}
 
 	// create reverse proxy
 	proxy := false
+	startup := r.cfg.Network.StartupCheck
+	added := make(map[int]*proxyHandler)
+	// handlers of the listeners to the upstream share the dial limit
+	limiter := newDialLimiter(r.cfg.Network.DialLimit)
 	for _, v := range r.cfg.Listen.HTTP {
-		if (v.TargetPort != targetPort) && !r.cfg.localMode {
+		if v.TargetPort != targetPort && !(r.cfg.localMode && r.cfg.Listen.allowsLocalTargetPort(targetPort)) {
 			continue
-			// local mode allows any port
+			// local mode allows any port unless listen.local_target_ports is specified
 		}
 		if ph.exists(v.ListenPort, addr) {
 			proxy = true
@@ -225,15 +494,24 @@ func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPo
 		}
 		handler := rproxy.NewSingleHostReverseProxy(destUrl)
 		tp := &Transport{
-			Transport: newHTTPTransport(r.cfg.Network.ProxyTimeout),
-			Counter:   counter,
-			Subdomain: subdomain,
+			Transport:    withDialLimiter(newHTTPTransport(r.cfg.Network.ProxyTimeout), limiter),
+			Counter:      counter,
+			Subdomain:    subdomain,
+			StripRequest: r.cfg.Network.StripRequest,
+			Compression:  r.cfg.Network.Compression,
+		}
+		tp.PreflightHeaders = r.cfg.Network.Preflight.HeadersFor(subdomain)
+		if len(r.cfg.Network.ResponseHeaders) > 0 {
+			tp.ResponseHeaders = func() http.Header {
+				return r.responseHeadersOf(addr)
+			}
 		}
 		if v.RequireAuthCookie {
 			tp.AuthCookieValidateFunc = r.cfg.Auth.ValidateAuthCookie
+			tp.AuthCookieName = r.cfg.Auth.cookieName()
 		}
 		handler.Transport = tp
-		ph.add(v.ListenPort, addr, handler)
+		added[v.ListenPort] = ph.add(subdomain, v.ListenPort, addr, handler, startup == nil, r.handlerLifetime)
 		proxy = true
 		slog.Info(f("add subdomain: %s:%d -> %s", subdomain, v.ListenPort, addr))
 	}
@@ -243,6 +521,9 @@ func (r *ReverseProxy) AddSubdomain(subdomain string, ipaddress string, targetPo
 	}
 
 	r.domainMap[subdomain] = ph
+	if startup != nil && len(added) > 0 {
+		go r.waitReady(startup, subdomain, addr, added)
+	}
 	for _, name := range r.domains {
 		if name == subdomain {
 			return
@@ -257,6 +538,8 @@ func (r *ReverseProxy) RemoveSubdomain(subdomain string) {
 	slog.Info(f("removing subdomain: %s", subdomain))
 	delete(r.domainMap, subdomain)
 	delete(r.accessCounters, subdomain)
+	delete(r.rateLimiters, subdomain)
+	delete(r.health, subdomain)
 	for i, name := range r.domains {
 		if name == subdomain {
 			r.domains = append(r.domains[:i], r.domains[i+1:]...)
@@ -265,27 +548,210 @@ func (r *ReverseProxy) RemoveSubdomain(subdomain string) {
 	}
 }
 
+// Drain removes the upstreams at the IP address from the subdomain, and keeps them from being added again until Drained.
+// The subdomain is removed when no upstreams remain.
+func (r *ReverseProxy) Drain(subdomain string, ipaddress string) {
+	ipaddress = strings.TrimSuffix(strings.TrimPrefix(ipaddress, "["), "]")
+	r.mu.Lock()
+	slog.Info(f("draining upstream %s of subdomain %s", ipaddress, subdomain))
+	r.draining[ipaddress] = true
+	ph, exists := r.domainMap[subdomain]
+	for port, handlers := range ph {
+		for addr := range handlers {
+			if host, _, err := net.SplitHostPort(addr); err == nil && host == ipaddress {
+				delete(handlers, addr)
+			}
+		}
+		if len(handlers) == 0 {
+			delete(ph, port)
+		}
+	}
+	empty := exists && len(ph) == 0
+	r.mu.Unlock()
+	if empty {
+		r.RemoveSubdomain(subdomain)
+	}
+}
+
+// Drained allows the upstreams at the IP address to be added again.
+func (r *ReverseProxy) Drained(ipaddress string) {
+	ipaddress = strings.TrimSuffix(strings.TrimPrefix(ipaddress, "["), "]")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.draining, ipaddress)
+}
+
+// Draining reports whether the upstreams at the IP address are draining.
+func (r *ReverseProxy) Draining(ipaddress string) bool {
+	ipaddress = strings.TrimSuffix(strings.TrimPrefix(ipaddress, "["), "]")
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.draining[ipaddress]
+}
+
+// Upstreams returns the upstream addresses of each subdomain.
+func (r *ReverseProxy) Upstreams() map[string][]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	upstreams := make(map[string][]string, len(r.domainMap))
+	for subdomain, ph := range r.domainMap {
+		seen := make(map[string]bool)
+		for _, handlers := range ph {
+			for addr := range handlers {
+				if !seen[addr] {
+					seen[addr] = true
+					upstreams[subdomain] = append(upstreams[subdomain], addr)
+				}
+			}
+		}
+	}
+	return upstreams
+}
+
+func (r *ReverseProxy) SetHealth(subdomain string, healthy bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.domainMap[subdomain]; !exists {
+		return // removed while probing
+	}
+	r.health[subdomain] = healthy
+}
+
+// SetResponseHeaders replaces the headers added to the responses, keyed by the upstream address.
+func (r *ReverseProxy) SetResponseHeaders(headers map[string]http.Header) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.responseHeaders = headers
+}
+
+func (r *ReverseProxy) responseHeadersOf(addr string) http.Header {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.responseHeaders[addr]
+}
+
+// Health returns the result of the most recent health check of the subdomain.
+// It returns nil when the subdomain is not checked yet.
+func (r *ReverseProxy) Health(subdomain string) *bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if healthy, ok := r.health[subdomain]; ok {
+		return &healthy
+	}
+	return nil
+}
+
 func (r *ReverseProxy) Modify(action *proxyControl) {
 	switch action.Action {
 	case proxyAdd:
 		r.AddSubdomain(action.Subdomain, action.IPAddress, action.Port)
 	case proxyRemove:
 		r.RemoveSubdomain(action.Subdomain)
+	case proxyDrain:
+		r.Drain(action.Subdomain, action.IPAddress)
+	case proxyDrained:
+		r.Drained(action.IPAddress)
 	default:
 		slog.Error(f("unknown proxy action: %s", action.Action))
 	}
 }
 
-func (r *ReverseProxy) CollectAccessCounts() map[string]accessCount {
+func (r *ReverseProxy) CollectLatencies() map[string]latencyMetrics {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	metrics := make(map[string]latencyMetrics)
+	for subdomain, counter := range r.accessCounters {
+		if m := counter.CollectLatencies(); len(m) > 0 {
+			metrics[subdomain] = m
+		}
+	}
+	return metrics
+}
+
+func (r *ReverseProxy) CollectStatusCounts() map[string]statusCount {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	counts := make(map[string]statusCount)
+	for subdomain, counter := range r.accessCounters {
+		if c := counter.CollectStatuses(); len(c) > 0 {
+			counts[subdomain] = c
+		}
+	}
+	return counts
+}
+
+// AllStatusTotals returns the response counts by status class of all subdomains proxied.
+func (r *ReverseProxy) AllStatusTotals() map[string]map[string]int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	totals := make(map[string]map[string]int64, len(r.accessCounters))
+	for subdomain, counter := range r.accessCounters {
+		totals[subdomain] = counter.StatusTotals()
+	}
+	return totals
+}
+
+// StatusTotals returns the response count by status class of the subdomain.
+// It returns false if the subdomain is not proxied.
+func (r *ReverseProxy) StatusTotals(subdomain string) (map[string]int64, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
+	counter, ok := r.accessCounters[subdomain]
+	if !ok {
+		return nil, false
+	}
+	return counter.StatusTotals(), true
+}
+
+func (r *ReverseProxy) CollectAccessCounts() map[string]accessCount {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 	counts := make(map[string]accessCount)
 	for subdomain, counter := range r.accessCounters {
 		counts[subdomain] = counter.Collect()
 	}
+	for subdomain, restored := range r.restoredAccessCounts {
+		if counts[subdomain] == nil {
+			counts[subdomain] = make(accessCount, len(restored))
+		}
+		for ts, n := range restored {
+			counts[subdomain][ts] += n
+		}
+	}
+	r.restoredAccessCounts = nil
 	return counts
 }
 
+// Shutdown flushes the access counts not collected yet. They are put by putAccessCounts (to CloudWatch),
+// or saved to network.access_counts_file in local mode to be restored on the next startup.
+func (r *ReverseProxy) Shutdown(ctx context.Context) error {
+	all := r.CollectAccessCounts()
+	for subdomain, counts := range all {
+		if lo.Sum(lo.Values(counts)) == 0 {
+			delete(all, subdomain)
+		}
+	}
+	if len(all) == 0 {
+		return nil
+	}
+	if file := r.cfg.Network.AccessCountsFile; r.cfg.localMode && file != "" {
+		if err := saveAccessCounts(file, all); err != nil {
+			return fmt.Errorf("failed to save access counts to %s: %w", file, err)
+		}
+		slog.Info(f("saved access counts of %d subdomains to %s", len(all), file))
+		return nil
+	}
+	if r.putAccessCounts == nil {
+		return nil
+	}
+	if err := r.putAccessCounts(ctx, all); err != nil {
+		s, _ := json.Marshal(all)
+		return fmt.Errorf("failed to put access counts %s: %w", string(s), err)
+	}
+	slog.Info(f("flushed access counts of %d subdomains", len(all)))
+	return nil
+}
+
 func newHTTPTransport(t time.Duration) http.RoundTripper {
 	tp := http.DefaultTransport.(*http.Transport).Clone()
 	tp.DialContext = (&net.Dialer{
@@ -302,17 +768,45 @@ type Transport struct {
 	Transport              http.RoundTripper
 	Subdomain              string
 	AuthCookieValidateFunc func(*http.Cookie) error
+	AuthCookieName         string // default AuthCookieName
+	PreflightHeaders       http.Header
+	StripRequest           *StripRequest
+	ResponseHeaders        func() http.Header
+	Compression            *Compression
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	t.Counter.Add()
+	resp, err := t.roundTrip(req)
+	if t.Counter != nil {
+		if err != nil {
+			// the reverse proxy responds 502 Bad Gateway
+			t.Counter.AddStatus(http.StatusBadGateway)
+		} else {
+			t.Counter.AddStatus(resp.StatusCode)
+		}
+	}
+	return resp, err
+}
+
+func (t *Transport) roundTrip(req *http.Request) (*http.Response, error) {
+	if t.Counter != nil {
+		t.Counter.Add()
+	}
 
 	slog.Debug(f("subdomain %s %s roundtrip", t.Subdomain, req.URL))
+	if t.PreflightHeaders != nil && isPreflightRequest(req) {
+		slog.Debug(f("subdomain %s %s roundtrip: answer preflight", t.Subdomain, req.URL))
+		return newPreflightResponse(t.PreflightHeaders), nil
+	}
 	// OPTIONS request is not authenticated because it is preflighted.
 	// https://developer.mozilla.org/en-US/docs/Web/HTTP/Access_control_CORS#Preflighted_requests
 	if t.AuthCookieValidateFunc != nil && req.Method != http.MethodOptions {
 		slog.Debug(f("subdomain %s %s roundtrip: require auth cookie", t.Subdomain, req.URL))
-		cookie, err := req.Cookie(AuthCookieName)
+		name := t.AuthCookieName
+		if name == "" {
+			name = AuthCookieName
+		}
+		cookie, err := req.Cookie(name)
 		if err != nil || cookie == nil {
 			slog.Warn(f("subdomain %s %s roundtrip failed: %s", t.Subdomain, req.URL, err))
 			return newForbiddenResponse(), nil
@@ -322,15 +816,35 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 			return newForbiddenResponse(), nil
 		}
 	}
+	orig := req
+	req = t.StripRequest.Apply(req)
+	setAccessLogUpstream(req)
+	start := time.Now()
 	resp, err := t.Transport.RoundTrip(req)
+	if err == nil && t.Counter != nil {
+		// time to the response headers of the upstream
+		t.Counter.AddLatency(time.Since(start))
+	}
 	if err != nil {
 		slog.Warn(f("subdomain %s %s roundtrip failed: %s", t.Subdomain, req.URL, err))
+		if errors.Is(err, ErrDialLimitExceeded) {
+			return newServiceUnavailableResponse(t.Subdomain, req.URL.String(), err), nil
+		}
 		if strings.Contains(err.Error(), "timeout") {
 			return newTimeoutResponse(t.Subdomain, req.URL.String(), err), nil
 		}
 		return nil, err
 	}
-	return resp, nil
+	if t.ResponseHeaders != nil {
+		if resp.Header == nil {
+			resp.Header = make(http.Header)
+		}
+		for k, v := range t.ResponseHeaders() {
+			resp.Header[k] = v
+		}
+	}
+	// compress by Accept-Encoding of the client, even if it is stripped
+	return t.Compression.Apply(orig, resp), nil
 }
 
 func newTimeoutResponse(subdomain string, u string, err error) *http.Response {
@@ -341,9 +855,30 @@ func newTimeoutResponse(subdomain string, u string, err error) *http.Response {
 	return resp
 }
 
+func newServiceUnavailableResponse(subdomain string, u string, err error) *http.Response {
+	resp := new(http.Response)
+	resp.StatusCode = http.StatusServiceUnavailable
+	resp.Header = http.Header{"Retry-After": []string{"1"}}
+	msg := fmt.Sprintf("%s upstream is busy: %s %s", subdomain, u, err.Error())
+	resp.Body = io.NopCloser(strings.NewReader(msg))
+	return resp
+}
+
 func newForbiddenResponse() *http.Response {
 	resp := new(http.Response)
 	resp.StatusCode = http.StatusForbidden
 	resp.Body = io.NopCloser(strings.NewReader("Forbidden"))
 	return resp
 }
+
+func isPreflightRequest(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+func newPreflightResponse(h http.Header) *http.Response {
+	resp := new(http.Response)
+	resp.StatusCode = http.StatusNoContent
+	resp.Header = h.Clone()
+	resp.Body = http.NoBody
+	return resp
+}
@@ -2,7 +2,15 @@ package mirageecs_test
 
 import (
 	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 
@@ -94,3 +102,510 @@ func TestReverseProxy(t *testing.T) {
 		}
 	}
 }
+
+func TestReverseProxyWildcardLabels(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("*.bar", "10.0.0.1", 80)
+	rp.AddSubdomain("api.bar", "10.0.0.2", 80)
+	rp.AddSubdomain("baz", "10.0.0.3", 80)
+
+	wildcard := rp.FindHandler("foo.bar", 80)
+	if wildcard == nil {
+		t.Fatal("handler not found for foo.bar")
+	}
+	if h := rp.FindHandler("qux.bar", 80); h != wildcard {
+		t.Error("qux.bar must be matched with *.bar")
+	}
+	// the exact match precedes the wildcard
+	if h := rp.FindHandler("api.bar", 80); h == nil || h == wildcard {
+		t.Error("api.bar must be matched with api.bar")
+	}
+	// a wildcard matches a single label
+	for _, name := range []string{"bar", "foo.qux.bar", "foo.bar.qux"} {
+		if rp.Exists(name) {
+			t.Errorf("%s must not be matched", name)
+		}
+	}
+	// the first label is resolved when no registration matches
+	if h := rp.FindHandler("baz.unknown", 80); h == nil || h != rp.FindHandler("baz", 80) {
+		t.Error("baz.unknown must be matched with baz")
+	}
+}
+
+func TestSubdomainFromHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		suffix   string
+		expected string
+	}{
+		{host: "foo.dev.example.net", suffix: ".dev.example.net", expected: "foo"},
+		{host: "foo.dev.example.net:8080", suffix: ".dev.example.net", expected: "foo"},
+		{host: "FOO.Dev.Example.Net:8080", suffix: ".dev.example.net", expected: "foo"},
+		{host: "foo-bar.localtest.me:5000", suffix: ".localtest.me", expected: "foo-bar"},
+		{host: "app.foo.dev.example.net:8080", suffix: ".dev.example.net", expected: "app.foo"},
+		{host: "foo:8080", suffix: ".dev.example.net", expected: "foo"},
+	}
+	for _, tt := range tests {
+		if got := mirageecs.SubdomainFromHost(tt.host, tt.suffix); got != tt.expected {
+			t.Errorf("SubdomainFromHost(%s, %s) = %s, want %s", tt.host, tt.suffix, got, tt.expected)
+		}
+	}
+}
+
+func TestReverseProxyServeHTTPWithPortInHost(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	targetPort, _ := strconv.Atoi(u.Port())
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{
+		{ListenPort: 8080, TargetPort: targetPort},
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", targetPort)
+
+	for _, host := range []string{"aaa.example.net:8080", "AAA.example.net:8080", "aaa.example.net"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 8080)
+		if rec.Code != http.StatusOK || rec.Body.String() != "upstream" {
+			t.Errorf("host %s: unexpected response %d %s", host, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestReverseProxyServeCatchAll(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "shared %s", r.Host)
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		Domain: "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mirageecs.NewReverseProxy(cfg).ServeCatchAll(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil), 80) {
+		t.Error("catch-all must not serve when not configured")
+	}
+
+	cfg.Network.CatchAll = &mirageecs.CatchAll{Upstream: u.Host}
+	cfg.Auth = &mirageecs.Auth{CookieSecret: "secret"}
+	cfg.Listen.HTTP = []mirageecs.PortMap{
+		{ListenPort: 80, TargetPort: 80},
+		{ListenPort: 8080, TargetPort: 8080, RequireAuthCookie: true},
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "unknown.example.net"
+		return req
+	}
+	rec := httptest.NewRecorder()
+	if !rp.ServeCatchAll(rec, newRequest(), 80) {
+		t.Fatal("catch-all must serve when configured")
+	}
+	if rec.Code != http.StatusOK || rec.Body.String() != "shared unknown.example.net" {
+		t.Errorf("unexpected response %d %s", rec.Code, rec.Body.String())
+	}
+
+	if rp.ServeCatchAll(httptest.NewRecorder(), newRequest(), 8081) {
+		t.Error("catch-all must not serve the port not listened")
+	}
+
+	rec = httptest.NewRecorder()
+	if !rp.ServeCatchAll(rec, newRequest(), 8080) {
+		t.Fatal("catch-all must serve when configured")
+	}
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("request without auth cookie must be forbidden: %d %s", rec.Code, rec.Body.String())
+	}
+
+	cookie, err := cfg.Auth.NewAuthCookie(time.Minute, ".example.net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newRequest()
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	rp.ServeCatchAll(rec, req, 8080)
+	if rec.Code != http.StatusOK || rec.Body.String() != "shared unknown.example.net" {
+		t.Errorf("unexpected response with auth cookie %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCatchAllValidate(t *testing.T) {
+	for upstream, valid := range map[string]bool{
+		"shared.internal:8080": true,
+		"10.0.0.1:80":          true,
+		"":                     false,
+		"shared.internal":      false,
+		":8080":                false,
+		"shared.internal:0":    false,
+		"shared.internal:http": false,
+	} {
+		err := (&mirageecs.CatchAll{Upstream: upstream}).Validate()
+		if valid && err != nil {
+			t.Errorf("%s should be valid: %s", upstream, err)
+		} else if !valid && err == nil {
+			t.Errorf("%s should be invalid", upstream)
+		}
+	}
+}
+
+func TestReverseProxyLocalTargetPorts(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("any", "127.0.0.1", 3000)
+	if !rp.Exists("any") {
+		t.Error("local mode should allow any port without local_target_ports")
+	}
+
+	cfg.Listen.LocalTargetPorts = []int{80, 5000}
+	rp = mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("allowed", "127.0.0.1", 5000)
+	rp.AddSubdomain("denied", "127.0.0.1", 3000)
+	if !rp.Exists("allowed") {
+		t.Error("port 5000 should be allowed")
+	}
+	if rp.Exists("denied") {
+		t.Error("port 3000 should not be allowed")
+	}
+}
+
+func TestReverseProxyHandlerLifetime(t *testing.T) {
+	newProxy := func(lifetime time.Duration) *mirageecs.ReverseProxy {
+		cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+			LocalMode: true,
+			Domain:    "example.net",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Network.ProxyHandlerLifetime != mirageecs.LocalProxyHandlerLifetime {
+			t.Errorf("unexpected default lifetime in local mode %s", cfg.Network.ProxyHandlerLifetime)
+		}
+		cfg.Network.ProxyHandlerLifetime = lifetime
+		rp := mirageecs.NewReverseProxy(cfg)
+		rp.AddSubdomain("foo", "127.0.0.1", 80)
+		return rp
+	}
+	short := newProxy(10 * time.Millisecond)
+	long := newProxy(time.Hour)
+
+	time.Sleep(50 * time.Millisecond)
+	if short.FindHandler("foo", 80) != nil {
+		t.Error("handler of the short lifetime should be expired")
+	}
+	if long.FindHandler("foo", 80) == nil {
+		t.Error("handler of the long lifetime should be alive")
+	}
+}
+
+func TestReverseProxyIPv6(t *testing.T) {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 is not available:", err)
+	}
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ipv6")
+	}))
+	upstream.Listener = l
+	upstream.Start()
+	defer upstream.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("bare", "::1", port)
+	rp.AddSubdomain("bracketed", "[::1]", port)
+
+	want := "[::1]:" + strconv.Itoa(port)
+	for _, subdomain := range []string{"bare", "bracketed"} {
+		if diff := cmp.Diff([]string{want}, rp.Upstreams()[subdomain]); diff != "" {
+			t.Errorf("unexpected upstreams of %s (-want +got):\n%s", subdomain, diff)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://"+subdomain+".localtest.me/", nil)
+		w := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(w, req, 80)
+		if w.Code != http.StatusOK || w.Body.String() != "ipv6" {
+			t.Errorf("unexpected response of %s %d %s", subdomain, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestReverseProxyStartupCheck(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+	cfg.Network.StartupCheck = &mirageecs.StartupCheck{
+		HealthCheck: mirageecs.HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond},
+	}
+	if err := cfg.Network.StartupCheck.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	readyAt := time.Now().Add(200 * time.Millisecond)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if time.Now().Before(readyAt) {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("aaa", "127.0.0.1", port)
+
+	serve := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "aaa.example.net"
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 8080)
+		return rec
+	}
+	if rec := serve(); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status before ready: %d", rec.Code)
+	} else if !strings.Contains(rec.Body.String(), "aaa is starting") {
+		t.Errorf("unexpected body before ready: %s", rec.Body.String())
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec := serve()
+		if rec.Code == http.StatusOK {
+			if body := rec.Body.String(); body != "upstream" {
+				t.Errorf("unexpected body after ready: %s", body)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("upstream is not routed after ready: %d", rec.Code)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if time.Now().Before(readyAt) {
+		t.Error("routed before the upstream is ready")
+	}
+}
+
+func TestReverseProxyStickySession(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "example.net",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 8080, TargetPort: 80}}
+	cfg.Network.StickySession = &mirageecs.StickySession{}
+	if err := cfg.Network.StickySession.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+
+	// local mode allows any target port, so the replicas listen on different ports of the same address
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer upstream.Close()
+		u, _ := url.Parse(upstream.URL)
+		port, _ := strconv.Atoi(u.Port())
+		rp.AddSubdomain("aaa", "127.0.0.1", port)
+	}
+
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "aaa.example.net"
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 8080)
+		return rec
+	}
+
+	rec := serve(nil)
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != mirageecs.DefaultStickySessionCookieName {
+		t.Fatalf("sticky cookie must be set: %v", cookies)
+	}
+	backend := rec.Body.String()
+	for i := 0; i < 10; i++ {
+		rec := serve(cookies[0])
+		if got := rec.Body.String(); got != backend {
+			t.Errorf("request with sticky cookie must hit %s, but %s", backend, got)
+		}
+		if len(rec.Result().Cookies()) != 0 {
+			t.Error("sticky cookie must not be set again for the same backend")
+		}
+	}
+
+	// unknown backend falls back to another one and pins it
+	rec = serve(&http.Cookie{Name: mirageecs.DefaultStickySessionCookieName, Value: "unknown"})
+	if rec.Code != http.StatusOK {
+		t.Errorf("unexpected status %d", rec.Code)
+	}
+	if cookies := rec.Result().Cookies(); len(cookies) != 1 || cookies[0].Value == "unknown" {
+		t.Errorf("sticky cookie must be reset: %v", cookies)
+	}
+}
+
+func TestReverseProxyShutdown(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "upstream")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	targetPort, _ := strconv.Atoi(u.Port())
+
+	serve := func(t *testing.T, rp *mirageecs.ReverseProxy) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = "aaa.example.net"
+		rec := httptest.NewRecorder()
+		rp.ServeHTTPWithPort(rec, req, 80)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected response %d %s", rec.Code, rec.Body.String())
+		}
+	}
+	sum := func(counts mirageecs.AccessCount) (n int64) {
+		for _, c := range counts {
+			n += c
+		}
+		return
+	}
+
+	t.Run("put", func(t *testing.T) {
+		cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+			Domain: "example.net",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 80, TargetPort: targetPort}}
+		rp := mirageecs.NewReverseProxy(cfg)
+		var flushed map[string]mirageecs.AccessCount
+		rp.SetPutAccessCounts(func(_ context.Context, all map[string]mirageecs.AccessCount) error {
+			flushed = all
+			return nil
+		})
+		rp.AddSubdomain("aaa", "127.0.0.1", targetPort)
+		serve(t, rp)
+		if err := rp.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if n := sum(flushed["aaa"]); n != 1 {
+			t.Errorf("unexpected flushed count %d", n)
+		}
+		if n := sum(rp.CollectAccessCounts()["aaa"]); n != 0 {
+			t.Errorf("access counts must be collected on shutdown: %d", n)
+		}
+	})
+
+	t.Run("local file", func(t *testing.T) {
+		cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+			LocalMode: true,
+			Domain:    "example.net",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 80, TargetPort: targetPort}}
+		cfg.Network.AccessCountsFile = t.TempDir() + "/access_counts.json"
+		rp := mirageecs.NewReverseProxy(cfg)
+		rp.AddSubdomain("aaa", "127.0.0.1", targetPort)
+		serve(t, rp)
+		serve(t, rp)
+		if err := rp.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := mirageecs.NewReverseProxy(cfg)
+		if n := sum(restored.CollectAccessCounts()["aaa"]); n != 2 {
+			t.Errorf("unexpected restored count %d", n)
+		}
+		if n := sum(mirageecs.NewReverseProxy(cfg).CollectAccessCounts()["aaa"]); n != 0 {
+			t.Errorf("access counts must be restored only once: %d", n)
+		}
+	})
+}
+
+func TestReverseProxyDrain(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := mirageecs.NewReverseProxy(cfg)
+	rp.AddSubdomain("foo", "10.0.0.1", 80)
+	rp.AddSubdomain("foo", "10.0.0.2", 80)
+
+	// draining only the upstream of the task
+	rp.Drain("foo", "10.0.0.1")
+	if diff := cmp.Diff([]string{"10.0.0.2:80"}, rp.Upstreams()["foo"]); diff != "" {
+		t.Errorf("unexpected upstreams (-want +got):\n%s", diff)
+	}
+	// the sync doesn't route the draining task again
+	rp.AddSubdomain("foo", "10.0.0.1", 80)
+	if diff := cmp.Diff([]string{"10.0.0.2:80"}, rp.Upstreams()["foo"]); diff != "" {
+		t.Errorf("unexpected upstreams (-want +got):\n%s", diff)
+	}
+	if !rp.Draining("10.0.0.1") || rp.Draining("10.0.0.2") {
+		t.Error("unexpected draining")
+	}
+
+	// the subdomain is removed after the last upstream is drained
+	rp.Drain("foo", "10.0.0.2")
+	if rp.Exists("foo") {
+		t.Error("foo must be removed")
+	}
+
+	rp.Drained("10.0.0.1")
+	rp.AddSubdomain("foo", "10.0.0.1", 80)
+	if diff := cmp.Diff([]string{"10.0.0.1:80"}, rp.Upstreams()["foo"]); diff != "" {
+		t.Errorf("unexpected upstreams (-want +got):\n%s", diff)
+	}
+}
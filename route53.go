@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net"
 	"time"
 
 	ttlcache "github.com/ReneKroon/ttlcache/v2"
@@ -26,6 +27,21 @@ type route53Change struct {
 	delete bool
 }
 
+// route53RecordSet identifies the record set of the change.
+type route53RecordSet struct {
+	name   string
+	rrType types.RRType
+}
+
+// recordSet returns the record set of the change. The record of an IPv6 address is AAAA.
+func (c *route53Change) recordSet() route53RecordSet {
+	rrType := types.RRTypeA
+	if ip := net.ParseIP(c.value); ip != nil && ip.To4() == nil {
+		rrType = types.RRTypeAaaa
+	}
+	return route53RecordSet{name: c.name, rrType: rrType}
+}
+
 func (c *route53Change) String() string {
 	return fmt.Sprintf("%s %s %s", c.action(), c.name, c.value)
 }
@@ -109,23 +125,23 @@ func (r *Route53) Apply(ctx context.Context) error {
 		r.changes = r.changes[0:0]
 	}()
 
-	addes := make(map[string][]*route53Change)
-	deletes := make(map[string][]*route53Change)
+	addes := make(map[route53RecordSet][]*route53Change)
+	deletes := make(map[route53RecordSet][]*route53Change)
 	for _, c := range r.changes {
 		if c.delete {
-			deletes[c.name] = append(deletes[c.name], c)
+			deletes[c.recordSet()] = append(deletes[c.recordSet()], c)
 		} else {
-			addes[c.name] = append(addes[c.name], c)
+			addes[c.recordSet()] = append(addes[c.recordSet()], c)
 		}
 	}
 
-	// sum by name
+	// sum by name and type
 	var changes []types.Change
 DELETES:
-	for name, cs := range deletes {
+	for rs, cs := range deletes {
 		var records []types.ResourceRecord
 		for _, c := range cs {
-			if len(addes[c.name]) > 0 {
+			if len(addes[rs]) > 0 {
 				continue DELETES // skip delete when adds exists
 			}
 			records = append(records, types.ResourceRecord{Value: &c.value})
@@ -133,16 +149,16 @@ DELETES:
 		change := types.Change{
 			Action: "DELETE",
 			ResourceRecordSet: &types.ResourceRecordSet{
-				Name:            aws.String(name),
+				Name:            aws.String(rs.name),
 				ResourceRecords: records,
 				TTL:             aws.Int64(60),
-				Type:            types.RRTypeA,
+				Type:            rs.rrType,
 			},
 		}
 		changes = append(changes, change)
 		slog.Info(f("route53 change: %v", change))
 	}
-	for name, cs := range addes {
+	for rs, cs := range addes {
 		var records []types.ResourceRecord
 		for _, c := range cs {
 			records = append(records, types.ResourceRecord{Value: &c.value})
@@ -150,10 +166,10 @@ DELETES:
 		change := types.Change{
 			Action: "UPSERT",
 			ResourceRecordSet: &types.ResourceRecordSet{
-				Name:            aws.String(name),
+				Name:            aws.String(rs.name),
 				ResourceRecords: records,
 				TTL:             aws.Int64(60),
-				Type:            types.RRTypeA,
+				Type:            rs.rrType,
 			},
 		}
 		changes = append(changes, change)
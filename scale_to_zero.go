@@ -0,0 +1,254 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	DefaultScaleToZeroCheckInterval = time.Minute
+	DefaultScaleToZeroWakeTimeout   = 5 * time.Minute
+
+	// wakeRetryAfter is a value of Retry-After header in the splash page.
+	wakeRetryAfter = 5
+)
+
+// ScaleToZero configures terminating idle subdomains and relaunching them on the next request.
+type ScaleToZero struct {
+	IdleDuration  time.Duration `yaml:"idle_duration"`
+	CheckInterval time.Duration `yaml:"check_interval"`
+	WakeTimeout   time.Duration `yaml:"wake_timeout"`
+}
+
+func (s *ScaleToZero) Validate() error {
+	if s.IdleDuration < PurgeMinimumDuration {
+		return fmt.Errorf("idle_duration must be at least %s", PurgeMinimumDuration)
+	}
+	if s.CheckInterval == 0 {
+		s.CheckInterval = DefaultScaleToZeroCheckInterval
+	}
+	if s.WakeTimeout == 0 {
+		s.WakeTimeout = DefaultScaleToZeroWakeTimeout
+	}
+	if s.CheckInterval < 0 || s.WakeTimeout < 0 {
+		return fmt.Errorf("check_interval and wake_timeout must be positive")
+	}
+	return nil
+}
+
+// sleepingSubdomain is a subdomain scaled to zero. It keeps the parameters to relaunch.
+type sleepingSubdomain struct {
+	Subdomain string
+	Taskdefs  []string
+	Parameter TaskParameter
+	SleptAt   time.Time
+	WokenAt   time.Time
+}
+
+type sleepingSubdomains struct {
+	mu         sync.Mutex
+	subdomains map[string]*sleepingSubdomain
+	wakes      singleflight.Group
+}
+
+func newSleepingSubdomains() *sleepingSubdomains {
+	return &sleepingSubdomains{
+		subdomains: make(map[string]*sleepingSubdomain),
+	}
+}
+
+func (s *sleepingSubdomains) get(subdomain string) (*sleepingSubdomain, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ss, ok := s.subdomains[subdomain]
+	return ss, ok
+}
+
+func (s *sleepingSubdomains) put(ss *sleepingSubdomain) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subdomains[ss.Subdomain] = ss
+}
+
+func (s *sleepingSubdomains) forget(subdomain string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subdomains, subdomain)
+}
+
+// sleepingSubdomainFrom builds sleepingSubdomain from the running tasks of the subdomain.
+func sleepingSubdomainFrom(infos []*Information, params Parameters, now time.Time) *sleepingSubdomain {
+	return &sleepingSubdomain{
+		Subdomain: infos[0].SubDomain,
+		Taskdefs:  taskdefsOf(infos),
+		Parameter: taskParameterFromInformation(infos[0], params),
+		SleptAt:   now,
+	}
+}
+
+func (m *Mirage) RunScaleToZero(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	s := m.Config.ScaleToZero
+	if s == nil {
+		slog.Debug("ScaleToZero is not configured")
+		return
+	}
+	slog.Info(f("starting up RunScaleToZero() idle_duration: %s", s.IdleDuration))
+	if err := m.restoreSleeping(ctx); err != nil {
+		slog.Warn(f("failed to restore sleeping subdomains: %s", err))
+	}
+	tk := time.NewTicker(s.CheckInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-tk.C:
+		case <-ctx.Done():
+			slog.Info("RunScaleToZero() is done")
+			return
+		}
+		if err := m.scaleToZero(ctx, s); err != nil {
+			slog.Warn(f("scale to zero failed: %s", err))
+		}
+	}
+}
+
+// scaleToZero terminates subdomains which have no access in the idle duration.
+func (m *Mirage) scaleToZero(ctx context.Context, s *ScaleToZero) error {
+	infos, err := m.runner.List(ctx, statusRunning)
+	if err != nil {
+		return fmt.Errorf("failed to list tasks: %w", err)
+	}
+	bySubdomain := make(map[string][]*Information)
+	var subdomains []string
+	for _, info := range infos {
+		if _, ok := bySubdomain[info.SubDomain]; !ok {
+			subdomains = append(subdomains, info.SubDomain)
+		}
+		bySubdomain[info.SubDomain] = append(bySubdomain[info.SubDomain], info)
+	}
+	now := time.Now()
+	for _, subdomain := range subdomains {
+		// woken up
+		m.sleeping.forget(subdomain)
+
+		tasks := bySubdomain[subdomain]
+		young := false
+		for _, info := range tasks {
+			if info.Created.IsZero() || now.Sub(info.Created) < s.IdleDuration {
+				young = true
+				break
+			}
+		}
+		if young {
+			continue
+		}
+		sum, err := m.runner.GetAccessCount(ctx, subdomain, s.IdleDuration)
+		if err != nil {
+			slog.Warn(f("access count failed: %s %s", subdomain, err))
+			continue
+		}
+		if sum > 0 {
+			continue
+		}
+		ss := sleepingSubdomainFrom(tasks, m.Config.Parameter, now)
+		if err := m.WebApi.checkRestorable(ctx, subdomain, tasks, ss.Parameter); err != nil {
+			// the wake would relaunch it without the secrets or the command
+			slog.Info(f("skip scaling %s to zero: %s", subdomain, err))
+			continue
+		}
+		m.sleeping.put(ss)
+		err = m.runner.TerminateBySubdomain(ctx, subdomain)
+		m.WebApi.recordHistory(ctx, &HistoryRecord{
+			Subdomain:  subdomain,
+			Action:     HistoryActionSleep,
+			Branch:     ss.Parameter["branch"],
+			Taskdefs:   ss.Taskdefs,
+			Parameters: ss.Parameter,
+			Actor:      "mirage-ecs",
+		}, err)
+		if err != nil {
+			slog.Warn(f("failed to scale %s to zero: %s", subdomain, err))
+			m.sleeping.forget(subdomain)
+			continue
+		}
+		slog.Info(f("scaled %s to zero after idle %s", subdomain, s.IdleDuration), "taskdefs", ss.Taskdefs)
+	}
+	return nil
+}
+
+// restoreSleeping restores the sleeping subdomains scaled to zero before the restart from the history.
+// A subdomain is sleeping when the latest successful action in the history is sleep.
+func (m *Mirage) restoreSleeping(ctx context.Context) error {
+	history := m.WebApi.history
+	if history == nil {
+		slog.Warn("history is not configured. the subdomains scaled to zero before the restart are not restored")
+		return nil
+	}
+	records, err := history.Query(ctx, HistoryQuery{})
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, r := range records { // newest first
+		if r.Outcome != HistoryOutcomeOK || seen[r.Subdomain] {
+			continue
+		}
+		seen[r.Subdomain] = true
+		if r.Action != HistoryActionSleep || len(r.Taskdefs) == 0 {
+			continue
+		}
+		if _, ok := m.sleeping.get(r.Subdomain); ok {
+			continue
+		}
+		parameter := TaskParameter{}
+		for k, v := range r.Parameters {
+			parameter[k] = v
+		}
+		m.sleeping.put(&sleepingSubdomain{
+			Subdomain: r.Subdomain,
+			Taskdefs:  r.Taskdefs,
+			Parameter: parameter,
+			SleptAt:   r.Timestamp,
+		})
+		slog.Info(f("restored sleeping subdomain %s", r.Subdomain), "taskdefs", r.Taskdefs)
+	}
+	return nil
+}
+
+// wake relaunches the sleeping subdomain in background.
+func (m *Mirage) wake(ss *sleepingSubdomain) {
+	s := m.Config.ScaleToZero
+	m.sleeping.mu.Lock()
+	wokenAt := ss.WokenAt
+	m.sleeping.mu.Unlock()
+	if !wokenAt.IsZero() && time.Since(wokenAt) < s.WakeTimeout {
+		// already woken, waiting for the task to be running
+		return
+	}
+	go m.sleeping.wakes.Do(ss.Subdomain, func() (interface{}, error) {
+		slog.Info(f("waking up %s", ss.Subdomain), "taskdefs", ss.Taskdefs)
+		ctx, cancel := context.WithTimeout(context.Background(), APICallTimeout)
+		defer cancel()
+		if err := m.WebApi.wake(ctx, ss); err != nil {
+			slog.Error(f("failed to wake up %s: %s", ss.Subdomain, err))
+			return nil, err
+		}
+		m.sleeping.mu.Lock()
+		ss.WokenAt = time.Now()
+		m.sleeping.mu.Unlock()
+		// the launch forgets the sleeping subdomain, but it is kept until the task is running in wake_timeout
+		m.sleeping.put(ss)
+		return nil, nil
+	})
+}
+
+func (m *Mirage) serveSleeping(w http.ResponseWriter, ss *sleepingSubdomain) {
+	m.wake(ss)
+	m.WebApi.renderer.serveWaitingPage(w, ss.Subdomain, "waking up", wakeRetryAfter)
+}
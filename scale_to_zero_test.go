@@ -0,0 +1,300 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+func TestScaleToZero(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ScaleToZero = &mirageecs.ScaleToZero{IdleDuration: time.Hour}
+	if err := cfg.ScaleToZero.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	runner := m.Runner()
+	if err := runner.Launch(ctx, "sleepy", mirageecs.TaskParameter{"branch": "feature/sleepy"}, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := runner.Launch(ctx, "young", mirageecs.TaskParameter{"branch": "feature/young"}, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := runner.List(ctx, "RUNNING")
+	for _, info := range infos {
+		if info.SubDomain == "sleepy" {
+			info.Created = time.Now().Add(-2 * time.Hour)
+		}
+	}
+
+	if err := m.ScaleToZero(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sleeping, _ := m.SleepingState("sleepy"); !sleeping {
+		t.Fatal("sleepy should be scaled to zero")
+	}
+	if sleeping, _ := m.SleepingState("young"); sleeping {
+		t.Fatal("young should not be scaled to zero")
+	}
+	infos, _ = runner.List(ctx, "RUNNING")
+	if len(infos) != 1 || infos[0].SubDomain != "young" {
+		t.Fatalf("only young should be running %#v", infos)
+	}
+
+	// request to the sleeping subdomain wakes it up
+	req := httptest.NewRequest(http.MethodGet, "http://sleepy.localtest.me/", nil)
+	w := httptest.NewRecorder()
+	m.ServeHTTPWithPort(w, req, 80)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("splash page should be 503, got %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "sleepy is waking up") || w.Header().Get("Retry-After") == "" {
+		t.Errorf("unexpected splash page %s", w.Body.String())
+	}
+	woken := waitRunning(t, runner, "sleepy")
+	if woken.TaskDef != "app:1" || woken.GitBranch != "feature/sleepy" {
+		t.Errorf("sleepy should be relaunched with the same parameters %#v", woken)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, woken := m.SleepingState("sleepy"); woken {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("sleepy is not woken up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the running subdomain is not sleeping anymore
+	if err := m.ScaleToZero(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sleeping, _ := m.SleepingState("sleepy"); sleeping {
+		t.Error("sleepy should not be sleeping after woken up")
+	}
+}
+
+// waitRunning waits for the subdomain to be running, and returns the task.
+func waitRunning(t *testing.T, runner mirageecs.TaskRunner, subdomain string) *mirageecs.Information {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		infos, _ := runner.List(context.Background(), "RUNNING")
+		for _, info := range infos {
+			if info.SubDomain == subdomain {
+				return info
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is not running", subdomain)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestScaleToZeroWakeGuarded(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ScaleToZero = &mirageecs.ScaleToZero{IdleDuration: time.Hour}
+	if err := cfg.ScaleToZero.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth = &mirageecs.Auth{CookieSecret: "secret"}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 80, TargetPort: 80, RequireAuthCookie: true}}
+	cfg.ECS.MaxConcurrentTasks = 1
+	m := mirageecs.New(ctx, cfg)
+	runner := m.Runner()
+	if err := runner.Launch(ctx, "sleepy", mirageecs.TaskParameter{}, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	infos, _ := runner.List(ctx, "RUNNING")
+	infos[0].Created = time.Now().Add(-2 * time.Hour)
+	if err := m.ScaleToZero(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sleeping, _ := m.SleepingState("sleepy"); !sleeping {
+		t.Fatal("sleepy should be scaled to zero")
+	}
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://sleepy.localtest.me/", nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		m.ServeHTTPWithPort(w, req, 80)
+		return w
+	}
+
+	// the request without the auth cookie doesn't wake it up
+	if w := serve(nil); w.Code != http.StatusForbidden {
+		t.Errorf("unexpected status without the auth cookie %d", w.Code)
+	}
+	if _, woken := m.SleepingState("sleepy"); woken {
+		t.Error("sleepy should not be woken up without the auth cookie")
+	}
+
+	cookie, err := cfg.Auth.NewAuthCookie(time.Hour, "localtest.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the limit of the concurrent tasks is applied to the wake
+	if err := runner.Launch(ctx, "other", mirageecs.TaskParameter{}, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(cookie); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+	time.Sleep(100 * time.Millisecond)
+	infos, _ = runner.List(ctx, "RUNNING")
+	if len(infos) != 1 || infos[0].SubDomain != "other" {
+		t.Errorf("sleepy should not be woken up over the limit %#v", infos)
+	}
+
+	if err := runner.TerminateBySubdomain(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(cookie); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("unexpected status %d", w.Code)
+	}
+	waitRunning(t, runner, "sleepy")
+}
+
+func TestScaleToZeroRestoreSleeping(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ScaleToZero = &mirageecs.ScaleToZero{IdleDuration: time.Hour}
+	if err := cfg.ScaleToZero.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	runner := m.Runner()
+	for _, subdomain := range []string{"sleepy", "terminated"} {
+		if err := runner.Launch(ctx, subdomain, mirageecs.TaskParameter{"branch": "feature/" + subdomain}, "app:1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	infos, _ := runner.List(ctx, "RUNNING")
+	for _, info := range infos {
+		info.Created = time.Now().Add(-2 * time.Hour)
+	}
+	if err := m.ScaleToZero(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the sleeping subdomain terminated by the API is not restored
+	history := m.HistoryStore()
+	if err := history.Put(ctx, &mirageecs.HistoryRecord{
+		Subdomain: "terminated",
+		Action:    mirageecs.HistoryActionTerminate,
+		Timestamp: time.Now().Add(time.Second),
+		Outcome:   mirageecs.HistoryOutcomeOK,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// restart
+	restarted := mirageecs.New(ctx, cfg)
+	restarted.SetHistoryStore(history)
+	if err := restarted.RestoreSleeping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sleeping, _ := restarted.SleepingState("sleepy"); !sleeping {
+		t.Fatal("sleepy should be restored as sleeping")
+	}
+	if sleeping, _ := restarted.SleepingState("terminated"); sleeping {
+		t.Error("terminated should not be restored")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://sleepy.localtest.me/", nil)
+	w := httptest.NewRecorder()
+	restarted.ServeHTTPWithPort(w, req, 80)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("splash page should be 503, got %d", w.Code)
+	}
+	woken := waitRunning(t, restarted.Runner(), "sleepy")
+	if woken.TaskDef != "app:1" || woken.GitBranch != "feature/sleepy" {
+		t.Errorf("sleepy should be relaunched with the same parameters %#v", woken)
+	}
+}
+
+func TestScaleToZeroNotRestorable(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ScaleToZero = &mirageecs.ScaleToZero{IdleDuration: time.Hour}
+	if err := cfg.ScaleToZero.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	runner := m.Runner().(*mirageecs.LocalTaskRunner)
+	if err := runner.Launch(ctx, "plain", mirageecs.TaskParameter{}, "app:1"); err != nil {
+		t.Fatal(err)
+	}
+	newInfo := func(subdomain, taskdef string, ov types.ContainerOverride) *mirageecs.Information {
+		ov.Name = aws.String("app")
+		return mirageecs.NewInformation(&types.Task{
+			TaskArn:           aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/" + subdomain),
+			TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/" + taskdef),
+			LastStatus:        aws.String("RUNNING"),
+			Overrides:         &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{ov}},
+			Tags: []types.Tag{
+				{Key: aws.String("Subdomain"), Value: aws.String(base64.URLEncoding.EncodeToString([]byte(subdomain)))},
+				{Key: aws.String(mirageecs.TagManagedBy), Value: aws.String(mirageecs.TagValueMirage)},
+			},
+		}, cfg)
+	}
+	runner.Informations = append(runner.Informations,
+		newInfo("commanded", "app:1", types.ContainerOverride{Command: []string{"rails", "console"}}),
+		newInfo("secret", "app-mirage-secrets:1", types.ContainerOverride{}),
+	)
+	for _, info := range runner.Informations {
+		info.Created = time.Now().Add(-2 * time.Hour)
+	}
+
+	if err := m.ScaleToZero(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if sleeping, _ := m.SleepingState("plain"); !sleeping {
+		t.Error("plain should be scaled to zero")
+	}
+	for _, subdomain := range []string{"commanded", "secret"} {
+		if sleeping, _ := m.SleepingState(subdomain); sleeping {
+			t.Errorf("%s should not be scaled to zero", subdomain)
+		}
+		if infos, _ := runner.Status(ctx, subdomain); len(infos) == 0 {
+			t.Errorf("%s should be running", subdomain)
+		}
+	}
+}
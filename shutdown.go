@@ -0,0 +1,83 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultDrainTimeout is the default timeout to drain in-flight requests on shutdown.
+const DefaultDrainTimeout = 30 * time.Second
+
+// inflightRequests tracks the requests in progress to report them on shutdown.
+type inflightRequests struct {
+	mu   sync.Mutex
+	seq  uint64
+	reqs map[uint64]inflightRequest
+}
+
+type inflightRequest struct {
+	host    string
+	method  string
+	path    string
+	started time.Time
+}
+
+func newInflightRequests() *inflightRequests {
+	return &inflightRequests{
+		reqs: make(map[uint64]inflightRequest),
+	}
+}
+
+// track registers the request. The returned func must be called when the request is done.
+func (r *inflightRequests) track(req *http.Request) func() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seq++
+	id := r.seq
+	r.reqs[id] = inflightRequest{
+		host:    req.Host,
+		method:  req.Method,
+		path:    req.URL.Path,
+		started: time.Now(),
+	}
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delete(r.reqs, id)
+	}
+}
+
+// list returns the descriptions of the requests in progress, the oldest first.
+func (r *inflightRequests) list(now time.Time) []string {
+	r.mu.Lock()
+	reqs := make([]inflightRequest, 0, len(r.reqs))
+	for _, req := range r.reqs {
+		reqs = append(reqs, req)
+	}
+	r.mu.Unlock()
+	sort.Slice(reqs, func(i, j int) bool {
+		return reqs[i].started.Before(reqs[j].started)
+	})
+	s := make([]string, 0, len(reqs))
+	for _, req := range reqs {
+		s = append(s, fmt.Sprintf("%s %s%s (%s)", req.method, req.host, req.path, now.Sub(req.started).Truncate(time.Millisecond)))
+	}
+	return s
+}
+
+// drainContext returns a context that is canceled when the timeout elapsed after ctx is done.
+// It bounds the graceful shutdown started by the cancellation of ctx.
+func drainContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	dctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(timeout, cancel)
+	})
+	return dctx, func() {
+		stop()
+		cancel()
+	}
+}
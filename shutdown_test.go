@@ -0,0 +1,60 @@
+package mirageecs_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestDrainContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	dctx, dcancel := mirageecs.DrainContext(ctx, 100*time.Millisecond)
+	defer dcancel()
+
+	cancel()
+	select {
+	case <-dctx.Done():
+		t.Fatal("drain context must not be done before the timeout")
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case <-dctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("drain context must be done after the timeout")
+	}
+}
+
+func TestDrainContextNotStarted(t *testing.T) {
+	dctx, dcancel := mirageecs.DrainContext(context.Background(), time.Millisecond)
+	select {
+	case <-dctx.Done():
+		t.Fatal("drain context must not be done until the parent is done")
+	case <-time.After(50 * time.Millisecond):
+	}
+	dcancel()
+	<-dctx.Done()
+}
+
+func TestInflightRequests(t *testing.T) {
+	r := mirageecs.NewInflightRequests()
+	now := time.Now()
+	done1 := r.Track(httptest.NewRequest("GET", "http://foo.example.net/ws", nil))
+	done2 := r.Track(httptest.NewRequest("POST", "http://bar.example.net/upload", nil))
+	if got := r.List(now); len(got) != 2 {
+		t.Errorf("unexpected in-flight requests %v", got)
+	}
+	done2()
+	got := r.List(now)
+	if diff := cmp.Diff([]string{"GET foo.example.net/ws (0s)"}, got); diff != "" {
+		t.Errorf("unexpected in-flight requests (-want +got):\n%s", diff)
+	}
+	done1()
+	if got := r.List(now); len(got) != 0 {
+		t.Errorf("unexpected in-flight requests %v", got)
+	}
+}
@@ -0,0 +1,53 @@
+package mirageecs
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+)
+
+const TagColumnDecodeBase64 = "base64"
+
+// TagColumn configures a tag of tasks to be shown as a named column in the list.
+type TagColumn struct {
+	Key    string `yaml:"key"`
+	Label  string `yaml:"label"`
+	Decode string `yaml:"decode"`
+}
+
+func (c *TagColumn) Validate() error {
+	if c.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	if c.Label == "" {
+		c.Label = c.Key
+	}
+	switch c.Decode {
+	case "", TagColumnDecodeBase64:
+	default:
+		return fmt.Errorf("unsupported decode %s for %s", c.Decode, c.Key)
+	}
+	return nil
+}
+
+// tagLabels extracts values of the tags configured by columns. The keys of the result are labels of the columns.
+func tagLabels(columns []*TagColumn, tags []types.Tag) map[string]string {
+	if len(columns) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(columns))
+	for _, c := range columns {
+		for _, t := range tags {
+			if t.Key == nil || t.Value == nil || *t.Key != c.Key {
+				continue
+			}
+			v := *t.Value
+			if c.Decode == TagColumnDecodeBase64 {
+				v = decodeTagValue(v)
+			}
+			labels[c.Label] = v
+			break
+		}
+	}
+	return labels
+}
@@ -0,0 +1,43 @@
+package mirageecs_test
+
+import (
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestTagLabels(t *testing.T) {
+	columns := []*mirageecs.TagColumn{
+		{Key: "Team"},
+		{Key: "PRNumber", Label: "PR"},
+		{Key: "Subdomain", Decode: "base64"},
+		{Key: "Missing"},
+	}
+	for _, c := range columns {
+		if err := c.Validate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tags := []types.Tag{
+		{Key: aws.String("Team"), Value: aws.String("platform")},
+		{Key: aws.String("PRNumber"), Value: aws.String("123")},
+		{Key: aws.String("Subdomain"), Value: aws.String("Zm9v")},
+		{Key: aws.String("Other"), Value: aws.String("ignored")},
+	}
+	expected := map[string]string{
+		"Team":      "platform",
+		"PR":        "123",
+		"Subdomain": "foo",
+	}
+	if diff := cmp.Diff(expected, mirageecs.TagLabels(columns, tags)); diff != "" {
+		t.Errorf("unexpected labels (-want +got):\n%s", diff)
+	}
+
+	invalid := &mirageecs.TagColumn{Key: "Team", Decode: "rot13"}
+	if err := invalid.Validate(); err == nil {
+		t.Error("unsupported decode must be an error")
+	}
+}
@@ -0,0 +1,261 @@
+package mirageecs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/samber/lo"
+	"gopkg.in/yaml.v2"
+)
+
+// TaskOverrideTemplateData is the data to render ecs.override_template.
+type TaskOverrideTemplateData struct {
+	Subdomain  string
+	Taskdef    string
+	Parameters map[string]string
+}
+
+func parseTaskOverrideTemplate(name string, content []byte) (*template.Template, error) {
+	return template.New(name).Option("missingkey=zero").Parse(string(content))
+}
+
+// renderTaskOverride renders the template as YAML (or JSON) and decodes it to TaskOverride.
+// The keys are the same as the overrides of RunTask API, e.g. containerOverrides.
+func renderTaskOverride(tmpl *template.Template, data TaskOverrideTemplateData) (*types.TaskOverride, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to render override template: %w", err)
+	}
+	var v interface{}
+	if err := yaml.Unmarshal(buf.Bytes(), &v); err != nil {
+		return nil, fmt.Errorf("failed to parse rendered override: %w", err)
+	}
+	b, err := json.Marshal(toJSONCompatible(v))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse rendered override: %w", err)
+	}
+	ov := &types.TaskOverride{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(ov); err != nil {
+		return nil, fmt.Errorf("failed to decode rendered override: %w", err)
+	}
+	return ov, nil
+}
+
+// toJSONCompatible converts map[interface{}]interface{} decoded by yaml.v2 to map[string]interface{}.
+func toJSONCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = toJSONCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = toJSONCompatible(val)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// validateTaskOverride validates the rendered override against the task definition.
+func validateTaskOverride(ov *types.TaskOverride, td *types.TaskDefinition) error {
+	names := lo.Map(td.ContainerDefinitions, func(c types.ContainerDefinition, _ int) string {
+		return aws.ToString(c.Name)
+	})
+	seen := make(map[string]struct{}, len(ov.ContainerOverrides))
+	for _, c := range ov.ContainerOverrides {
+		name := aws.ToString(c.Name)
+		if name == "" {
+			return fmt.Errorf("name of container override is required")
+		}
+		if !lo.Contains(names, name) {
+			return fmt.Errorf("container %s is not defined in task definition %s", name, aws.ToString(td.TaskDefinitionArn))
+		}
+		if _, ok := seen[name]; ok {
+			return fmt.Errorf("container %s is overridden twice", name)
+		}
+		seen[name] = struct{}{}
+		for _, e := range c.Environment {
+			if aws.ToString(e.Name) == "" {
+				return fmt.Errorf("name of environment variable in container %s is required", name)
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTaskOverride merges ov into base. The values of ov take precedence.
+// Environment variables of containers are merged by name.
+func mergeTaskOverride(base, ov *types.TaskOverride) {
+	if ov.Cpu != nil {
+		base.Cpu = ov.Cpu
+	}
+	if ov.Memory != nil {
+		base.Memory = ov.Memory
+	}
+	if ov.EphemeralStorage != nil {
+		base.EphemeralStorage = ov.EphemeralStorage
+	}
+	if ov.ExecutionRoleArn != nil {
+		base.ExecutionRoleArn = ov.ExecutionRoleArn
+	}
+	if ov.TaskRoleArn != nil {
+		base.TaskRoleArn = ov.TaskRoleArn
+	}
+	if ov.InferenceAcceleratorOverrides != nil {
+		base.InferenceAcceleratorOverrides = ov.InferenceAcceleratorOverrides
+	}
+	for _, c := range ov.ContainerOverrides {
+		_, i, ok := lo.FindIndexOf(base.ContainerOverrides, func(b types.ContainerOverride) bool {
+			return aws.ToString(b.Name) == aws.ToString(c.Name)
+		})
+		if !ok {
+			base.ContainerOverrides = append(base.ContainerOverrides, c)
+			continue
+		}
+		b := &base.ContainerOverrides[i]
+		b.Environment = mergeEnvironment(b.Environment, c.Environment)
+		if c.Command != nil {
+			b.Command = c.Command
+		}
+		if c.Cpu != nil {
+			b.Cpu = c.Cpu
+		}
+		if c.Memory != nil {
+			b.Memory = c.Memory
+		}
+		if c.MemoryReservation != nil {
+			b.MemoryReservation = c.MemoryReservation
+		}
+		if c.EnvironmentFiles != nil {
+			b.EnvironmentFiles = c.EnvironmentFiles
+		}
+		if c.ResourceRequirements != nil {
+			b.ResourceRequirements = c.ResourceRequirements
+		}
+	}
+}
+
+func mergeEnvironment(base, ov []types.KeyValuePair) []types.KeyValuePair {
+	merged := make([]types.KeyValuePair, 0, len(base)+len(ov))
+	for _, e := range base {
+		if lo.ContainsBy(ov, func(o types.KeyValuePair) bool { return aws.ToString(o.Name) == aws.ToString(e.Name) }) {
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return append(merged, ov...)
+}
+
+type memoryRange struct {
+	min, max, step int
+}
+
+// fargateMemoryRanges are the memory (MiB) which Fargate allows for each CPU units.
+// https://docs.aws.amazon.com/AmazonECS/latest/developerguide/task-cpu-memory-error.html
+var fargateMemoryRanges = map[int][]memoryRange{
+	256:   {{min: 512, max: 1024, step: 512}, {min: 2048, max: 2048, step: 1}},
+	512:   {{min: 1024, max: 4096, step: 1024}},
+	1024:  {{min: 2048, max: 8192, step: 1024}},
+	2048:  {{min: 4096, max: 16384, step: 1024}},
+	4096:  {{min: 8192, max: 30720, step: 1024}},
+	8192:  {{min: 16384, max: 61440, step: 4096}},
+	16384: {{min: 32768, max: 122880, step: 8192}},
+}
+
+func (r memoryRange) contains(memory int) bool {
+	return r.min <= memory && memory <= r.max && (memory-r.min)%r.step == 0
+}
+
+// validateTaskSize validates the cpu units and memory (MiB) of the launch request.
+// The combination is validated by applyTaskSize only for the Fargate task definitions,
+// because the EC2 launch type accepts any positive values.
+func validateTaskSize(cpu, memory string) error {
+	if cpu != "" {
+		if c, err := strconv.Atoi(cpu); err != nil || c <= 0 {
+			return fmt.Errorf("invalid cpu %s", cpu)
+		}
+	}
+	if memory != "" {
+		if m, err := strconv.Atoi(memory); err != nil || m <= 0 {
+			return fmt.Errorf("invalid memory %s", memory)
+		}
+	}
+	return nil
+}
+
+func validateFargateTaskSize(cpu, memory int) error {
+	ranges, ok := fargateMemoryRanges[cpu]
+	if !ok {
+		return fmt.Errorf("cpu %d is not supported by Fargate", cpu)
+	}
+	if !lo.SomeBy(ranges, func(r memoryRange) bool { return r.contains(memory) }) {
+		return fmt.Errorf("memory %d is not supported with cpu %d by Fargate", memory, cpu)
+	}
+	return nil
+}
+
+// applyTaskSize sets the cpu and memory to the override.
+// For the Fargate task definitions, the combination with the values of the task definition is validated.
+func applyTaskSize(ov *types.TaskOverride, td *types.TaskDefinition, cpu, memory string) error {
+	if cpu != "" {
+		ov.Cpu = aws.String(cpu)
+	}
+	if memory != "" {
+		ov.Memory = aws.String(memory)
+	}
+	if !lo.Contains(td.RequiresCompatibilities, types.CompatibilityFargate) {
+		return nil
+	}
+	cpu, memory = aws.ToString(td.Cpu), aws.ToString(td.Memory)
+	if ov.Cpu != nil {
+		cpu = *ov.Cpu
+	}
+	if ov.Memory != nil {
+		memory = *ov.Memory
+	}
+	c, err := strconv.Atoi(cpu)
+	if err != nil {
+		return fmt.Errorf("invalid cpu %s for task definition %s", cpu, aws.ToString(td.TaskDefinitionArn))
+	}
+	m, err := strconv.Atoi(memory)
+	if err != nil {
+		return fmt.Errorf("invalid memory %s for task definition %s", memory, aws.ToString(td.TaskDefinitionArn))
+	}
+	return validateFargateTaskSize(c, m)
+}
+
+// applyCommand sets the command to the override of the container. The empty container means the first container
+// of the task definition, and the container must be defined in the task definition.
+func applyCommand(ov *types.TaskOverride, td *types.TaskDefinition, container string, command []string) error {
+	if container == "" {
+		if len(td.ContainerDefinitions) == 0 {
+			return fmt.Errorf("task definition %s has no containers", aws.ToString(td.TaskDefinitionArn))
+		}
+		container = aws.ToString(td.ContainerDefinitions[0].Name)
+	}
+	if !lo.SomeBy(td.ContainerDefinitions, func(c types.ContainerDefinition) bool { return aws.ToString(c.Name) == container }) {
+		return fmt.Errorf("container %s is not defined in task definition %s", container, aws.ToString(td.TaskDefinitionArn))
+	}
+	for i, c := range ov.ContainerOverrides {
+		if aws.ToString(c.Name) == container {
+			ov.ContainerOverrides[i].Command = command
+			return nil
+		}
+	}
+	ov.ContainerOverrides = append(ov.ContainerOverrides, types.ContainerOverride{
+		Name:    aws.String(container),
+		Command: command,
+	})
+	return nil
+}
@@ -0,0 +1,214 @@
+package mirageecs_test
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+const testOverrideTemplate = `
+memory: "2048"
+containerOverrides:
+  - name: app
+    command: ["bundle", "exec", "rails", "server"]
+    environment:
+      - name: RAILS_ENV
+        value: {{ if eq .Parameters.branch "main" }}staging{{ else }}development{{ end }}
+      - name: SUBDOMAIN
+        value: "{{ .Subdomain }}-app"
+{{- if .Parameters.worker }}
+  - name: worker
+    cpu: 512
+{{- end }}
+`
+
+func TestRenderTaskOverride(t *testing.T) {
+	tmpl, err := mirageecs.ParseTaskOverrideTemplate("test", []byte(testOverrideTemplate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ov, err := mirageecs.RenderTaskOverride(tmpl, mirageecs.TaskOverrideTemplateData{
+		Subdomain:  "foo",
+		Taskdef:    "app:1",
+		Parameters: map[string]string{"branch": "main", "worker": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	td := &types.TaskDefinition{
+		TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:1"),
+		ContainerDefinitions: []types.ContainerDefinition{
+			{Name: aws.String("app")},
+			{Name: aws.String("worker")},
+		},
+	}
+	if err := mirageecs.ValidateTaskOverride(ov, td); err != nil {
+		t.Fatal(err)
+	}
+
+	base := &types.TaskOverride{
+		ContainerOverrides: []types.ContainerOverride{
+			{
+				Name: aws.String("app"),
+				Environment: []types.KeyValuePair{
+					{Name: aws.String("SUBDOMAIN"), Value: aws.String("foo")},
+					{Name: aws.String("GIT_BRANCH"), Value: aws.String("main")},
+				},
+			},
+		},
+	}
+	mirageecs.MergeTaskOverride(base, ov)
+	expected := &types.TaskOverride{
+		Memory: aws.String("2048"),
+		ContainerOverrides: []types.ContainerOverride{
+			{
+				Name:    aws.String("app"),
+				Command: []string{"bundle", "exec", "rails", "server"},
+				Environment: []types.KeyValuePair{
+					{Name: aws.String("GIT_BRANCH"), Value: aws.String("main")},
+					{Name: aws.String("RAILS_ENV"), Value: aws.String("staging")},
+					{Name: aws.String("SUBDOMAIN"), Value: aws.String("foo-app")},
+				},
+			},
+			{
+				Name: aws.String("worker"),
+				Cpu:  aws.Int32(512),
+			},
+		},
+	}
+	opt := cmpopts.IgnoreUnexported(types.TaskOverride{}, types.ContainerOverride{}, types.KeyValuePair{})
+	if diff := cmp.Diff(expected, base, opt); diff != "" {
+		t.Errorf("unexpected override %s", diff)
+	}
+}
+
+func TestRenderTaskOverrideInvalid(t *testing.T) {
+	td := &types.TaskDefinition{
+		ContainerDefinitions: []types.ContainerDefinition{{Name: aws.String("app")}},
+	}
+	tests := []struct {
+		name string
+		tmpl string
+	}{
+		{name: "unknown field", tmpl: `containerOverride: []`},
+		{name: "invalid type", tmpl: `cpu: {foo: bar}`},
+		{name: "unknown container", tmpl: `containerOverrides: [{name: db}]`},
+		{name: "no container name", tmpl: `containerOverrides: [{cpu: 256}]`},
+		{name: "duplicated container", tmpl: `containerOverrides: [{name: app}, {name: app}]`},
+		{name: "no env name", tmpl: `containerOverrides: [{name: app, environment: [{value: x}]}]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := mirageecs.ParseTaskOverrideTemplate(tt.name, []byte(tt.tmpl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			ov, err := mirageecs.RenderTaskOverride(tmpl, mirageecs.TaskOverrideTemplateData{})
+			if err == nil {
+				err = mirageecs.ValidateTaskOverride(ov, td)
+			}
+			if err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
+
+func TestValidateTaskSize(t *testing.T) {
+	cases := []struct {
+		cpu     string
+		memory  string
+		wantErr bool
+	}{
+		{cpu: "", memory: "", wantErr: false},
+		{cpu: "1024", memory: "", wantErr: false},
+		{cpu: "", memory: "4096", wantErr: false},
+		{cpu: "256", memory: "512", wantErr: false},
+		{cpu: "300", memory: "700", wantErr: false}, // valid for EC2
+		{cpu: "768", memory: "", wantErr: false},
+		{cpu: "0", memory: "", wantErr: true},
+		{cpu: "1 vCPU", memory: "", wantErr: true},
+		{cpu: "", memory: "-1", wantErr: true},
+		{cpu: "", memory: "2GB", wantErr: true},
+	}
+	for _, c := range cases {
+		err := mirageecs.ValidateTaskSize(c.cpu, c.memory)
+		if c.wantErr && err == nil {
+			t.Errorf("cpu:%s memory:%s should be invalid", c.cpu, c.memory)
+		} else if !c.wantErr && err != nil {
+			t.Errorf("cpu:%s memory:%s should be valid: %s", c.cpu, c.memory, err)
+		}
+	}
+}
+
+func TestValidateFargateTaskSize(t *testing.T) {
+	cases := []struct {
+		cpu     int
+		memory  int
+		wantErr bool
+	}{
+		{cpu: 256, memory: 512, wantErr: false},
+		{cpu: 256, memory: 2048, wantErr: false},
+		{cpu: 256, memory: 1536, wantErr: true},
+		{cpu: 512, memory: 512, wantErr: true},
+		{cpu: 1024, memory: 8192, wantErr: false},
+		{cpu: 1024, memory: 9216, wantErr: true},
+		{cpu: 4096, memory: 30720, wantErr: false},
+		{cpu: 8192, memory: 20480, wantErr: false},
+		{cpu: 8192, memory: 17408, wantErr: true},
+		{cpu: 16384, memory: 122880, wantErr: false},
+		{cpu: 768, memory: 2048, wantErr: true},
+	}
+	for _, c := range cases {
+		err := mirageecs.ValidateFargateTaskSize(c.cpu, c.memory)
+		if c.wantErr && err == nil {
+			t.Errorf("cpu:%d memory:%d should be invalid", c.cpu, c.memory)
+		} else if !c.wantErr && err != nil {
+			t.Errorf("cpu:%d memory:%d should be valid: %s", c.cpu, c.memory, err)
+		}
+	}
+}
+
+func TestApplyTaskSize(t *testing.T) {
+	fargate := &types.TaskDefinition{
+		TaskDefinitionArn:       aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/app:1"),
+		Cpu:                     aws.String("256"),
+		Memory:                  aws.String("512"),
+		RequiresCompatibilities: []types.Compatibility{types.CompatibilityFargate},
+	}
+	ov := &types.TaskOverride{}
+	if err := mirageecs.ApplyTaskSize(ov, fargate, "1024", "2048"); err != nil {
+		t.Fatal(err)
+	}
+	if aws.ToString(ov.Cpu) != "1024" || aws.ToString(ov.Memory) != "2048" {
+		t.Errorf("unexpected override cpu:%s memory:%s", aws.ToString(ov.Cpu), aws.ToString(ov.Memory))
+	}
+
+	// memory of the task definition (512) is too small for 1024 cpu units
+	if err := mirageecs.ApplyTaskSize(&types.TaskOverride{}, fargate, "1024", ""); err == nil {
+		t.Error("cpu 1024 with memory 512 should be invalid for Fargate")
+	}
+
+	ec2 := &types.TaskDefinition{
+		Cpu:    aws.String("256"),
+		Memory: aws.String("512"),
+	}
+	ov = &types.TaskOverride{}
+	if err := mirageecs.ApplyTaskSize(ov, ec2, "1024", ""); err != nil {
+		t.Errorf("combination should not be validated for EC2: %s", err)
+	}
+	if aws.ToString(ov.Cpu) != "1024" || ov.Memory != nil {
+		t.Errorf("unexpected override cpu:%s memory:%v", aws.ToString(ov.Cpu), ov.Memory)
+	}
+	if err := mirageecs.ApplyTaskSize(&types.TaskOverride{}, ec2, "300", "700"); err != nil {
+		t.Errorf("cpu 300 with memory 700 should be valid for EC2: %s", err)
+	}
+	if err := mirageecs.ApplyTaskSize(&types.TaskOverride{}, fargate, "300", "700"); err == nil {
+		t.Error("cpu 300 with memory 700 should be invalid for Fargate")
+	}
+}
@@ -0,0 +1,60 @@
+package mirageecs
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"strconv"
+)
+
+// defaultTemplates are the template files built into the binary.
+// They are used when htmldir does not have the files.
+//
+//go:embed html/*.html
+var defaultTemplates embed.FS
+
+// loadTemplates loads the default templates, and then the files in htmlDir over them.
+// A file in htmlDir overrides the default template of the same name.
+func loadTemplates(htmlDir string) (*template.Template, error) {
+	tmpl := mustLoadDefaultTemplates()
+	files, err := filepath.Glob(filepath.Join(htmlDir, "*"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid htmldir %s: %w", htmlDir, err)
+	}
+	if len(files) == 0 {
+		slog.Info(f("no templates in %s, using the default templates", htmlDir))
+		return tmpl, nil
+	}
+	if _, err := tmpl.ParseFiles(files...); err != nil {
+		return nil, fmt.Errorf("failed to parse templates in %s: %w", htmlDir, err)
+	}
+	return tmpl, nil
+}
+
+// mustLoadDefaultTemplates parses the default templates. They are verified by the tests.
+func mustLoadDefaultTemplates() *template.Template {
+	return template.Must(template.ParseFS(defaultTemplates, "html/*.html"))
+}
+
+// waitingPageFile is the template of the page for the subdomain which is not ready to serve yet.
+const waitingPageFile = "starting.html"
+
+// serveWaitingPage renders starting.html as 503 Service Unavailable for the subdomain which is not ready yet.
+// state is what the subdomain is doing, e.g. "launching". The page should reload itself after retryAfter seconds.
+func (t *Template) serveWaitingPage(w http.ResponseWriter, subdomain, state string, retryAfter int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	err := t.Render(w, waitingPageFile, map[string]interface{}{
+		"Subdomain":  subdomain,
+		"State":      state,
+		"RetryAfter": retryAfter,
+	}, nil)
+	if err != nil {
+		slog.Warn(f("failed to render the %s page of %s: %s", state, subdomain, err))
+	}
+}
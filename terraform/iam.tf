@@ -26,6 +26,7 @@ resource "aws_iam_policy" "mirage-ecs" {
           "ecs:RunTask",
           "ecs:DescribeTasks",
           "ecs:DescribeTaskDefinition",
+          "ecs:RegisterTaskDefinition",
           "ecs:DescribeServices",
           "ecs:StopTask",
           "ecs:ListTasks",
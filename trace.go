@@ -0,0 +1,108 @@
+package mirageecs
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	ttlcache "github.com/ReneKroon/ttlcache/v2"
+	"github.com/fujiwara/tracer"
+)
+
+const (
+	// DefaultTraceDuration is the default duration of the timeline traced around the task lifecycle.
+	DefaultTraceDuration = 5 * time.Minute
+	// DefaultTraceMaxDuration is the default max duration specified by the duration query parameter.
+	DefaultTraceMaxDuration = time.Hour
+	// DefaultTraceCacheTTL is the default TTL of the trace results cached.
+	DefaultTraceCacheTTL = time.Minute
+)
+
+// TraceEvent is an event of the task timeline reported by tracer.
+type TraceEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Source    string    `json:"source"`
+	Message   string    `json:"message"`
+}
+
+// TraceResult is a result of tracing the task.
+type TraceResult struct {
+	Subject string        `json:"subject"`
+	Events  []*TraceEvent `json:"events"`
+
+	text string
+}
+
+// String returns the raw output of tracer.
+func (r *TraceResult) String() string {
+	return r.text
+}
+
+// parseTrace parses the output of tracer into TraceResult.
+// Each event of the timeline is a line of "timestamp\tsource\tmessage".
+// Lines that do not start with a timestamp (e.g. multi-line log messages) are appended to the previous event.
+func parseTrace(text string) *TraceResult {
+	r := &TraceResult{
+		Events: []*TraceEvent{},
+		text:   text,
+	}
+	var last *TraceEvent
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if r.Subject == "" && last == nil && strings.HasPrefix(line, "Tracer:") {
+			r.Subject = line
+			continue
+		}
+		cols := strings.SplitN(line, "\t", 3)
+		if len(cols) == 3 {
+			if ts, err := time.Parse(tracer.TimeFormat, cols[0]); err == nil {
+				last = &TraceEvent{Timestamp: ts, Source: cols[1], Message: cols[2]}
+				r.Events = append(r.Events, last)
+				continue
+			}
+		}
+		if last != nil {
+			last.Message += "\n" + line
+		}
+	}
+	return r
+}
+
+// traceCache caches the trace results by the task id and duration,
+// not to run tracer again on refreshing the trace page.
+// A nil traceCache caches nothing.
+type traceCache struct {
+	cache *ttlcache.Cache
+}
+
+func newTraceCache(ttl time.Duration) *traceCache {
+	if ttl <= 0 {
+		return nil
+	}
+	cache := ttlcache.NewCache()
+	cache.SetTTL(ttl)
+	cache.SkipTTLExtensionOnHit(true)
+	return &traceCache{cache: cache}
+}
+
+// get returns the cached trace result, or traces the task and caches the result.
+// Errors are not cached.
+func (c *traceCache) get(ctx context.Context, id string, duration time.Duration, trace func(context.Context, string, time.Duration) (*TraceResult, error)) (*TraceResult, error) {
+	if c == nil {
+		return trace(ctx, id, duration)
+	}
+	key := fmt.Sprintf("%s/%s", id, duration)
+	if v, err := c.cache.Get(key); err == nil {
+		if r, ok := v.(*TraceResult); ok {
+			slog.Debug(f("cache hit for the trace of %s", key))
+			return r, nil
+		}
+	}
+	r, err := trace(ctx, id, duration)
+	if err != nil {
+		return nil, err
+	}
+	c.cache.Set(key, r)
+	return r, nil
+}
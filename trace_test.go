@@ -0,0 +1,72 @@
+package mirageecs_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+const testTraceOutput = `Tracer: 0123456789abcdef on default
+2023-07-01T12:00:00.000Z	TASK	Created
+2023-07-01T12:00:05.123Z	TASK	Pull started
+2023-07-01T12:00:10.000Z	CONTAINER:app	panic: something wrong
+goroutine 1 [running]:
+main.main()
+2023-07-01T12:00:11.000Z	TASK	StoppedReason:Essential container in task exited
+`
+
+func TestParseTrace(t *testing.T) {
+	r := mirageecs.ParseTrace(testTraceOutput)
+	if r.Subject != "Tracer: 0123456789abcdef on default" {
+		t.Errorf("unexpected subject %s", r.Subject)
+	}
+	if r.String() != testTraceOutput {
+		t.Errorf("unexpected text %s", r.String())
+	}
+	expected := []*mirageecs.TraceEvent{
+		{Timestamp: time.Date(2023, 7, 1, 12, 0, 0, 0, time.UTC), Source: "TASK", Message: "Created"},
+		{Timestamp: time.Date(2023, 7, 1, 12, 0, 5, 123000000, time.UTC), Source: "TASK", Message: "Pull started"},
+		{Timestamp: time.Date(2023, 7, 1, 12, 0, 10, 0, time.UTC), Source: "CONTAINER:app", Message: "panic: something wrong\ngoroutine 1 [running]:\nmain.main()"},
+		{Timestamp: time.Date(2023, 7, 1, 12, 0, 11, 0, time.UTC), Source: "TASK", Message: "StoppedReason:Essential container in task exited"},
+	}
+	if diff := cmp.Diff(expected, r.Events); diff != "" {
+		t.Errorf("unexpected events (-want +got):\n%s", diff)
+	}
+}
+
+func TestTraceResultJSON(t *testing.T) {
+	b, err := json.Marshal(mirageecs.ParseTrace(testTraceOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(b) {
+		t.Fatalf("invalid json %s", b)
+	}
+	var r struct {
+		Subject string `json:"subject"`
+		Events  []struct {
+			Timestamp string `json:"timestamp"`
+			Source    string `json:"source"`
+			Message   string `json:"message"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Subject != "Tracer: 0123456789abcdef on default" || len(r.Events) != 4 {
+		t.Fatalf("unexpected trace %s", b)
+	}
+	if e := r.Events[1]; e.Timestamp != "2023-07-01T12:00:05.123Z" || e.Source != "TASK" || e.Message != "Pull started" {
+		t.Errorf("unexpected event %#v", e)
+	}
+
+	// the events are an empty array when tracer outputs nothing, e.g. trace_stdout is false
+	b, _ = json.Marshal(mirageecs.ParseTrace(""))
+	if string(b) != `{"subject":"","events":[]}` {
+		t.Errorf("unexpected json %s", b)
+	}
+}
@@ -1,14 +1,19 @@
 package mirageecs_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
+
 	mirageecs "github.com/acidlemon/mirage-ecs/v2"
 )
 
@@ -124,3 +129,229 @@ func TestRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestRoundTripPreflight(t *testing.T) {
+	var upstreamCalled bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamCalled = true
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}))
+	defer server.Close()
+
+	p := &mirageecs.Preflight{
+		Subdomains: []string{"test-*"},
+		Headers: map[string]string{
+			"Access-Control-Allow-Origin":  "https://www.example.com",
+			"Access-Control-Allow-Methods": "GET, POST",
+		},
+	}
+	if h := p.HeadersFor("other"); h != nil {
+		t.Errorf("headers should be nil for unmatched subdomain %v", h)
+	}
+	tr := &mirageecs.Transport{
+		Counter:          mirageecs.NewAccessCounter(time.Second),
+		Transport:        mirageecs.NewHTTPTransport(time.Second),
+		Subdomain:        "test-subdomain",
+		PreflightHeaders: p.HeadersFor("test-subdomain"),
+	}
+
+	req, _ := http.NewRequest(http.MethodOptions, server.URL, nil)
+	req.Header.Set("Origin", "https://www.example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("wanted status %v, got %v", http.StatusNoContent, resp.StatusCode)
+	}
+	if v := resp.Header.Get("Access-Control-Allow-Origin"); v != "https://www.example.com" {
+		t.Errorf("unexpected Access-Control-Allow-Origin: %s", v)
+	}
+	if upstreamCalled {
+		t.Error("preflight request should not be proxied")
+	}
+
+	// OPTIONS without Access-Control-Request-Method is not a preflight
+	req, _ = http.NewRequest(http.MethodOptions, server.URL, nil)
+	resp, err = tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed || !upstreamCalled {
+		t.Errorf("request should be proxied, got %v", resp.StatusCode)
+	}
+}
+
+func TestRoundTripStripRequest(t *testing.T) {
+	var received *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	tr := &mirageecs.Transport{
+		Counter:   mirageecs.NewAccessCounter(time.Second),
+		Transport: mirageecs.NewHTTPTransport(time.Second),
+		Subdomain: "test-subdomain",
+		StripRequest: &mirageecs.StripRequest{
+			Headers: []string{"X-Internal-Token"},
+			Cookies: []string{mirageecs.AuthCookieName},
+		},
+	}
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("X-Internal-Token", "secret")
+	req.Header.Set("X-Other", "ok")
+	req.AddCookie(&http.Cookie{Name: mirageecs.AuthCookieName, Value: "jwt"})
+	req.AddCookie(&http.Cookie{Name: "session", Value: "app"})
+	resp, err := tr.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	resp.Body.Close()
+
+	if v := received.Header.Get("X-Internal-Token"); v != "" {
+		t.Errorf("X-Internal-Token should be stripped: %s", v)
+	}
+	if v := received.Header.Get("X-Other"); v != "ok" {
+		t.Errorf("X-Other should be forwarded: %s", v)
+	}
+	if _, err := received.Cookie(mirageecs.AuthCookieName); err == nil {
+		t.Error("auth cookie should be stripped")
+	}
+	if c, err := received.Cookie("session"); err != nil || c.Value != "app" {
+		t.Errorf("session cookie should be forwarded: %v", err)
+	}
+	// the original request is not modified
+	if _, err := req.Cookie(mirageecs.AuthCookieName); err != nil {
+		t.Error("original request should not be modified")
+	}
+}
+
+func TestDialLimiter(t *testing.T) {
+	tests := []struct {
+		name         string
+		queueTimeout time.Duration
+		wantErr      bool
+	}{
+		{name: "fast fail", queueTimeout: 0, wantErr: true},
+		{name: "queue timeout", queueTimeout: 10 * time.Millisecond, wantErr: true},
+		{name: "queued until released", queueTimeout: time.Second, wantErr: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ready := make(chan struct{})
+			release := make(chan struct{})
+			tp := &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					if addr == "slow:80" {
+						ready <- struct{}{}
+						<-release
+					}
+					c, _ := net.Pipe()
+					return c, nil
+				},
+			}
+			limiter := mirageecs.NewDialLimiter(&mirageecs.DialLimit{MaxConcurrent: 1, QueueTimeout: tt.queueTimeout})
+			rt := mirageecs.WithDialLimiter(tp, limiter).(*http.Transport)
+			ctx := context.Background()
+
+			// the first dial is in flight
+			done := make(chan error)
+			go func() {
+				_, err := rt.DialContext(ctx, "tcp", "slow:80")
+				done <- err
+			}()
+			<-ready
+
+			if tt.queueTimeout >= time.Second {
+				time.AfterFunc(50*time.Millisecond, func() { close(release) })
+			}
+			_, err := rt.DialContext(ctx, "tcp", "fast:80")
+			if tt.wantErr {
+				if !errors.Is(err, mirageecs.ErrDialLimitExceeded) {
+					t.Errorf("expected ErrDialLimitExceeded, got %v", err)
+				}
+				// the proxy answers 503 for requests over the limit
+				tr := &mirageecs.Transport{
+					Counter:   mirageecs.NewAccessCounter(time.Second),
+					Transport: rt,
+					Subdomain: "test-subdomain",
+				}
+				req := httptest.NewRequest(http.MethodGet, "http://fast/", nil)
+				resp, err := tr.RoundTrip(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if resp.StatusCode != http.StatusServiceUnavailable {
+					t.Errorf("unexpected status %d", resp.StatusCode)
+				}
+				close(release)
+			} else if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+			if err := <-done; err != nil {
+				t.Errorf("unexpected error of the first dial: %v", err)
+			}
+		})
+	}
+}
+
+func TestRoundTripStatusCounts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			io.WriteString(w, "OK")
+		case "/redirect":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		case "/error":
+			http.Error(w, "error", http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	counter := mirageecs.NewAccessCounter(time.Second)
+	tr := &mirageecs.Transport{
+		Counter:   counter,
+		Transport: mirageecs.NewHTTPTransport(time.Second),
+		Subdomain: "test-subdomain",
+	}
+	for _, path := range []string{"/ok", "/ok", "/ok", "/redirect", "/missing", "/missing", "/error"} {
+		req, _ := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		resp, err := tr.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	// connection refused
+	req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:1/", nil)
+	if _, err := tr.RoundTrip(req); err == nil {
+		t.Fatal("roundtrip to the closed port should fail")
+	}
+
+	expected := map[string]int64{"2xx": 3, "3xx": 1, "4xx": 2, "5xx": 2}
+	if diff := cmp.Diff(expected, counter.StatusTotals()); diff != "" {
+		t.Errorf("unexpected status totals %s", diff)
+	}
+	var collected int64
+	for _, classes := range counter.CollectStatuses() {
+		for _, n := range classes {
+			collected += n
+		}
+	}
+	if collected != 8 {
+		t.Errorf("unexpected collected count %d", collected)
+	}
+	if c := counter.CollectStatuses(); len(c) != 0 {
+		t.Errorf("statuses should be reset %#v", c)
+	}
+	if diff := cmp.Diff(expected, counter.StatusTotals()); diff != "" {
+		t.Errorf("status totals should not be reset %s", diff)
+	}
+}
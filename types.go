@@ -3,8 +3,11 @@ package mirageecs
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,13 +19,91 @@ type APIListResponse struct {
 
 type APITaskInfo = Information
 
+// SubdomainSummary aggregates tasks of a subdomain.
+type SubdomainSummary struct {
+	SubDomain    string            `json:"subdomain"`
+	GitBranch    string            `json:"branch"`
+	RunningCount int               `json:"running_count"`
+	LastStatus   string            `json:"last_status"`
+	Healthy      *bool             `json:"healthy"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Tasks        []*Information    `json:"tasks"`
+}
+
+// HealthStatus returns "healthy", "unhealthy" or "" (not checked yet).
+func (s *SubdomainSummary) HealthStatus() string {
+	switch {
+	case s.Healthy == nil:
+		return ""
+	case *s.Healthy:
+		return "healthy"
+	default:
+		return "unhealthy"
+	}
+}
+
+// aggregateBySubdomain aggregates running and stopped tasks by subdomain.
+// Subdomains which have running tasks come first in order of the running tasks.
+func aggregateBySubdomain(running, stopped []*Information) []*SubdomainSummary {
+	summaries := []*SubdomainSummary{}
+	bySubdomain := make(map[string]*SubdomainSummary)
+	get := func(info *Information) *SubdomainSummary {
+		if s, ok := bySubdomain[info.SubDomain]; ok {
+			return s
+		}
+		s := &SubdomainSummary{
+			SubDomain:  info.SubDomain,
+			GitBranch:  info.GitBranch,
+			LastStatus: info.LastStatus,
+			Labels:     info.Labels,
+		}
+		bySubdomain[info.SubDomain] = s
+		summaries = append(summaries, s)
+		return s
+	}
+	for _, info := range running {
+		s := get(info)
+		s.RunningCount++
+		s.Tasks = append(s.Tasks, info)
+		if info.Healthy != nil {
+			s.Healthy = info.Healthy
+		}
+		if info.LastStatus == statusRunning {
+			s.LastStatus = statusRunning
+		}
+	}
+	for _, info := range stopped {
+		s := get(info)
+		s.Tasks = append(s.Tasks, info)
+	}
+	return summaries
+}
+
 // APILaunchResponse is a response of /api/launch, and /api/terminate
 type APICommonResponse struct {
 	Result string `json:"result"`
+	// Error is the detail of the invalid subdomain.
+	Error *SubdomainError `json:"error,omitempty"`
+}
+
+type APILaunchResponse struct {
+	Result string        `json:"result"`
+	JobID  string        `json:"job_id,omitempty"`
+	DryRun bool          `json:"dry_run,omitempty"`
+	Plans  []*LaunchPlan `json:"plans,omitempty"`
+}
+
+// LogEvent is an event of the logs of a container.
+type LogEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Container string    `json:"container,omitempty"`
+	Message   string    `json:"message"`
 }
 
 type APILogsResponse struct {
-	Result []string `json:"result"`
+	// Result are the messages of the events as plain text for compatibility.
+	Result []string   `json:"result"`
+	Events []LogEvent `json:"events"`
 }
 
 // APIAccessResponse is a response of /api/access
@@ -32,11 +113,110 @@ type APIAccessResponse struct {
 	Sum      int64  `json:"sum"`
 }
 
+// APIStatsResponse is a response of /api/stats
+type APIStatsResponse struct {
+	Result       string           `json:"result"`
+	Subdomain    string           `json:"subdomain"`
+	Requests     int64            `json:"requests"`
+	StatusCounts map[string]int64 `json:"status_counts"`
+}
+
+// APIRefreshResponse is a response of /api/refresh
+type APIRefreshResponse struct {
+	Result  string   `json:"result"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// PrometheusSDTargetGroup is a target group of Prometheus HTTP service discovery.
+// /api/prometheus_sd returns a list of them.
+type PrometheusSDTargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// prometheusSDTargetGroups builds target groups for each port of running tasks.
+func prometheusSDTargetGroups(infos []*Information) []*PrometheusSDTargetGroup {
+	groups := []*PrometheusSDTargetGroup{}
+	for _, info := range infos {
+		if info.IPAddress == "" {
+			continue
+		}
+		mappings := info.PortMappings
+		if len(mappings) == 0 {
+			mappings = make(map[string][]PortMapping, len(info.PortMap))
+			for name, port := range info.PortMap {
+				mappings[name] = []PortMapping{{HostPort: port}}
+			}
+		}
+		containers := make([]string, 0, len(mappings))
+		for name := range mappings {
+			containers = append(containers, name)
+		}
+		sort.Strings(containers)
+		for _, name := range containers {
+			for _, m := range mappings[name] {
+				labels := map[string]string{
+					"subdomain": info.SubDomain,
+					"branch":    info.GitBranch,
+					"taskdef":   info.TaskDef,
+					"container": name,
+				}
+				if m.Name != "" {
+					labels["port_name"] = m.Name
+				}
+				groups = append(groups, &PrometheusSDTargetGroup{
+					Targets: []string{net.JoinHostPort(info.IPAddress, strconv.Itoa(m.HostPort))},
+					Labels:  labels,
+				})
+			}
+		}
+	}
+	return groups
+}
+
+// APIMetricsResponse is a response of /api/metrics
+type APIMetricsResponse struct {
+	AWSAPICalls []AWSAPICallCount `json:"aws_api_calls"`
+}
+
+// APIReservationsResponse is a response of /api/reservations
+type APIReservationsResponse struct {
+	Result []*ReservationRecord `json:"result"`
+}
+
+type APIReserveRequest struct {
+	Subdomain string `json:"subdomain" form:"subdomain"`
+}
+
+type APIReleaseRequest struct {
+	Subdomain string `json:"subdomain" form:"subdomain"`
+}
+
+// APIHistoryResponse is a response of /api/history
+type APIHistoryResponse struct {
+	Result []*HistoryRecord `json:"result"`
+}
+
 type APILaunchRequest struct {
-	Subdomain  string            `json:"subdomain" form:"subdomain"`
-	Branch     string            `json:"branch" form:"branch"`
-	Taskdef    []string          `json:"taskdef" form:"taskdef"`
-	Parameters map[string]string `json:"parameters" form:"parameters"`
+	Subdomain   string            `json:"subdomain" form:"subdomain"`
+	Branch      string            `json:"branch" form:"branch"`
+	Taskdef     []string          `json:"taskdef" form:"taskdef"`
+	Parameters  map[string]string `json:"parameters" form:"parameters"`
+	MaxLifetime string            `json:"max_lifetime" form:"max_lifetime"`
+	Cpu         string            `json:"cpu" form:"cpu"`
+	Memory      string            `json:"memory" form:"memory"`
+	Preset      string            `json:"preset" form:"preset"`
+	Tags        map[string]string `json:"tags" form:"tags"`
+
+	// Command overrides the command of the container in the task definition. The first container by default.
+	Command          []string `json:"command" form:"command"`
+	CommandContainer string   `json:"command_container" form:"command_container"`
+
+	RetryAttempts int    `json:"retry_attempts" form:"retry_attempts"`
+	RetryTimeout  string `json:"retry_timeout" form:"retry_timeout"`
+	Async         bool   `json:"async" form:"async"`
+	DryRun        bool   `json:"dry_run" form:"dry_run"`
 }
 
 func (r *APILaunchRequest) GetParameter(key string) string {
@@ -51,7 +231,10 @@ func (r *APILaunchRequest) MergeForm(form url.Values) {
 		r.Parameters = make(map[string]string, len(form))
 	}
 	for key, values := range form {
-		if key == "branch" || key == "subdomain" || key == "taskdef" {
+		if key == "branch" || key == "subdomain" || key == "taskdef" || key == "max_lifetime" ||
+			key == "cpu" || key == "memory" || key == "preset" ||
+			key == "retry_attempts" || key == "retry_timeout" || key == "async" || key == "dry_run" || key == "tags" ||
+			key == "command" || key == "command_container" {
 			continue
 		}
 		r.Parameters[key] = values[0]
@@ -62,17 +245,72 @@ type APIPurgeRequest struct {
 	Duration      json.Number `json:"duration" form:"duration" yaml:"duration"`
 	Excludes      []string    `json:"excludes" form:"excludes" yaml:"excludes"`
 	ExcludeTags   []string    `json:"exclude_tags" form:"exclude_tags" yaml:"exclude_tags"`
+	ExcludeEnv    []string    `json:"exclude_env" form:"exclude_env" yaml:"exclude_env"`
 	ExcludeRegexp string      `json:"exclude_regexp" form:"exclude_regexp" yaml:"exclude_regexp"`
+	MinAge        json.Number `json:"min_age" form:"min_age" yaml:"min_age"`
+
+	KeepLatestPerBranch int `json:"keep_latest_per_branch" form:"keep_latest_per_branch" yaml:"keep_latest_per_branch"`
+
+	// DryRun returns the subdomains to be purged without terminating them. It is not available for the scheduled purge.
+	DryRun bool `json:"dry_run" form:"dry_run" yaml:"-"`
+	// Sync waits for the completion of the purge and returns the result. It is not available for the scheduled purge.
+	Sync bool `json:"sync" form:"sync" yaml:"-"`
+}
+
+// APIPurgeResponse is a response of /api/purge with dry_run or sync
+type APIPurgeResponse struct {
+	Result     string   `json:"result"`
+	DryRun     bool     `json:"dry_run,omitempty"`
+	Subdomains []string `json:"subdomains"`
+	*PurgeResult
+}
+
+// PurgeResult is the result of the purge.
+type PurgeResult struct {
+	Purged []string `json:"purged"`
+	// Skipped are the subdomains accessed in the duration.
+	Skipped []string `json:"skipped"`
+	// Errors are the errors of each subdomain.
+	Errors map[string]string `json:"errors"`
+}
+
+func newPurgeResult() *PurgeResult {
+	return &PurgeResult{
+		Purged:  []string{},
+		Skipped: []string{},
+		Errors:  make(map[string]string),
+	}
+}
+
+// APIPurgeEvaluateRequest is a request of /api/purge/evaluate
+type APIPurgeEvaluateRequest struct {
+	Subdomain string `json:"subdomain" form:"subdomain"`
+	APIPurgeRequest
+}
+
+// APIPurgeEvaluateResponse is a response of /api/purge/evaluate
+type APIPurgeEvaluateResponse struct {
+	Subdomain   string             `json:"subdomain"`
+	Purge       bool               `json:"purge"`
+	Reason      string             `json:"reason"`
+	AccessCount *int64             `json:"access_count,omitempty"`
+	Tasks       []*PurgeEvaluation `json:"tasks"`
 }
 
 type PurgeParams struct {
 	Duration      time.Duration
 	Excludes      []string
 	ExcludeTags   []string
+	ExcludeEnv    []string
 	ExcludeRegexp *regexp.Regexp
+	// MinAge is the grace period after the task is created. The tasks younger than it are not purged regardless of Duration.
+	MinAge time.Duration
+
+	KeepLatestPerBranch int
 
 	excludesMap    map[string]struct{}
 	excludeTagsMap map[string]string
+	excludeEnvMap  map[string]string
 }
 
 func (r *APIPurgeRequest) Validate() (*PurgeParams, error) {
@@ -100,6 +338,15 @@ func (r *APIPurgeRequest) Validate() (*PurgeParams, error) {
 		k, v := p[0], p[1]
 		excludeTagsMap[k] = v
 	}
+	excludeEnvMap := make(map[string]string, len(r.ExcludeEnv))
+	for _, excludeEnv := range r.ExcludeEnv {
+		p := strings.SplitN(excludeEnv, ":", 2)
+		if len(p) != 2 {
+			return nil, fmt.Errorf("invalid exclude_env format %s", excludeEnv)
+		}
+		k, v := p[0], p[1]
+		excludeEnvMap[k] = v
+	}
 	var excludeRegexp *regexp.Regexp
 	if r.ExcludeRegexp != "" {
 		var err error
@@ -108,16 +355,31 @@ func (r *APIPurgeRequest) Validate() (*PurgeParams, error) {
 			return nil, fmt.Errorf("invalid exclude_regexp %s", r.ExcludeRegexp)
 		}
 	}
+	var minAge int64
+	if r.MinAge != "" {
+		minAge, err = r.MinAge.Int64()
+		if err != nil || minAge < 0 {
+			return nil, fmt.Errorf("invalid min_age %s", r.MinAge)
+		}
+	}
+	if r.KeepLatestPerBranch < 0 {
+		return nil, fmt.Errorf("invalid keep_latest_per_branch %d", r.KeepLatestPerBranch)
+	}
 	duration := time.Duration(di) * time.Second
 
 	return &PurgeParams{
 		Duration:      duration,
 		Excludes:      excludes,
 		ExcludeTags:   excludeTags,
+		ExcludeEnv:    r.ExcludeEnv,
 		ExcludeRegexp: excludeRegexp,
+		MinAge:        time.Duration(minAge) * time.Second,
+
+		KeepLatestPerBranch: r.KeepLatestPerBranch,
 
 		excludesMap:    excludesMap,
 		excludeTagsMap: excludeTagsMap,
+		excludeEnvMap:  excludeEnvMap,
 	}, nil
 }
 
@@ -125,3 +387,7 @@ type APITerminateRequest struct {
 	ID        string `json:"id" form:"id"`
 	Subdomain string `json:"subdomain" form:"subdomain"`
 }
+
+type APIRestartRequest struct {
+	Subdomain string `json:"subdomain" form:"subdomain"`
+}
@@ -0,0 +1,56 @@
+package mirageecs
+
+import (
+	"fmt"
+	"html/template"
+)
+
+// UI configures the web UI.
+type UI struct {
+	Banner *Banner `yaml:"banner"`
+}
+
+// Banner is a notice rendered at the top of every page.
+type Banner struct {
+	Text        string `yaml:"text"`
+	HTML        string `yaml:"html"`
+	Severity    string `yaml:"severity"`
+	Dismissible bool   `yaml:"dismissible"`
+}
+
+const DefaultBannerSeverity = "info"
+
+var bannerSeverities = map[string]bool{
+	"primary":   true,
+	"secondary": true,
+	"success":   true,
+	"danger":    true,
+	"warning":   true,
+	"info":      true,
+	"light":     true,
+	"dark":      true,
+}
+
+func (b *Banner) Validate() error {
+	if b.Text == "" && b.HTML == "" {
+		return fmt.Errorf("text or html is required")
+	}
+	if b.Text != "" && b.HTML != "" {
+		return fmt.Errorf("text and html are exclusive")
+	}
+	if b.Severity == "" {
+		b.Severity = DefaultBannerSeverity
+	}
+	if !bannerSeverities[b.Severity] {
+		return fmt.Errorf("invalid severity %s", b.Severity)
+	}
+	return nil
+}
+
+// Content returns the content of the banner. The html is rendered without escaping.
+func (b *Banner) Content() template.HTML {
+	if b.HTML != "" {
+		return template.HTML(b.HTML)
+	}
+	return template.HTML(template.HTMLEscapeString(b.Text))
+}
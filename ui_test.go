@@ -0,0 +1,279 @@
+package mirageecs_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+)
+
+func TestBanner(t *testing.T) {
+	tests := []struct {
+		name     string
+		banner   *mirageecs.Banner
+		contains []string
+		excludes []string
+	}{
+		{
+			name:     "no banner",
+			excludes: []string{`role="alert"`},
+		},
+		{
+			name:     "text",
+			banner:   &mirageecs.Banner{Text: "previews <b>auto-purge</b> after 1h"},
+			contains: []string{"alert-info", "previews &lt;b&gt;auto-purge&lt;/b&gt; after 1h"},
+			excludes: []string{"btn-close"},
+		},
+		{
+			name:     "html dismissible",
+			banner:   &mirageecs.Banner{HTML: "<b>maintenance</b>", Severity: "warning", Dismissible: true},
+			contains: []string{"alert-warning", "alert-dismissible", "<b>maintenance</b>", "btn-close"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+				LocalMode: true,
+				Domain:    "localtest.me",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.banner != nil {
+				if err := tt.banner.Validate(); err != nil {
+					t.Fatal(err)
+				}
+				cfg.UI.Banner = tt.banner
+			}
+			app := mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{})
+			ts := httptest.NewServer(app)
+			defer ts.Close()
+			res, err := http.Get(ts.URL + "/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			b, _ := io.ReadAll(res.Body)
+			body := string(b)
+			for _, s := range tt.contains {
+				if !strings.Contains(body, s) {
+					t.Errorf("body should contain %q", s)
+				}
+			}
+			for _, s := range tt.excludes {
+				if strings.Contains(body, s) {
+					t.Errorf("body should not contain %q", s)
+				}
+			}
+		})
+	}
+
+	if err := (&mirageecs.Banner{Text: "foo", Severity: "pink"}).Validate(); err == nil {
+		t.Error("invalid severity must be an error")
+	}
+}
+
+func TestLauncherParameterGroups(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Parameter = append(cfg.Parameter,
+		&mirageecs.Parameter{Name: "db_host", Group: "database", HelpURL: "https://wiki.example.com/db"},
+		&mirageecs.Parameter{Name: "db_name", Group: "database"},
+	)
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/launcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	body := string(b)
+	for _, s := range []string{
+		`<legend class="fs-6 fw-bold">database</legend>`,
+		`<a href="https://wiki.example.com/db" target="_blank"`,
+		`name="branch"`,
+		`name="db_name"`,
+	} {
+		if !strings.Contains(body, s) {
+			t.Errorf("body should contain %q", s)
+		}
+	}
+	if n := strings.Count(body, "<fieldset"); n != 1 {
+		t.Errorf("unexpected number of fieldsets %d", n)
+	}
+}
+
+func TestListStoppedTask(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &mirageecs.LocalTaskRunner{
+		Informations: []*mirageecs.Information{
+			{
+				ShortID:       "0123",
+				SubDomain:     "foo",
+				LastStatus:    "STOPPED",
+				StoppedReason: "Essential container in task exited",
+				ExitCodes:     map[string]int32{"app": 137},
+			},
+		},
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, _ := io.ReadAll(res.Body)
+	for _, s := range []string{"Essential container in task exited", "app: 137", "bg-warning"} {
+		if !strings.Contains(string(b), s) {
+			t.Errorf("body should contain %q", s)
+		}
+	}
+
+	res, err = http.Get(ts.URL + "/api/list?status=stopped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var r mirageecs.APIListResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Result) != 1 || r.Result[0].StoppedReason != "Essential container in task exited" || r.Result[0].ExitCodes["app"] != 137 {
+		t.Errorf("unexpected stopped tasks %#v", r.Result)
+	}
+}
+
+func TestDefaultTemplates(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		contains string
+	}{
+		{
+			name:     "nonexistent htmldir",
+			contains: "Mirage-ECS Dashboard",
+		},
+		{
+			name:     "override layout.html",
+			files:    map[string]string{"layout.html": `custom top {{ .Version }}`},
+			contains: "custom top",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+				LocalMode: true,
+				Domain:    "localtest.me",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.HtmlDir = filepath.Join(t.TempDir(), "html")
+			if len(tt.files) > 0 {
+				if err := os.Mkdir(cfg.HtmlDir, 0755); err != nil {
+					t.Fatal(err)
+				}
+				for name, content := range tt.files {
+					if err := os.WriteFile(filepath.Join(cfg.HtmlDir, name), []byte(content), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+			defer ts.Close()
+			for _, path := range []string{"/", "/launcher"} {
+				res, err := http.Get(ts.URL + path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(res.Body)
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("%s: unexpected status %d", path, res.StatusCode)
+				}
+				if path == "/" && !strings.Contains(string(b), tt.contains) {
+					t.Errorf("%s: body should contain %q", path, tt.contains)
+				}
+			}
+		})
+	}
+}
+
+func TestReloadTemplates(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.HtmlDir = t.TempDir()
+	layout := filepath.Join(cfg.HtmlDir, "layout.html")
+	if err := os.WriteFile(layout, []byte("version 1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	top := func() string {
+		res, err := http.Get(ts.URL + "/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, _ := io.ReadAll(res.Body)
+		return string(b)
+	}
+	reload := func() int {
+		res, err := http.Post(ts.URL+"/admin/reload-templates", "application/json", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if body := top(); body != "version 1" {
+		t.Errorf("unexpected body %q", body)
+	}
+	if err := os.WriteFile(layout, []byte("version 2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload(); code != http.StatusOK {
+		t.Errorf("unexpected status %d", code)
+	}
+	if body := top(); body != "version 2" {
+		t.Errorf("unexpected body %q after reload", body)
+	}
+
+	// the broken template is not applied
+	if err := os.WriteFile(layout, []byte("version {{ .Broken "), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if code := reload(); code != http.StatusInternalServerError {
+		t.Errorf("unexpected status %d", code)
+	}
+	if body := top(); body != "version 2" {
+		t.Errorf("unexpected body %q after failed reload", body)
+	}
+}
@@ -2,6 +2,8 @@ package mirageecs
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -9,6 +11,7 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -16,11 +19,17 @@ import (
 	"time"
 	"unicode/utf8"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/samber/lo"
+	"golang.org/x/sync/errgroup"
 )
 
+// SubdomainErrorHeader is the response header of the launcher which has SubdomainError as JSON.
+const SubdomainErrorHeader = "X-Mirage-Subdomain-Error"
+
 var DNSNameRegexpWithPattern = regexp.MustCompile(`^[a-zA-Z*?\[\]][a-zA-Z0-9-*?\[\]]{0,61}[a-zA-Z0-9*?\[\]]$`)
 
 const PurgeMinimumDuration = 5 * time.Minute
@@ -33,30 +42,81 @@ type WebApi struct {
 	cfg    *Config
 	runner TaskRunner
 	mu     *sync.Mutex
+
+	history      HistoryStore
+	reservations ReservationStore
+	syncRouting  func(context.Context) (*RoutingChanges, error)
+	healthOf     func(subdomain string) *bool
+	// forgetSleeping forgets the subdomain scaled to zero not to be woken up.
+	forgetSleeping func(subdomain string)
+	// statusTotalsOf returns the response counts by status class of the subdomain proxied.
+	statusTotalsOf func(subdomain string) (map[string]int64, bool)
+	// markLaunching shows the launching page for the subdomain until it is routed.
+	markLaunching func(subdomain string)
+
+	launchLocks      *subdomainLocks
+	launchProgresses *launchProgresses
+	launchJobs       *launchJobs
+	taskEvents       taskEventCounts
+	traces           *traceCache
+	renderer         *Template
 }
 
 type Template struct {
+	mu        sync.RWMutex
 	templates *template.Template
+	banner    *Banner
+	htmlDir   string
 }
 
 func (t *Template) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	t.mu.RLock()
+	templates := t.templates
+	t.mu.RUnlock()
 	if m, ok := data.(map[string]interface{}); ok {
 		m["Version"] = Version
-		return t.templates.ExecuteTemplate(w, name, m)
+		m["Banner"] = t.banner
+		return templates.ExecuteTemplate(w, name, m)
 	} else {
-		return t.templates.ExecuteTemplate(w, name, data)
+		return templates.ExecuteTemplate(w, name, data)
 	}
 }
 
+// Reload parses the templates in htmlDir again.
+// When parsing fails, the current templates are kept.
+func (t *Template) Reload() error {
+	templates, err := loadTemplates(t.htmlDir)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.templates = templates
+	return nil
+}
+
 func NewWebApi(cfg *Config, runner TaskRunner) *WebApi {
 	app := &WebApi{
-		mu:     &sync.Mutex{},
-		runner: runner,
+		mu:           &sync.Mutex{},
+		runner:       runner,
+		history:      cfg.NewHistoryStore(),
+		reservations: cfg.NewReservationStore(),
+
+		launchLocks:      newSubdomainLocks(),
+		launchProgresses: newLaunchProgresses(),
+		launchJobs:       newLaunchJobs(LaunchJobTTL),
+		traces:           newTraceCache(cfg.ECS.TraceCacheTTL),
 	}
 	app.cfg = cfg
 
 	e := echo.New()
+	e.IPExtractor = cfg.Network.ipExtractor()
 	e.Use(middleware.Logger())
+	e.Use(cfg.ValidateOriginMiddleware)
+	if limit := cfg.Network.WebApiBodyLimit; limit != "" {
+		// responds 413 Request Entity Too Large before binding the body
+		e.Use(middleware.BodyLimit(limit))
+	}
 
 	web := e.Group("")
 	web.Use(cfg.AuthMiddlewareForWeb)
@@ -68,18 +128,49 @@ func NewWebApi(cfg *Config, runner TaskRunner) *WebApi {
 	web.POST("/terminate", app.Terminate)
 
 	api := e.Group("/api")
+	if cfg.CORS != nil {
+		// before the auth, preflight requests don't have the token
+		api.Use(cfg.CORS.middleware(cfg.Host.WebApi))
+	}
 	api.Use(cfg.CompatMiddlewareForAPI)
 	api.Use(cfg.AuthMiddlewareForAPI)
 	api.GET("/list", app.ApiList)
+	api.GET("/status", app.ApiStatus)
 	api.GET("/access", app.ApiAccess)
 	api.GET("/logs", app.ApiLogs)
+	api.GET("/logs/stream", app.ApiLogsStream)
+	api.GET("/trace/:taskid", app.ApiTrace)
 	api.POST("/launch", app.ApiLaunch)
+	api.GET("/launch/progress", app.ApiLaunchProgress)
+	api.GET("/launch/status", app.ApiLaunchStatus)
+	api.GET("/stats", app.ApiStats)
 	api.POST("/terminate", app.ApiTerminate)
+	api.POST("/restart", app.ApiRestart)
 	api.POST("/purge", app.ApiPurge)
+	api.POST("/purge/evaluate", app.ApiPurgeEvaluate)
+	api.POST("/refresh", app.ApiRefresh)
+	api.GET("/history", app.ApiHistory)
+	api.GET("/prometheus_sd", app.ApiPrometheusSD)
+	api.GET("/metrics", app.ApiMetrics)
+	api.GET("/reservations", app.ApiReservations)
+	api.POST("/reserve", app.ApiReserve)
+	api.POST("/release", app.ApiRelease)
 
-	e.Renderer = &Template{
-		templates: template.Must(template.ParseGlob(cfg.HtmlDir + "/*")),
+	admin := e.Group("/admin")
+	admin.Use(cfg.AuthMiddlewareForAPI)
+	admin.POST("/reload-templates", app.AdminReloadTemplates)
+
+	templates, err := loadTemplates(cfg.HtmlDir)
+	if err != nil {
+		slog.Error(f("failed to load templates, using the default templates: %s", err))
+		templates = mustLoadDefaultTemplates()
+	}
+	app.renderer = &Template{
+		templates: templates,
+		banner:    cfg.UI.Banner,
+		htmlDir:   cfg.HtmlDir,
 	}
+	e.Renderer = app.renderer
 	app.Echo = e
 
 	return app
@@ -95,10 +186,22 @@ func (api *WebApi) List(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
+	api.fillHealth(infoRunning)
+	api.fillLabels(infoRunning)
+	api.fillExpiry(infoRunning)
 	infoStopped, err := api.runner.List(ctx, statusStopped)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
+	api.fillLabels(infoStopped)
+	// all stopped tasks for drill-down, newest first
+	allStopped := make([]*Information, len(infoStopped))
+	copy(allStopped, infoStopped)
+	sort.SliceStable(allStopped, func(i, j int) bool {
+		return allStopped[i].Created.After(allStopped[j].Created)
+	})
+	subdomains := aggregateBySubdomain(infoRunning, allStopped)
+
 	sort.Slice(infoStopped, func(i, j int) bool {
 		return infoStopped[i].Created.Before(infoStopped[j].Created)
 	})
@@ -114,28 +217,37 @@ func (api *WebApi) List(c echo.Context) error {
 	})
 	info := append(infoRunning, infoStopped...)
 	value := map[string]interface{}{
-		"info":  info,
-		"error": err,
+		"info":        info,
+		"subdomains":  subdomains,
+		"tag_columns": api.cfg.TagColumns,
+		"colspan":     6 + len(api.cfg.TagColumns),
+		"error":       err,
 	}
 	return c.Render(http.StatusOK, "list.html", value)
 }
 
 func (api *WebApi) Launcher(c echo.Context) error {
-	var taskdefs []string
-	if api.cfg.Link.DefaultTaskDefinitions != nil {
-		taskdefs = api.cfg.Link.DefaultTaskDefinitions
-	} else {
-		taskdefs = []string{api.cfg.ECS.DefaultTaskDefinition}
+	taskdefs := api.cfg.DefaultTaskDefinitions(api.defaultParameterValue)
+	if len(taskdefs) == 0 {
+		taskdefs = []string{""} // shows an empty input
 	}
 	return c.Render(http.StatusOK, "launcher.html", map[string]interface{}{
 		"DefaultTaskDefinitions": taskdefs,
 		"Parameters":             api.cfg.Parameter,
+		"ParameterGroups":        api.cfg.Parameter.Groups(),
 	})
 }
 
 func (api *WebApi) Launch(c echo.Context) error {
-	code, err := api.launch(c)
+	code, _, err := api.launch(c)
 	if err != nil {
+		var se *SubdomainError
+		if errors.As(err, &se) {
+			// the launcher highlights the field by the detail
+			if b, err := json.Marshal(se); err == nil {
+				c.Response().Header().Set(SubdomainErrorHeader, string(b))
+			}
+		}
 		return c.String(code, err.Error())
 	}
 	if c.Request().Header.Get("Hx-Request") == "true" {
@@ -157,62 +269,487 @@ func (api *WebApi) Trace(c echo.Context) error {
 	if taskID == "" {
 		return c.String(http.StatusBadRequest, "taskid required")
 	}
-	trace, err := api.runner.Trace(c.Request().Context(), taskID)
+	format, err := traceFormat(c, "text")
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	duration, err := api.traceDuration(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	trace, err := api.trace(c.Request().Context(), taskID, duration)
 	if err != nil {
 		return c.String(http.StatusInternalServerError, err.Error())
 	}
-	return c.String(http.StatusOK, trace)
+	if format == "json" {
+		return c.JSON(http.StatusOK, trace)
+	}
+	return c.String(http.StatusOK, trace.String())
+}
+
+func (api *WebApi) ApiTrace(c echo.Context) error {
+	taskID := c.Param("taskid")
+	if taskID == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "taskid required"})
+	}
+	format, err := traceFormat(c, "json")
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	duration, err := api.traceDuration(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	trace, err := api.trace(c.Request().Context(), taskID, duration)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	if format == "text" {
+		return c.String(http.StatusOK, trace.String())
+	}
+	return c.JSON(http.StatusOK, trace)
+}
+
+func (api *WebApi) trace(ctx context.Context, taskID string, duration time.Duration) (*TraceResult, error) {
+	return api.traces.get(ctx, taskID, duration, api.runner.Trace)
+}
+
+// traceDuration returns the duration of the trace specified by the duration query parameter.
+// The duration is up to ecs.trace_max_duration.
+func (api *WebApi) traceDuration(c echo.Context) (time.Duration, error) {
+	s := c.QueryParam("duration")
+	if s == "" {
+		return api.cfg.ECS.TraceDuration, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %s: must be a positive duration such as 10m", s)
+	}
+	if max := api.cfg.ECS.TraceMaxDuration; max > 0 && d > max {
+		return 0, fmt.Errorf("duration %s exceeds the max %s", d, max)
+	}
+	return d, nil
+}
+
+// traceFormat returns the response format of the trace, "json" or "text".
+// The format query parameter takes precedence over the Accept header.
+func traceFormat(c echo.Context, defaultFormat string) (string, error) {
+	switch format := c.QueryParam("format"); format {
+	case "json", "text":
+		return format, nil
+	case "":
+	default:
+		return "", fmt.Errorf("invalid format %s: must be json or text", format)
+	}
+	accept := c.Request().Header.Get(echo.HeaderAccept)
+	switch {
+	case strings.HasPrefix(accept, echo.MIMEApplicationJSON):
+		return "json", nil
+	case strings.HasPrefix(accept, echo.MIMETextPlain):
+		return "text", nil
+	}
+	return defaultFormat, nil
 }
 
 func (api *WebApi) ApiList(c echo.Context) error {
+	switch c.QueryParam("status") {
+	case "", "running":
+	case "stopped":
+		// stopped tasks with the stopped reason and the exit codes
+		info, err := api.runner.List(c.Request().Context(), statusStopped)
+		if err != nil {
+			return c.JSON(500, APIListResponse{})
+		}
+		api.fillLabels(info)
+		return c.JSON(200, APIListResponse{Result: info})
+	default:
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "status must be running or stopped"})
+	}
 	info, err := api.runner.List(c.Request().Context(), statusRunning)
 	if err != nil {
 		return c.JSON(500, APIListResponse{})
 	}
+	api.fillHealth(info)
+	api.fillLabels(info)
+	api.fillExpiry(info)
 	return c.JSON(200, APIListResponse{Result: info})
 }
 
+func (api *WebApi) ApiStatus(c echo.Context) error {
+	subdomain := c.QueryParam("subdomain")
+	if subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "subdomain is required"})
+	}
+	info, err := api.runner.Status(c.Request().Context(), subdomain)
+	if err != nil {
+		slog.Error(f("status of %s failed: %s", subdomain, err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	if len(info) == 0 {
+		return c.JSON(http.StatusNotFound, APIListResponse{Result: []*APITaskInfo{}})
+	}
+	api.fillHealth(info)
+	api.fillLabels(info)
+	api.fillExpiry(info)
+	return c.JSON(http.StatusOK, APIListResponse{Result: info})
+}
+
+func (api *WebApi) ApiPrometheusSD(c echo.Context) error {
+	info, err := api.runner.List(c.Request().Context(), statusRunning)
+	if err != nil {
+		slog.Error(f("list ecs failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	return c.JSON(http.StatusOK, prometheusSDTargetGroups(info))
+}
+
+func (api *WebApi) ApiMetrics(c echo.Context) error {
+	res := APIMetricsResponse{AWSAPICalls: []AWSAPICallCount{}}
+	if api.cfg.awsAPICalls != nil {
+		res.AWSAPICalls = api.cfg.awsAPICalls.Counts()
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (api *WebApi) fillHealth(infos []*Information) {
+	if api.healthOf == nil {
+		return
+	}
+	for _, info := range infos {
+		info.Healthy = api.healthOf(info.SubDomain)
+	}
+}
+
+func (api *WebApi) fillExpiry(infos []*Information) {
+	for _, info := range infos {
+		info.ExpiresAt = expiresAt(info, api.cfg.ECS.MaxLifetime)
+	}
+}
+
+func (api *WebApi) fillLabels(infos []*Information) {
+	for _, info := range infos {
+		info.Labels = tagLabels(api.cfg.TagColumns, info.Tags)
+	}
+}
+
 func (api *WebApi) ApiLaunch(c echo.Context) error {
-	code, err := api.launch(c)
+	code, res, err := api.launch(c)
 	if err != nil {
-		return c.JSON(code, APICommonResponse{Result: err.Error()})
+		return c.JSON(code, errorResponse(err))
+	}
+	if res != nil {
+		return c.JSON(code, res)
+	}
+	if code == http.StatusAccepted {
+		return c.JSON(code, APICommonResponse{Result: "accepted"})
 	}
 	return c.JSON(code, APICommonResponse{Result: "ok"})
 }
 
-func (api *WebApi) launch(c echo.Context) (int, error) {
+func (api *WebApi) ApiLaunchProgress(c echo.Context) error {
+	subdomain := strings.ToLower(c.QueryParam("subdomain"))
+	if subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "parameter required: subdomain"})
+	}
+	p, ok := api.launchProgresses.get(subdomain)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APICommonResponse{Result: "launch with retry is not found"})
+	}
+	return c.JSON(http.StatusOK, p)
+}
+
+func (api *WebApi) ApiLaunchStatus(c echo.Context) error {
+	id := c.QueryParam("job_id")
+	if id == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "parameter required: job_id"})
+	}
+	job, ok := api.launchJobs.get(id)
+	if !ok {
+		return c.JSON(http.StatusNotFound, APICommonResponse{Result: "launch job is not found"})
+	}
+	return c.JSON(http.StatusOK, job)
+}
+
+// ErrMaxConcurrentTasks is the error when the running subdomains reach ecs.max_concurrent_tasks.
+var ErrMaxConcurrentTasks = errors.New("too many running subdomains")
+
+// checkMaxConcurrentTasks rejects the launch of a new subdomain when the running subdomains reach ecs.max_concurrent_tasks.
+// The subdomains being launched are counted too. The relaunch of a running subdomain is always allowed.
+func (api *WebApi) checkMaxConcurrentTasks(ctx context.Context, subdomain string) error {
+	max := api.cfg.ECS.MaxConcurrentTasks
+	if max <= 0 {
+		return nil
+	}
+	infos, err := api.runner.List(ctx, statusRunning)
+	if err != nil {
+		return fmt.Errorf("failed to list running tasks: %w", err)
+	}
+	running := make(map[string]bool, len(infos))
+	for _, info := range infos {
+		running[info.SubDomain] = true
+	}
+	if running[subdomain] {
+		// terminate-then-launch doesn't increase the running subdomains
+		return nil
+	}
+	for _, s := range api.launchLocks.list() {
+		if s != subdomain {
+			running[s] = true
+		}
+	}
+	if n := len(running); n >= max {
+		slog.Warn(f("launch %s rejected: %d subdomains are running or launching", subdomain, n))
+		return fmt.Errorf("%w: %d subdomains are running or launching, the limit is %d", ErrMaxConcurrentTasks, n, max)
+	}
+	return nil
+}
+
+func maxConcurrentTasksStatus(err error) int {
+	if errors.Is(err, ErrMaxConcurrentTasks) {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusInternalServerError
+}
+
+// launch launches the subdomain by the request.
+// It returns the response with the job ID for the asynchronous launch, or the plans for the dry-run.
+func (api *WebApi) launch(c echo.Context) (int, *APILaunchResponse, error) {
 	r := APILaunchRequest{}
 	ps, _ := c.FormParams()
 	r.MergeForm(ps)
 	if err := c.Bind(&r); err != nil {
-		return http.StatusBadRequest, err
+		return http.StatusBadRequest, nil, err
+	}
+	for name, v := range map[string]*bool{"async": &r.Async, "dry_run": &r.DryRun} {
+		if q := c.QueryParam(name); q != "" {
+			b, err := strconv.ParseBool(q)
+			if err != nil {
+				return http.StatusBadRequest, nil, fmt.Errorf("invalid %s %s", name, q)
+			}
+			*v = b
+		}
 	}
 
 	subdomain := r.Subdomain
 	subdomain = strings.ToLower(subdomain)
 	if err := validateSubdomain(subdomain); err != nil {
 		slog.Error(f("launch failed: %s", err))
-		return http.StatusBadRequest, err
+		return http.StatusBadRequest, nil, err
+	}
+	if err := api.cfg.Host.checkReserved(subdomain); err != nil {
+		slog.Error(f("launch failed: %s", err))
+		return http.StatusBadRequest, nil, err
+	}
+	retry, err := launchRetryFrom(&r)
+	if err != nil {
+		return http.StatusBadRequest, nil, err
+	}
+	if r.Preset != "" {
+		p, ok := api.cfg.Preset(r.Preset)
+		if !ok {
+			return http.StatusBadRequest, nil, fmt.Errorf("preset %s is not defined", r.Preset)
+		}
+		r.ApplyPreset(p)
 	}
-	taskdefs := r.Taskdef
 	parameter, err := api.LoadParameter(r.GetParameter)
 	if err != nil {
 		slog.Error(f("failed to load parameter: %s", err))
-		return http.StatusBadRequest, err
+		return http.StatusBadRequest, nil, err
+	}
+	if r.MaxLifetime != "" {
+		if d, err := time.ParseDuration(r.MaxLifetime); err != nil || d <= 0 {
+			return http.StatusBadRequest, nil, fmt.Errorf("invalid max_lifetime %s", r.MaxLifetime)
+		}
+		parameter[TagMaxLifetime] = r.MaxLifetime
+	}
+	if r.Cpu != "" || r.Memory != "" {
+		if err := validateTaskSize(r.Cpu, r.Memory); err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		parameter[TagCpu] = r.Cpu
+		parameter[TagMemory] = r.Memory
+	}
+	if len(r.Command) > 0 {
+		if r.Command[0] == "" {
+			return http.StatusBadRequest, nil, fmt.Errorf("the first element of command must not be empty")
+		}
+		parameter.SetCommand(r.CommandContainer, r.Command)
+	} else if r.CommandContainer != "" {
+		return http.StatusBadRequest, nil, fmt.Errorf("command_container requires command")
+	}
+	if len(r.Tags) > 0 {
+		if err := validateCustomTags(r.Tags, api.cfg.Parameter); err != nil {
+			return http.StatusBadRequest, nil, err
+		}
+		parameter.SetCustomTags(r.Tags)
+		if n := len(parameter.ToECSTags(subdomain, api.cfg.Parameter)); n > maxTagsPerTask {
+			return http.StatusBadRequest, nil, fmt.Errorf("too many tags %d: must be %d or less including the tags of mirage-ecs", n, maxTagsPerTask)
+		}
+	}
+	taskdefs := r.Taskdef
+	if len(taskdefs) == 0 {
+		taskdefs = api.cfg.DefaultTaskDefinitions(func(name string) string {
+			return parameter[name]
+		})
+		slog.Info(f("taskdef is not specified, using default taskdefs %v", taskdefs))
 	}
 
 	if subdomain == "" || len(taskdefs) == 0 {
-		return http.StatusBadRequest, fmt.Errorf("parameter required: subdomain=%s, taskdef=%v", subdomain, taskdefs)
+		return http.StatusBadRequest, nil, fmt.Errorf("parameter required: subdomain=%s, taskdef=%v", subdomain, taskdefs)
 	} else {
+		if code, err := api.checkTaskdefs(taskdefs); err != nil {
+			slog.Warn(f("launch %s rejected: %s", subdomain, err))
+			return code, nil, err
+		}
 		ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
 		defer cancel()
+		if err := api.checkReservation(ctx, subdomain, ownerOf(c)); errors.Is(err, ErrReservedByOther) {
+			slog.Warn(f("launch %s rejected: %s", subdomain, err))
+			return http.StatusForbidden, nil, err
+		} else if err != nil {
+			slog.Error(f("launch failed: %s", err))
+			return http.StatusInternalServerError, nil, err
+		}
+		if v := api.cfg.LaunchValidation; v != nil {
+			err := v.Check(ctx, &LaunchValidationRequest{
+				Subdomain:  subdomain,
+				Branch:     parameter["branch"],
+				Taskdefs:   taskdefs,
+				Parameters: parameter,
+				Actor:      actorOf(c),
+			})
+			if errors.Is(err, ErrLaunchRejected) {
+				slog.Warn(f("launch %s rejected: %s", subdomain, err))
+				return http.StatusForbidden, nil, err
+			} else if err != nil {
+				slog.Error(f("launch validation failed: %s", err))
+				return http.StatusBadGateway, nil, err
+			}
+		}
+		if r.DryRun {
+			if err := api.checkMaxConcurrentTasks(ctx, subdomain); err != nil {
+				return maxConcurrentTasksStatus(err), nil, err
+			}
+			plans, err := api.runner.PlanLaunch(ctx, subdomain, parameter, taskdefs...)
+			if err != nil {
+				slog.Error(f("dry-run of launch failed: %s", err))
+				return http.StatusBadRequest, nil, err
+			}
+			return http.StatusOK, &APILaunchResponse{Result: "ok", DryRun: true, Plans: plans}, nil
+		}
+		if !api.launchLocks.tryLock(subdomain) {
+			return http.StatusConflict, nil, fmt.Errorf("launch of subdomain %s is in progress", subdomain)
+		}
+		if err := api.checkMaxConcurrentTasks(ctx, subdomain); err != nil {
+			api.launchLocks.unlock(subdomain)
+			return maxConcurrentTasksStatus(err), nil, err
+		}
+		actor := actorOf(c)
+		var job *LaunchJob
+		if r.Async {
+			job = api.launchJobs.create(subdomain)
+		}
+		if retry != nil {
+			api.launchProgresses.start(subdomain, retry.Attempts)
+			go func() {
+				defer api.launchLocks.unlock(subdomain)
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), retry.Timeout)
+				defer cancel()
+				if job == nil {
+					api.launchInBackground(ctx, subdomain, parameter, taskdefs, actor, retry)
+					return
+				}
+				api.launchJobs.update(job.ID, LaunchStatusRunning, nil)
+				api.launchJobs.finish(job.ID, api.launchInBackground(ctx, subdomain, parameter, taskdefs, actor, retry))
+			}()
+			if job != nil {
+				return http.StatusAccepted, &APILaunchResponse{Result: "accepted", JobID: job.ID}, nil
+			}
+			return http.StatusAccepted, nil, nil
+		}
+		if job != nil {
+			go func() {
+				defer api.launchLocks.unlock(subdomain)
+				// running in background. Don't cancel by client context.
+				ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), APICallTimeout)
+				defer cancel()
+				api.launchJobs.update(job.ID, LaunchStatusRunning, nil)
+				err := api.runner.Launch(ctx, subdomain, parameter, taskdefs...)
+				api.finishLaunch(ctx, subdomain, parameter, taskdefs, actor, err)
+				if err != nil {
+					slog.Error(f("launch %s failed: %s", subdomain, err))
+				}
+				api.launchJobs.finish(job.ID, err)
+			}()
+			return http.StatusAccepted, &APILaunchResponse{Result: "accepted", JobID: job.ID}, nil
+		}
+		defer api.launchLocks.unlock(subdomain)
 		err := api.runner.Launch(ctx, subdomain, parameter, taskdefs...)
+		api.finishLaunch(ctx, subdomain, parameter, taskdefs, actor, err)
 		if err != nil {
 			slog.Error(f("launch failed: %s", err))
-			return http.StatusInternalServerError, err
+			return http.StatusInternalServerError, nil, err
 		}
 	}
-	return http.StatusOK, nil
+	return http.StatusOK, nil, nil
+}
+
+// launchInBackground launches the subdomain with retry and reports the progress.
+func (api *WebApi) launchInBackground(ctx context.Context, subdomain string, parameter TaskParameter, taskdefs []string, actor string, retry *LaunchRetry) error {
+	launch := func(ctx context.Context) error {
+		return api.runner.Launch(ctx, subdomain, parameter, taskdefs...)
+	}
+	report := func(attempt int, err error) {
+		api.launchProgresses.update(subdomain, func(p *LaunchProgress) {
+			p.Status = LaunchStatusRetrying
+			p.Attempt = attempt + 1
+			p.LastError = err.Error()
+		})
+	}
+	err := launchWithRetry(ctx, launch, retry.Attempts, launchRetryBackoff, report)
+	api.launchProgresses.update(subdomain, func(p *LaunchProgress) {
+		if err != nil {
+			p.Status = LaunchStatusFailed
+			p.LastError = err.Error()
+		} else {
+			p.Status = LaunchStatusSucceeded
+		}
+	})
+	if err != nil {
+		slog.Error(f("launch %s failed: %s", subdomain, err))
+	}
+	// ctx is done when the retry is timed out
+	fctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), APICallTimeout)
+	defer cancel()
+	api.finishLaunch(fctx, subdomain, parameter, taskdefs, actor, err)
+	return err
+}
+
+// finishLaunch records the history of the launch, and notifies the event on success.
+func (api *WebApi) finishLaunch(ctx context.Context, subdomain string, parameter TaskParameter, taskdefs []string, actor string, err error) {
+	api.recordHistory(ctx, &HistoryRecord{
+		Subdomain: subdomain,
+		Action:    HistoryActionLaunch,
+		Branch:    parameter["branch"],
+		Taskdefs:  taskdefs,
+		Actor:     actor,
+	}, err)
+	if err != nil {
+		return
+	}
+	api.taskEvents.launches.Add(1)
+	api.cfg.events().OnLaunch(&LaunchEvent{
+		Subdomain:  subdomain,
+		Taskdefs:   taskdefs,
+		Parameters: parameter,
+		Actor:      actor,
+	})
+	if api.forgetSleeping != nil {
+		api.forgetSleeping(subdomain)
+	}
+	if api.markLaunching != nil {
+		api.markLaunching(subdomain)
+	}
 }
 
 func (api *WebApi) ApiLogs(c echo.Context) error {
@@ -220,7 +757,83 @@ func (api *WebApi) ApiLogs(c echo.Context) error {
 	if err != nil {
 		return c.JSON(code, APICommonResponse{Result: err.Error()})
 	}
-	return c.JSON(code, APILogsResponse{Result: logs})
+	return c.JSON(code, APILogsResponse{Result: logMessages(logs), Events: logs})
+}
+
+// ApiLogsStream streams the new logs of the subdomain by Server-Sent Events until the client disconnects.
+func (api *WebApi) ApiLogsStream(c echo.Context) error {
+	subdomain := c.QueryParam("subdomain")
+	if subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "parameter required: subdomain"})
+	}
+	var since time.Time
+	if s := c.QueryParam("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, APICommonResponse{Result: f("cannot parse since: %s", err)})
+		}
+	}
+
+	// the stream is started by the first call of fn, after the log streams are resolved.
+	res := c.Response()
+	ctx := c.Request().Context()
+	err := api.runner.FollowLogs(ctx, subdomain, c.QueryParam("container"), since, func(logs []LogEvent) error {
+		if !res.Committed {
+			res.Header().Set(echo.HeaderContentType, "text/event-stream")
+			res.Header().Set("Cache-Control", "no-cache")
+			res.Header().Set("X-Accel-Buffering", "no") // disable buffering of nginx
+			res.WriteHeader(http.StatusOK)
+		}
+		if len(logs) == 0 {
+			// keep the idle stream alive through the load balancers
+			if _, err := io.WriteString(res, ":\n\n"); err != nil {
+				return err
+			}
+		}
+		for _, l := range logs {
+			b, err := json.Marshal(l)
+			if err != nil {
+				return err
+			}
+			if err := writeServerSentEvent(res, "", string(b)); err != nil {
+				return err
+			}
+		}
+		res.Flush()
+		return nil
+	})
+	if err == nil || ctx.Err() != nil {
+		return nil
+	}
+	slog.Warn(f("failed to follow logs of subdomain %s: %s", subdomain, err))
+	if !res.Committed {
+		code := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, ErrSubdomainNotFound):
+			code = http.StatusNotFound
+		case errors.Is(err, ErrContainerNotFound), errors.Is(err, ErrAmbiguousContainer):
+			code = http.StatusBadRequest
+		}
+		return c.JSON(code, APICommonResponse{Result: err.Error()})
+	}
+	writeServerSentEvent(res, "error", err.Error())
+	res.Flush()
+	return nil
+}
+
+// writeServerSentEvent writes the event. The multi-line data is sent as multiple data fields.
+func writeServerSentEvent(w io.Writer, event, data string) error {
+	var b strings.Builder
+	if event != "" {
+		b.WriteString("event: " + event + "\n")
+	}
+	for _, line := range strings.Split(data, "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+	_, err := io.WriteString(w, b.String())
+	return err
 }
 
 func (api *WebApi) ApiTerminate(c echo.Context) error {
@@ -231,6 +844,14 @@ func (api *WebApi) ApiTerminate(c echo.Context) error {
 	return c.JSON(code, APICommonResponse{Result: "ok"})
 }
 
+func (api *WebApi) ApiRestart(c echo.Context) error {
+	code, err := api.restart(c)
+	if err != nil {
+		return c.JSON(code, APICommonResponse{Result: err.Error()})
+	}
+	return c.JSON(code, APICommonResponse{Result: "ok"})
+}
+
 func (api *WebApi) ApiAccess(c echo.Context) error {
 	code, sum, duration, err := api.accessCounter(c)
 	if err != nil {
@@ -239,11 +860,45 @@ func (api *WebApi) ApiAccess(c echo.Context) error {
 	return c.JSON(code, APIAccessResponse{Result: "ok", Sum: sum, Duration: duration})
 }
 
+func (api *WebApi) ApiStats(c echo.Context) error {
+	subdomain := strings.ToLower(c.QueryParam("subdomain"))
+	if subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "parameter required: subdomain"})
+	}
+	var counts map[string]int64
+	var ok bool
+	if api.statusTotalsOf != nil {
+		counts, ok = api.statusTotalsOf(subdomain)
+	}
+	if !ok {
+		return c.JSON(http.StatusNotFound, APICommonResponse{Result: fmt.Sprintf("subdomain %s is not proxied", subdomain)})
+	}
+	var requests int64
+	for _, n := range counts {
+		requests += n
+	}
+	return c.JSON(http.StatusOK, APIStatsResponse{
+		Result:       "ok",
+		Subdomain:    subdomain,
+		Requests:     requests,
+		StatusCounts: counts,
+	})
+}
+
 func (api *WebApi) ApiPurge(c echo.Context) error {
 	r := APIPurgeRequest{}
 	if err := c.Bind(&r); err != nil {
 		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
 	}
+	for name, v := range map[string]*bool{"dry_run": &r.DryRun, "sync": &r.Sync} {
+		if q := c.QueryParam(name); q != "" {
+			b, err := strconv.ParseBool(q)
+			if err != nil {
+				return c.JSON(http.StatusBadRequest, APICommonResponse{Result: f("invalid %s %s", name, q)})
+			}
+			*v = b
+		}
+	}
 
 	params, err := r.Validate()
 	if err != nil {
@@ -252,14 +907,238 @@ func (api *WebApi) ApiPurge(c echo.Context) error {
 	}
 
 	ctx := c.Request().Context()
+	if r.DryRun {
+		subdomains, err := api.purgeDryRun(ctx, params)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+		}
+		return c.JSON(http.StatusOK, APIPurgeResponse{Result: "ok", DryRun: true, Subdomains: subdomains})
+	}
+	if r.Sync {
+		// don't stop purging in the middle by the client disconnection
+		subdomains, res, err := api.purgeSync(context.WithoutCancel(ctx), params)
+		if errors.Is(err, ErrPurgeRunning) {
+			return c.JSON(http.StatusConflict, APICommonResponse{Result: err.Error()})
+		} else if err != nil {
+			return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+		}
+		return c.JSON(http.StatusOK, APIPurgeResponse{Result: "ok", Subdomains: subdomains, PurgeResult: res})
+	}
 	if err := api.purge(ctx, params); err != nil {
 		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
 	}
 	return c.JSON(http.StatusOK, APICommonResponse{Result: "accepted"})
 }
 
-func (api *WebApi) logs(c echo.Context) (int, []string, error) {
+// ApiPurgeEvaluate evaluates purge rules for the subdomain without terminating tasks.
+func (api *WebApi) ApiPurgeEvaluate(c echo.Context) error {
+	r := APIPurgeEvaluateRequest{}
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	if r.Subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "subdomain is required"})
+	}
+	params, err := r.APIPurgeRequest.Validate()
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+
+	ctx := c.Request().Context()
+	infos, err := api.runner.List(ctx, statusRunning)
+	if err != nil {
+		slog.Error(f("list ecs failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	api.fillExpiry(infos)
+	// keep_latest_per_branch is evaluated among all of the running tasks
+	retained := params.RetainedSubdomains(infos)
+	now := time.Now()
+	res := APIPurgeEvaluateResponse{
+		Subdomain: r.Subdomain,
+		Tasks:     []*PurgeEvaluation{},
+	}
+	var candidate, expired bool
+	for _, info := range infos {
+		if info.SubDomain != r.Subdomain {
+			continue
+		}
+		ev := evaluatePurge(info, params, retained, now)
+		res.Tasks = append(res.Tasks, ev)
+		candidate = candidate || ev.Candidate
+		expired = expired || ev.Expired
+	}
+	switch {
+	case len(res.Tasks) == 0:
+		return c.JSON(http.StatusNotFound, APICommonResponse{Result: "subdomain is not running"})
+	case expired:
+		res.Purge = true
+		res.Reason = "exceeds max lifetime"
+	case candidate:
+		sum, err := api.runner.GetAccessCount(ctx, r.Subdomain, params.Duration)
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+		}
+		res.AccessCount = &sum
+		if sum > 0 {
+			res.Reason = f("%d access in %s", sum, params.Duration)
+		} else {
+			res.Purge = true
+			res.Reason = f("no access in %s", params.Duration)
+		}
+	default:
+		res.Reason = res.Tasks[0].Reason
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func (api *WebApi) ApiRefresh(c echo.Context) error {
+	if api.syncRouting == nil {
+		return c.JSON(http.StatusNotImplemented, APICommonResponse{Result: "refresh is not available"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	changes, err := api.syncRouting(ctx)
+	if err != nil {
+		slog.Error(f("refresh failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	slog.Info(f("refreshed proxy routing added:%v removed:%v", changes.Added, changes.Removed))
+	return c.JSON(http.StatusOK, APIRefreshResponse{
+		Result:  "ok",
+		Added:   changes.Added,
+		Removed: changes.Removed,
+	})
+}
+
+func (api *WebApi) ApiHistory(c echo.Context) error {
+	if api.history == nil {
+		return c.JSON(http.StatusNotImplemented, APICommonResponse{Result: "history is not configured"})
+	}
+	limit, err := parseHistoryLimit(c.QueryParam("limit"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	records, err := api.history.Query(ctx, HistoryQuery{
+		Subdomain: c.QueryParam("subdomain"),
+		Limit:     limit,
+	})
+	if err != nil {
+		slog.Error(f("history query failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	return c.JSON(http.StatusOK, APIHistoryResponse{Result: records})
+}
+
+func (api *WebApi) ApiReservations(c echo.Context) error {
+	if api.reservations == nil {
+		return c.JSON(http.StatusNotImplemented, APICommonResponse{Result: "reservation is not configured"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	records, err := api.reservations.List(ctx)
+	if err != nil {
+		slog.Error(f("list reservations failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	return c.JSON(http.StatusOK, APIReservationsResponse{Result: records})
+}
+
+func (api *WebApi) ApiReserve(c echo.Context) error {
+	if api.reservations == nil {
+		return c.JSON(http.StatusNotImplemented, APICommonResponse{Result: "reservation is not configured"})
+	}
+	r := APIReserveRequest{}
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	subdomain := strings.ToLower(r.Subdomain)
+	if err := validateSubdomain(subdomain); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse(err))
+	}
+	if err := api.cfg.Host.checkReserved(subdomain); err != nil {
+		return c.JSON(http.StatusBadRequest, errorResponse(err))
+	}
+	owner := ownerOf(c)
+	if owner == "" {
+		return c.JSON(http.StatusForbidden, APICommonResponse{Result: "reservation requires an authenticated user"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	err := api.reservations.Reserve(ctx, &ReservationRecord{
+		Subdomain:  subdomain,
+		Owner:      owner,
+		ReservedAt: time.Now(),
+	})
+	if errors.Is(err, ErrReservedByOther) {
+		return c.JSON(http.StatusConflict, APICommonResponse{Result: err.Error()})
+	} else if err != nil {
+		slog.Error(f("reserve failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	slog.Info(f("subdomain %s is reserved by %s", subdomain, owner))
+	return c.JSON(http.StatusOK, APICommonResponse{Result: "ok"})
+}
+
+func (api *WebApi) ApiRelease(c echo.Context) error {
+	if api.reservations == nil {
+		return c.JSON(http.StatusNotImplemented, APICommonResponse{Result: "reservation is not configured"})
+	}
+	r := APIReleaseRequest{}
+	if err := c.Bind(&r); err != nil {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: err.Error()})
+	}
+	subdomain := strings.ToLower(r.Subdomain)
+	if subdomain == "" {
+		return c.JSON(http.StatusBadRequest, APICommonResponse{Result: "parameter required: subdomain"})
+	}
+	owner := ownerOf(c)
+	if owner == "" {
+		return c.JSON(http.StatusForbidden, APICommonResponse{Result: "reservation requires an authenticated user"})
+	}
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	err := api.reservations.Release(ctx, subdomain, owner)
+	if errors.Is(err, ErrNotReserved) {
+		return c.JSON(http.StatusConflict, APICommonResponse{Result: err.Error()})
+	} else if err != nil {
+		slog.Error(f("release failed: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	slog.Info(f("subdomain %s is released by %s", subdomain, owner))
+	return c.JSON(http.StatusOK, APICommonResponse{Result: "ok"})
+}
+
+// AdminReloadTemplates reloads the templates in htmldir without restarting.
+func (api *WebApi) AdminReloadTemplates(c echo.Context) error {
+	if err := api.renderer.Reload(); err != nil {
+		slog.Error(f("failed to reload templates: %s", err))
+		return c.JSON(http.StatusInternalServerError, APICommonResponse{Result: err.Error()})
+	}
+	slog.Info(f("templates are reloaded from %s", api.cfg.HtmlDir))
+	return c.JSON(http.StatusOK, APICommonResponse{Result: "ok"})
+}
+
+// checkReservation returns an error when the subdomain is reserved by another owner.
+func (api *WebApi) checkReservation(ctx context.Context, subdomain, owner string) error {
+	if api.reservations == nil {
+		return nil
+	}
+	r, err := api.reservations.Get(ctx, subdomain)
+	if err != nil {
+		return fmt.Errorf("failed to get reservation: %w", err)
+	}
+	if r != nil && r.Owner != owner {
+		return fmt.Errorf("%w: %s is reserved by %s", ErrReservedByOther, subdomain, r.Owner)
+	}
+	return nil
+}
+
+func (api *WebApi) logs(c echo.Context) (int, []LogEvent, error) {
 	subdomain := c.QueryParam("subdomain")
+	container := c.QueryParam("container")
 	since := c.QueryParam("since")
 	tail := c.QueryParam("tail")
 
@@ -288,8 +1167,10 @@ func (api *WebApi) logs(c echo.Context) (int, []string, error) {
 
 	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
 	defer cancel()
-	logs, err := api.runner.Logs(ctx, subdomain, sinceTime, tailN)
-	if err != nil {
+	logs, err := api.runner.Logs(ctx, subdomain, container, sinceTime, tailN)
+	if errors.Is(err, ErrContainerNotFound) || errors.Is(err, ErrAmbiguousContainer) {
+		return http.StatusBadRequest, nil, err
+	} else if err != nil {
 		return http.StatusInternalServerError, nil, err
 	}
 	return http.StatusOK, logs, nil
@@ -305,20 +1186,246 @@ func (api *WebApi) terminate(c echo.Context) (int, error) {
 
 	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
 	defer cancel()
+	var err error
 	if id != "" {
-		if err := api.runner.Terminate(ctx, id); err != nil {
-			return http.StatusInternalServerError, err
+		if api.history != nil || api.cfg.eventListener != nil {
+			subdomain = api.subdomainOfTask(ctx, id)
 		}
+		err = api.runner.Terminate(ctx, id)
 	} else if subdomain != "" {
-		if err := api.runner.TerminateBySubdomain(ctx, subdomain); err != nil {
-			return http.StatusInternalServerError, err
+		if api.forgetSleeping != nil {
+			// the subdomain scaled to zero has no tasks to terminate
+			api.forgetSleeping(subdomain)
 		}
+		err = api.runner.TerminateBySubdomain(ctx, subdomain)
 	} else {
 		return http.StatusBadRequest, fmt.Errorf("parameter required: id or subdomain")
 	}
+	api.recordHistory(ctx, &HistoryRecord{
+		Subdomain: subdomain,
+		Action:    HistoryActionTerminate,
+		Actor:     actorOf(c),
+	}, err)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	api.taskEvents.terminations.Add(1)
+	api.cfg.events().OnTerminate(&TerminateEvent{
+		Subdomain: subdomain,
+		TaskID:    id,
+		Actor:     actorOf(c),
+	})
+	return http.StatusOK, nil
+}
+
+// restart relaunches the running subdomain with the same task definitions and parameters.
+func (api *WebApi) restart(c echo.Context) (int, error) {
+	r := APIRestartRequest{}
+	if err := c.Bind(&r); err != nil {
+		return http.StatusBadRequest, err
+	}
+	subdomain := strings.ToLower(r.Subdomain)
+	if subdomain == "" {
+		return http.StatusBadRequest, fmt.Errorf("parameter required: subdomain")
+	}
+	if err := validateSubdomain(subdomain); err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request().Context(), APICallTimeout)
+	defer cancel()
+	infos, err := api.runner.Status(ctx, subdomain)
+	if err != nil {
+		slog.Error(f("restart failed: %s", err))
+		return http.StatusInternalServerError, err
+	}
+	if len(infos) == 0 {
+		return http.StatusNotFound, fmt.Errorf("subdomain %s is not running", subdomain)
+	}
+	taskdefs := taskdefsOf(infos)
+	if code, err := api.checkTaskdefs(taskdefs); err != nil {
+		slog.Warn(f("restart %s rejected: %s", subdomain, err))
+		return code, err
+	}
+	actor := actorOf(c)
+	if err := api.checkReservation(ctx, subdomain, ownerOf(c)); errors.Is(err, ErrReservedByOther) {
+		slog.Warn(f("restart %s rejected: %s", subdomain, err))
+		return http.StatusForbidden, err
+	} else if err != nil {
+		slog.Error(f("restart failed: %s", err))
+		return http.StatusInternalServerError, err
+	}
+	if !api.launchLocks.tryLock(subdomain) {
+		return http.StatusConflict, fmt.Errorf("launch of subdomain %s is in progress", subdomain)
+	}
+	defer api.launchLocks.unlock(subdomain)
+
+	parameter := taskParameterFromInformation(infos[0], api.cfg.Parameter)
+	if err := api.checkRestorable(ctx, subdomain, infos, parameter); errors.Is(err, ErrNotRestorable) {
+		slog.Warn(f("restart %s rejected: %s", subdomain, err))
+		return http.StatusConflict, err
+	} else if err != nil {
+		slog.Error(f("restart failed: %s", err))
+		return http.StatusInternalServerError, err
+	}
+	slog.Info(f("restarting subdomain %s taskdefs:%v", subdomain, taskdefs))
+	err = api.runner.Launch(ctx, subdomain, parameter, taskdefs...)
+	api.finishLaunch(ctx, subdomain, parameter, taskdefs, actor, err)
+	if err != nil {
+		slog.Error(f("restart failed: %s", err))
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// wakeActor is the actor of the launches waking up the sleeping subdomains.
+const wakeActor = "mirage-ecs"
+
+// wake relaunches the subdomain scaled to zero by the same checks as the launch API.
+// The reservation made while the subdomain is sleeping is not taken over by the wake.
+func (api *WebApi) wake(ctx context.Context, ss *sleepingSubdomain) error {
+	subdomain := ss.Subdomain
+	if _, err := api.checkTaskdefs(ss.Taskdefs); err != nil {
+		return err
+	}
+	if api.reservations != nil {
+		r, err := api.reservations.Get(ctx, subdomain)
+		if err != nil {
+			return fmt.Errorf("failed to get reservation: %w", err)
+		}
+		if r != nil && r.ReservedAt.After(ss.SleptAt) {
+			return fmt.Errorf("%w: %s is reserved by %s while sleeping", ErrReservedByOther, subdomain, r.Owner)
+		}
+	}
+	if v := api.cfg.LaunchValidation; v != nil {
+		err := v.Check(ctx, &LaunchValidationRequest{
+			Subdomain:  subdomain,
+			Branch:     ss.Parameter["branch"],
+			Taskdefs:   ss.Taskdefs,
+			Parameters: ss.Parameter,
+			Actor:      wakeActor,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if !api.launchLocks.tryLock(subdomain) {
+		return fmt.Errorf("launch of subdomain %s is in progress", subdomain)
+	}
+	defer api.launchLocks.unlock(subdomain)
+	if err := api.checkMaxConcurrentTasks(ctx, subdomain); err != nil {
+		return err
+	}
+	err := api.runner.Launch(ctx, subdomain, ss.Parameter, ss.Taskdefs...)
+	api.finishLaunch(ctx, subdomain, ss.Parameter, ss.Taskdefs, wakeActor, err)
+	return err
+}
+
+// checkTaskdefs checks the task definitions can be launched by link.strict_taskdef and ecs.allowed/denied_task_definitions.
+// It returns the status code to respond with the error.
+func (api *WebApi) checkTaskdefs(taskdefs []string) (int, error) {
+	if err := api.cfg.validateTaskdefs(taskdefs); err != nil {
+		return http.StatusBadRequest, err
+	}
+	for _, td := range taskdefs {
+		if !api.cfg.ECS.taskdefAllowed(td) {
+			return http.StatusForbidden, fmt.Errorf("taskdef %s is not allowed to launch", td)
+		}
+	}
 	return http.StatusOK, nil
 }
 
+// ErrNotRestorable is returned when the tasks were launched with what cannot be restored from the tasks.
+var ErrNotRestorable = errors.New("the launch cannot be restored")
+
+// checkRestorable returns ErrNotRestorable when the relaunch by parameter would lose what the tasks were launched with.
+// The secret parameters and the command override are neither tagged nor restored from the tasks.
+// The commands rendered by the override template are reproduced by the relaunch, so they are compared with the plan.
+func (api *WebApi) checkRestorable(ctx context.Context, subdomain string, infos []*Information, parameter TaskParameter) error {
+	for _, info := range infos {
+		if info.launchedWithSecrets(api.cfg.Parameter) {
+			return fmt.Errorf("%w: subdomain %s was launched with secret parameters. launch it again with them", ErrNotRestorable, subdomain)
+		}
+	}
+	var plans []*LaunchPlan
+	for _, info := range infos {
+		commands := info.containerCommands()
+		if len(commands) == 0 {
+			continue
+		}
+		if plans == nil {
+			var err error
+			if plans, err = api.runner.PlanLaunch(ctx, subdomain, parameter, taskdefsOf(infos)...); err != nil {
+				return err
+			}
+		}
+		plan, _ := lo.Find(plans, func(p *LaunchPlan) bool { return p.Taskdef == info.TaskDef })
+		for container, command := range commands {
+			var planned []string
+			if plan != nil {
+				if c, ok := lo.Find(plan.Overrides.ContainerOverrides, func(c types.ContainerOverride) bool {
+					return aws.ToString(c.Name) == container
+				}); ok {
+					planned = c.Command
+				}
+			}
+			if !slices.Equal(command, planned) {
+				return fmt.Errorf("%w: subdomain %s was launched with the command override of %s. launch it again with the command", ErrNotRestorable, subdomain, container)
+			}
+		}
+	}
+	return nil
+}
+
+func (api *WebApi) subdomainOfTask(ctx context.Context, id string) string {
+	infos, err := api.runner.List(ctx, statusRunning)
+	if err != nil {
+		slog.Warn(f("failed to list tasks: %s", err))
+		return ""
+	}
+	for _, info := range infos {
+		if info.ID == id || info.ShortID == id {
+			return info.SubDomain
+		}
+	}
+	return ""
+}
+
+func (api *WebApi) recordHistory(ctx context.Context, r *HistoryRecord, err error) {
+	if api.history == nil {
+		return
+	}
+	if r.Subdomain == "" {
+		slog.Warn(f("skip recording %s history without subdomain", r.Action))
+		return
+	}
+	r.Timestamp = time.Now()
+	if err != nil {
+		r.Outcome = err.Error()
+	} else {
+		r.Outcome = HistoryOutcomeOK
+	}
+	// record even if the request context is canceled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), APICallTimeout)
+	defer cancel()
+	if err := api.history.Put(ctx, r); err != nil {
+		slog.Warn(f("failed to record history: %s", err))
+	}
+}
+
+// actorOf returns the authenticated user, or the client IP address for the records of the actions.
+func actorOf(c echo.Context) string {
+	if owner := ownerOf(c); owner != "" {
+		return owner
+	}
+	return c.RealIP()
+}
+
+// ownerOf returns the authenticated user who can hold reservations. It is empty when the request is not authenticated.
+func ownerOf(c echo.Context) string {
+	return authIdentityOf(c.Request())
+}
+
 func (api *WebApi) accessCounter(c echo.Context) (int, int64, int64, error) {
 	subdomain := c.QueryParam("subdomain")
 	duration := c.QueryParam("duration")
@@ -340,6 +1447,10 @@ func (api *WebApi) LoadParameter(getFunc func(string) string) (TaskParameter, er
 
 	for _, v := range api.cfg.Parameter {
 		param := getFunc(v.Name)
+		if param == "" {
+			// the defaults of the config are applied to every launch unless the client specifies
+			param = api.cfg.Defaults[v.Name]
+		}
 		if param == "" && v.Default != "" {
 			param = v.Default
 		}
@@ -354,8 +1465,14 @@ func (api *WebApi) LoadParameter(getFunc func(string) string) (TaskParameter, er
 				return nil, fmt.Errorf("parameter %s value is rule error", v.Name)
 			}
 		}
-		if utf8.RuneCountInString(param) > 255 {
-			return nil, fmt.Errorf("parameter %s value is too long(max 255 unicode characters)", v.Name)
+		if max := v.ValueMaxLength(); utf8.RuneCountInString(param) > max {
+			return nil, fmt.Errorf("parameter %s value is too long(max %d unicode characters)", v.Name, max)
+		}
+		if v.Secret && !isSecretReference(param) {
+			return nil, fmt.Errorf("parameter %s value must be an ARN of SSM Parameter Store or Secrets Manager", v.Name)
+		}
+		if v.Secret && !v.secretAllowed(param) {
+			return nil, fmt.Errorf("parameter %s value is not allowed by allowed_secrets", v.Name)
 		}
 		parameter[v.Name] = param
 	}
@@ -363,80 +1480,267 @@ func (api *WebApi) LoadParameter(getFunc func(string) string) (TaskParameter, er
 	return parameter, nil
 }
 
+func (api *WebApi) defaultParameterValue(name string) string {
+	if v := api.cfg.Defaults[name]; v != "" {
+		return v
+	}
+	for _, v := range api.cfg.Parameter {
+		if v.Name == name {
+			return v.Default
+		}
+	}
+	return ""
+}
+
+const (
+	SubdomainMinLength = 2
+	SubdomainMaxLength = 63
+
+	SubdomainErrorTooShort     = "too_short"
+	SubdomainErrorTooLong      = "too_long"
+	SubdomainErrorInvalidChars = "invalid_chars"
+	SubdomainErrorBadPattern   = "bad_pattern"
+	SubdomainErrorReserved     = "reserved"
+)
+
+// SubdomainError is an error of validateSubdomain.
+// Code and the bounds let the UI and API clients show the field-specific message.
+type SubdomainError struct {
+	Code      string `json:"code"`
+	Subdomain string `json:"subdomain"`
+	MinLength int    `json:"min_length"`
+	MaxLength int    `json:"max_length"`
+	Pattern   string `json:"pattern"`
+
+	err error
+}
+
+func newSubdomainError(code, subdomain string, err error) *SubdomainError {
+	return &SubdomainError{
+		Code:      code,
+		Subdomain: subdomain,
+		MinLength: SubdomainMinLength,
+		MaxLength: SubdomainMaxLength,
+		Pattern:   DNSNameRegexpWithPattern.String(),
+		err:       err,
+	}
+}
+
+func (e *SubdomainError) Error() string {
+	return e.err.Error()
+}
+
+func (e *SubdomainError) Unwrap() error {
+	return e.err
+}
+
 func validateSubdomain(s string) error {
 	if s == "" {
-		return fmt.Errorf("subdomain is empty")
+		return newSubdomainError(SubdomainErrorTooShort, s, fmt.Errorf("subdomain is empty"))
 	}
-	if len(s) < 2 {
-		return fmt.Errorf("subdomain is too short")
+	if len(s) < SubdomainMinLength {
+		return newSubdomainError(SubdomainErrorTooShort, s, fmt.Errorf("subdomain is too short"))
 	}
-	if len(s) > 63 {
-		return fmt.Errorf("subdomain is too long")
+	if len(s) > SubdomainMaxLength {
+		return newSubdomainError(SubdomainErrorTooLong, s, fmt.Errorf("subdomain is too long"))
 	}
-	if !DNSNameRegexpWithPattern.MatchString(s) {
-		return fmt.Errorf("subdomain %s includes invalid characters", s)
+	// a subdomain may have multiple labels, e.g. *.feature-123 routes foo.feature-123 and bar.feature-123
+	for _, label := range strings.Split(s, ".") {
+		if label != "*" && !DNSNameRegexpWithPattern.MatchString(label) {
+			return newSubdomainError(SubdomainErrorInvalidChars, s, fmt.Errorf("subdomain %s includes invalid characters", s))
+		}
 	}
 	if _, err := path.Match(s, "x"); err != nil {
-		return err
+		return newSubdomainError(SubdomainErrorBadPattern, s, err)
 	}
 	return nil
 }
 
+// errorResponse returns APICommonResponse of the error with the detail of SubdomainError.
+func errorResponse(err error) APICommonResponse {
+	res := APICommonResponse{Result: err.Error()}
+	var se *SubdomainError
+	if errors.As(err, &se) {
+		res.Error = se
+	}
+	return res
+}
+
+// ErrPurgeRunning is returned when another purge is running.
+var ErrPurgeRunning = errors.New("another purge is running")
+
 func (api *WebApi) purge(ctx context.Context, p *PurgeParams) error {
+	terminates, expired, err := api.selectPurgeSubdomains(ctx, p)
+	if err != nil {
+		return err
+	}
+	if len(terminates) == 0 {
+		slog.Info("no subdomains to purge")
+		return nil
+	}
+	slog.Info(f("purge %d subdomains", len(terminates)))
+	// running in background. Don't cancel by client context.
+	go api.purgeSubdomains(context.Background(), terminates, expired, p.Duration)
+	return nil
+}
+
+// purgeSync purges the subdomains by the params and waits for the completion.
+// It returns the candidate subdomains and the result.
+func (api *WebApi) purgeSync(ctx context.Context, p *PurgeParams) ([]string, *PurgeResult, error) {
+	terminates, expired, err := api.selectPurgeSubdomains(ctx, p)
+	if err != nil {
+		return nil, nil, err
+	}
+	res, err := api.purgeSubdomains(ctx, terminates, expired, p.Duration)
+	return terminates, res, err
+}
+
+// scheduledPurge purges the subdomains by the params for the scheduled purger.
+// It runs synchronously, so the scheduler can recover a panic in the termination.
+func (api *WebApi) scheduledPurge(ctx context.Context, p *PurgeParams) error {
+	_, res, err := api.purgeSync(ctx, p)
+	if err != nil {
+		return err
+	}
+	slog.Info(f("scheduled purge: purged %d, skipped %d, failed %d", len(res.Purged), len(res.Skipped), len(res.Errors)))
+	return nil
+}
+
+// purgeDryRun returns the subdomains which would be purged by the params without terminating them.
+func (api *WebApi) purgeDryRun(ctx context.Context, p *PurgeParams) ([]string, error) {
+	terminates, expired, err := api.selectPurgeSubdomains(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	idle, _ := api.idleSubdomains(ctx, terminates, expired, p.Duration)
+	slog.Info(f("dry-run purge %d subdomains", len(idle)), "subdomains", idle)
+	return idle, nil
+}
+
+// selectPurgeSubdomains selects the candidate subdomains to purge by the rules.
+// The access counts are not checked here. The expired subdomains are returned as a set too.
+func (api *WebApi) selectPurgeSubdomains(ctx context.Context, p *PurgeParams) ([]string, map[string]struct{}, error) {
 	infos, err := api.runner.List(ctx, statusRunning)
 	if err != nil {
 		slog.Error(f("list ecs failed: %s", err))
-		return fmt.Errorf("list tasks failed: %w", err)
+		return nil, nil, fmt.Errorf("list tasks failed: %w", err)
 	}
 	slog.Info("purge subdomains",
 		"duration", p.Duration,
 		"excludes", p.Excludes,
 		"exclude_tags", p.ExcludeTags,
+		"exclude_env", p.ExcludeEnv,
 		"exclude_regexp", p.ExcludeRegexp,
+		"min_age", p.MinAge,
+		"keep_latest_per_branch", p.KeepLatestPerBranch,
 	)
+	api.fillExpiry(infos)
+	retained := p.RetainedSubdomains(infos)
 	terminates := []string{}
+	expired := make(map[string]struct{})
+	now := time.Now()
 	for _, info := range infos {
-		if info.ShouldBePurged(p) {
-			terminates = append(terminates, info.SubDomain)
+		ev := evaluatePurge(info, p, retained, now)
+		if !ev.Candidate {
+			slog.Info(f("skip %s subdomain: %s", ev.Reason, info.SubDomain))
+			continue
+		}
+		if ev.Expired {
+			slog.Info(f("subdomain %s %s", info.SubDomain, ev.Reason))
+			expired[info.SubDomain] = struct{}{}
 		}
+		terminates = append(terminates, info.SubDomain)
 	}
-	terminates = lo.Uniq(terminates)
-	if len(terminates) > 0 {
-		slog.Info(f("purge %d subdomains", len(terminates)))
-		// running in background. Don't cancel by client context.
-		go api.purgeSubdomains(context.Background(), terminates, p.Duration)
+	return lo.Uniq(terminates), expired, nil
+}
+
+// purgeConcurrency returns the concurrency to check access counts on purge.
+func (api *WebApi) purgeConcurrency() int {
+	if c := api.cfg.ECS.PurgeConcurrency; c > 0 {
+		return c
 	}
+	return DefaultPurgeConcurrency
+}
 
-	slog.Info("no subdomains to purge")
-	return nil
+// idleSubdomains returns the subdomains which have no access in the duration, in the order of subdomains.
+// The expired subdomains are idle regardless of access.
+// The result has the subdomains skipped by access and the errors of the access counts.
+func (api *WebApi) idleSubdomains(ctx context.Context, subdomains []string, expired map[string]struct{}, duration time.Duration) ([]string, *PurgeResult) {
+	// check access counts concurrently. these are read-only.
+	accesses := make([]int64, len(subdomains))
+	errs := make([]error, len(subdomains))
+	var eg errgroup.Group
+	eg.SetLimit(api.purgeConcurrency())
+	for i, subdomain := range subdomains {
+		if _, ok := expired[subdomain]; ok {
+			continue
+		}
+		eg.Go(func() error {
+			accesses[i], errs[i] = api.runner.GetAccessCount(ctx, subdomain, duration)
+			return nil
+		})
+	}
+	eg.Wait()
+
+	idle := []string{}
+	res := newPurgeResult()
+	for i, subdomain := range subdomains {
+		switch {
+		case errs[i] != nil:
+			slog.Warn(f("access count failed: %s %s", subdomain, errs[i]))
+			res.Errors[subdomain] = f("access count failed: %s", errs[i])
+		case accesses[i] > 0:
+			slog.Info(f("skip purge %s %d access", subdomain, accesses[i]))
+			res.Skipped = append(res.Skipped, subdomain)
+		default:
+			idle = append(idle, subdomain)
+		}
+	}
+	return idle, res
 }
 
-func (api *WebApi) purgeSubdomains(ctx context.Context, subdomains []string, duration time.Duration) {
+// purgeSubdomains terminates the subdomains which have no access in the duration.
+// The expired subdomains are terminated regardless of access.
+// It returns ErrPurgeRunning when another purge is running.
+func (api *WebApi) purgeSubdomains(ctx context.Context, subdomains []string, expired map[string]struct{}, duration time.Duration) (*PurgeResult, error) {
 	if api.mu.TryLock() {
 		defer api.mu.Unlock()
 	} else {
 		slog.Info("skip purge subdomains, another purge is running")
-		return
+		return nil, ErrPurgeRunning
 	}
-	slog.Info(f("start purge subdomains %d", len(subdomains)))
-	purged := 0
-	for _, subdomain := range subdomains {
-		sum, err := api.runner.GetAccessCount(ctx, subdomain, duration)
-		if err != nil {
-			slog.Warn(f("access count failed: %s %s", subdomain, err))
-			continue
-		}
-		if sum > 0 {
-			slog.Info(f("skip purge %s %d access", subdomain, sum))
-			continue
+	interval := api.cfg.ECS.PurgeTerminateInterval
+	if interval <= 0 {
+		interval = DefaultPurgeTerminateInterval
+	}
+	slog.Info(f("start purge subdomains %d", len(subdomains)),
+		"concurrency", api.purgeConcurrency(),
+		"terminate_interval", interval,
+	)
+
+	// terminate idle subdomains with rate limiting
+	idle, res := api.idleSubdomains(ctx, subdomains, expired, duration)
+	for i, subdomain := range idle {
+		if i > 0 {
+			time.Sleep(interval)
 		}
-		if err := api.runner.TerminateBySubdomain(ctx, subdomain); err != nil {
+		err := api.runner.TerminateBySubdomain(ctx, subdomain)
+		api.recordHistory(ctx, &HistoryRecord{
+			Subdomain: subdomain,
+			Action:    HistoryActionPurge,
+			Actor:     "mirage-ecs",
+		}, err)
+		if err != nil {
 			slog.Warn(f("terminate failed %s %s", subdomain, err))
+			res.Errors[subdomain] = f("terminate failed: %s", err)
 		} else {
-			purged++
+			res.Purged = append(res.Purged, subdomain)
 			slog.Info(f("purged %s", subdomain))
+			api.taskEvents.terminations.Add(1)
+			_, isExpired := expired[subdomain]
+			api.cfg.events().OnPurge(&PurgeEvent{Subdomain: subdomain, Expired: isExpired})
 		}
-		time.Sleep(3 * time.Second)
 	}
-	slog.Info(f("purge %d subdomains completed", purged))
+	slog.Info(f("purge %d subdomains completed", len(res.Purged)))
+	return res, nil
 }
@@ -2,16 +2,25 @@ package mirageecs_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	mirageecs "github.com/acidlemon/mirage-ecs/v2"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ecs/types"
+	"github.com/google/go-cmp/cmp"
 	"github.com/labstack/echo/v4"
 )
 
@@ -135,6 +144,136 @@ parameters:
 
 }
 
+func TestLoadParameterDefaults(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Parameter = append(cfg.Parameter,
+		&mirageecs.Parameter{Name: "log_level", Env: "LOG_LEVEL"},
+		&mirageecs.Parameter{Name: "nick", Env: "NICK", Default: "anonymous"},
+	)
+	cfg.Defaults = map[string]string{"log_level": "debug", "nick": "mirageman"}
+	app := mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{})
+
+	tests := []struct {
+		name   string
+		values map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "defaults",
+			values: map[string]string{"branch": "develop"},
+			want:   map[string]string{"LOG_LEVEL": "debug", "NICK": "mirageman", "GIT_BRANCH": "develop"},
+		},
+		{
+			name:   "overridden",
+			values: map[string]string{"branch": "develop", "log_level": "info"},
+			want:   map[string]string{"LOG_LEVEL": "info", "NICK": "mirageman", "GIT_BRANCH": "develop"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parameter, err := app.LoadParameter(func(name string) string { return tt.values[name] })
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]string{}
+			for _, kv := range parameter.ToECSKeyValuePairs("test", cfg.Parameter, func(s string) string { return s }) {
+				got[*kv.Name] = *kv.Value
+			}
+			delete(got, mirageecs.EnvSubdomain)
+			delete(got, mirageecs.EnvSubdomainRaw)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected env %s", diff)
+			}
+		})
+	}
+}
+
+func TestLoadParameterMaxLength(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Parameter = append(cfg.Parameter,
+		&mirageecs.Parameter{Name: "payload", Env: "PAYLOAD", MaxLength: 4096},
+		&mirageecs.Parameter{Name: "nick", Env: "NICK"},
+	)
+	app := mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{})
+
+	tests := []struct {
+		name    string
+		param   string
+		value   string
+		wantErr bool
+	}{
+		{name: "long value", param: "payload", value: strings.Repeat("あ", 4096)},
+		{name: "too long value", param: "payload", value: strings.Repeat("a", 4097), wantErr: true},
+		{name: "default max length", param: "nick", value: strings.Repeat("あ", 255)},
+		{name: "longer than default", param: "nick", value: strings.Repeat("a", 256), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := map[string]string{"branch": "develop", tt.param: tt.value}
+			parameter, err := app.LoadParameter(func(name string) string { return values[name] })
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error for %d characters", len([]rune(tt.value)))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parameter[tt.param] != tt.value {
+				t.Errorf("unexpected value of %s", tt.param)
+			}
+		})
+	}
+}
+
+func TestLoadParameterSecret(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{LocalMode: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Parameter = append(cfg.Parameter, &mirageecs.Parameter{
+		Name:   "token",
+		Env:    "API_TOKEN",
+		Secret: true,
+		AllowedSecrets: []string{
+			"arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/",
+			"arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:mirage-",
+		},
+	})
+	app := mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{})
+
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{value: "arn:aws:ssm:ap-northeast-1:123456789012:parameter/mirage/token"},
+		{value: "arn:aws:secretsmanager:ap-northeast-1:123456789012:secret:mirage-token-AbCdEf"},
+		{value: "s3cr3t", wantErr: true},
+		{value: "arn:aws:s3:::mirage/token", wantErr: true},
+		{value: "arn:aws:ssm:ap-northeast-1:123456789012:parameter/other/token", wantErr: true},
+		{value: "arn:aws:secretsmanager:ap-northeast-1:210987654321:secret:mirage-token-AbCdEf", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			values := map[string]string{"branch": "develop", "token": tt.value}
+			_, err := app.LoadParameter(func(name string) string { return values[name] })
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
 var validSubdomains = []string{
 	"ab",
 	"abc",
@@ -146,6 +285,8 @@ var validSubdomains = []string{
 	"foo[0-9]",
 	"api-?-test",
 	"*-xxx",
+	"*.bar",
+	"foo.feature-123",
 	strings.Repeat("a", 63),
 }
 
@@ -154,6 +295,9 @@ var invalidSubdomains = []string{
 	"a-",
 	"-a",
 	"a.b",
+	"*.b",
+	"foo..bar",
+	".foo",
 	"a+b",
 	"a_b",
 	"a^b",
@@ -177,3 +321,1209 @@ func TestValidateSubdomain(t *testing.T) {
 		}
 	}
 }
+
+func TestValidateSubdomainError(t *testing.T) {
+	for s, code := range map[string]string{
+		"":                      mirageecs.SubdomainErrorTooShort,
+		"a":                     mirageecs.SubdomainErrorTooShort,
+		strings.Repeat("a", 64): mirageecs.SubdomainErrorTooLong,
+		"a$b":                   mirageecs.SubdomainErrorInvalidChars,
+		"www/xxx":               mirageecs.SubdomainErrorInvalidChars,
+		"foo[0-9":               mirageecs.SubdomainErrorBadPattern,
+	} {
+		var se *mirageecs.SubdomainError
+		if err := mirageecs.ValidateSubdomain(s); !errors.As(err, &se) {
+			t.Errorf("%s: unexpected error %v", s, err)
+			continue
+		}
+		if se.Code != code {
+			t.Errorf("%s: unexpected code %s, want %s", s, se.Code, code)
+		}
+		if se.MinLength != mirageecs.SubdomainMinLength || se.MaxLength != mirageecs.SubdomainMaxLength || se.Pattern == "" {
+			t.Errorf("%s: bounds are missing %#v", s, se)
+		}
+	}
+}
+
+func TestApiLaunchInvalidSubdomain(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"a","taskdef":["app:1"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status %d", res.StatusCode)
+	}
+	var r mirageecs.APICommonResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Result != "subdomain is too short" {
+		t.Errorf("unexpected result %s", r.Result)
+	}
+	if r.Error == nil || r.Error.Code != mirageecs.SubdomainErrorTooShort || r.Error.MinLength != 2 {
+		t.Errorf("unexpected error detail %#v", r.Error)
+	}
+}
+
+func TestApiLaunchReservedSubdomain(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Host.ReservedSubdomains = []string{"admin"}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	for _, s := range []string{"mirage", "Mirage", "admin"} {
+		t.Run(s, func(t *testing.T) {
+			res, err := ts.Client().Post(ts.URL+"/api/launch", "application/json",
+				strings.NewReader(`{"subdomain":"`+s+`","branch":"develop","taskdef":["app:1"]}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != http.StatusBadRequest {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+			var r mirageecs.APICommonResponse
+			if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Error == nil || r.Error.Code != mirageecs.SubdomainErrorReserved {
+				t.Errorf("unexpected error detail %#v", r.Error)
+			}
+		})
+	}
+}
+
+func TestAggregateBySubdomain(t *testing.T) {
+	running := []*mirageecs.Information{
+		{ShortID: "1", SubDomain: "foo", GitBranch: "feature/foo", LastStatus: "RUNNING"},
+		{ShortID: "2", SubDomain: "foo", GitBranch: "feature/foo", LastStatus: "PENDING"},
+		{ShortID: "3", SubDomain: "bar", GitBranch: "feature/bar", LastStatus: "PENDING"},
+	}
+	stopped := []*mirageecs.Information{
+		{ShortID: "4", SubDomain: "foo", GitBranch: "feature/foo", LastStatus: "STOPPED"},
+		{ShortID: "5", SubDomain: "baz", GitBranch: "feature/baz", LastStatus: "STOPPED"},
+		{ShortID: "6", SubDomain: "baz", GitBranch: "feature/baz", LastStatus: "STOPPED"},
+	}
+	summaries := mirageecs.AggregateBySubdomain(running, stopped)
+	if len(summaries) != 3 {
+		t.Fatalf("unexpected summaries %#v", summaries)
+	}
+	expected := []struct {
+		subdomain string
+		running   int
+		status    string
+		tasks     int
+	}{
+		{"foo", 2, "RUNNING", 3},
+		{"bar", 1, "PENDING", 1},
+		{"baz", 0, "STOPPED", 2},
+	}
+	for i, e := range expected {
+		s := summaries[i]
+		if s.SubDomain != e.subdomain || s.RunningCount != e.running || s.LastStatus != e.status || len(s.Tasks) != e.tasks {
+			t.Errorf("unexpected summary[%d] %#v", i, s)
+		}
+	}
+}
+
+type purgeTestRunner struct {
+	*mirageecs.LocalTaskRunner
+	mu         sync.Mutex
+	accesses   map[string]int64
+	terminated []string
+}
+
+func (r *purgeTestRunner) GetAccessCount(_ context.Context, subdomain string, _ time.Duration) (int64, error) {
+	return r.accesses[subdomain], nil
+}
+
+func (r *purgeTestRunner) TerminateBySubdomain(_ context.Context, subdomain string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.terminated = append(r.terminated, subdomain)
+	return nil
+}
+
+func TestPurgeSubdomains(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.PurgeConcurrency = 4
+	cfg.ECS.PurgeTerminateInterval = time.Millisecond
+	runner := &purgeTestRunner{
+		LocalTaskRunner: &mirageecs.LocalTaskRunner{},
+		accesses:        map[string]int64{"bbb": 10, "ddd": 1},
+	}
+	app := mirageecs.NewWebApi(cfg, runner)
+	expired := map[string]struct{}{"ddd": {}}
+	app.PurgeSubdomains(ctx, []string{"aaa", "bbb", "ccc", "ddd", "eee"}, expired, time.Hour)
+
+	// ddd is accessed but expired
+	if diff := cmp.Diff([]string{"aaa", "ccc", "ddd", "eee"}, runner.terminated); diff != "" {
+		t.Errorf("unexpected terminated subdomains (-want +got):\n%s", diff)
+	}
+}
+
+func TestApiPurgeEvaluate(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	running := func(subdomain string, created time.Time) *mirageecs.Information {
+		return &mirageecs.Information{
+			ID:         "task-" + subdomain,
+			SubDomain:  subdomain,
+			LastStatus: "RUNNING",
+			Created:    created,
+		}
+	}
+	runner := &purgeTestRunner{
+		LocalTaskRunner: &mirageecs.LocalTaskRunner{
+			Informations: []*mirageecs.Information{
+				running("idle", now.Add(-2*time.Hour)),
+				running("accessed", now.Add(-2*time.Hour)),
+				running("recent", now.Add(-time.Minute)),
+				running("excluded", now.Add(-2*time.Hour)),
+			},
+		},
+		accesses: map[string]int64{"accessed": 3},
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	tests := []struct {
+		subdomain string
+		code      int
+		purge     bool
+		reason    string
+	}{
+		{subdomain: "idle", code: http.StatusOK, purge: true, reason: "no access in 1h0m0s"},
+		{subdomain: "accessed", code: http.StatusOK, purge: false, reason: "3 access in 1h0m0s"},
+		{subdomain: "recent", code: http.StatusOK, purge: false, reason: "recent created"},
+		{subdomain: "excluded", code: http.StatusOK, purge: false, reason: "exclude subdomain"},
+		{subdomain: "missing", code: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subdomain, func(t *testing.T) {
+			body := fmt.Sprintf(`{"subdomain":%q,"duration":"3600","excludes":["excluded"]}`, tt.subdomain)
+			res, err := ts.Client().Post(ts.URL+"/api/purge/evaluate", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Fatalf("unexpected status %d", res.StatusCode)
+			}
+			if tt.code != http.StatusOK {
+				return
+			}
+			var r mirageecs.APIPurgeEvaluateResponse
+			if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			if r.Purge != tt.purge || !strings.HasPrefix(r.Reason, tt.reason) {
+				t.Errorf("unexpected evaluation %#v", r)
+			}
+			if len(r.Tasks) != 1 || r.Tasks[0].ID != "task-"+tt.subdomain {
+				t.Errorf("unexpected tasks %#v", r.Tasks)
+			}
+		})
+	}
+}
+
+func TestApiPurgeDryRun(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	running := func(subdomain string, created time.Time) *mirageecs.Information {
+		return &mirageecs.Information{
+			ID:         "task-" + subdomain,
+			SubDomain:  subdomain,
+			LastStatus: "RUNNING",
+			Created:    created,
+		}
+	}
+	runner := &purgeTestRunner{
+		LocalTaskRunner: &mirageecs.LocalTaskRunner{
+			Informations: []*mirageecs.Information{
+				running("idle", now.Add(-2*time.Hour)),
+				running("accessed", now.Add(-2*time.Hour)),
+				running("recent", now.Add(-time.Minute)),
+				running("excluded", now.Add(-2*time.Hour)),
+				running("idle2", now.Add(-3*time.Hour)),
+			},
+		},
+		accesses: map[string]int64{"accessed": 3},
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	body := `{"duration":"3600","excludes":["excluded"]}`
+	res, err := ts.Client().Post(ts.URL+"/api/purge?dry_run=true", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	var r mirageecs.APIPurgeResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if !r.DryRun {
+		t.Errorf("dry_run must be true %#v", r)
+	}
+	if diff := cmp.Diff([]string{"idle", "idle2"}, r.Subdomains); diff != "" {
+		t.Errorf("unexpected subdomains (-want +got):\n%s", diff)
+	}
+	// wait for the background purge if it was started by mistake
+	time.Sleep(100 * time.Millisecond)
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if len(runner.terminated) != 0 {
+		t.Errorf("dry-run must not terminate subdomains %v", runner.terminated)
+	}
+}
+
+func TestApiPurgeSync(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.PurgeTerminateInterval = time.Millisecond
+	now := time.Now()
+	running := func(subdomain string, created time.Time) *mirageecs.Information {
+		return &mirageecs.Information{
+			ID:         "task-" + subdomain,
+			SubDomain:  subdomain,
+			LastStatus: "RUNNING",
+			Created:    created,
+		}
+	}
+	runner := &purgeTestRunner{
+		LocalTaskRunner: &mirageecs.LocalTaskRunner{
+			Informations: []*mirageecs.Information{
+				running("idle", now.Add(-2*time.Hour)),
+				running("accessed", now.Add(-2*time.Hour)),
+				running("recent", now.Add(-time.Minute)),
+				running("idle2", now.Add(-3*time.Hour)),
+			},
+		},
+		accesses: map[string]int64{"accessed": 3},
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	body := `{"duration":"3600","sync":true}`
+	res, err := ts.Client().Post(ts.URL+"/api/purge", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	var r mirageecs.APIPurgeResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	expected := mirageecs.APIPurgeResponse{
+		Result:     "ok",
+		Subdomains: []string{"idle", "accessed", "idle2"},
+		PurgeResult: &mirageecs.PurgeResult{
+			Purged:  []string{"idle", "idle2"},
+			Skipped: []string{"accessed"},
+			Errors:  map[string]string{},
+		},
+	}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("unexpected response (-want +got):\n%s", diff)
+	}
+	runner.mu.Lock()
+	defer runner.mu.Unlock()
+	if diff := cmp.Diff([]string{"idle", "idle2"}, runner.terminated); diff != "" {
+		t.Errorf("unexpected terminated subdomains (-want +got):\n%s", diff)
+	}
+}
+
+type panicPurgeTestRunner struct {
+	*purgeTestRunner
+	panicked bool
+}
+
+func (r *panicPurgeTestRunner) TerminateBySubdomain(ctx context.Context, subdomain string) error {
+	if !r.panicked {
+		r.panicked = true
+		panic("terminate panicked")
+	}
+	return r.purgeTestRunner.TerminateBySubdomain(ctx, subdomain)
+}
+
+func TestScheduledPurgeRecoversPanic(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.PurgeTerminateInterval = time.Millisecond
+	runner := &panicPurgeTestRunner{
+		purgeTestRunner: &purgeTestRunner{
+			LocalTaskRunner: &mirageecs.LocalTaskRunner{
+				Informations: []*mirageecs.Information{
+					{
+						ID:         "task-idle",
+						SubDomain:  "idle",
+						LastStatus: "RUNNING",
+						Created:    time.Now().Add(-2 * time.Hour),
+					},
+				},
+			},
+		},
+	}
+	api := mirageecs.NewWebApi(cfg, runner)
+	p := &mirageecs.Purge{
+		Schedule: "*/5 * * * ? *",
+		Request:  &mirageecs.APIPurgeRequest{Duration: "3600"},
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Date(2024, 1, 1, 0, 0, 30, 0, time.UTC)
+	clock := func() time.Time { return now }
+	after := func(d time.Duration) <-chan time.Time {
+		if ctx.Err() != nil {
+			return nil // never fires after cancel
+		}
+		now = now.Add(d)
+		ch := make(chan time.Time, 1)
+		ch <- now
+		return ch
+	}
+	invoked := 0
+	purge := func(ctx context.Context, params *mirageecs.PurgeParams) error {
+		invoked++
+		if invoked == 2 {
+			defer cancel()
+		}
+		return api.ScheduledPurge(ctx, params)
+	}
+	// the first purge panics in the termination, and the second one succeeds
+	mirageecs.RunScheduledPurge(ctx, p, clock, after, purge)
+
+	if invoked != 2 {
+		t.Errorf("unexpected invocations %d", invoked)
+	}
+	if !runner.panicked {
+		t.Error("terminate did not panic")
+	}
+	if diff := cmp.Diff([]string{"idle"}, runner.terminated); diff != "" {
+		t.Errorf("unexpected terminated subdomains (-want +got):\n%s", diff)
+	}
+}
+
+type followLogsTestRunner struct {
+	*mirageecs.LocalTaskRunner
+	done chan struct{}
+}
+
+func (r *followLogsTestRunner) FollowLogs(ctx context.Context, subdomain string, container string, _ time.Time, fn func([]mirageecs.LogEvent) error) error {
+	defer close(r.done)
+	switch {
+	case subdomain == "bar":
+		return fmt.Errorf("%w: %s", mirageecs.ErrSubdomainNotFound, subdomain)
+	case container == "nope":
+		return fmt.Errorf("%w: %s", mirageecs.ErrContainerNotFound, container)
+	}
+	// the log streams are resolved
+	if err := fn(nil); err != nil {
+		return err
+	}
+	if subdomain == "broken" {
+		return errors.New("access denied")
+	}
+	ts := time.Date(2023, 3, 13, 0, 29, 8, 0, time.UTC)
+	if err := fn([]mirageecs.LogEvent{{Timestamp: ts, Container: "app", Message: "first"}}); err != nil {
+		return err
+	}
+	// idle poll
+	if err := fn(nil); err != nil {
+		return err
+	}
+	if err := fn([]mirageecs.LogEvent{{Timestamp: ts, Container: "app", Message: "second\nline"}}); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return nil
+}
+
+func TestApiLogsStream(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &followLogsTestRunner{
+		LocalTaskRunner: &mirageecs.LocalTaskRunner{},
+		done:            make(chan struct{}),
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	res, err := ts.Client().Get(ts.URL + "/api/logs/stream?subdomain=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("unexpected content type %s", ct)
+	}
+	// read the frames until the second event
+	buf := make([]byte, 0, 1024)
+	expected := ":\n\n" +
+		`data: {"timestamp":"2023-03-13T00:29:08Z","container":"app","message":"first"}` + "\n\n" +
+		":\n\n" +
+		`data: {"timestamp":"2023-03-13T00:29:08Z","container":"app","message":"second\nline"}` + "\n\n"
+	for len(buf) < len(expected) {
+		b := make([]byte, 1024)
+		n, err := res.Body.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, b[:n]...)
+	}
+	if string(buf) != expected {
+		t.Errorf("unexpected frames %q", string(buf))
+	}
+	// disconnect
+	res.Body.Close()
+	select {
+	case <-runner.done:
+	case <-time.After(3 * time.Second):
+		t.Error("FollowLogs is not stopped by the client disconnection")
+	}
+
+	// the error before the stream is started is returned as JSON
+	for query, code := range map[string]int{
+		"subdomain=bar":                http.StatusNotFound,
+		"subdomain=foo&container=nope": http.StatusBadRequest,
+	} {
+		runner.done = make(chan struct{})
+		res, err := ts.Client().Get(ts.URL + "/api/logs/stream?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != code {
+			t.Errorf("unexpected status %d for %s", res.StatusCode, query)
+		}
+		if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("unexpected content type %s for %s", ct, query)
+		}
+	}
+
+	// the error after the stream is started is sent as an event
+	runner.done = make(chan struct{})
+	res, err = ts.Client().Get(ts.URL + "/api/logs/stream?subdomain=broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != ":\n\nevent: error\ndata: access denied\n\n" {
+		t.Errorf("unexpected frames %q", string(b))
+	}
+}
+
+func TestApiStatus(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &mirageecs.LocalTaskRunner{
+		Informations: []*mirageecs.Information{
+			{ID: "task-1", SubDomain: "foo", LastStatus: "RUNNING"},
+			{ID: "task-2", SubDomain: "foo", LastStatus: "RUNNING"},
+			{ID: "task-3", SubDomain: "bar", LastStatus: "RUNNING"},
+			{ID: "task-4", SubDomain: "baz", LastStatus: "STOPPED"},
+		},
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	tests := []struct {
+		subdomain string
+		code      int
+		ids       []string
+	}{
+		{subdomain: "foo", code: http.StatusOK, ids: []string{"task-1", "task-2"}},
+		{subdomain: "bar", code: http.StatusOK, ids: []string{"task-3"}},
+		{subdomain: "baz", code: http.StatusNotFound, ids: []string{}},
+		{subdomain: "missing", code: http.StatusNotFound, ids: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.subdomain, func(t *testing.T) {
+			res, err := ts.Client().Get(ts.URL + "/api/status?subdomain=" + tt.subdomain)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+			var r mirageecs.APIListResponse
+			if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			ids := []string{}
+			for _, info := range r.Result {
+				ids = append(ids, info.ID)
+			}
+			if diff := cmp.Diff(tt.ids, ids); diff != "" {
+				t.Errorf("unexpected tasks (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPrometheusSDTargetGroups(t *testing.T) {
+	infos := []*mirageecs.Information{
+		{
+			SubDomain: "aaa",
+			GitBranch: "feature/aaa",
+			TaskDef:   "app:1",
+			IPAddress: "10.0.0.1",
+			PortMap:   map[string]int{"nginx": 80, "app": 8080},
+		},
+		{
+			SubDomain: "bbb",
+			GitBranch: "feature/bbb",
+			TaskDef:   "app:2",
+			PortMap:   map[string]int{"nginx": 80}, // no IP address yet
+		},
+		{
+			SubDomain: "ccc",
+			GitBranch: "feature/ccc",
+			TaskDef:   "app:3",
+			IPAddress: "10.0.0.3",
+			PortMap:   map[string]int{"app": 3000},
+			PortMappings: map[string][]mirageecs.PortMapping{
+				"app": {
+					{Name: "web", ContainerPort: 3000, HostPort: 3000},
+					{Name: "metrics", ContainerPort: 9090, HostPort: 9090},
+				},
+			},
+		},
+	}
+	expected := []*mirageecs.PrometheusSDTargetGroup{
+		{
+			Targets: []string{"10.0.0.1:8080"},
+			Labels:  map[string]string{"subdomain": "aaa", "branch": "feature/aaa", "taskdef": "app:1", "container": "app"},
+		},
+		{
+			Targets: []string{"10.0.0.1:80"},
+			Labels:  map[string]string{"subdomain": "aaa", "branch": "feature/aaa", "taskdef": "app:1", "container": "nginx"},
+		},
+		{
+			Targets: []string{"10.0.0.3:3000"},
+			Labels:  map[string]string{"subdomain": "ccc", "branch": "feature/ccc", "taskdef": "app:3", "container": "app", "port_name": "web"},
+		},
+		{
+			Targets: []string{"10.0.0.3:9090"},
+			Labels:  map[string]string{"subdomain": "ccc", "branch": "feature/ccc", "taskdef": "app:3", "container": "app", "port_name": "metrics"},
+		},
+	}
+	if diff := cmp.Diff(expected, mirageecs.PrometheusSDTargetGroups(infos)); diff != "" {
+		t.Errorf("unexpected target groups (-want +got):\n%s", diff)
+	}
+}
+
+func TestApiTrace(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &mirageecs.LocalTaskRunner{}))
+	defer ts.Close()
+
+	tests := []struct {
+		path        string
+		accept      string
+		code        int
+		contentType string
+	}{
+		{path: "/trace/task-1", code: http.StatusOK, contentType: "text/plain"},
+		{path: "/trace/task-1", accept: "text/html,*/*", code: http.StatusOK, contentType: "text/plain"},
+		{path: "/trace/task-1", accept: "application/json", code: http.StatusOK, contentType: "application/json"},
+		{path: "/trace/task-1?format=json", code: http.StatusOK, contentType: "application/json"},
+		{path: "/trace/task-1?format=xml", code: http.StatusBadRequest, contentType: "text/plain"},
+		{path: "/api/trace/task-1", code: http.StatusOK, contentType: "application/json"},
+		{path: "/api/trace/task-1", accept: "text/plain", code: http.StatusOK, contentType: "text/plain"},
+		{path: "/api/trace/task-1?format=text", accept: "application/json", code: http.StatusOK, contentType: "text/plain"},
+		{path: "/api/trace/task-1?duration=10m", code: http.StatusOK, contentType: "application/json"},
+		{path: "/api/trace/task-1?duration=2h", code: http.StatusBadRequest, contentType: "application/json"},
+		{path: "/api/trace/task-1?duration=-1m", code: http.StatusBadRequest, contentType: "application/json"},
+		{path: "/trace/task-1?duration=xxx", code: http.StatusBadRequest, contentType: "text/plain"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.accept, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			if res.StatusCode != tt.code {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+			if ct := res.Header.Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+				t.Errorf("unexpected content type %s", ct)
+			}
+			if tt.code != http.StatusOK || tt.contentType != "application/json" {
+				return
+			}
+			var r mirageecs.TraceResult
+			if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+				t.Fatal(err)
+			}
+			if len(r.Events) != 1 || r.Events[0].Message != "mock trace of task-1" {
+				t.Errorf("unexpected events %#v", r.Events)
+			}
+		})
+	}
+}
+
+type traceTestRunner struct {
+	mirageecs.TaskRunner
+	mu        sync.Mutex
+	durations []time.Duration
+}
+
+func (r *traceTestRunner) Trace(ctx context.Context, id string, duration time.Duration) (*mirageecs.TraceResult, error) {
+	r.mu.Lock()
+	r.durations = append(r.durations, duration)
+	r.mu.Unlock()
+	return r.TaskRunner.Trace(ctx, id, duration)
+}
+
+func TestApiTraceCache(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &traceTestRunner{TaskRunner: &mirageecs.LocalTaskRunner{}}
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	for _, path := range []string{
+		"/trace/task-1",
+		"/api/trace/task-1", // cached by /trace/task-1
+		"/trace/task-1?duration=10m",
+		"/trace/task-1?duration=10m",
+		"/trace/task-2",
+	} {
+		res, err := ts.Client().Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Errorf("unexpected status %d for %s", res.StatusCode, path)
+		}
+	}
+	expected := []time.Duration{mirageecs.DefaultTraceDuration, 10 * time.Minute, mirageecs.DefaultTraceDuration}
+	if diff := cmp.Diff(expected, runner.durations); diff != "" {
+		t.Errorf("unexpected traces (-want +got):\n%s", diff)
+	}
+}
+
+func TestApiStats(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Listen.HTTP = []mirageecs.PortMap{{ListenPort: 80, TargetPort: 80}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	port, _ := strconv.Atoi(u.Port())
+
+	m := mirageecs.New(ctx, cfg)
+	m.ReverseProxy.AddSubdomain("foo", "127.0.0.1", port)
+	for _, path := range []string{"/", "/", "/missing"} {
+		req := httptest.NewRequest(http.MethodGet, "http://foo.localtest.me"+path, nil)
+		m.ServeHTTPWithPort(httptest.NewRecorder(), req, 80)
+	}
+	ts := httptest.NewServer(m.WebApi)
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/api/stats?subdomain=foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", res.StatusCode)
+	}
+	var r mirageecs.APIStatsResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	expected := mirageecs.APIStatsResponse{
+		Result:       "ok",
+		Subdomain:    "foo",
+		Requests:     3,
+		StatusCounts: map[string]int64{"2xx": 2, "4xx": 1},
+	}
+	if diff := cmp.Diff(expected, r); diff != "" {
+		t.Errorf("unexpected stats %s", diff)
+	}
+
+	res, err = http.Get(ts.URL + "/api/stats?subdomain=bar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status for the unknown subdomain %d", res.StatusCode)
+	}
+}
+
+func TestApiLaunchCustomTags(t *testing.T) {
+	ctx := context.Background()
+	cfg, err := mirageecs.NewConfig(ctx, &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := mirageecs.New(ctx, cfg)
+	ts := httptest.NewServer(m.WebApi)
+	defer ts.Close()
+
+	invalid := []string{
+		`{"ManagedBy":"someone"}`,
+		`{"branch":"main"}`,
+		`{"aws:createdBy":"me"}`,
+		`{"Team":"<script>"}`,
+		`{"` + strings.Repeat("k", 129) + `":"v"}`,
+	}
+	for _, tags := range invalid {
+		res, err := http.Post(ts.URL+"/api/launch", "application/json",
+			strings.NewReader(`{"subdomain":"foo","branch":"develop","taskdef":["app:1"],"tags":`+tags+`}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: unexpected status %d", tags, res.StatusCode)
+		}
+	}
+
+	res, err := http.Post(ts.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"foo","branch":"develop","taskdef":["app:1"],"tags":{"Team":"platform","CostCenter":"cc-1234"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("launch failed %d", res.StatusCode)
+	}
+
+	res, err = http.Get(ts.URL + "/api/list")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var r mirageecs.APIListResponse
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Result) != 1 {
+		t.Fatalf("unexpected tasks %#v", r.Result)
+	}
+	tags := make(map[string]string)
+	for _, tag := range r.Result[0].Tags {
+		tags[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	if tags["Team"] != "platform" || tags["CostCenter"] != "cc-1234" || tags[mirageecs.TagManagedBy] != mirageecs.TagValueMirage {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+type restartTestRunner struct {
+	mirageecs.TaskRunner
+	mu       sync.Mutex
+	params   []mirageecs.TaskParameter
+	taskdefs [][]string
+}
+
+func (r *restartTestRunner) Launch(ctx context.Context, subdomain string, param mirageecs.TaskParameter, taskdefs ...string) error {
+	r.mu.Lock()
+	r.params = append(r.params, param)
+	r.taskdefs = append(r.taskdefs, taskdefs)
+	r.mu.Unlock()
+	return r.TaskRunner.Launch(ctx, subdomain, param, taskdefs...)
+}
+
+func TestApiRestart(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner := &restartTestRunner{TaskRunner: mirageecs.NewLocalTaskRunner(cfg)}
+	ch := make(chan *mirageecs.ProxyControl, 10)
+	runner.SetProxyControlChannel(ch)
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	res, err := http.Post(ts.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"foo","branch":"develop","nick":"mirage","taskdef":["app:1"],"max_lifetime":"2h","tags":{"Team":"platform"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("launch failed %d", res.StatusCode)
+	}
+
+	res, err = http.Post(ts.URL+"/api/restart", "application/json", strings.NewReader(`{"subdomain":"foo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("restart failed %d", res.StatusCode)
+	}
+	if len(runner.params) != 2 {
+		t.Fatalf("unexpected launches %d", len(runner.params))
+	}
+	if diff := cmp.Diff(runner.params[0], runner.params[1]); diff != "" {
+		t.Errorf("parameters are not reused (-launch +restart):\n%s", diff)
+	}
+	if diff := cmp.Diff(runner.taskdefs[0], runner.taskdefs[1]); diff != "" {
+		t.Errorf("taskdefs are not reused (-launch +restart):\n%s", diff)
+	}
+
+	res, err = http.Post(ts.URL+"/api/restart", "application/json", strings.NewReader(`{"subdomain":"bar"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("unexpected status %d for the subdomain not running", res.StatusCode)
+	}
+
+	cfg.ECS.DeniedTaskDefinitions = []string{"app"}
+	res, err = http.Post(ts.URL+"/api/restart", "application/json", strings.NewReader(`{"subdomain":"foo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("unexpected status %d for the denied taskdef", res.StatusCode)
+	}
+
+	cfg.ECS.DeniedTaskDefinitions = nil
+	cfg.Link.StrictTaskdef = true
+	res, err = http.Post(ts.URL+"/api/restart", "application/json", strings.NewReader(`{"subdomain":"foo"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusBadRequest {
+		t.Errorf("unexpected status %d for the unknown taskdef", res.StatusCode)
+	}
+	if len(runner.params) != 2 {
+		t.Errorf("rejected restarts must not launch: %d launches", len(runner.params))
+	}
+}
+
+// notRestorableTestRunner returns the tasks launched with infos and the plans rendering planned commands.
+type notRestorableTestRunner struct {
+	mirageecs.TaskRunner
+	infos    []*mirageecs.Information
+	planned  []string
+	launched bool
+}
+
+func (r *notRestorableTestRunner) Status(ctx context.Context, subdomain string) ([]*mirageecs.Information, error) {
+	return r.infos, nil
+}
+
+func (r *notRestorableTestRunner) PlanLaunch(ctx context.Context, subdomain string, param mirageecs.TaskParameter, taskdefs ...string) ([]*mirageecs.LaunchPlan, error) {
+	var plans []*mirageecs.LaunchPlan
+	for _, taskdef := range taskdefs {
+		plans = append(plans, &mirageecs.LaunchPlan{
+			Taskdef: taskdef,
+			Overrides: &types.TaskOverride{
+				ContainerOverrides: []types.ContainerOverride{{Name: aws.String("app"), Command: r.planned}},
+			},
+		})
+	}
+	return plans, nil
+}
+
+func (r *notRestorableTestRunner) Launch(ctx context.Context, subdomain string, param mirageecs.TaskParameter, taskdefs ...string) error {
+	r.launched = true
+	return nil
+}
+
+func TestApiRestartNotRestorable(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newInfo := func(taskdef string, ov types.ContainerOverride) *mirageecs.Information {
+		ov.Name = aws.String("app")
+		return mirageecs.NewInformation(&types.Task{
+			TaskArn:           aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task/mirage/0123456789abcdef"),
+			TaskDefinitionArn: aws.String("arn:aws:ecs:ap-northeast-1:123456789012:task-definition/" + taskdef),
+			LastStatus:        aws.String("RUNNING"),
+			Overrides:         &types.TaskOverride{ContainerOverrides: []types.ContainerOverride{ov}},
+			Tags: []types.Tag{
+				{Key: aws.String("Subdomain"), Value: aws.String("Zm9v")},
+				{Key: aws.String(mirageecs.TagManagedBy), Value: aws.String(mirageecs.TagValueMirage)},
+			},
+		}, cfg)
+	}
+	tests := []struct {
+		name    string
+		info    *mirageecs.Information
+		planned []string
+		want    int
+	}{
+		{
+			name: "no command",
+			info: newInfo("app:3", types.ContainerOverride{}),
+			want: http.StatusOK,
+		},
+		{
+			name: "secret parameters",
+			info: newInfo("app-mirage-secrets:5", types.ContainerOverride{}),
+			want: http.StatusConflict,
+		},
+		{
+			name: "command override",
+			info: newInfo("app:3", types.ContainerOverride{Command: []string{"rake", "db:migrate"}}),
+			want: http.StatusConflict,
+		},
+		{
+			name:    "command of the override template",
+			info:    newInfo("app:3", types.ContainerOverride{Command: []string{"server"}}),
+			planned: []string{"server"},
+			want:    http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := &notRestorableTestRunner{TaskRunner: mirageecs.NewLocalTaskRunner(cfg), infos: []*mirageecs.Information{tt.info}, planned: tt.planned}
+			ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+			defer ts.Close()
+			res, err := http.Post(ts.URL+"/api/restart", "application/json", strings.NewReader(`{"subdomain":"foo"}`))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("unexpected status %d, want %d", res.StatusCode, tt.want)
+			}
+			if runner.launched != (tt.want == http.StatusOK) {
+				t.Errorf("unexpected launched %v", runner.launched)
+			}
+		})
+	}
+}
+
+func TestApiLaunchMaxConcurrentTasks(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.ECS.MaxConcurrentTasks = 2
+	runner := mirageecs.NewLocalTaskRunner(cfg)
+	ch := make(chan *mirageecs.ProxyControl, 10)
+	runner.SetProxyControlChannel(ch)
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, runner))
+	defer ts.Close()
+
+	tests := []struct {
+		subdomain  string
+		query      string
+		wantStatus int
+	}{
+		{subdomain: "foo", wantStatus: http.StatusOK},
+		{subdomain: "bar", wantStatus: http.StatusOK},
+		{subdomain: "baz", wantStatus: http.StatusTooManyRequests},
+		{subdomain: "baz", query: "?dry_run=true", wantStatus: http.StatusTooManyRequests},
+		// relaunch of the running subdomain
+		{subdomain: "foo", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		res, err := http.Post(ts.URL+"/api/launch"+tt.query, "application/json",
+			strings.NewReader(fmt.Sprintf(`{"subdomain":"%s","branch":"develop","taskdef":["app"]}`, tt.subdomain)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tt.wantStatus {
+			t.Errorf("launch %s%s: unexpected status %d", tt.subdomain, tt.query, res.StatusCode)
+		}
+	}
+
+	if err := runner.TerminateBySubdomain(context.Background(), "bar"); err != nil {
+		t.Fatal(err)
+	}
+	res, err := http.Post(ts.URL+"/api/launch", "application/json",
+		strings.NewReader(`{"subdomain":"baz","branch":"develop","taskdef":["app"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("launch after terminate: unexpected status %d", res.StatusCode)
+	}
+}
+
+func TestWebApiBodyLimit(t *testing.T) {
+	cfg, err := mirageecs.NewConfig(context.Background(), &mirageecs.ConfigParams{
+		LocalMode: true,
+		Domain:    "localtest.me",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Network.WebApiBodyLimit != mirageecs.DefaultWebApiBodyLimit {
+		t.Errorf("unexpected default body limit %s", cfg.Network.WebApiBodyLimit)
+	}
+	cfg.Network.WebApiBodyLimit = "1K"
+	ts := httptest.NewServer(mirageecs.NewWebApi(cfg, &launchJobTestRunner{&mirageecs.LocalTaskRunner{}}))
+	defer ts.Close()
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{
+			name:       "launch",
+			path:       "/api/launch",
+			body:       `{"subdomain":"foo","branch":"develop","taskdef":["app:1"]}`,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "oversized launch",
+			path:       "/api/launch",
+			body:       `{"subdomain":"foo","branch":"` + strings.Repeat("x", 2048) + `","taskdef":["app:1"]}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "oversized terminate",
+			path:       "/api/terminate",
+			body:       `{"subdomain":"` + strings.Repeat("x", 2048) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "oversized web terminate",
+			path:       "/terminate",
+			body:       `{"subdomain":"` + strings.Repeat("x", 2048) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := http.Post(ts.URL+tt.path, "application/json", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.wantStatus {
+				t.Errorf("unexpected status %d", res.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package mirageecs
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const WebhookTimeout = 10 * time.Second
+
+var webhookClient = &http.Client{Timeout: WebhookTimeout}
+
+// postWebhook posts the payload as JSON to the url.
+func postWebhook(ctx context.Context, url string, payload interface{}) error {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal webhook payload: %w", err)
+	}
+	return postWebhookBody(ctx, url, b, nil)
+}
+
+// postWebhookBody posts the JSON body to the url with the extra headers.
+func postWebhookBody(ctx context.Context, url string, body []byte, header http.Header) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "mirage-ecs/"+Version)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s returned status %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// postWebhookInBackground posts the payload without blocking the caller.
+// Errors are only logged because webhooks are best-effort.
+func postWebhookInBackground(url string, payload interface{}) {
+	go func() {
+		if err := postWebhook(context.Background(), url, payload); err != nil {
+			slog.Warn(f("webhook failed: %s", err))
+		}
+	}()
+}